@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveBatch tunes the batch size and the number of batches in flight of
+// an import while it runs, from how long its inserts take.
+type AdaptiveBatch struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	MinSize int  `yaml:"min_size" json:"min_size"`
+	MaxSize int  `yaml:"max_size" json:"max_size"`
+	// a batch taking longer than this is slow
+	TargetMillis int `yaml:"target_millis" json:"target_millis"`
+	// a batch with a larger share of failed rows counts as slow too
+	MaxErrorRate float64 `yaml:"max_error_rate" json:"max_error_rate"`
+}
+
+func defaultAdaptiveBatch() AdaptiveBatch {
+	return AdaptiveBatch{MinSize: 50, MaxSize: 5000, TargetMillis: 250, MaxErrorRate: 0.5}
+}
+
+// BatchTuning is where the tuner of an import stands.
+type BatchTuning struct {
+	BatchSize      int     `json:"batch_size"`
+	InFlight       int     `json:"in_flight"`
+	MaxInFlight    int     `json:"max_in_flight"`
+	LastLatencyMs  float64 `json:"last_latency_ms"`
+	Increases      int64   `json:"increases"`
+	Decreases      int64   `json:"decreases"`
+	SlowBatches    int64   `json:"slow_batches"`
+	FailingBatches int64   `json:"failing_batches"`
+}
+
+// batchTuner grows the batch size by min_size after every batch within the
+// target and halves it after a slow one (additive increase, multiplicative
+// decrease). A slow batch shrinks the size before the batches in flight, so a
+// database still struggling at min_size gets fewer concurrent inserts; a fast
+// one restores the batches in flight before it grows the size.
+type batchTuner struct {
+	settings AdaptiveBatch
+	target   time.Duration
+
+	mu     sync.Mutex
+	free   *sync.Cond
+	active int
+	stats  BatchTuning
+}
+
+// newBatchTuner starts from batch_size and every worker inserting.
+func newBatchTuner(settings *Config) *batchTuner {
+	a := settings.AdaptiveBatch
+	t := &batchTuner{settings: a, target: time.Duration(a.TargetMillis) * time.Millisecond}
+	t.free = sync.NewCond(&t.mu)
+	t.stats.BatchSize = min(max(settings.BatchSize, a.MinSize), a.MaxSize)
+	t.stats.MaxInFlight = settings.Workers + 1
+	t.stats.InFlight = t.stats.MaxInFlight
+	return t
+}
+
+func (t *batchTuner) batchSize() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats.BatchSize
+}
+
+// acquire waits until fewer batches than allowed are in flight.
+func (t *batchTuner) acquire() {
+	t.mu.Lock()
+	for t.active >= t.stats.InFlight {
+		t.free.Wait()
+	}
+	t.active++
+	t.mu.Unlock()
+}
+
+// release ends a batch taken with acquire and adjusts to how it went; rows is
+// 0 for a batch that never reached the database.
+func (t *batchTuner) release(rows, failed int, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	defer t.free.Broadcast()
+	if rows == 0 {
+		return
+	}
+
+	s := &t.stats
+	s.LastLatencyMs = math.Round(float64(latency.Microseconds())) / 1000
+	failing := float64(failed)/float64(rows) > t.settings.MaxErrorRate
+	slow := latency > t.target
+	if failing {
+		s.FailingBatches++
+	}
+	if slow {
+		s.SlowBatches++
+	}
+
+	switch {
+	case slow || failing:
+		if s.BatchSize > t.settings.MinSize {
+			s.BatchSize = max(s.BatchSize/2, t.settings.MinSize)
+		} else if s.InFlight > 1 {
+			s.InFlight = max(s.InFlight/2, 1)
+		} else {
+			return
+		}
+		s.Decreases++
+	case s.InFlight < s.MaxInFlight:
+		s.InFlight++
+		s.Increases++
+	case s.BatchSize < t.settings.MaxSize:
+		s.BatchSize = min(s.BatchSize+t.settings.MinSize, t.settings.MaxSize)
+		s.Increases++
+	}
+}
+
+// batchTuning is nil unless the import tunes its batches.
+func (imp *Import) batchTuning() *BatchTuning {
+	imp.mu.Lock()
+	t := imp.tuner
+	imp.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats
+	return &s
+}
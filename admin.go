@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// set at build time with -ldflags "-X main.buildVersion=... -X main.buildCommit=..."
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+)
+
+// requireAdmin only lets through requests carrying the configured admin
+// token, or an API key with the admin role.
+func requireAdmin(c *gin.Context) {
+	if key, ok := lookupAPIKey(c.GetHeader("X-API-Key")); ok {
+		if key.Role != roleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "This action requires the " + roleAdmin + " role"})
+			return
+		}
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+		return
+	}
+
+	token := cfg().AdminToken
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Admin API is disabled, set admin_token to enable it"})
+		return
+	}
+
+	given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid admin token"})
+		return
+	}
+
+	c.Next()
+}
+
+func buildInfo() gin.H {
+	commit := buildCommit
+	goVersion := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		goVersion = info.GoVersion
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && commit == "" {
+				commit = s.Value
+			}
+		}
+	}
+
+	return gin.H{"version": buildVersion, "commit": commit, "go_version": goVersion}
+}
+
+// destinationHealth pings the configured database with a short timeout.
+func destinationHealth() gin.H {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	dbPool, releasePool, err := acquirePoolContext(ctx)
+	if err == nil {
+		defer releasePool()
+		err = dbPool.Ping(ctx)
+	}
+
+	if err != nil {
+		return gin.H{"status": "down", "error": err.Error()}
+	}
+	return gin.H{"status": "up", "latency_ms": time.Since(start).Milliseconds()}
+}
+
+// handleAdminConfig returns the effective configuration, secrets redacted.
+func handleAdminConfig(c *gin.Context) {
+	current := cfg()
+
+	c.JSON(http.StatusOK, gin.H{
+		"config":        current.redacted(),
+		"feature_flags": current.FeatureFlags,
+		"codecs":        codecNames(),
+		"build":         buildInfo(),
+		"destination":   destinationHealth(),
+	})
+}
+
+// handleUpdateConfig applies a partial JSON document on top of the current
+// configuration. Settings read only at startup cannot be changed, and secrets
+// sent back redacted keep their value.
+func handleUpdateConfig(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to read the request body"})
+		return
+	}
+
+	current := cfg()
+	next := current.clone()
+	if err := json.Unmarshal(body, next); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid configuration: " + err.Error()})
+		return
+	}
+
+	if err := next.keepRedactedSecrets(current); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid configuration: " + err.Error()})
+		return
+	}
+
+	var restart []string
+	for _, setting := range restartOnlySettings {
+		if setting.changed(current, next) {
+			restart = append(restart, setting.name)
+		}
+	}
+	if len(restart) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": strings.Join(restart, ", ") + " can only be changed with a restart"})
+		return
+	}
+
+	if err := next.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid configuration: " + err.Error()})
+		return
+	}
+
+	if !currentConfig.CompareAndSwap(current, next) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Configuration changed concurrently, retry"})
+		return
+	}
+
+	log.Println("=> configuration updated from", c.ClientIP())
+	for _, hook := range configHooks {
+		hook(current, next)
+	}
+	// the body may hold secrets, the audit log only names what changed
+	auditRequest(c, auditConfigUpdate, "", "changed: "+strings.Join(changedSettings(current, next), ", "))
+	c.JSON(http.StatusOK, gin.H{"config": next.redacted()})
+}
+
+// restartSetting is a setting handleUpdateConfig refuses to change.
+type restartSetting struct {
+	name    string
+	changed func(before, after *Config) bool
+}
+
+func restartOnly[T comparable](name string, field func(*Config) T) restartSetting {
+	return restartSetting{name, func(before, after *Config) bool { return field(before) != field(after) }}
+}
+
+func restartOnlyList(name string, field func(*Config) []string) restartSetting {
+	return restartSetting{name, func(before, after *Config) bool { return !slices.Equal(field(before), field(after)) }}
+}
+
+// restartOnlySettings are read once at startup, or name where state is kept
+// that a live change would leave behind: the side tables (rows written to the
+// old table would be lost or, for migration_table, applied again) and the keys
+// of tokens and hashes already stored. The other secrets (database_url,
+// warehouse_dsn, admin_token, webhook_secret, url_signing_secret) can be
+// rotated live, as can template_table and warehouse_table.
+var restartOnlySettings = []restartSetting{
+	restartOnly("listen_addr", func(c *Config) string { return c.ListenAddr }),
+	restartOnly("listen_socket", func(c *Config) string { return c.ListenSocket }),
+	restartOnly("grpc_addr", func(c *Config) string { return c.GRPCAddr }),
+	restartOnlyList("trusted_proxies", func(c *Config) []string { return c.TrustedProxies }),
+	restartOnly("mapping_dir", func(c *Config) string { return c.MappingDir }),
+	restartOnly("error_log_file", func(c *Config) string { return c.ErrorLogFile }),
+	restartOnly("api_keys_file", func(c *Config) string { return c.APIKeysFile }),
+	restartOnly("upload_dir", func(c *Config) string { return c.UploadDir }),
+	restartOnly("spool_dir", func(c *Config) string { return c.SpoolDir }),
+	restartOnly("audit_table", func(c *Config) string { return c.AuditTable }),
+	restartOnly("history_table", func(c *Config) string { return c.HistoryTable }),
+	restartOnly("index_table", func(c *Config) string { return c.IndexTable }),
+	restartOnly("snapshot_table", func(c *Config) string { return c.SnapshotTable }),
+	restartOnly("migration_table", func(c *Config) string { return c.MigrationTable }),
+	restartOnly("token_vault_table", func(c *Config) string { return c.TokenVaultTable }),
+	restartOnly("tokenization_key", func(c *Config) string { return c.TokenizationKey }),
+	restartOnly("pii_hash_key", func(c *Config) string { return c.PIIHashKey }),
+	restartOnly("tracing_exporter", func(c *Config) string { return c.TracingExporter }),
+	restartOnly("tracing_endpoint", func(c *Config) string { return c.TracingEndpoint }),
+	restartOnly("tracing_service_name", func(c *Config) string { return c.TracingServiceName }),
+	restartOnly("tracing_sample_ratio", func(c *Config) float64 { return c.TracingSampleRatio }),
+	restartOnly("mirror_database_url", func(c *Config) string { return c.MirrorDatabaseURL }),
+	restartOnly("mirror_file", func(c *Config) string { return c.MirrorFile }),
+	restartOnly("broker", func(c *Config) string { return c.Broker }),
+	restartOnlyList("broker_addrs", func(c *Config) []string { return c.BrokerAddrs }),
+	restartOnly("node_role", func(c *Config) string { return c.NodeRole }),
+	restartOnly("distributed_imports", func(c *Config) bool { return c.DistributedImports }),
+	restartOnly("chunk_table", func(c *Config) string { return c.ChunkTable }),
+	restartOnly("queue_workers", func(c *Config) int { return c.QueueWorkers }),
+	restartOnly("checkpoint_store", func(c *Config) string { return c.CheckpointStore }),
+	restartOnly("checkpoint_table", func(c *Config) string { return c.CheckpointTable }),
+	restartOnly("checkpoint_redis_url", func(c *Config) string { return c.CheckpointRedisURL }),
+}
+
+// changedSettings lists the top-level settings whose value differs between
+// before and after; an empty list and none are the same.
+func changedSettings(before, after *Config) []string {
+	var a, b map[string]json.RawMessage
+	encoded, _ := json.Marshal(before)
+	json.Unmarshal(encoded, &a)
+	encoded, _ = json.Marshal(after)
+	json.Unmarshal(encoded, &b)
+
+	var changed []string
+	empty := func(v json.RawMessage) bool {
+		s := string(v)
+		return s == "" || s == "null" || s == "[]" || s == "{}"
+	}
+	for key, value := range b {
+		if !bytes.Equal(a[key], value) && !(empty(a[key]) && empty(value)) {
+			changed = append(changed, key)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
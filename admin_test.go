@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChangedSettings(t *testing.T) {
+	before := defaultConfig()
+	after := before.clone()
+	after.Workers = 20
+	after.DatabaseURL = "postgres://importer:s3cret@db/cashback"
+	after.WebhookSecret = "hunter2"
+
+	changed := changedSettings(before, after)
+	for _, want := range []string{"workers", "database_url"} {
+		if !slices.Contains(changed, want) {
+			t.Errorf("changedSettings = %v, missing %s", changed, want)
+		}
+	}
+	for _, name := range changed {
+		if strings.Contains(name, "s3cret") || strings.Contains(name, "hunter2") {
+			t.Errorf("changedSettings leaks a value: %v", changed)
+		}
+	}
+	if got := changedSettings(before, before.clone()); len(got) != 0 {
+		t.Errorf("changedSettings of an unchanged config = %v", got)
+	}
+}
+
+func TestKeepRedactedSecrets(t *testing.T) {
+	current := defaultConfig()
+	current.DatabaseURL = "postgres://importer:s3cret@db/cashback"
+	current.AdminToken = "hunter2"
+	current.Tenants = []TenantConfig{{Name: "acme", DatabaseURL: "postgres://acme:pw@db/acme"}}
+
+	next := current.redacted()
+	next.Workers = 20
+	if err := next.keepRedactedSecrets(current); err != nil {
+		t.Fatal(err)
+	}
+	if next.DatabaseURL != current.DatabaseURL || next.AdminToken != current.AdminToken || next.Tenants[0].DatabaseURL != current.Tenants[0].DatabaseURL {
+		t.Errorf("redacted secrets were not kept: %+v", next.redacted())
+	}
+
+	next = current.redacted()
+	next.PIIHashKey = "*****"
+	if err := next.keepRedactedSecrets(current); err == nil {
+		t.Error("a redacted secret with nothing to keep was accepted")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An import is compared with the previous anomaly_months months of the same
+// mapping in the import history: its period's row count and the configured
+// sums and averages are flagged when they stray more than anomaly_threshold
+// from the mean of those months.
+
+var anomalyMetricPattern = regexp.MustCompile(`^(sum|avg)\(([A-Za-z_][A-Za-z0-9_]*)\)$`)
+
+// anomalyMetric is one of anomaly_metrics, e.g. sum(total_biaya).
+type anomalyMetric struct {
+	name, fn, column string
+}
+
+func parseAnomalyMetrics(specs []string) ([]anomalyMetric, error) {
+	var metrics []anomalyMetric
+	for _, spec := range specs {
+		m := anomalyMetricPattern.FindStringSubmatch(spec)
+		if m == nil {
+			return nil, fmt.Errorf("anomaly_metrics: %q must look like sum(column) or avg(column)", spec)
+		}
+		metrics = append(metrics, anomalyMetric{name: spec, fn: m[1], column: m[2]})
+	}
+	return metrics, nil
+}
+
+// Anomaly is a metric of an import's period that strays from the previous
+// months; Deviation is relative to their mean, 0.4 meaning 40% above.
+type Anomaly struct {
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Baseline  float64 `json:"baseline"`
+	Deviation float64 `json:"deviation"`
+	Months    int     `json:"months"`
+}
+
+// metricTotals adds up the numeric columns of anomaly_metrics over the rows
+// an import inserted.
+type metricTotals struct {
+	sync.Mutex
+	columns []int
+	sums    []float64
+	counts  []int64
+}
+
+// newMetricTotals returns the totals of the metric columns plan has, nil when
+// anomaly detection is off.
+func newMetricTotals(settings *Config, plan *executionPlan) *metricTotals {
+	if settings.AnomalyMonths == 0 {
+		return nil
+	}
+	t := &metricTotals{}
+	for _, m := range settings.anomalyMetrics {
+		i := plan.columnIndex(m.column)
+		if i < 0 || !numericType(plan.types[i]) || t.has(i) {
+			continue
+		}
+		t.columns = append(t.columns, i)
+	}
+	t.sums = make([]float64, len(t.columns))
+	t.counts = make([]int64, len(t.columns))
+	return t
+}
+
+func (t *metricTotals) has(column int) bool {
+	for _, i := range t.columns {
+		if i == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *metricTotals) count(values []interface{}, sign float64) {
+	t.Lock()
+	defer t.Unlock()
+	for j, i := range t.columns {
+		v, ok := numberValue(values[i])
+		if !ok {
+			continue
+		}
+		t.sums[j] += sign * v
+		t.counts[j] += int64(sign)
+	}
+}
+
+// values returns the metrics of the import as stored in the history: rows,
+// and sum(column) and count(column) of every metric column.
+func (t *metricTotals) values(plan *executionPlan, inserted int64) map[string]float64 {
+	t.Lock()
+	defer t.Unlock()
+	values := map[string]float64{"rows": float64(inserted)}
+	for j, i := range t.columns {
+		values["sum("+plan.columns[i]+")"] = t.sums[j]
+		values["count("+plan.columns[i]+")"] = float64(t.counts[j])
+	}
+	return values
+}
+
+// metricValue computes a metric from the stored values of a period.
+func metricValue(name string, values map[string]float64) (float64, bool) {
+	if name == "rows" {
+		v, ok := values["rows"]
+		return v, ok
+	}
+	m := anomalyMetricPattern.FindStringSubmatch(name)
+	sum, ok := values["sum("+m[2]+")"]
+	if !ok || m[1] == "sum" {
+		return sum, ok
+	}
+	count := values["count("+m[2]+")"]
+	return sum / count, count > 0
+}
+
+// detectAnomalies compares the period of a finished import with the previous
+// months of its mapping. The imports of the period already in the history
+// count along, except for a replace, which stands for the period alone.
+// Aborted imports are not checked.
+func (imp *Import) detectAnomalies() {
+	settings := cfg()
+	imp.mu.Lock()
+	aborted := imp.abortReason != ""
+	imp.mu.Unlock()
+	if imp.metrics == nil || aborted {
+		return
+	}
+	month, ok := parseMonth(imp.Month)
+	year, err := strconv.Atoi(imp.Year)
+	if !ok || err != nil {
+		return
+	}
+	current := year*12 + int(month) - 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	periods, err := historyMetrics(ctx, settings.HistoryTable, imp.plan.version, imp.Tenant, year-settings.AnomalyMonths/12-1, year)
+	if err != nil {
+		log.Println("Anomaly check of import", imp.ID, "skipped:", err)
+		return
+	}
+	if imp.Mode == importModeReplace {
+		delete(periods, current)
+	}
+	own := imp.metrics.values(imp.plan, atomic.LoadInt64(&imp.inserted))
+	if periods[current] == nil {
+		periods[current] = map[string]float64{}
+	}
+	for k, v := range own {
+		periods[current][k] += v
+	}
+
+	var previous []int
+	for p := range periods {
+		if p < current && p >= current-settings.AnomalyMonths {
+			previous = append(previous, p)
+		}
+	}
+	if len(previous) == 0 {
+		return
+	}
+	sort.Ints(previous)
+
+	names := []string{"rows"}
+	for _, m := range settings.anomalyMetrics {
+		names = append(names, m.name)
+	}
+	var anomalies []Anomaly
+	for _, name := range names {
+		value, ok := metricValue(name, periods[current])
+		if !ok {
+			continue
+		}
+		var total float64
+		months := 0
+		for _, p := range previous {
+			if v, ok := metricValue(name, periods[p]); ok {
+				total += v
+				months++
+			}
+		}
+		if months == 0 || total == 0 {
+			continue
+		}
+		baseline := total / float64(months)
+		deviation := (value - baseline) / math.Abs(baseline)
+		if math.Abs(deviation) > settings.AnomalyThreshold {
+			anomalies = append(anomalies, Anomaly{
+				Metric:    name,
+				Value:     math.Round(value*100) / 100,
+				Baseline:  math.Round(baseline*100) / 100,
+				Deviation: math.Round(deviation*1000) / 1000,
+				Months:    months,
+			})
+		}
+	}
+
+	imp.mu.Lock()
+	imp.anomalies = anomalies
+	imp.mu.Unlock()
+}
+
+// historyMetrics adds up the stored metrics of the imports of a mapping that
+// did not fail, per period numbered year*12+month-1, for the years given.
+func historyMetrics(ctx context.Context, table, mapping, tenant string, fromYear, toYear int) (map[int]map[string]float64, error) {
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePool()
+	if err := ensureTable(ctx, dbPool, table, historyTableDDL); err != nil {
+		return nil, err
+	}
+
+	rows, err := dbPool.Query(ctx, `SELECT month, year, metrics FROM `+table+`
+		WHERE metrics IS NOT NULL AND status <> $1 AND mapping_version = $2 AND coalesce(tenant, '') = $3
+		AND (CASE WHEN year ~ '^[0-9]{4}$' THEN year::int END) BETWEEN $4 AND $5`, importStatusFailed, mapping, tenant, fromYear, toYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := map[int]map[string]float64{}
+	for rows.Next() {
+		var month, year string
+		var data []byte
+		if err := rows.Scan(&month, &year, &data); err != nil {
+			return nil, err
+		}
+		m, ok := parseMonth(month)
+		y, err := strconv.Atoi(year)
+		var values map[string]float64
+		if !ok || err != nil || json.Unmarshal(data, &values) != nil {
+			continue
+		}
+		p := y*12 + int(m) - 1
+		if periods[p] == nil {
+			periods[p] = map[string]float64{}
+		}
+		for k, v := range values {
+			periods[p][k] += v
+		}
+	}
+	return periods, rows.Err()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiKeyContextKey = "api_key"
+
+// APIKey is a client credential. Only the SHA-256 of the secret is stored.
+type APIKey struct {
+	ID                   string `json:"id"`
+	Name                 string `json:"name"`
+	Hash                 string `json:"hash"`
+	Prefix               string `json:"prefix"`
+	Role                 string `json:"role"`
+	MaxConcurrentImports int    `json:"max_concurrent_imports"`
+	DailyBytes           int64  `json:"daily_bytes"`
+	// the tenant the key imports for; empty keys pick one by path
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// keyUsage is the in-memory quota accounting of one key or tenant.
+type keyUsage struct {
+	running   int
+	day       string
+	bytesUsed int64
+}
+
+// apiKeys is the file-backed key store plus live usage per key and tenant.
+var apiKeys = struct {
+	sync.Mutex
+	byHash  map[string]*APIKey
+	usage   map[string]*keyUsage
+	tenants map[string]*keyUsage
+}{byHash: map[string]*APIKey{}, usage: map[string]*keyUsage{}, tenants: map[string]*keyUsage{}}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// loadAPIKeys reads the key store; a missing file means no keys yet.
+func loadAPIKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("api keys %s: %w", path, err)
+	}
+
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	for _, k := range keys {
+		if k.Role == "" {
+			k.Role = roleUploader
+		}
+		apiKeys.byHash[k.Hash] = k
+	}
+	return nil
+}
+
+// saveAPIKeysLocked writes the key store atomically. The caller holds the lock.
+func saveAPIKeysLocked(path string) error {
+	keys := make([]*APIKey, 0, len(apiKeys.byHash))
+	for _, k := range apiKeys.byHash {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".api_keys")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// requireAPIKey authenticates the caller with the X-API-Key header (or a
+// bearer token) and stores the key in the request context.
+func requireAPIKey(c *gin.Context) {
+	if !cfg().RequireAPIKey {
+		c.Next()
+		return
+	}
+
+	secret := c.GetHeader("X-API-Key")
+	if secret == "" {
+		secret = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if secret == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Missing API key"})
+		return
+	}
+
+	key, ok := lookupAPIKey(secret)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid API key"})
+		return
+	}
+
+	c.Set(apiKeyContextKey, key)
+	c.Next()
+}
+
+func lookupAPIKey(secret string) (*APIKey, bool) {
+	if secret == "" {
+		return nil, false
+	}
+
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	key, ok := apiKeys.byHash[hashAPIKey(secret)]
+	return key, ok
+}
+
+// requestAPIKey returns the authenticated key, or nil when auth is disabled.
+func requestAPIKey(c *gin.Context) *APIKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*APIKey)
+	}
+	return nil
+}
+
+// usageLocked returns the usage of id, starting a new day's volume when the
+// date changed. The caller holds the apiKeys lock.
+func usageLocked(usage map[string]*keyUsage, id string) *keyUsage {
+	u, ok := usage[id]
+	if !ok {
+		u = &keyUsage{}
+		usage[id] = u
+	}
+
+	today := time.Now().Format("2006-01-02")
+	if u.day != today {
+		u.day, u.bytesUsed = today, 0
+	}
+	return u
+}
+
+// reserveImportQuota accounts one running import of size bytes against the
+// quotas of the key and of the tenant, either of which may be missing. The
+// returned function releases the concurrency slots.
+func reserveImportQuota(key *APIKey, tenant string, size int64) (func(), error) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	var held []*keyUsage
+	if key != nil {
+		u := usageLocked(apiKeys.usage, key.ID)
+		if key.MaxConcurrentImports > 0 && u.running >= key.MaxConcurrentImports {
+			return nil, fmt.Errorf("API key %s already runs %d imports", key.Name, u.running)
+		}
+		if key.DailyBytes > 0 && u.bytesUsed+size > key.DailyBytes {
+			return nil, fmt.Errorf("API key %s exceeded its daily volume of %d bytes", key.Name, key.DailyBytes)
+		}
+		held = append(held, u)
+	}
+	if t := cfg().tenant(tenant); t != nil {
+		u := usageLocked(apiKeys.tenants, t.Name)
+		if t.MaxConcurrentImports > 0 && u.running >= t.MaxConcurrentImports {
+			return nil, fmt.Errorf("tenant %s already runs %d imports", t.Name, u.running)
+		}
+		if t.DailyBytes > 0 && u.bytesUsed+size > t.DailyBytes {
+			return nil, fmt.Errorf("tenant %s exceeded its daily volume of %d bytes", t.Name, t.DailyBytes)
+		}
+		held = append(held, u)
+	}
+
+	for _, u := range held {
+		u.running++
+		u.bytesUsed += size
+	}
+	return func() {
+		apiKeys.Lock()
+		for _, u := range held {
+			u.running--
+		}
+		apiKeys.Unlock()
+	}, nil
+}
+
+// handleTenantUsage reports the quotas of the tenants and what they use.
+func handleTenantUsage(c *gin.Context) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	tenants := []gin.H{}
+	for _, t := range cfg().Tenants {
+		entry := gin.H{
+			"name":                   t.Name,
+			"own_database":           t.DatabaseURL != "",
+			"max_concurrent_imports": t.MaxConcurrentImports,
+			"daily_bytes":            t.DailyBytes,
+		}
+		if u, ok := apiKeys.tenants[t.Name]; ok {
+			entry["running_imports"] = u.running
+			entry["bytes_used_today"] = u.bytesUsed
+		}
+		tenants = append(tenants, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+}
+
+// handleListAPIKeys lists the keys with their current usage.
+func handleListAPIKeys(c *gin.Context) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	keys := make([]gin.H, 0, len(apiKeys.byHash))
+	for _, k := range apiKeys.byHash {
+		entry := gin.H{
+			"id":                     k.ID,
+			"name":                   k.Name,
+			"prefix":                 k.Prefix,
+			"role":                   k.Role,
+			"max_concurrent_imports": k.MaxConcurrentImports,
+			"daily_bytes":            k.DailyBytes,
+			"tenant":                 k.Tenant,
+			"created_at":             k.CreatedAt,
+		}
+		if u, ok := apiKeys.usage[k.ID]; ok {
+			entry["running_imports"] = u.running
+			entry["bytes_used_today"] = u.bytesUsed
+		}
+		keys = append(keys, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// handleCreateAPIKey issues a new key. The secret is only returned here.
+func handleCreateAPIKey(c *gin.Context) {
+	var req struct {
+		Name                 string `json:"name"`
+		Role                 string `json:"role"`
+		MaxConcurrentImports int    `json:"max_concurrent_imports"`
+		DailyBytes           int64  `json:"daily_bytes"`
+		Tenant               string `json:"tenant"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "name is required"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUploader
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "role must be uploader, approver or admin"})
+		return
+	}
+	if req.MaxConcurrentImports < 0 || req.DailyBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "quotas must not be negative"})
+		return
+	}
+	if req.Tenant != "" && cfg().tenant(req.Tenant) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown tenant " + req.Tenant})
+		return
+	}
+
+	secret := "imp_" + randomHex(24)
+	key := &APIKey{
+		ID:                   randomHex(6),
+		Name:                 req.Name,
+		Hash:                 hashAPIKey(secret),
+		Prefix:               secret[:8],
+		Role:                 req.Role,
+		MaxConcurrentImports: req.MaxConcurrentImports,
+		DailyBytes:           req.DailyBytes,
+		Tenant:               req.Tenant,
+		CreatedAt:            time.Now().UTC(),
+	}
+
+	apiKeys.Lock()
+	apiKeys.byHash[key.Hash] = key
+	err := saveAPIKeysLocked(cfg().APIKeysFile)
+	if err != nil {
+		delete(apiKeys.byHash, key.Hash)
+	}
+	apiKeys.Unlock()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the API key: " + err.Error()})
+		return
+	}
+
+	auditRequest(c, auditKeyCreate, "", "id="+key.ID+" name="+key.Name+" role="+key.Role+" tenant="+key.Tenant)
+	c.JSON(http.StatusCreated, gin.H{"id": key.ID, "name": key.Name, "role": key.Role, "tenant": key.Tenant, "key": secret})
+}
+
+// handleDeleteAPIKey revokes a key by id.
+func handleDeleteAPIKey(c *gin.Context) {
+	id := c.Param("id")
+
+	apiKeys.Lock()
+	var revoked *APIKey
+	var err error
+	for hash, k := range apiKeys.byHash {
+		if k.ID != id {
+			continue
+		}
+
+		delete(apiKeys.byHash, hash)
+		if err = saveAPIKeysLocked(cfg().APIKeysFile); err != nil {
+			apiKeys.byHash[hash] = k
+		}
+		revoked = k
+		break
+	}
+	apiKeys.Unlock()
+
+	switch {
+	case revoked == nil:
+		c.JSON(http.StatusNotFound, gin.H{"message": "API key not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the API keys: " + err.Error()})
+	default:
+		auditRequest(c, auditKeyRevoke, "", "id="+id+" name="+revoked.Name)
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked", "id": id})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BackfillFile is one file of a backfill and how its import went.
+type BackfillFile struct {
+	Name     string `json:"name"`
+	Month    string `json:"month,omitempty"`
+	Year     string `json:"year,omitempty"`
+	ImportID string `json:"import_id,omitempty"`
+	// the status of the import, or skipped
+	Status   string `json:"status"`
+	RowsRead int64  `json:"rows_read"`
+	Inserted int64  `json:"inserted"`
+	Rejected int64  `json:"rejected"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BackfillReport sums up the imports of a backfill, oldest month first.
+type BackfillReport struct {
+	Source   string         `json:"source"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+	Files    []BackfillFile `json:"files"`
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Skipped  int            `json:"skipped"`
+	RowsRead int64          `json:"rows_read"`
+	Inserted int64          `json:"inserted"`
+	Rejected int64          `json:"rejected"`
+	Seconds  float64        `json:"seconds"`
+}
+
+const backfillSkipped = "skipped"
+
+// filenamePattern compiles a filename_pattern, which must name the month and
+// year of a file.
+func filenamePattern(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("month") < 0 || re.SubexpIndex("year") < 0 {
+		return nil, errors.New("needs (?P<month>...) and (?P<year>...) groups")
+	}
+	return re, nil
+}
+
+// periodKey orders months, 202405 for May 2024.
+func periodKey(d DateParams) int {
+	month, _ := parseMonth(d.Month)
+	year, _ := strconv.Atoi(d.Year)
+	return year*100 + int(month)
+}
+
+// parsePeriodFlag reads a -from or -to month written 2024-05.
+func parsePeriodFlag(name, v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("2006-01", v)
+	if err != nil {
+		return 0, fmt.Errorf("backfill: -%s must be a month like 2024-05", name)
+	}
+	return t.Year()*100 + int(t.Month()), nil
+}
+
+// runBackfillCommand imports the historical files of a directory or bucket
+// prefix one after the other, oldest month first, each into the month its
+// name holds, and prints a consolidated report. The files are left in place.
+func runBackfillCommand(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	source := fs.String("source", "", "directory, sftp://, s3:// or gs:// prefix of the files (required)")
+	pattern := fs.String("pattern", "", "glob the file names must match, e.g. *.csv*")
+	namePattern := fs.String("filename-pattern", "", "regexp with (?P<month>...) and (?P<year>...) groups (required)")
+	mapping := fs.String("mapping", "", "mapping version, the default one when empty")
+	mode := fs.String("mode", importModeAppend, "append or replace, per month")
+	existing := fs.String("existing", "", "skip or update rows already loaded, with mode append")
+	tenant := fs.String("tenant", "", "tenant to import for")
+	target := fs.String("target", "", "named database target")
+	priority := fs.String("priority", priorityLow, "priority of the imports: high, normal or low")
+	from := fs.String("from", "", "first month to import, e.g. 2022-01")
+	to := fs.String("to", "", "last month to import, e.g. 2023-12")
+	dryRun := fs.Bool("dry-run", false, "list the files and their months without importing")
+	stopOnError := fs.Bool("stop-on-error", false, "stop at the first failed import")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *source == "" || *namePattern == "" {
+		return errors.New("backfill needs -source and -filename-pattern")
+	}
+	re, err := filenamePattern(*namePattern)
+	if err != nil {
+		return fmt.Errorf("backfill: -filename-pattern %w", err)
+	}
+	if _, err := path.Match(*pattern, ""); err != nil {
+		return fmt.Errorf("backfill: -pattern: %w", err)
+	}
+	first, err := parsePeriodFlag("from", *from)
+	if err != nil {
+		return err
+	}
+	last, err := parsePeriodFlag("to", *to)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	src, err := openFileSource(ctx, *source)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	files, err := src.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	// period reads the month of a file like a schedule with this pattern
+	named := ScheduleConfig{filename: re}
+	report := BackfillReport{Source: *source, DryRun: *dryRun}
+	type queued struct {
+		file remoteFile
+		date DateParams
+	}
+	var todo []queued
+	for _, f := range files {
+		if ok, _ := path.Match(*pattern, f.Name); *pattern != "" && !ok {
+			continue
+		}
+		date, err := named.period(f)
+		switch {
+		case err != nil:
+			report.Files = append(report.Files, BackfillFile{Name: f.Name, Status: backfillSkipped, Error: err.Error()})
+		case first > 0 && periodKey(date) < first, last > 0 && periodKey(date) > last:
+		default:
+			todo = append(todo, queued{f, date})
+		}
+	}
+	sort.SliceStable(todo, func(i, j int) bool {
+		if a, b := periodKey(todo[i].date), periodKey(todo[j].date); a != b {
+			return a < b
+		}
+		return todo[i].file.Name < todo[j].file.Name
+	})
+
+	started := time.Now()
+	settings := cfg()
+	for i, q := range todo {
+		entry := BackfillFile{Name: q.file.Name, Month: q.date.Month, Year: q.date.Year}
+		if *dryRun {
+			entry.Status = backfillSkipped
+			report.Files = append(report.Files, entry)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s -> %s %s\n", i+1, len(todo), q.file.Name, q.date.Month, q.date.Year)
+
+		spec := importSpec{
+			date:           q.date,
+			mapping:        *mapping,
+			mode:           *mode,
+			existing:       *existing,
+			priority:       *priority,
+			staged:         settings.StagingLoad,
+			profile:        settings.ProfileImports,
+			rebuildIndexes: settings.RebuildIndexes,
+			analyze:        settings.AnalyzeAfterImport,
+			tenant:         *tenant,
+			database:       *target,
+		}
+		var imp *Import
+		err := spec.resolve(settings)
+		if err == nil {
+			imp, err = loadSourceFile(ctx, src, &spec, q.file, "backfill")
+		}
+		if imp != nil {
+			r := imp.report()
+			entry.ImportID, entry.Status = imp.ID, r.Status
+			entry.RowsRead, entry.Inserted, entry.Rejected = r.RowsRead, r.Inserted, r.Rejected
+			entry.Error = r.AbortReason
+			report.RowsRead += r.RowsRead
+			report.Inserted += r.Inserted
+			report.Rejected += r.Rejected
+		}
+		if err != nil {
+			entry.Status, entry.Error = importStatusFailed, err.Error()
+		}
+		if entry.Status == importStatusFailed {
+			report.Failed++
+		} else {
+			report.Imported++
+		}
+		report.Files = append(report.Files, entry)
+		fmt.Fprintf(os.Stderr, "    %s, %d inserted, %d rejected %s\n", entry.Status, entry.Inserted, entry.Rejected, entry.Error)
+		if entry.Status == importStatusFailed && *stopOnError {
+			break
+		}
+	}
+	for _, f := range report.Files {
+		if f.Status == backfillSkipped {
+			report.Skipped++
+		}
+	}
+	report.Seconds = time.Since(started).Round(time.Millisecond).Seconds()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("backfill: %d of %d imports failed", report.Failed, report.Failed+report.Imported)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// how long a worker waits for more rows before sending a partial batch, so
+// rows are not held back while the reader is slow or paused
+const batchFlushDelay = 50 * time.Millisecond
+
+// collectBatch gathers up to size rows, starting with first, from jobs.
+func collectBatch(first []interface{}, jobs <-chan []interface{}, size int) [][]interface{} {
+	batch := [][]interface{}{first}
+	if size <= 1 {
+		return batch
+	}
+
+	timer := time.NewTimer(batchFlushDelay)
+	defer timer.Stop()
+
+	for len(batch) < size {
+		select {
+		case job, ok := <-jobs:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, job)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// insertBatch pipelines the rows of a batch in one round trip. The statement
+// is prepared once per connection by prepareInsert. A batch runs as one
+// implicit transaction, so a failing row rolls back the rows before it: that
+// row is rejected, the rows before it are sent again as a batch and the rows
+// after it one by one, as insertSavepoint does, rather than resending the rest
+// of the batch after every bad row. The returned errors are indexed like rows.
+func insertBatch(ctx context.Context, conn *pgxpool.Conn, query string, rows [][]interface{}) []error {
+	errs := make([]error, len(rows))
+	query = prepareInsert(ctx, conn, query)
+
+	pending := make([]int, len(rows))
+	for i := range pending {
+		pending[i] = i
+	}
+	failed, err := sendBatch(ctx, conn, query, rows, pending)
+	switch {
+	case err == nil:
+		return errs
+	case failed < 0:
+		// the batch failed as a whole, none of its rows is in
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	errs[failed] = err
+
+	// the rows before the bad one went in once, they only go one by one if
+	// they fail again
+	rest := pending[failed+1:]
+	if failed > 0 {
+		if _, err := sendBatch(ctx, conn, query, rows, pending[:failed]); err != nil {
+			rest = append(pending[:failed:failed], rest...)
+		}
+	}
+	for _, i := range rest {
+		_, errs[i] = conn.Exec(ctx, query, rows[i]...)
+	}
+	return errs
+}
+
+// sendBatch inserts the pending rows in one batch. It returns the position in
+// pending of the row that failed it, or -1 when the batch failed past its
+// rows, on commit.
+func sendBatch(ctx context.Context, conn *pgxpool.Conn, query string, rows [][]interface{}, pending []int) (int, error) {
+	b := &pgx.Batch{}
+	for _, i := range pending {
+		b.Queue(query, rows[i]...)
+	}
+
+	results := conn.SendBatch(ctx, b)
+	for j := range pending {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return j, err
+		}
+	}
+	return -1, results.Close()
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// insert strategies a benchmark compares
+const (
+	benchmarkRow      = "row"      // one INSERT per row, what a batch_size of 1 does
+	benchmarkMultiRow = "multirow" // one INSERT ... VALUES (...), (...) per batch
+	benchmarkBatch    = "batch"    // a pipelined pgx batch of single-row INSERTs, what the workers do
+	benchmarkCopy     = "copy"     // COPY FROM STDIN
+)
+
+var benchmarkStrategies = []string{benchmarkRow, benchmarkMultiRow, benchmarkBatch, benchmarkCopy}
+
+// a statement takes at most this many parameters
+const maxQueryParams = 65535
+
+const defaultBenchmarkRows = 20000
+
+// BenchmarkResult is the load of the sample with one strategy and batch size.
+type BenchmarkResult struct {
+	Strategy   string  `json:"strategy"`
+	BatchSize  int     `json:"batch_size,omitempty"`
+	Rows       int     `json:"rows"`
+	Seconds    float64 `json:"seconds"`
+	RowsPerSec float64 `json:"rows_per_sec"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type BenchmarkReport struct {
+	Mapping     string            `json:"mapping_version"`
+	Table       string            `json:"table"`
+	SampleRows  int               `json:"sample_rows"`
+	SkippedRows int               `json:"skipped_rows"`
+	Results     []BenchmarkResult `json:"results"`
+	Fastest     *BenchmarkResult  `json:"fastest,omitempty"`
+	// the fastest batch size of the strategy the workers use
+	BatchSize int    `json:"recommended_batch_size,omitempty"`
+	Note      string `json:"note"`
+	// how the sample was read, as an import of the file would
+	Dialect CSVDialect `json:"dialect"`
+}
+
+type benchmarkOptions struct {
+	mapping    string
+	month      string
+	year       string
+	strategies []string
+	batchSizes []int
+	maxRows    int
+}
+
+// parseBenchmarkOptions reads the comma separated strategies and batch sizes;
+// empty values take every strategy and 100, 500, 1000 plus batch_size.
+func parseBenchmarkOptions(mapping, month, year, strategies, batchSizes string, maxRows int) (benchmarkOptions, error) {
+	o := benchmarkOptions{mapping: mapping, month: month, year: year, maxRows: maxRows}
+	if o.maxRows <= 0 {
+		o.maxRows = defaultBenchmarkRows
+	}
+
+	o.strategies = benchmarkStrategies
+	if strategies != "" {
+		o.strategies = strings.Split(strategies, ",")
+		for _, s := range o.strategies {
+			if !validBenchmarkStrategy(s) {
+				return o, fmt.Errorf("strategy must be one of %s", strings.Join(benchmarkStrategies, ", "))
+			}
+		}
+	}
+
+	if batchSizes == "" {
+		o.batchSizes = []int{100, 500, 1000}
+		if n := cfg().BatchSize; n != 100 && n != 500 && n != 1000 {
+			o.batchSizes = append(o.batchSizes, n)
+		}
+		return o, nil
+	}
+	for _, s := range strings.Split(batchSizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			return o, fmt.Errorf("batch sizes must be positive numbers, got %q", s)
+		}
+		o.batchSizes = append(o.batchSizes, n)
+	}
+	return o, nil
+}
+
+func validBenchmarkStrategy(s string) bool {
+	for _, known := range benchmarkStrategies {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// readBenchmarkSample converts up to maxRows rows of the sample like an import
+// would, with delimiter or the sniffed one when it is 0. Rows that do not
+// convert are skipped and counted. Tokenized columns keep their values, the
+// vault is not written by a benchmark; protected ones are hashed or masked as
+// usual.
+func readBenchmarkSample(r io.Reader, plan *executionPlan, maxRows int, delimiter rune) ([][]interface{}, int, CSVDialect, error) {
+	var dialect CSVDialect
+	body, err := decompressUpload(r)
+	if err != nil {
+		return nil, 0, dialect, err
+	}
+	defer body.Close()
+
+	input := bufio.NewReaderSize(limitRowLength(body, cfg().MaxRowBytes), rowSampleBytes)
+	if delimiter == 0 {
+		delimiter, dialect.Sniffed = sniffInput(input)
+	}
+	dialect.Delimiter = string(delimiter)
+	csvReader := csv.NewReader(input)
+	csvReader.Comma = delimiter
+
+	var rows [][]interface{}
+	skipped := 0
+	isHeader := true
+	for len(rows) < maxRows {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errLimitExceeded) {
+				return nil, 0, dialect, err
+			}
+			skipped++
+			continue
+		}
+		if isHeader {
+			isHeader = false
+			continue
+		}
+
+		if plan.combined {
+			row = plan.combine(row)
+		}
+		plan.clean(row)
+		values, failed := plan.convert(row)
+		if len(failed) > 0 || len(row) < plan.fileColumns {
+			skipped++
+			continue
+		}
+		plan.protectValues(values, cfg().PIIHashKey)
+		rows = append(rows, values)
+	}
+	if len(rows) == 0 {
+		return nil, skipped, dialect, errors.New("the sample has no row that converts with the mapping")
+	}
+	return rows, skipped, dialect, nil
+}
+
+// runBenchmark loads rows into a temporary table once per strategy and batch
+// size, on a single connection. The table copies the import target, indexes
+// included, when it exists and is built from the mapping otherwise.
+func runBenchmark(ctx context.Context, o benchmarkOptions, plan *executionPlan, rows [][]interface{}) (*BenchmarkReport, error) {
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePool()
+
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	report := &BenchmarkReport{Mapping: plan.version, SampleRows: len(rows)}
+	report.Table, err = createBenchmarkTable(ctx, conn, o, plan)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Exec(context.Background(), "DROP TABLE IF EXISTS "+report.Table)
+
+	for _, strategy := range o.strategies {
+		sizes := o.batchSizes
+		if strategy == benchmarkRow || strategy == benchmarkCopy {
+			sizes = []int{0}
+		}
+		for _, size := range sizes {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if _, err := conn.Exec(ctx, "TRUNCATE "+report.Table); err != nil {
+				return nil, err
+			}
+			result := benchmarkStrategy(ctx, conn, report.Table, plan, strategy, size, rows)
+			log.Println("=> benchmark", strategy, size, result.RowsPerSec, "rows/s")
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	var fastestBatch float64
+	for i, r := range report.Results {
+		if r.Error != "" {
+			continue
+		}
+		if report.Fastest == nil || r.RowsPerSec > report.Fastest.RowsPerSec {
+			report.Fastest = &report.Results[i]
+		}
+		if r.Strategy == benchmarkBatch && r.RowsPerSec > fastestBatch {
+			fastestBatch = r.RowsPerSec
+			report.BatchSize = r.BatchSize
+		}
+	}
+	report.Note = "one connection; an import runs up to workers of them at once, so the totals scale with the pool " +
+		"until the database saturates. imports use batch (row when batch_size is 1)"
+	return report, nil
+}
+
+func createBenchmarkTable(ctx context.Context, conn *pgxpool.Conn, o benchmarkOptions, plan *executionPlan) (string, error) {
+	table := "benchmark_" + randomHex(4)
+
+	if o.month != "" && o.year != "" {
+		spec := importSpec{date: DateParams{Month: o.month, Year: o.year}, mapping: o.mapping, mode: importModeAppend}
+		if err := spec.resolve(cfg()); err != nil {
+			return "", err
+		}
+		target := spec.schema + "." + spec.table
+		var exists bool
+		if err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", target).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists {
+			_, err := conn.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING INDEXES)", table, target))
+			return table, err
+		}
+	}
+
+	columns := make([]string, len(plan.columns))
+	for i, name := range plan.columns {
+		columns[i] = name + " " + sqlTypes[plan.types[i]]
+	}
+	_, err := conn.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (%s)", table, strings.Join(columns, ", ")))
+	return table, err
+}
+
+func benchmarkStrategy(ctx context.Context, conn *pgxpool.Conn, table string, plan *executionPlan, strategy string, size int, rows [][]interface{}) BenchmarkResult {
+	result := BenchmarkResult{Strategy: strategy, BatchSize: size, Rows: len(rows)}
+	query := plan.insertQuery(table)
+
+	// multi-row statements are capped by the parameter limit of postgres
+	if strategy == benchmarkMultiRow && size*len(plan.columns) > maxQueryParams {
+		result.BatchSize = maxQueryParams / len(plan.columns)
+		size = result.BatchSize
+	}
+
+	start := time.Now()
+	var err error
+	switch strategy {
+	case benchmarkRow:
+		for _, values := range rows {
+			if _, err = conn.Exec(ctx, query, values...); err != nil {
+				break
+			}
+		}
+	case benchmarkMultiRow:
+		for i := 0; i < len(rows) && err == nil; i += size {
+			chunk := rows[i:min(i+size, len(rows))]
+			args := make([]interface{}, 0, len(chunk)*len(plan.columns))
+			for _, values := range chunk {
+				args = append(args, values...)
+			}
+			_, err = conn.Exec(ctx, multiRowInsertQuery(table, plan.columns, len(chunk)), args...)
+		}
+	case benchmarkBatch:
+		for i := 0; i < len(rows) && err == nil; i += size {
+			for _, e := range insertBatch(ctx, conn, query, rows[i:min(i+size, len(rows))]) {
+				if e != nil {
+					err = e
+					break
+				}
+			}
+		}
+	case benchmarkCopy:
+		_, err = conn.CopyFrom(ctx, pgx.Identifier{table}, plan.columns, plan.copySource(rows))
+	}
+	elapsed := time.Since(start)
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Seconds = math.Round(elapsed.Seconds()*1000) / 1000
+	if elapsed > 0 {
+		result.RowsPerSec = math.Round(float64(len(rows)) / elapsed.Seconds())
+	}
+	return result
+}
+
+func multiRowInsertQuery(table string, columns []string, rows int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ","))
+	n := 1
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('(')
+		for c := range columns {
+			if c > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "$%d", n)
+			n++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// handleBenchmark loads an uploaded sample with every strategy:
+//
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" -F "file=@sample.csv" "http://localhost:8080/admin/benchmark?mapping=default&batch_sizes=200,1000"
+//
+// With month and year the scratch table copies the indexes of that import
+// target.
+func handleBenchmark(c *gin.Context) {
+	if !limitUploadBody(c) {
+		return
+	}
+
+	maxRows, _ := strconv.Atoi(c.Query("rows"))
+	o, err := parseBenchmarkOptions(c.Query("mapping"), c.Query("month"), c.Query("year"), c.Query("strategies"), c.Query("batch_sizes"), maxRows)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	plan, err := planForVersion(o.mapping)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var upload *spillBuffer
+	mr, err := c.Request.MultipartReader()
+	if err == nil {
+		upload, _, err = readUploadPart(mr, cfg().UploadMemoryBytes)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to read the sample file"})
+		return
+	}
+	defer upload.close()
+
+	sample, err := upload.reader()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the sample file"})
+		return
+	}
+	delimiter, err := parseDelimiter(c.DefaultQuery("delimiter", cfg().CSVDelimiter))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	rows, skipped, dialect, err := readBenchmarkSample(sample, plan, o.maxRows, delimiter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	report, err := runBenchmark(c.Request.Context(), o, plan, rows)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Benchmark failed: " + err.Error()})
+		return
+	}
+	report.SkippedRows = skipped
+	report.Dialect = dialect
+	auditRequest(c, auditBenchmark, "", fmt.Sprintf("mapping=%s rows=%d", plan.version, len(rows)))
+	c.JSON(http.StatusOK, report)
+}
+
+// runBenchmarkCommand is the offline form, `big_file_pgsql benchmark -file
+// sample.csv`, printing the report as JSON.
+func runBenchmarkCommand(args []string) error {
+	fs := flag.NewFlagSet("benchmark", flag.ContinueOnError)
+	file := fs.String("file", "", "sample csv file (required)")
+	mapping := fs.String("mapping", "", "mapping version, the default one when empty")
+	month := fs.String("month", "", "month of the import target whose indexes to copy")
+	year := fs.String("year", "", "year of the import target whose indexes to copy")
+	strategies := fs.String("strategies", "", "comma separated strategies: "+strings.Join(benchmarkStrategies, ","))
+	batchSizes := fs.String("batch-sizes", "", "comma separated batch sizes")
+	maxRows := fs.Int("rows", defaultBenchmarkRows, "rows of the sample to load")
+	delimiterFlag := fs.String("delimiter", cfg().CSVDelimiter, "field delimiter: auto, ;, ,, tab or |")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("benchmark: -file is required")
+	}
+
+	o, err := parseBenchmarkOptions(*mapping, *month, *year, *strategies, *batchSizes, *maxRows)
+	if err != nil {
+		return err
+	}
+	plan, err := planForVersion(o.mapping)
+	if err != nil {
+		return err
+	}
+
+	delimiter, err := parseDelimiter(*delimiterFlag)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, skipped, dialect, err := readBenchmarkSample(f, plan, o.maxRows, delimiter)
+	if err != nil {
+		return err
+	}
+
+	report, err := runBenchmark(context.Background(), o, plan, rows)
+	if err != nil {
+		return err
+	}
+	report.SkippedRows = skipped
+	report.Dialect = dialect
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
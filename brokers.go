@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// what a broker message carries for each row
+const (
+	brokerPayloadKeys = "keys"
+	brokerPayloadRows = "rows"
+)
+
+// how rows are grouped into messages
+const (
+	brokerPerBatch = "batch"
+	brokerPerRow   = "row"
+)
+
+// brokerMessage is one message for the broker; the key picks the partition
+// on kafka and is ignored by nats.
+type brokerMessage struct {
+	key   []byte
+	value []byte
+}
+
+// broker sends messages to a kafka topic or nats subject.
+type broker interface {
+	send(ctx context.Context, topic string, msgs []brokerMessage) error
+	close()
+}
+
+// brokers compiled into this binary, by name; the clients are extra modules
+// and register themselves from files behind build tags
+var brokerDrivers = map[string]func(addrs []string) (broker, error){}
+
+func registerBroker(name string, open func(addrs []string) (broker, error)) {
+	brokerDrivers[name] = open
+}
+
+func brokerNames() []string {
+	names := make([]string, 0, len(brokerDrivers))
+	for name := range brokerDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the broker batches are published to, opened once at startup
+var activeBroker broker
+
+func startBroker(settings *Config) (func(), error) {
+	if settings.Broker == "" {
+		return func() {}, nil
+	}
+	open := brokerDrivers[settings.Broker]
+	if open == nil {
+		return nil, fmt.Errorf("broker %q is not compiled in, build with -tags %s", settings.Broker, settings.Broker)
+	}
+	b, err := open(settings.BrokerAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("broker %s: %w", settings.Broker, err)
+	}
+	activeBroker = b
+	log.Println("=> publishing batches to", settings.Broker, settings.BrokerTopic)
+	return b.close, nil
+}
+
+// BatchMessage is what consumers receive for a committed batch, or for a
+// single row with broker_granularity: row.
+type BatchMessage struct {
+	ImportID    string                   `json:"import_id"`
+	Tenant      string                   `json:"tenant,omitempty"`
+	Database    string                   `json:"database,omitempty"`
+	Table       string                   `json:"table"`
+	Batch       int64                    `json:"batch"`
+	CommittedAt time.Time                `json:"committed_at"`
+	Keys        []map[string]interface{} `json:"keys,omitempty"`
+	Rows        []map[string]interface{} `json:"rows,omitempty"`
+}
+
+// published reports whether the batches of imp are sent to the broker. Like
+// mirroring this only covers rows that are in the live table once their batch
+// commits.
+func (imp *Import) published() bool {
+	return activeBroker != nil && !imp.oneTransaction() && !imp.Staged && imp.Mode == importModeAppend && !imp.routed()
+}
+
+// publishBatch sends the committed rows of batch number n to broker_topic.
+func (imp *Import) publishBatch(ctx context.Context, n int64, rows [][]interface{}) {
+	if len(rows) == 0 {
+		return
+	}
+	settings := cfg()
+	topic := strings.NewReplacer("{table}", imp.target(), "{tenant}", imp.Tenant).Replace(settings.BrokerTopic)
+
+	columns := imp.plan.columns
+	payloadColumns := columns
+	if settings.BrokerPayload == brokerPayloadKeys {
+		payloadColumns = settings.BrokerKeyColumns
+	}
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[column] = i
+	}
+	pick := func(values []interface{}, names []string) map[string]interface{} {
+		m := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			if i, ok := index[name]; ok {
+				m[name] = values[i]
+			} else {
+				m[name] = nil
+			}
+		}
+		return m
+	}
+
+	base := BatchMessage{ImportID: imp.ID, Tenant: imp.Tenant, Database: imp.Database, Table: imp.target(), Batch: n, CommittedAt: time.Now()}
+	encode := func(rows [][]interface{}) (brokerMessage, error) {
+		m := base
+		for _, values := range rows {
+			if settings.BrokerPayload == brokerPayloadKeys {
+				m.Keys = append(m.Keys, pick(values, payloadColumns))
+			} else {
+				m.Rows = append(m.Rows, pick(values, payloadColumns))
+			}
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			return brokerMessage{}, err
+		}
+		key := imp.ID
+		if len(rows) == 1 && len(settings.BrokerKeyColumns) > 0 {
+			// rows with the same key keep their order on one partition
+			key = brokerKey(pick(rows[0], settings.BrokerKeyColumns), settings.BrokerKeyColumns)
+		}
+		return brokerMessage{key: []byte(key), value: value}, nil
+	}
+
+	var msgs []brokerMessage
+	var err error
+	if settings.BrokerGranularity == brokerPerRow {
+		msgs = make([]brokerMessage, len(rows))
+		for i := range rows {
+			if msgs[i], err = encode(rows[i : i+1]); err != nil {
+				break
+			}
+		}
+	} else {
+		var msg brokerMessage
+		msg, err = encode(rows)
+		msgs = []brokerMessage{msg}
+	}
+	if err == nil {
+		err = activeBroker.send(ctx, topic, msgs)
+	}
+	if err != nil {
+		atomic.AddInt64(&imp.publishFailed, int64(len(rows)))
+		log.Println("Publishing batch", n, "of import", imp.ID, "failed:", err)
+		return
+	}
+	atomic.AddInt64(&imp.publishedRows, int64(len(rows)))
+}
+
+func brokerKey(values map[string]interface{}, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = fmt.Sprint(values[column])
+	}
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,44 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka needs github.com/segmentio/kafka-go, so it is only compiled in with
+// `-tags kafka`. broker_addrs are the bootstrap servers (host:9092); messages
+// are hashed onto partitions by key and acknowledged by all in-sync replicas.
+func init() {
+	registerBroker("kafka", openKafkaBroker)
+}
+
+type kafkaBroker struct {
+	writer *kafka.Writer
+}
+
+func openKafkaBroker(addrs []string) (broker, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("broker_addrs needs at least one bootstrap server")
+	}
+	return &kafkaBroker{writer: &kafka.Writer{
+		Addr:         kafka.TCP(addrs...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}, nil
+}
+
+func (b *kafkaBroker) send(ctx context.Context, topic string, msgs []brokerMessage) error {
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		kmsgs[i] = kafka.Message{Topic: topic, Key: m.key, Value: m.value}
+	}
+	return b.writer.WriteMessages(ctx, kmsgs...)
+}
+
+func (b *kafkaBroker) close() {
+	b.writer.Close()
+}
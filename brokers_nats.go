@@ -0,0 +1,47 @@
+//go:build nats
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS needs github.com/nats-io/nats.go, so it is only compiled in with
+// `-tags nats`. broker_addrs are server urls (nats://host:4222) and
+// broker_topic is the subject; a batch counts as sent once the server has
+// received it.
+func init() {
+	registerBroker("nats", openNATSBroker)
+}
+
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+func openNATSBroker(addrs []string) (broker, error) {
+	url := nats.DefaultURL
+	if len(addrs) > 0 {
+		url = strings.Join(addrs, ",")
+	}
+	conn, err := nats.Connect(url, nats.Name("big_file_pgsql"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{conn: conn}, nil
+}
+
+func (b *natsBroker) send(ctx context.Context, subject string, msgs []brokerMessage) error {
+	for _, m := range msgs {
+		if err := b.conn.Publish(subject, m.value); err != nil {
+			return err
+		}
+	}
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *natsBroker) close() {
+	b.conn.Drain()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SourceBundle bundles the parameters the files of one sender, a courier or
+// a client, are always uploaded with; ?source=<name> applies them. A
+// parameter sent with the upload still wins over the bundle.
+type SourceBundle struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	// a mapping version or a template, not both
+	Mapping     string `yaml:"mapping" json:"mapping,omitempty"`
+	Template    string `yaml:"template" json:"template,omitempty"`
+	Delimiter   string `yaml:"delimiter" json:"delimiter,omitempty"`
+	SkipRows    int    `yaml:"skip_rows" json:"skip_rows,omitempty"`
+	SkipColumns int    `yaml:"skip_columns" json:"skip_columns,omitempty"`
+	Mode        string `yaml:"mode" json:"mode,omitempty"`
+	Strict      bool   `yaml:"strict" json:"strict,omitempty"`
+	Transaction bool   `yaml:"transaction" json:"transaction,omitempty"`
+	Staging     *bool  `yaml:"staging" json:"staging,omitempty"`
+	Existing    string `yaml:"existing" json:"existing,omitempty"`
+	Priority    string `yaml:"priority" json:"priority,omitempty"`
+	// fail or flag for the control totals sent with the files
+	OnMismatch string `yaml:"on_mismatch" json:"on_mismatch,omitempty"`
+	// off, verify or infer for the months of the rows
+	PeriodCheck string `yaml:"period_check" json:"period_check,omitempty"`
+	// told about the imports of this source besides the global notifiers,
+	// from notify_error_rate unless set here
+	Notifiers       []NotifierConfig `yaml:"notifiers" json:"notifiers,omitempty"`
+	NotifyErrorRate float64          `yaml:"notify_error_rate" json:"notify_error_rate,omitempty"`
+}
+
+func (s *SourceBundle) check() error {
+	switch {
+	case !identifierPattern.MatchString(s.Name):
+		return fmt.Errorf("source name %q must be a plain identifier", s.Name)
+	case s.Mapping != "" && s.Template != "":
+		return fmt.Errorf("source %s: mapping and template cannot be used together", s.Name)
+	case s.Mode != "" && !validImportMode(s.Mode):
+		return fmt.Errorf("source %s: mode must be append or replace", s.Name)
+	case !validExistingMode(s.Existing):
+		return fmt.Errorf("source %s: existing must be skip or update", s.Name)
+	case checkPriority(s.Priority) != nil:
+		return fmt.Errorf("source %s: %w", s.Name, checkPriority(s.Priority))
+	case s.OnMismatch != "" && s.OnMismatch != controlMismatchFail && s.OnMismatch != controlMismatchFlag:
+		return fmt.Errorf("source %s: on_mismatch must be fail or flag", s.Name)
+	case s.PeriodCheck != "" && !validPeriodCheck(s.PeriodCheck):
+		return fmt.Errorf("source %s: period_check must be off, verify or infer", s.Name)
+	case s.SkipRows < 0 || s.SkipColumns < 0:
+		return fmt.Errorf("source %s: skip_rows and skip_columns must not be negative", s.Name)
+	case s.NotifyErrorRate < 0 || s.NotifyErrorRate > 1:
+		return fmt.Errorf("source %s: notify_error_rate must be between 0 and 1", s.Name)
+	}
+	if s.Delimiter != "" {
+		if _, err := parseDelimiter(s.Delimiter); err != nil {
+			return fmt.Errorf("source %s: %w", s.Name, err)
+		}
+	}
+	for _, nc := range s.Notifiers {
+		if err := checkNotifier(nc); err != nil {
+			return fmt.Errorf("source %s: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// sourceBundle returns the bundle of the configured source name.
+func (c *Config) sourceBundle(name string) (*SourceBundle, error) {
+	for i := range c.Sources {
+		if c.Sources[i].Name == name {
+			return &c.Sources[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown source %s", name)
+}
+
+// applySource fills in the parameters of s the upload left out, given
+// reporting whether it sent one, from the bundle named by s.source.
+func (s *importSpec) applySource(settings *Config, given func(param string) bool) error {
+	if s.source == "" {
+		return nil
+	}
+	src, err := settings.sourceBundle(s.source)
+	if err != nil {
+		return err
+	}
+	if !given("mapping") && !given("template") {
+		s.mapping, s.template = src.Mapping, src.Template
+	}
+	set := func(param string, field *string, value string) {
+		if value != "" && !given(param) {
+			*field = value
+		}
+	}
+	set("mode", &s.mode, src.Mode)
+	set("existing", &s.existing, src.Existing)
+	set("priority", &s.priority, src.Priority)
+	set("delimiter", &s.delimiter, src.Delimiter)
+	set("on_mismatch", &s.controls.onMismatch, src.OnMismatch)
+	set("period_check", &s.periodCheck, src.PeriodCheck)
+	if src.SkipRows > 0 {
+		set("skip_rows", &s.skipRows, strconv.Itoa(src.SkipRows))
+	}
+	if src.SkipColumns > 0 {
+		set("skip_columns", &s.skipColumns, strconv.Itoa(src.SkipColumns))
+	}
+	if !given("strict") {
+		s.strict = src.Strict
+	}
+	if !given("transaction") {
+		s.transaction = src.Transaction
+	}
+	if src.Staging != nil && !given("staging") {
+		s.staged = *src.Staging
+	}
+	return nil
+}
+
+// queryGiven reports whether the request sent a query parameter.
+func queryGiven(c *gin.Context) func(string) bool {
+	return func(param string) bool {
+		_, ok := c.GetQuery(param)
+		return ok
+	}
+}
+
+// sourceNotifiers are the notifiers told about the imports of the named
+// source and the error rate that triggers them.
+func (c *Config) sourceNotifiers(name string) ([]NotifierConfig, float64) {
+	notifiers, rate := c.Notifiers, c.NotifyErrorRate
+	if name == "" {
+		return notifiers, rate
+	}
+	src, err := c.sourceBundle(name)
+	if err != nil {
+		return notifiers, rate
+	}
+	if src.NotifyErrorRate > 0 {
+		rate = src.NotifyErrorRate
+	}
+	return append(append([]NotifierConfig(nil), notifiers...), src.Notifiers...), rate
+}
+
+// handleListSources lists the source bundles and what they apply.
+func handleListSources(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sources": cfg().redacted().Sources})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errImportCancelled = errors.New("import cancelled")
+
+// runContext returns the context the import runs under, the same for the
+// window wait and the load, cancelled by cancel.
+func (imp *Import) runContext() (context.Context, context.CancelFunc) {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.runCtx == nil {
+		imp.runCtx, imp.cancelRun = context.WithCancel(context.Background())
+	}
+	return imp.runCtx, imp.cancelRun
+}
+
+// cancel stops imp wherever it is: waiting for its window or a slot, paused,
+// or loading. It fails like an aborted import, so a replace or staged import
+// leaves the table as it was.
+func (imp *Import) cancel(by, reason string) error {
+	imp.mu.Lock()
+	finished := !imp.finishedAt.IsZero()
+	imp.mu.Unlock()
+	if finished {
+		return errImportFinished
+	}
+
+	err := fmt.Errorf("%w by %s", errImportCancelled, by)
+	if reason != "" {
+		err = fmt.Errorf("%w: %s", err, reason)
+	}
+	imp.abort(err)
+	_, stop := imp.runContext()
+	stop()
+	return nil
+}
+
+// handleCancelImport cancels a queued, paused or running import.
+func handleCancelImport(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+	reason := c.Query("reason")
+	if err := imp.cancel(requestPrincipal(c), reason); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	auditRequest(c, auditCancel, imp.ID, reason)
+	c.JSON(http.StatusAccepted, gin.H{"import_id": imp.ID, "message": "Import cancelled, it stops after the batches in flight"})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// optionalConnector is an integration that needs extra modules and is only
+// compiled in with its build tag.
+type optionalConnector struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Tag      string `json:"tag"`
+	Compiled bool   `json:"compiled"`
+}
+
+// optionalConnectors lists every connector that can be added with a build
+// tag, whether this binary has it or not.
+func optionalConnectors() []optionalConnector {
+	return []optionalConnector{
+		{Name: "bigquery", Kind: "warehouse", Tag: "bigquery", Compiled: warehouseDrivers["bigquery"] != nil},
+		{Name: "sftp", Kind: "file_source", Tag: "sftp", Compiled: fileSourceDrivers["sftp"] != nil},
+		{Name: "s3", Kind: "file_source", Tag: "s3", Compiled: fileSourceDrivers["s3"] != nil},
+		{Name: "gcs", Kind: "file_source", Tag: "gcs", Compiled: fileSourceDrivers["gs"] != nil},
+		{Name: "otlp", Kind: "tracing", Tag: "otel", Compiled: tracerFactories["otlp"] != nil},
+		{Name: "kafka", Kind: "broker", Tag: "kafka", Compiled: brokerDrivers["kafka"] != nil},
+		{Name: "nats", Kind: "broker", Tag: "nats", Compiled: brokerDrivers["nats"] != nil},
+		{Name: "redis", Kind: "checkpoint_store", Tag: "redis", Compiled: checkpointStores["redis"] != nil},
+		{Name: "xlsx", Kind: "export_format", Tag: "xlsx", Compiled: exportFormats["xlsx"] != nil},
+		{Name: "parquet", Kind: "input_format", Tag: "parquet", Compiled: inputFormats["parquet"] != nil},
+		{Name: "grpc", Kind: "api", Tag: "grpc", Compiled: grpcServer != nil},
+	}
+}
+
+// buildTags returns the -tags the binary was built with.
+func buildTags() []string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	for _, s := range info.Settings {
+		if s.Key == "-tags" && s.Value != "" {
+			return strings.Split(s.Value, ",")
+		}
+	}
+	return nil
+}
+
+// handleCapabilities reports what this binary can talk to, so a lean build
+// missing a connector is spotted before a config relies on it.
+func handleCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"build":             buildInfo(),
+		"build_tags":        buildTags(),
+		"codecs":            codecNames(),
+		"warehouse_drivers": warehouseDriverNames(),
+		"file_sources":      fileSourceSchemes(),
+		"notifiers":         notifierTypeNames(),
+		"tracing":           tracerNames(),
+		"brokers":           brokerNames(),
+		"checkpoint_stores": checkpointStoreNames(),
+		"input_formats":     inputFormatNames(),
+		"export_formats":    exportFormatNames(),
+		"optional":          optionalConnectors(),
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// start of the file looked at to estimate the row width
+const rowSampleBytes = 64 << 10
+
+// memory of a converted value besides its text: interface, string header and
+// allocation rounding
+const valueOverheadBytes = 40
+
+// bounds of an adaptive jobs buffer
+const (
+	minJobBuffer = 16
+	maxJobBuffer = 100000
+)
+
+// ChannelStats shows whether the reader or the workers were the bottleneck:
+// a reader that often finds the buffer full is waiting on the database, a
+// buffer that stays near empty means the workers wait on the reader.
+type ChannelStats struct {
+	Capacity       int     `json:"capacity"`
+	RowBytes       int     `json:"row_bytes"`
+	Sends          int64   `json:"sends"`
+	BlockedSends   int64   `json:"blocked_sends"`
+	BlockedSeconds float64 `json:"blocked_seconds"`
+	AvgOccupancy   float64 `json:"avg_occupancy"`
+	MaxOccupancy   int64   `json:"max_occupancy"`
+	OccupancyRatio float64 `json:"occupancy_ratio"`
+}
+
+// jobBufferSize sizes the jobs channel so the rows it holds stay within
+// job_buffer_bytes, from the average line length of the start of the file.
+// job_buffer_rows overrides the estimate. It also returns the estimated
+// memory of one row.
+func jobBufferSize(r *bufio.Reader, columns int, settings *Config) (int, int) {
+	sample, _ := r.Peek(rowSampleBytes)
+	lineBytes := len(sample)
+	if lines := bytes.Count(sample, []byte{'\n'}); lines > 0 {
+		lineBytes = len(sample) / lines
+	}
+	rowBytes := lineBytes + columns*valueOverheadBytes
+
+	if settings.JobBufferRows > 0 {
+		return settings.JobBufferRows, rowBytes
+	}
+
+	size := int(settings.JobBufferBytes / int64(rowBytes))
+	switch {
+	case size < minJobBuffer:
+		size = minJobBuffer
+	case size > maxJobBuffer:
+		size = maxJobBuffer
+	}
+	return size, rowBytes
+}
+
+// sendJob hands a row to the workers, counting how full the buffer was and
+// whether the reader had to wait. It reports false when ctx ended first.
+func (imp *Import) sendJob(ctx context.Context, jobs chan<- []interface{}, values []interface{}) bool {
+	occupancy := int64(len(jobs))
+	atomic.AddInt64(&imp.chanSends, 1)
+	atomic.AddInt64(&imp.chanOccupancy, occupancy)
+	// files parsed in parallel have several readers sending
+	for max := atomic.LoadInt64(&imp.chanMaxOccupancy); occupancy > max; max = atomic.LoadInt64(&imp.chanMaxOccupancy) {
+		if atomic.CompareAndSwapInt64(&imp.chanMaxOccupancy, max, occupancy) {
+			break
+		}
+	}
+
+	select {
+	case jobs <- values:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&imp.chanBlocked, 1)
+	waited := time.Now()
+	defer func() { atomic.AddInt64(&imp.chanBlockedNanos, int64(time.Since(waited))) }()
+	select {
+	case jobs <- values:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// channelStats is nil until the jobs channel was created.
+func (imp *Import) channelStats() *ChannelStats {
+	capacity := int(atomic.LoadInt64(&imp.chanCapacity))
+	if capacity == 0 {
+		return nil
+	}
+
+	s := &ChannelStats{
+		Capacity:       capacity,
+		RowBytes:       int(atomic.LoadInt64(&imp.chanRowBytes)),
+		Sends:          atomic.LoadInt64(&imp.chanSends),
+		BlockedSends:   atomic.LoadInt64(&imp.chanBlocked),
+		BlockedSeconds: math.Round(time.Duration(atomic.LoadInt64(&imp.chanBlockedNanos)).Seconds()*1000) / 1000,
+		MaxOccupancy:   atomic.LoadInt64(&imp.chanMaxOccupancy),
+	}
+	if s.Sends > 0 {
+		avg := float64(atomic.LoadInt64(&imp.chanOccupancy)) / float64(s.Sends)
+		s.AvgOccupancy = math.Round(avg*10) / 10
+		s.OccupancyRatio = math.Round(avg/float64(capacity)*1000) / 1000
+	}
+	return s
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ImportCheckpoint records how far the file of a distributed import has been
+// queued, so an upload retried with the same import_id and file continues
+// after the batches already queued.
+type ImportCheckpoint struct {
+	ImportID string
+	Checksum string
+	// byte offset of the end of the last queued batch, and their number
+	Offset  int64
+	Batches int
+}
+
+// BatchCheckpoint is a batch of rows (a chunk of the file) of a distributed
+// import, with its state and the lease of the worker loading it.
+type BatchCheckpoint struct {
+	ImportID   string
+	Batch      int
+	Spec       []byte
+	Data       []byte
+	State      string
+	Worker     string
+	LeaseUntil time.Time
+	Result     []byte
+	Error      string
+}
+
+// CheckpointStore keeps the state distributed imports share between nodes:
+// per import offsets, batch states and worker leases.
+type CheckpointStore interface {
+	saveCheckpoint(ctx context.Context, cp ImportCheckpoint) error
+	// loadCheckpoint returns nil when the import has none
+	loadCheckpoint(ctx context.Context, importID string) (*ImportCheckpoint, error)
+
+	queueBatch(ctx context.Context, b *BatchCheckpoint) error
+	// claimBatch leases the oldest queued batch to worker, nil when there is
+	// none; two workers never get the same batch
+	claimBatch(ctx context.Context, worker string, lease time.Duration) (*BatchCheckpoint, error)
+	renewLease(ctx context.Context, importID string, batch int, worker string, lease time.Duration) error
+	// finishBatch stores the state, result and error of a claimed batch
+	finishBatch(ctx context.Context, b *BatchCheckpoint) error
+	// takeFinished removes and returns the finished batches of an import,
+	// failing running ones whose lease ran out
+	takeFinished(ctx context.Context, importID string) ([]*BatchCheckpoint, error)
+	// pending counts the batches of an import that are queued or running
+	pending(ctx context.Context, importID string) (int, error)
+	// forget drops everything kept for an import
+	forget(ctx context.Context, importID string) error
+	close()
+}
+
+// checkpoint stores by checkpoint_store; redis registers itself from a file
+// behind a build tag
+var checkpointStores = map[string]func(settings *Config) (CheckpointStore, error){}
+
+func registerCheckpointStore(name string, open func(settings *Config) (CheckpointStore, error)) {
+	checkpointStores[name] = open
+}
+
+func checkpointStoreNames() []string {
+	names := make([]string, 0, len(checkpointStores))
+	for name := range checkpointStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerCheckpointStore("postgres", func(settings *Config) (CheckpointStore, error) {
+		return &pgCheckpointStore{batches: settings.ChunkTable, checkpoints: settings.CheckpointTable}, nil
+	})
+}
+
+// the store of this node, opened at startup with distributed_imports
+var checkpoints CheckpointStore
+
+func startCheckpointStore(settings *Config) (func(), error) {
+	if !settings.DistributedImports {
+		return func() {}, nil
+	}
+	open := checkpointStores[settings.CheckpointStore]
+	if open == nil {
+		return nil, fmt.Errorf("checkpoint store %q is not compiled in, build with -tags %s", settings.CheckpointStore, settings.CheckpointStore)
+	}
+	store, err := open(settings)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint store %s: %w", settings.CheckpointStore, err)
+	}
+	checkpoints = store
+	return store.close, nil
+}
+
+const chunkTableDDL = `CREATE TABLE IF NOT EXISTS %[1]s (
+	import_id   text NOT NULL,
+	chunk       int NOT NULL,
+	spec        jsonb NOT NULL,
+	data        bytea NOT NULL,
+	state       text NOT NULL DEFAULT 'queued',
+	worker      text,
+	queued_at   timestamptz NOT NULL DEFAULT now(),
+	claimed_at  timestamptz,
+	lease_until timestamptz,
+	finished_at timestamptz,
+	result      jsonb,
+	error       text,
+	PRIMARY KEY (import_id, chunk)
+);
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS lease_until timestamptz`
+
+const checkpointTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	import_id  text PRIMARY KEY,
+	checksum   text NOT NULL,
+	byte_offset bigint NOT NULL,
+	batches    int NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// pgCheckpointStore keeps batches in chunk_table and offsets in
+// checkpoint_table of database_url; SKIP LOCKED lets any number of workers
+// claim side by side.
+type pgCheckpointStore struct {
+	batches     string
+	checkpoints string
+}
+
+// exec runs fn with the shared pool once both tables exist.
+func (s *pgCheckpointStore) exec(ctx context.Context, fn func(db *pgxpool.Pool) error) error {
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+
+	if err := ensureTable(ctx, dbPool, s.batches, chunkTableDDL); err != nil {
+		return err
+	}
+	if err := ensureTable(ctx, dbPool, s.checkpoints, checkpointTableDDL); err != nil {
+		return err
+	}
+	return fn(dbPool)
+}
+
+func (s *pgCheckpointStore) saveCheckpoint(ctx context.Context, cp ImportCheckpoint) error {
+	return s.exec(ctx, func(db *pgxpool.Pool) error {
+		return dbExec(ctx, db, fmt.Sprintf(`INSERT INTO %s (import_id, checksum, byte_offset, batches) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (import_id) DO UPDATE SET checksum = $2, byte_offset = $3, batches = $4, updated_at = now()`, s.checkpoints),
+			cp.ImportID, cp.Checksum, cp.Offset, cp.Batches)
+	})
+}
+
+func (s *pgCheckpointStore) loadCheckpoint(ctx context.Context, importID string) (*ImportCheckpoint, error) {
+	var cp *ImportCheckpoint
+	err := s.exec(ctx, func(db *pgxpool.Pool) error {
+		c := ImportCheckpoint{ImportID: importID}
+		err := db.QueryRow(ctx, fmt.Sprintf("SELECT checksum, byte_offset, batches FROM %s WHERE import_id = $1", s.checkpoints), importID).Scan(&c.Checksum, &c.Offset, &c.Batches)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		cp = &c
+		return err
+	})
+	return cp, err
+}
+
+func (s *pgCheckpointStore) queueBatch(ctx context.Context, b *BatchCheckpoint) error {
+	return s.exec(ctx, func(db *pgxpool.Pool) error {
+		return dbExec(ctx, db, fmt.Sprintf("INSERT INTO %s (import_id, chunk, spec, data) VALUES ($1, $2, $3, $4)", s.batches),
+			b.ImportID, b.Batch, b.Spec, b.Data)
+	})
+}
+
+func (s *pgCheckpointStore) claimBatch(ctx context.Context, worker string, lease time.Duration) (*BatchCheckpoint, error) {
+	var claimed *BatchCheckpoint
+	err := s.exec(ctx, func(db *pgxpool.Pool) error {
+		b := BatchCheckpoint{State: chunkRunning, Worker: worker}
+		err := db.QueryRow(ctx, fmt.Sprintf(`UPDATE %[1]s SET state = '%[2]s', worker = $1, claimed_at = now(), lease_until = now() + make_interval(secs => $2)
+			WHERE (import_id, chunk) = (
+				SELECT import_id, chunk FROM %[1]s WHERE state = '%[3]s'
+				ORDER BY queued_at, chunk LIMIT 1 FOR UPDATE SKIP LOCKED)
+			RETURNING import_id, chunk, spec, data, lease_until`, s.batches, chunkRunning, chunkQueued), worker, lease.Seconds()).
+			Scan(&b.ImportID, &b.Batch, &b.Spec, &b.Data, &b.LeaseUntil)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		claimed = &b
+		return err
+	})
+	return claimed, err
+}
+
+func (s *pgCheckpointStore) renewLease(ctx context.Context, importID string, batch int, worker string, lease time.Duration) error {
+	return s.exec(ctx, func(db *pgxpool.Pool) error {
+		return dbExec(ctx, db, fmt.Sprintf(`UPDATE %s SET lease_until = now() + make_interval(secs => $4)
+			WHERE import_id = $1 AND chunk = $2 AND worker = $3 AND state = '%s'`, s.batches, chunkRunning),
+			importID, batch, worker, lease.Seconds())
+	})
+}
+
+func (s *pgCheckpointStore) finishBatch(ctx context.Context, b *BatchCheckpoint) error {
+	return s.exec(ctx, func(db *pgxpool.Pool) error {
+		// the rows are loaded, only the result is kept
+		return dbExec(ctx, db, fmt.Sprintf(`UPDATE %s SET state = $3, result = $4, error = nullif($5, ''), finished_at = now(), data = ''::bytea
+			WHERE import_id = $1 AND chunk = $2`, s.batches), b.ImportID, b.Batch, b.State, b.Result, b.Error)
+	})
+}
+
+func (s *pgCheckpointStore) takeFinished(ctx context.Context, importID string) ([]*BatchCheckpoint, error) {
+	var taken []*BatchCheckpoint
+	err := s.exec(ctx, func(db *pgxpool.Pool) error {
+		_, err := db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET state = '%s', error = 'worker lost', finished_at = now()
+			WHERE import_id = $1 AND state = '%s' AND lease_until < now()`, s.batches, chunkFailed, chunkRunning), importID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.Query(ctx, fmt.Sprintf(`DELETE FROM %s WHERE import_id = $1 AND state IN ('%s', '%s')
+			RETURNING chunk, state, coalesce(worker, ''), result, coalesce(error, '')`, s.batches, chunkDone, chunkFailed), importID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			b := &BatchCheckpoint{ImportID: importID}
+			if err := rows.Scan(&b.Batch, &b.State, &b.Worker, &b.Result, &b.Error); err != nil {
+				return err
+			}
+			taken = append(taken, b)
+		}
+		return rows.Err()
+	})
+	return taken, err
+}
+
+func (s *pgCheckpointStore) pending(ctx context.Context, importID string) (int, error) {
+	var n int
+	err := s.exec(ctx, func(db *pgxpool.Pool) error {
+		return db.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE import_id = $1 AND state IN ('%s', '%s')", s.batches, chunkQueued, chunkRunning), importID).Scan(&n)
+	})
+	return n, err
+}
+
+func (s *pgCheckpointStore) forget(ctx context.Context, importID string) error {
+	return s.exec(ctx, func(db *pgxpool.Pool) error {
+		if _, err := db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE import_id = $1", s.batches), importID); err != nil {
+			return err
+		}
+		return dbExec(ctx, db, fmt.Sprintf("DELETE FROM %s WHERE import_id = $1", s.checkpoints), importID)
+	})
+}
+
+func (s *pgCheckpointStore) close() {}
+
+// dbExec is Exec for statements whose command tag does not matter.
+func dbExec(ctx context.Context, db *pgxpool.Pool, sql string, args ...interface{}) error {
+	_, err := db.Exec(ctx, sql, args...)
+	return err
+}
@@ -0,0 +1,228 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The redis checkpoint store needs github.com/redis/go-redis/v9, so it is only
+// compiled in with `-tags redis`. checkpoint_redis_url is a redis:// url; the
+// queue is a list, every batch a hash and leases are compared against the
+// clock of the node collecting the batches.
+func init() {
+	registerCheckpointStore("redis", openRedisCheckpointStore)
+}
+
+const redisKeyPrefix = "big_file_pgsql:"
+
+// claimScript pops batches off the queue until one still exists and leases
+// it, so a batch is never popped without being marked running.
+var claimScript = redis.NewScript(`
+while true do
+	local id = redis.call('LPOP', KEYS[1])
+	if not id then return false end
+	local key = ARGV[1] .. id
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('HSET', key, 'state', ARGV[4], 'worker', ARGV[2], 'lease_until', ARGV[3])
+		return id
+	end
+end`)
+
+// renewScript extends the lease only for the worker holding it.
+var renewScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'worker') == ARGV[1] and redis.call('HGET', KEYS[1], 'state') == ARGV[3] then
+	redis.call('HSET', KEYS[1], 'lease_until', ARGV[2])
+end
+return 0`)
+
+type redisCheckpointStore struct {
+	client *redis.Client
+}
+
+func openRedisCheckpointStore(settings *Config) (CheckpointStore, error) {
+	if settings.CheckpointRedisURL == "" {
+		return nil, errors.New("checkpoint_store redis needs checkpoint_redis_url")
+	}
+	opts, err := redis.ParseURL(settings.CheckpointRedisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisCheckpointStore{client: client}, nil
+}
+
+func checkpointKey(importID string) string { return redisKeyPrefix + "checkpoint:" + importID }
+func batchSetKey(importID string) string   { return redisKeyPrefix + "batches:" + importID }
+func batchKey(id string) string            { return redisKeyPrefix + "batch:" + id }
+func batchID(importID string, batch int) string {
+	return importID + "/" + strconv.Itoa(batch)
+}
+
+func (s *redisCheckpointStore) saveCheckpoint(ctx context.Context, cp ImportCheckpoint) error {
+	return s.client.HSet(ctx, checkpointKey(cp.ImportID), "checksum", cp.Checksum, "offset", cp.Offset, "batches", cp.Batches).Err()
+}
+
+func (s *redisCheckpointStore) loadCheckpoint(ctx context.Context, importID string) (*ImportCheckpoint, error) {
+	fields, err := s.client.HGetAll(ctx, checkpointKey(importID)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	cp := &ImportCheckpoint{ImportID: importID, Checksum: fields["checksum"]}
+	cp.Offset, _ = strconv.ParseInt(fields["offset"], 10, 64)
+	cp.Batches, _ = strconv.Atoi(fields["batches"])
+	return cp, nil
+}
+
+func (s *redisCheckpointStore) queueBatch(ctx context.Context, b *BatchCheckpoint) error {
+	id := batchID(b.ImportID, b.Batch)
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, batchKey(id), "spec", b.Spec, "data", b.Data, "state", chunkQueued)
+		p.SAdd(ctx, batchSetKey(b.ImportID), b.Batch)
+		p.RPush(ctx, redisKeyPrefix+"queue", id)
+		return nil
+	})
+	return err
+}
+
+func (s *redisCheckpointStore) claimBatch(ctx context.Context, worker string, lease time.Duration) (*BatchCheckpoint, error) {
+	leaseUntil := time.Now().Add(lease)
+	id, err := claimScript.Run(ctx, s.client, []string{redisKeyPrefix + "queue"},
+		redisKeyPrefix+"batch:", worker, leaseUntil.UnixMilli(), chunkRunning).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	importID, n, _ := strings.Cut(id, "/")
+	b := &BatchCheckpoint{ImportID: importID, State: chunkRunning, Worker: worker, LeaseUntil: leaseUntil}
+	if b.Batch, err = strconv.Atoi(n); err != nil {
+		return nil, fmt.Errorf("bad batch id %q", id)
+	}
+	values, err := s.client.HMGet(ctx, batchKey(id), "spec", "data").Result()
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := values[0].(string)
+	data, _ := values[1].(string)
+	b.Spec, b.Data = []byte(spec), []byte(data)
+	return b, nil
+}
+
+func (s *redisCheckpointStore) renewLease(ctx context.Context, importID string, batch int, worker string, lease time.Duration) error {
+	return renewScript.Run(ctx, s.client, []string{batchKey(batchID(importID, batch))},
+		worker, time.Now().Add(lease).UnixMilli(), chunkRunning).Err()
+}
+
+func (s *redisCheckpointStore) finishBatch(ctx context.Context, b *BatchCheckpoint) error {
+	key := batchKey(batchID(b.ImportID, b.Batch))
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, "state", b.State, "result", b.Result, "error", b.Error)
+		// the rows are loaded, only the result is kept
+		p.HDel(ctx, key, "data")
+		return nil
+	})
+	return err
+}
+
+// batches returns the state of every batch of an import.
+func (s *redisCheckpointStore) batches(ctx context.Context, importID string) ([]*BatchCheckpoint, error) {
+	members, err := s.client.SMembers(ctx, batchSetKey(importID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var list []*BatchCheckpoint
+	for _, m := range members {
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		values, err := s.client.HMGet(ctx, batchKey(batchID(importID, n)), "state", "worker", "lease_until", "result", "error").Result()
+		if err != nil {
+			return nil, err
+		}
+		b := &BatchCheckpoint{ImportID: importID, Batch: n}
+		state, _ := values[0].(string)
+		b.State = state
+		b.Worker, _ = values[1].(string)
+		if ms, err := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64); err == nil {
+			b.LeaseUntil = time.UnixMilli(ms)
+		}
+		if result, ok := values[3].(string); ok && result != "" {
+			b.Result = []byte(result)
+		}
+		b.Error, _ = values[4].(string)
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+func (s *redisCheckpointStore) takeFinished(ctx context.Context, importID string) ([]*BatchCheckpoint, error) {
+	list, err := s.batches(ctx, importID)
+	if err != nil {
+		return nil, err
+	}
+	var taken []*BatchCheckpoint
+	for _, b := range list {
+		if b.State == chunkRunning && time.Now().After(b.LeaseUntil) {
+			b.State, b.Error = chunkFailed, "worker lost"
+		}
+		if b.State != chunkDone && b.State != chunkFailed {
+			continue
+		}
+		_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Del(ctx, batchKey(batchID(importID, b.Batch)))
+			p.SRem(ctx, batchSetKey(importID), b.Batch)
+			return nil
+		})
+		if err != nil {
+			return taken, err
+		}
+		taken = append(taken, b)
+	}
+	return taken, nil
+}
+
+func (s *redisCheckpointStore) pending(ctx context.Context, importID string) (int, error) {
+	list, err := s.batches(ctx, importID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range list {
+		if b.State == chunkQueued || b.State == chunkRunning {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *redisCheckpointStore) forget(ctx context.Context, importID string) error {
+	members, err := s.client.SMembers(ctx, batchSetKey(importID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{batchSetKey(importID), checkpointKey(importID)}
+	for _, m := range members {
+		keys = append(keys, redisKeyPrefix+"batch:"+importID+"/"+m)
+	}
+	// queue entries of dropped batches are skipped by claimScript
+	return s.client.Del(ctx, keys...).Err()
+}
+
+func (s *redisCheckpointStore) close() {
+	s.client.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// codec is a streaming compression format usable for uploads and artifacts.
+type codec struct {
+	name      string
+	extension string
+	magic     []byte
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+// compression codecs compiled into this binary, by name
+var codecs = map[string]*codec{}
+
+func registerCodec(c *codec) {
+	codecs[c.name] = c
+}
+
+func init() {
+	registerCodec(&codec{
+		name:      "gzip",
+		extension: ".gz",
+		magic:     []byte{0x1f, 0x8b},
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestSpeed)
+		},
+	})
+}
+
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupCodec returns the codec named name; "" and "none" mean uncompressed.
+func lookupCodec(name string) (*codec, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "none" || name == "identity" {
+		return nil, nil
+	}
+	if name == "zst" {
+		name = "zstd"
+	}
+
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compression %q is not supported by this build (available: %s)", name, strings.Join(codecNames(), ", "))
+	}
+	return c, nil
+}
+
+// compressed reports whether a file starting with head needs decompressing.
+func compressed(head []byte) bool {
+	for _, c := range codecs {
+		if len(c.magic) > 0 && bytes.HasPrefix(head, c.magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressUpload sniffs the first bytes of r and transparently decompresses
+// gzip or zstd input. The data is decoded as it is read, never buffered whole.
+func decompressUpload(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+
+	for _, c := range codecs {
+		if len(c.magic) > 0 && bytes.HasPrefix(head, c.magic) {
+			return c.newReader(br)
+		}
+	}
+
+	return io.NopCloser(br), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fieldCombiner builds the value of one column from the file fields it spans.
+type fieldCombiner func(fields []string) string
+
+// compileCombine compiles the combine expression of a column spanning several
+// file fields, named by sources. The expression joins field names and quoted
+// literals with +, e.g. `tgl_ttd + ' ' + jam_ttd`.
+func compileCombine(sources []string, expr string) (fieldCombiner, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, fmt.Errorf("sources need a combine expression")
+	}
+
+	index := make(map[string]int, len(sources))
+	for i, name := range sources {
+		if _, dup := index[name]; dup || name == "" {
+			return nil, fmt.Errorf("sources must be distinct names")
+		}
+		index[name] = i
+	}
+
+	// each term is either a literal or the position of a source field
+	type term struct {
+		literal string
+		field   int
+	}
+	var terms []term
+	for _, part := range splitCombine(expr) {
+		part = strings.TrimSpace(part)
+		switch {
+		case len(part) >= 2 && (part[0] == '\'' || part[0] == '"') && part[len(part)-1] == part[0]:
+			terms = append(terms, term{literal: part[1 : len(part)-1], field: -1})
+		case part == "":
+			return nil, fmt.Errorf("combine %q: empty term", expr)
+		default:
+			i, ok := index[part]
+			if !ok {
+				return nil, fmt.Errorf("combine %q: %s is not one of the sources %v", expr, part, sources)
+			}
+			terms = append(terms, term{field: i})
+		}
+	}
+
+	return func(fields []string) string {
+		var b strings.Builder
+		for _, t := range terms {
+			if t.field < 0 {
+				b.WriteString(t.literal)
+			} else if t.field < len(fields) {
+				b.WriteString(fields[t.field])
+			}
+		}
+		return b.String()
+	}, nil
+}
+
+// splitCombine splits an expression on the + signs outside quotes.
+func splitCombine(expr string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '+':
+			parts = append(parts, expr[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+// combine folds the file fields of a row into one field per column. Fields
+// past the mapped ones are kept so the row still shows up as too long.
+func (p *executionPlan) combine(row []string) []string {
+	out := make([]string, 0, len(row))
+	pos := 0
+	for i, span := range p.spans {
+		if pos >= len(row) {
+			break
+		}
+		end := pos + span
+		if end > len(row) {
+			end = len(row)
+		}
+		if fn := p.combiners[i]; fn != nil {
+			out = append(out, fn(row[pos:end]))
+		} else {
+			out = append(out, row[pos])
+		}
+		pos = end
+	}
+	return append(out, row[pos:]...)
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the resolved runtime configuration. A *Config is never modified
+// once published; live changes swap in a new copy, so an import keeps using
+// the snapshot it started with.
+type Config struct {
+	ListenAddr               string           `yaml:"listen_addr" json:"listen_addr"`
+	ListenSocket             string           `yaml:"listen_socket" json:"listen_socket"`
+	GRPCAddr                 string           `yaml:"grpc_addr" json:"grpc_addr"`
+	TrustedProxies           []string         `yaml:"trusted_proxies" json:"trusted_proxies"`
+	DatabaseURL              string           `yaml:"database_url" json:"database_url"`
+	DBMinConns               int              `yaml:"db_min_conns" json:"db_min_conns"`
+	DBMaxConns               int              `yaml:"db_max_conns" json:"db_max_conns"`
+	Workers                  int              `yaml:"workers" json:"workers"`
+	BatchSize                int              `yaml:"batch_size" json:"batch_size"`
+	AdaptiveBatch            AdaptiveBatch    `yaml:"adaptive_batch" json:"adaptive_batch"`
+	PeriodCheck              PeriodCheck      `yaml:"period_check" json:"period_check"`
+	JobBufferRows            int              `yaml:"job_buffer_rows" json:"job_buffer_rows"`
+	JobBufferBytes           int64            `yaml:"job_buffer_bytes" json:"job_buffer_bytes"`
+	StagingLoad              bool             `yaml:"staging_load" json:"staging_load"`
+	RebuildIndexes           bool             `yaml:"rebuild_indexes" json:"rebuild_indexes"`
+	IndexTable               string           `yaml:"index_table" json:"index_table"`
+	AnalyzeAfterImport       bool             `yaml:"analyze_after_import" json:"analyze_after_import"`
+	ProfileImports           bool             `yaml:"profile_imports" json:"profile_imports"`
+	MaintenanceSQL           []string         `yaml:"maintenance_sql" json:"maintenance_sql"`
+	PreImportSQL             []string         `yaml:"pre_import_sql" json:"pre_import_sql"`
+	PostImportSQL            []string         `yaml:"post_import_sql" json:"post_import_sql"`
+	TableLayout              string           `yaml:"table_layout" json:"table_layout"`
+	PartitionSchema          string           `yaml:"partition_schema" json:"partition_schema"`
+	SchemaPattern            string           `yaml:"schema_pattern" json:"schema_pattern"`
+	MonthDDL                 MonthDDL         `yaml:"month_ddl" json:"month_ddl"`
+	PartitionColumn          string           `yaml:"partition_column" json:"partition_column"`
+	ClientColumn             string           `yaml:"client_column" json:"client_column"`
+	PaymentColumn            string           `yaml:"payment_column" json:"payment_column"`
+	SummarySums              []string         `yaml:"summary_sums" json:"summary_sums"`
+	CSVDelimiter             string           `yaml:"csv_delimiter" json:"csv_delimiter"`
+	MappingDir               string           `yaml:"mapping_dir" json:"mapping_dir"`
+	ErrorLogFile             string           `yaml:"error_log_file" json:"error_log_file"`
+	LogRowValues             bool             `yaml:"log_row_values" json:"log_row_values"`
+	RedactColumns            []string         `yaml:"redact_columns" json:"redact_columns"`
+	MaxStoredRejects         int              `yaml:"max_stored_rejects" json:"max_stored_rejects"`
+	DuplicateKeysMax         int              `yaml:"duplicate_keys_max" json:"duplicate_keys_max"`
+	MilestoneEvery           int64            `yaml:"milestone_every" json:"milestone_every"`
+	LogsOrigins              []string         `yaml:"logs_origins" json:"logs_origins"`
+	AdminToken               string           `yaml:"admin_token" json:"admin_token"`
+	WebhookURLs              []string         `yaml:"webhook_urls" json:"webhook_urls"`
+	WebhookSecret            string           `yaml:"webhook_secret" json:"webhook_secret"`
+	URLSigningSecret         string           `yaml:"url_signing_secret" json:"url_signing_secret"`
+	TokenizationKey          string           `yaml:"tokenization_key" json:"tokenization_key"`
+	PIIHashKey               string           `yaml:"pii_hash_key" json:"pii_hash_key"`
+	TokenVaultTable          string           `yaml:"token_vault_table" json:"token_vault_table"`
+	PublicURL                string           `yaml:"public_url" json:"public_url"`
+	Notifiers                []NotifierConfig `yaml:"notifiers" json:"notifiers"`
+	NotifyErrorRate          float64          `yaml:"notify_error_rate" json:"notify_error_rate"`
+	NotifyTemplate           string           `yaml:"notify_template" json:"notify_template"`
+	AnomalyMonths            int              `yaml:"anomaly_months" json:"anomaly_months"`
+	AnomalyThreshold         float64          `yaml:"anomaly_threshold" json:"anomaly_threshold"`
+	AnomalyMetrics           []string         `yaml:"anomaly_metrics" json:"anomaly_metrics"`
+	DigestCron               string           `yaml:"digest_cron" json:"digest_cron"`
+	DigestPeriod             string           `yaml:"digest_period" json:"digest_period"`
+	RequireAPIKey            bool             `yaml:"require_api_key" json:"require_api_key"`
+	APIKeysFile              string           `yaml:"api_keys_file" json:"api_keys_file"`
+	ImportWindows            []string         `yaml:"import_windows" json:"import_windows"`
+	Schedules                []ScheduleConfig `yaml:"schedules" json:"schedules"`
+	Sources                  []SourceBundle   `yaml:"sources" json:"sources"`
+	Tenants                  []TenantConfig   `yaml:"tenants" json:"tenants"`
+	Targets                  []TargetConfig   `yaml:"targets" json:"targets"`
+	AuditTable               string           `yaml:"audit_table" json:"audit_table"`
+	HistoryTable             string           `yaml:"history_table" json:"history_table"`
+	TemplateTable            string           `yaml:"template_table" json:"template_table"`
+	WarehouseDriver          string           `yaml:"warehouse_driver" json:"warehouse_driver"`
+	WarehouseDSN             string           `yaml:"warehouse_dsn" json:"warehouse_dsn"`
+	WarehouseTable           string           `yaml:"warehouse_table" json:"warehouse_table"`
+	WarehouseIntervalMinutes int              `yaml:"warehouse_interval_minutes" json:"warehouse_interval_minutes"`
+	MaxUploadBytes           int64            `yaml:"max_upload_bytes" json:"max_upload_bytes"`
+	UploadMemoryBytes        int64            `yaml:"upload_memory_bytes" json:"upload_memory_bytes"`
+	SpoolDir                 string           `yaml:"spool_dir" json:"spool_dir"`
+	UploadDir                string           `yaml:"upload_dir" json:"upload_dir"`
+	UploadExpiryHours        int              `yaml:"upload_expiry_hours" json:"upload_expiry_hours"`
+	MaxRows                  int64            `yaml:"max_rows" json:"max_rows"`
+	MaxRowBytes              int              `yaml:"max_row_bytes" json:"max_row_bytes"`
+	RollbackRetentionHours   int              `yaml:"rollback_retention_hours" json:"rollback_retention_hours"`
+	SnapshotTable            string           `yaml:"snapshot_table" json:"snapshot_table"`
+	IdempotencyTTLHours      int              `yaml:"idempotency_ttl_hours" json:"idempotency_ttl_hours"`
+	FinishedImportTTLHours   int              `yaml:"finished_import_ttl_hours" json:"finished_import_ttl_hours"`
+	ImportLock               string           `yaml:"import_lock" json:"import_lock"`
+	MaxRunningImports        int              `yaml:"max_running_imports" json:"max_running_imports"`
+	PreemptImports           bool             `yaml:"preempt_imports" json:"preempt_imports"`
+	TracingExporter          string           `yaml:"tracing_exporter" json:"tracing_exporter"`
+	TracingEndpoint          string           `yaml:"tracing_endpoint" json:"tracing_endpoint"`
+	TracingServiceName       string           `yaml:"tracing_service_name" json:"tracing_service_name"`
+	TracingSampleRatio       float64          `yaml:"tracing_sample_ratio" json:"tracing_sample_ratio"`
+	MirrorDatabaseURL        string           `yaml:"mirror_database_url" json:"mirror_database_url"`
+	MirrorFile               string           `yaml:"mirror_file" json:"mirror_file"`
+	Broker                   string           `yaml:"broker" json:"broker"`
+	BrokerAddrs              []string         `yaml:"broker_addrs" json:"broker_addrs"`
+	BrokerTopic              string           `yaml:"broker_topic" json:"broker_topic"`
+	BrokerPayload            string           `yaml:"broker_payload" json:"broker_payload"`
+	BrokerKeyColumns         []string         `yaml:"broker_key_columns" json:"broker_key_columns"`
+	BrokerGranularity        string           `yaml:"broker_granularity" json:"broker_granularity"`
+	ParseWorkers             int              `yaml:"parse_workers" json:"parse_workers"`
+	ParallelParseMinBytes    int64            `yaml:"parallel_parse_min_bytes" json:"parallel_parse_min_bytes"`
+	NodeRole                 string           `yaml:"node_role" json:"node_role"`
+	DistributedImports       bool             `yaml:"distributed_imports" json:"distributed_imports"`
+	ChunkBytes               int64            `yaml:"chunk_bytes" json:"chunk_bytes"`
+	ChunkTable               string           `yaml:"chunk_table" json:"chunk_table"`
+	ChunkTimeoutMinutes      int              `yaml:"chunk_timeout_minutes" json:"chunk_timeout_minutes"`
+	QueueWorkers             int              `yaml:"queue_workers" json:"queue_workers"`
+	CheckpointStore          string           `yaml:"checkpoint_store" json:"checkpoint_store"`
+	CheckpointTable          string           `yaml:"checkpoint_table" json:"checkpoint_table"`
+	CheckpointRedisURL       string           `yaml:"checkpoint_redis_url" json:"checkpoint_redis_url"`
+	FeatureFlags             map[string]bool  `yaml:"feature_flags" json:"feature_flags"`
+	MigrationsDir            string           `yaml:"migrations_dir" json:"migrations_dir"`
+	MigrationTable           string           `yaml:"migration_table" json:"migration_table"`
+	MigrateOnStart           bool             `yaml:"migrate_on_start" json:"migrate_on_start"`
+
+	windows        []importWindow
+	digestCron     *cronSchedule
+	anomalyMetrics []anomalyMetric
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// configHooks run after a live configuration change has been published.
+var configHooks []func(old, next *Config)
+
+// cfg returns the configuration snapshot currently in effect.
+func cfg() *Config {
+	return currentConfig.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:               ":8080",
+		DatabaseURL:              "user=postgres dbname=test sslmode=disable", // Replace with your PostgreSQL connection details
+		DBMinConns:               4,
+		DBMaxConns:               50,
+		Workers:                  100,
+		BatchSize:                500,
+		AdaptiveBatch:            defaultAdaptiveBatch(),
+		PeriodCheck:              defaultPeriodCheck(),
+		JobBufferBytes:           64 << 20,
+		TableLayout:              layoutSchemaPerMonth,
+		PartitionSchema:          "public",
+		SchemaPattern:            "cashback_{month}_{year}",
+		MonthDDL:                 defaultMonthDDL(),
+		PartitionColumn:          "tgl_pengiriman",
+		ClientColumn:             "klien_pengiriman",
+		PaymentColumn:            "metode_pembayaran",
+		SummarySums:              []string{"total_biaya", "cod", "diskon"},
+		CSVDelimiter:             delimiterAuto,
+		MappingDir:               "mappings",
+		ErrorLogFile:             "error.log",
+		LogRowValues:             true,
+		MaxStoredRejects:         100000,
+		DuplicateKeysMax:         5000000,
+		MilestoneEvery:           10000,
+		RequireAPIKey:            true,
+		APIKeysFile:              "api_keys.json",
+		AuditTable:               "public.audit_log",
+		HistoryTable:             "public.import_history",
+		TemplateTable:            "public.mapping_templates",
+		IndexTable:               "public.dropped_indexes",
+		TokenVaultTable:          "public.token_vault",
+		WarehouseTable:           "public.import_history_export",
+		WarehouseIntervalMinutes: 60,
+		DigestPeriod:             digestDaily,
+		AnomalyThreshold:         0.3,
+		AnomalyMetrics:           []string{"sum(total_biaya)", "avg(berat_yang_ditagih)"},
+		MaxUploadBytes:           10 << 30,
+		UploadMemoryBytes:        32 << 20,
+		SpoolDir:                 filepath.Join(os.TempDir(), "big_file_pgsql"),
+		UploadDir:                "uploads",
+		UploadExpiryHours:        24,
+		MaxRowBytes:              64 << 10,
+		RollbackRetentionHours:   72,
+		SnapshotTable:            "public.replace_snapshots",
+		IdempotencyTTLHours:      24,
+		FinishedImportTTLHours:   24,
+		TracingServiceName:       "big_file_pgsql",
+		TracingSampleRatio:       1,
+		BrokerPayload:            brokerPayloadKeys,
+		BrokerGranularity:        brokerPerBatch,
+		ParseWorkers:             1,
+		ParallelParseMinBytes:    64 << 20,
+		NodeRole:                 nodeRoleAll,
+		ChunkBytes:               16 << 20,
+		ChunkTable:               "public.import_chunks",
+		ChunkTimeoutMinutes:      30,
+		QueueWorkers:             2,
+		CheckpointStore:          "postgres",
+		CheckpointTable:          "public.import_checkpoints",
+		FeatureFlags:             map[string]bool{},
+		MigrationsDir:            "migrations",
+		MigrationTable:           "public.schema_migrations",
+	}
+}
+
+// loadConfig resolves the configuration from the defaults, the optional YAML
+// file at path and finally the environment.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	if v := os.Getenv("DATABASE_URL"); v != "" {
+		c.DatabaseURL = v
+	}
+	if v := os.Getenv("ADMIN_TOKEN"); v != "" {
+		c.AdminToken = v
+	}
+	if v := os.Getenv("WEBHOOK_SECRET"); v != "" {
+		c.WebhookSecret = v
+	}
+	if v := os.Getenv("URL_SIGNING_SECRET"); v != "" {
+		c.URLSigningSecret = v
+	}
+	if v := os.Getenv("TOKENIZATION_KEY"); v != "" {
+		c.TokenizationKey = v
+	}
+	if v := os.Getenv("PII_HASH_KEY"); v != "" {
+		c.PIIHashKey = v
+	}
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		c.ListenAddr = v
+	}
+	if v := os.Getenv("LISTEN_SOCKET"); v != "" {
+		c.ListenSocket = v
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// validate checks the settings and prepares the values derived from them.
+func (c *Config) validate() error {
+	windows, err := parseImportWindows(c.ImportWindows)
+	if err != nil {
+		return err
+	}
+	c.windows = windows
+
+	if c.anomalyMetrics, err = parseAnomalyMetrics(c.AnomalyMetrics); err != nil {
+		return err
+	}
+
+	tenants := map[string]bool{}
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if err := t.check(); err != nil {
+			return err
+		}
+		if tenants[t.Name] {
+			return fmt.Errorf("tenant name %s is used twice", t.Name)
+		}
+		tenants[t.Name] = true
+	}
+
+	targets := map[string]bool{}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if err := t.check(); err != nil {
+			return err
+		}
+		if targets[t.Name] {
+			return fmt.Errorf("target name %s is used twice", t.Name)
+		}
+		targets[t.Name] = true
+	}
+
+	names := map[string]bool{}
+	for i := range c.Schedules {
+		s := &c.Schedules[i]
+		if err := s.compile(); err != nil {
+			return err
+		}
+		if names[s.Name] {
+			return fmt.Errorf("schedule name %s is used twice", s.Name)
+		}
+		names[s.Name] = true
+		if s.Tenant != "" && !tenants[s.Tenant] {
+			return fmt.Errorf("schedule %s: unknown tenant %s", s.Name, s.Tenant)
+		}
+		if err := c.checkDatabase(s.Tenant, s.Target); err != nil {
+			return fmt.Errorf("schedule %s: %w", s.Name, err)
+		}
+	}
+
+	for _, u := range c.WebhookURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("webhook url %q must be an absolute http(s) url", u)
+		}
+	}
+
+	for _, nc := range c.Notifiers {
+		if err := checkNotifier(nc); err != nil {
+			return err
+		}
+	}
+	sources := map[string]bool{}
+	for i := range c.Sources {
+		s := &c.Sources[i]
+		if err := s.check(); err != nil {
+			return err
+		}
+		if sources[s.Name] {
+			return fmt.Errorf("source %s is defined twice", s.Name)
+		}
+		sources[s.Name] = true
+	}
+	if _, err := template.New("notify").Parse(c.notifyTemplate()); err != nil {
+		return fmt.Errorf("notify_template: %w", err)
+	}
+
+	c.digestCron = nil
+	if c.DigestCron != "" {
+		if c.digestCron, err = parseCron(c.DigestCron); err != nil {
+			return fmt.Errorf("digest_cron: %w", err)
+		}
+	}
+
+	for _, statements := range [][]string{c.PreImportSQL, c.PostImportSQL, c.MaintenanceSQL} {
+		for _, stmt := range statements {
+			if strings.TrimSpace(stmt) == "" {
+				return fmt.Errorf("pre_import_sql, post_import_sql and maintenance_sql must not contain empty statements")
+			}
+		}
+	}
+
+	switch {
+	case c.DatabaseURL == "":
+		return fmt.Errorf("database_url is required")
+	case c.DBMaxConns < 1:
+		return fmt.Errorf("db_max_conns must be at least 1")
+	case c.DBMinConns < 0 || c.DBMinConns > c.DBMaxConns:
+		return fmt.Errorf("db_min_conns must be between 0 and db_max_conns")
+	case c.Workers < 1:
+		return fmt.Errorf("workers must be at least 1")
+	case !validLayout(c.TableLayout):
+		return fmt.Errorf("table_layout must be schema_per_month, partitioned or partitioned_by_client")
+	case c.RebuildIndexes && partitionedLayout(c.TableLayout) && !c.StagingLoad:
+		return fmt.Errorf("rebuild_indexes needs staging_load with a partitioned layout")
+	case !identifierPattern.MatchString(c.PartitionSchema) || !identifierPattern.MatchString(c.PartitionColumn) || !identifierPattern.MatchString(c.ClientColumn) || !identifierPattern.MatchString(c.PaymentColumn):
+		return fmt.Errorf("partition_schema, partition_column, client_column and payment_column must be plain identifiers")
+	case checkSchemaPattern(c.SchemaPattern) != nil:
+		return checkSchemaPattern(c.SchemaPattern)
+	case c.MonthDDL.AutoCreate && partitionedLayout(c.TableLayout):
+		return fmt.Errorf("month_ddl.auto_create only applies to the %s layout", layoutSchemaPerMonth)
+	case c.BatchSize < 1:
+		return fmt.Errorf("batch_size must be at least 1")
+	case c.AdaptiveBatch.Enabled && (c.AdaptiveBatch.MinSize < 1 || c.AdaptiveBatch.MaxSize < c.AdaptiveBatch.MinSize):
+		return fmt.Errorf("adaptive_batch.min_size must be at least 1 and max_size at least min_size")
+	case c.AdaptiveBatch.Enabled && (c.AdaptiveBatch.TargetMillis < 1 || c.AdaptiveBatch.MaxErrorRate < 0 || c.AdaptiveBatch.MaxErrorRate > 1):
+		return fmt.Errorf("adaptive_batch.target_millis must be at least 1 and max_error_rate between 0 and 1")
+	case c.PeriodCheck.check() != nil:
+		return c.PeriodCheck.check()
+	case c.JobBufferRows < 0 || c.JobBufferBytes < 1:
+		return fmt.Errorf("job_buffer_rows must not be negative and job_buffer_bytes must be at least 1")
+	case c.MaxStoredRejects < 0:
+		return fmt.Errorf("max_stored_rejects must not be negative")
+	case c.DuplicateKeysMax < 1:
+		return fmt.Errorf("duplicate_keys_max must be at least 1")
+	case !validDelimiter(c.CSVDelimiter):
+		return fmt.Errorf("csv_delimiter: %w", errDelimiter)
+	case c.MilestoneEvery < 1:
+		return fmt.Errorf("milestone_every must be at least 1")
+	case c.MaxUploadBytes < 0 || c.MaxRows < 0 || c.MaxRowBytes < 0:
+		return fmt.Errorf("max_upload_bytes, max_rows and max_row_bytes must not be negative")
+	case c.UploadDir == "" || c.UploadExpiryHours < 1:
+		return fmt.Errorf("upload_dir is required and upload_expiry_hours must be at least 1")
+	case c.SpoolDir == "" || c.UploadMemoryBytes < 0:
+		return fmt.Errorf("spool_dir is required and upload_memory_bytes must not be negative")
+	case c.WarehouseDriver != "" && warehouseDrivers[c.WarehouseDriver] == nil:
+		return fmt.Errorf("warehouse_driver must be one of %v", warehouseDriverNames())
+	case c.WarehouseIntervalMinutes < 1:
+		return fmt.Errorf("warehouse_interval_minutes must be at least 1")
+	case len(c.WebhookURLs) > 0 && c.WebhookSecret == "":
+		return fmt.Errorf("webhook_urls need a webhook_secret to sign the payloads")
+	case c.NotifyErrorRate < 0 || c.NotifyErrorRate > 1:
+		return fmt.Errorf("notify_error_rate must be between 0 and 1")
+	case !validDigestPeriod(c.DigestPeriod):
+		return fmt.Errorf("digest_period must be day or week")
+	case c.AnomalyMonths < 0 || c.AnomalyMonths > 36:
+		return fmt.Errorf("anomaly_months must be between 0 and 36")
+	case c.AnomalyThreshold <= 0:
+		return fmt.Errorf("anomaly_threshold must be above 0")
+	case c.RollbackRetentionHours < 0:
+		return fmt.Errorf("rollback_retention_hours must not be negative")
+	case c.IdempotencyTTLHours < 0:
+		return fmt.Errorf("idempotency_ttl_hours must not be negative")
+	case c.FinishedImportTTLHours < 1:
+		return fmt.Errorf("finished_import_ttl_hours must be at least 1")
+	case c.ImportLock != "" && c.ImportLock != importLockWait && c.ImportLock != importLockReject:
+		return fmt.Errorf("import_lock must be empty, wait or reject")
+	case c.MaxRunningImports < 0:
+		return fmt.Errorf("max_running_imports must not be negative")
+	case c.GRPCAddr != "" && grpcServer == nil:
+		return fmt.Errorf("grpc_addr needs a binary built with -tags grpc")
+	case c.TracingExporter != "" && tracerFactories[c.TracingExporter] == nil:
+		return fmt.Errorf("tracing_exporter must be one of %v", tracerNames())
+	case c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1:
+		return fmt.Errorf("tracing_sample_ratio must be between 0 and 1")
+	case c.Broker != "" && brokerDrivers[c.Broker] == nil:
+		return fmt.Errorf("broker must be one of %v", brokerNames())
+	case c.Broker != "" && c.BrokerTopic == "":
+		return fmt.Errorf("broker needs a broker_topic")
+	case c.BrokerPayload != brokerPayloadKeys && c.BrokerPayload != brokerPayloadRows:
+		return fmt.Errorf("broker_payload must be keys or rows")
+	case c.BrokerPayload == brokerPayloadKeys && c.Broker != "" && len(c.BrokerKeyColumns) == 0:
+		return fmt.Errorf("broker_payload keys needs broker_key_columns")
+	case c.BrokerGranularity != brokerPerBatch && c.BrokerGranularity != brokerPerRow:
+		return fmt.Errorf("broker_granularity must be batch or row")
+	case c.ParseWorkers < 1 || c.ParallelParseMinBytes < 0:
+		return fmt.Errorf("parse_workers must be at least 1 and parallel_parse_min_bytes not negative")
+	case c.NodeRole != nodeRoleAll && c.NodeRole != nodeRoleAPI && c.NodeRole != nodeRoleWorker:
+		return fmt.Errorf("node_role must be all, api or worker")
+	case c.NodeRole == nodeRoleWorker && !c.DistributedImports:
+		return fmt.Errorf("node_role worker needs distributed_imports")
+	case c.ChunkBytes < 1<<20:
+		return fmt.Errorf("chunk_bytes must be at least 1 MiB")
+	case !tableNamePattern.MatchString(c.ChunkTable):
+		return fmt.Errorf("chunk_table must be a table name like public.import_chunks")
+	case c.ChunkTimeoutMinutes < 1 || c.QueueWorkers < 1:
+		return fmt.Errorf("chunk_timeout_minutes and queue_workers must be at least 1")
+	case checkpointStores[c.CheckpointStore] == nil:
+		return fmt.Errorf("checkpoint_store must be one of %v", checkpointStoreNames())
+	case !tableNamePattern.MatchString(c.CheckpointTable):
+		return fmt.Errorf("checkpoint_table must be a table name like public.import_checkpoints")
+	case !tableNamePattern.MatchString(c.AuditTable):
+		return fmt.Errorf("audit_table must be a table name like public.audit_log")
+	case !tableNamePattern.MatchString(c.HistoryTable):
+		return fmt.Errorf("history_table must be a table name like public.import_history")
+	case !tableNamePattern.MatchString(c.SnapshotTable):
+		return fmt.Errorf("snapshot_table must be a table name like public.replace_snapshots")
+	case !tableNamePattern.MatchString(c.IndexTable):
+		return fmt.Errorf("index_table must be a table name like public.dropped_indexes")
+	case !tableNamePattern.MatchString(c.TemplateTable):
+		return fmt.Errorf("template_table must be a table name like public.mapping_templates")
+	case !tableNamePattern.MatchString(c.TokenVaultTable):
+		return fmt.Errorf("token_vault_table must be a table name like public.token_vault")
+	case !tableNamePattern.MatchString(c.MigrationTable):
+		return fmt.Errorf("migration_table must be a table name like public.schema_migrations")
+	}
+	return nil
+}
+
+// clone returns a deep copy that can be modified before being published.
+func (c *Config) clone() *Config {
+	n := *c
+	n.ImportWindows = append([]string(nil), c.ImportWindows...)
+	n.Schedules = append([]ScheduleConfig(nil), c.Schedules...)
+	n.Tenants = append([]TenantConfig(nil), c.Tenants...)
+	n.Targets = append([]TargetConfig(nil), c.Targets...)
+	n.BrokerAddrs = append([]string(nil), c.BrokerAddrs...)
+	n.BrokerKeyColumns = append([]string(nil), c.BrokerKeyColumns...)
+	n.AnomalyMetrics = append([]string(nil), c.AnomalyMetrics...)
+	n.RedactColumns = append([]string(nil), c.RedactColumns...)
+	n.SummarySums = append([]string(nil), c.SummarySums...)
+	n.TrustedProxies = append([]string(nil), c.TrustedProxies...)
+	n.WebhookURLs = append([]string(nil), c.WebhookURLs...)
+	n.Notifiers = make([]NotifierConfig, len(c.Notifiers))
+	for i, nc := range c.Notifiers {
+		nc.To = append([]string(nil), nc.To...)
+		n.Notifiers[i] = nc
+	}
+	n.Sources = make([]SourceBundle, len(c.Sources))
+	for i, s := range c.Sources {
+		s.Notifiers = append([]NotifierConfig(nil), s.Notifiers...)
+		for j := range s.Notifiers {
+			s.Notifiers[j].To = append([]string(nil), s.Notifiers[j].To...)
+		}
+		n.Sources[i] = s
+	}
+	n.MaintenanceSQL = append([]string(nil), c.MaintenanceSQL...)
+	n.PreImportSQL = append([]string(nil), c.PreImportSQL...)
+	n.PostImportSQL = append([]string(nil), c.PostImportSQL...)
+	n.MonthDDL.Indexes = append([]string(nil), c.MonthDDL.Indexes...)
+	n.MonthDDL.Grants = append([]string(nil), c.MonthDDL.Grants...)
+	n.FeatureFlags = make(map[string]bool, len(c.FeatureFlags))
+	for k, v := range c.FeatureFlags {
+		n.FeatureFlags[k] = v
+	}
+	return &n
+}
+
+// feature reports whether the named feature flag is switched on.
+func (c *Config) feature(name string) bool {
+	return c.FeatureFlags[name]
+}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+var dsnPasswordPattern = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+var urlPasswordPattern = regexp.MustCompile(`(://[^:/@]+:)([^@]+)(@)`)
+
+// secretSetting is a setting holding a credential, named by its path in the
+// json form of the config.
+type secretSetting struct {
+	name   string
+	value  *string
+	redact func(string) string
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "*****"
+}
+
+// secretSettings lists the credentials of c. Entries of named lists are
+// found by name, so reordering them keeps their secrets.
+func (c *Config) secretSettings() []secretSetting {
+	secrets := []secretSetting{
+		{"database_url", &c.DatabaseURL, redactDSN},
+		{"warehouse_dsn", &c.WarehouseDSN, redactDSN},
+		{"mirror_database_url", &c.MirrorDatabaseURL, redactDSN},
+		{"checkpoint_redis_url", &c.CheckpointRedisURL, redactDSN},
+		{"admin_token", &c.AdminToken, redactSecret},
+		{"webhook_secret", &c.WebhookSecret, redactSecret},
+		{"url_signing_secret", &c.URLSigningSecret, redactSecret},
+		{"tokenization_key", &c.TokenizationKey, redactSecret},
+		{"pii_hash_key", &c.PIIHashKey, redactSecret},
+	}
+	for i := range c.Schedules {
+		// sftp sources may carry a password
+		secrets = append(secrets, secretSetting{"schedules." + c.Schedules[i].Name + ".source", &c.Schedules[i].Source, redactDSN})
+	}
+	for i := range c.Tenants {
+		secrets = append(secrets, secretSetting{"tenants." + c.Tenants[i].Name + ".database_url", &c.Tenants[i].DatabaseURL, redactDSN})
+	}
+	for i := range c.Targets {
+		secrets = append(secrets, secretSetting{"targets." + c.Targets[i].Name + ".database_url", &c.Targets[i].DatabaseURL, redactDSN})
+	}
+	// chat webhook urls carry their own credentials
+	notifiers := func(prefix string, list []NotifierConfig) {
+		for i := range list {
+			name := fmt.Sprintf("%snotifiers.%d.", prefix, i)
+			secrets = append(secrets,
+				secretSetting{name + "webhook_url", &list[i].WebhookURL, redactSecret},
+				secretSetting{name + "password", &list[i].Password, redactSecret})
+		}
+	}
+	notifiers("", c.Notifiers)
+	for i := range c.Sources {
+		notifiers("sources."+c.Sources[i].Name+".", c.Sources[i].Notifiers)
+	}
+	return secrets
+}
+
+// redacted returns a copy safe to expose over the admin API.
+func (c *Config) redacted() *Config {
+	n := c.clone()
+	for _, s := range n.secretSettings() {
+		*s.value = s.redact(*s.value)
+	}
+	return n
+}
+
+// keepRedactedSecrets puts the secrets of current back into c where c holds
+// them as redacted() shows them, so the output of GET /admin/config can be
+// sent back with one setting changed. A redacted value with no secret to
+// restore is refused.
+func (c *Config) keepRedactedSecrets(current *Config) error {
+	previous := map[string]string{}
+	for _, s := range current.secretSettings() {
+		previous[s.name] = *s.value
+	}
+	for _, s := range c.secretSettings() {
+		value, ok := previous[s.name]
+		switch {
+		case ok && *s.value == value:
+		case ok && *s.value == s.redact(value):
+			*s.value = value
+		case strings.Contains(*s.value, "*****"):
+			return fmt.Errorf("%s holds a redacted secret, send its value or leave it out", s.name)
+		}
+	}
+	return nil
+}
+
+func redactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		return urlPasswordPattern.ReplaceAllString(dsn, "${1}*****${3}")
+	}
+	return dsnPasswordPattern.ReplaceAllString(dsn, "${1}*****")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+)
+
+// copySource hands rows converted by p to CopyFrom. COPY runs in the binary
+// format: pgx encodes ints, floats, times and the text of jsonb columns for
+// the type of each column of the table, but a decimal would go through its
+// string, which a numeric column refuses in binary. Decimals are therefore
+// passed as the pgtype.Numeric pgx encodes itself.
+func (p *executionPlan) copySource(rows [][]interface{}) pgx.CopyFromSource {
+	return pgx.CopyFromSlice(len(rows), func(i int) ([]interface{}, error) {
+		return p.copyValues(rows[i])
+	})
+}
+
+// copyValues returns values with the decimal columns of p in their binary
+// encodable form; the row itself is left as is for the rejects.
+func (p *executionPlan) copyValues(values []interface{}) ([]interface{}, error) {
+	out, copied := values, false
+	for i := range p.types {
+		value, ok := values[i].(decimal.Decimal)
+		if !ok {
+			continue
+		}
+		n := &pgtype.Numeric{}
+		if err := n.Scan(value.String()); err != nil {
+			return nil, err
+		}
+		if !copied {
+			out, copied = append([]interface{}(nil), values...), true
+		}
+		out[i] = n
+	}
+	return out, nil
+}
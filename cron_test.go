@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cronTime(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04 Mon", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseCronFields(t *testing.T) {
+	tests := []struct {
+		spec   string
+		minute []int
+		hour   []int
+		dow    []int
+	}{
+		{"* * * * *", nil, nil, nil},
+		{"5 2 * * *", []int{5}, []int{2}, nil},
+		{"0,30 9,17 * * 1-5", []int{0, 30}, []int{9, 17}, []int{1, 2, 3, 4, 5}},
+		{"*/15 */6 * * *", []int{0, 15, 30, 45}, []int{0, 6, 12, 18}, nil},
+		{"10-20/5 1-5/2 * * *", []int{10, 15, 20}, []int{1, 3, 5}, nil},
+		// a single value with a step runs to the end of the field
+		{"50/3 22/1 * * *", []int{50, 53, 56, 59}, []int{22, 23}, nil},
+		// 7 is Sunday like 0
+		{"0 0 * * 7", []int{0}, []int{0}, []int{0, 7}},
+		{"0 0 * * 5-7", []int{0}, []int{0}, []int{0, 5, 6, 7}},
+	}
+	bits := func(values []int) uint64 {
+		var set uint64
+		for _, v := range values {
+			set |= 1 << uint(v)
+		}
+		return set
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if tt.minute != nil && s.minute != bits(tt.minute) {
+			t.Errorf("%s: minutes %b, want %v", tt.spec, s.minute, tt.minute)
+		}
+		if tt.hour != nil && s.hour != bits(tt.hour) {
+			t.Errorf("%s: hours %b, want %v", tt.spec, s.hour, tt.hour)
+		}
+		if tt.dow != nil && s.dow != bits(tt.dow) {
+			t.Errorf("%s: days of week %b, want %v", tt.spec, s.dow, tt.dow)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		spec  string
+		after string
+		want  string
+	}{
+		{"* * * * *", "2024-05-17 10:15 Fri", "2024-05-17 10:16 Fri"},
+		{"*/15 * * * *", "2024-05-17 10:15 Fri", "2024-05-17 10:30 Fri"},
+		{"*/15 * * * *", "2024-05-17 10:59 Fri", "2024-05-17 11:00 Fri"},
+		{"30 2 * * *", "2024-05-17 02:30 Fri", "2024-05-18 02:30 Sat"},
+		{"0 9-17/4 * * *", "2024-05-17 13:00 Fri", "2024-05-17 17:00 Fri"},
+		{"0,30 9,17 * * 1-5", "2024-05-17 17:30 Fri", "2024-05-20 09:00 Mon"},
+		// rolling over the end of a month and of a year
+		{"0 0 1 * *", "2024-01-31 23:59 Wed", "2024-02-01 00:00 Thu"},
+		{"0 0 31 * *", "2024-01-31 12:00 Wed", "2024-03-31 00:00 Sun"},
+		{"0 12 * 1 *", "2024-12-31 23:00 Tue", "2025-01-01 12:00 Wed"},
+		{"0 0 29 2 *", "2024-03-01 00:00 Fri", "2028-02-29 00:00 Tue"},
+		{"59 23 30 4,6 *", "2024-04-30 23:59 Tue", "2024-06-30 23:59 Sun"},
+		// both day fields restricted: either one is enough
+		{"0 0 13 * 5", "2024-05-01 00:00 Wed", "2024-05-03 00:00 Fri"},
+		{"0 0 13 * 5", "2024-05-10 00:00 Fri", "2024-05-13 00:00 Mon"},
+		// one restricted: only that one counts
+		{"0 0 13 * *", "2024-05-01 00:00 Wed", "2024-05-13 00:00 Mon"},
+		{"0 0 * * 5", "2024-05-10 00:00 Fri", "2024-05-17 00:00 Fri"},
+		{"0 0 * * 0", "2024-05-17 00:00 Fri", "2024-05-19 00:00 Sun"},
+		{"0 0 * * 7", "2024-05-17 00:00 Fri", "2024-05-19 00:00 Sun"},
+		// a stepped * restricts its field, so either day is enough here too
+		{"0 0 */10 * 1", "2024-04-30 00:00 Tue", "2024-05-01 00:00 Wed"},
+		{"0 0 */10 * 1", "2024-05-01 00:00 Wed", "2024-05-06 00:00 Mon"},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		after := cronTime(tt.after).Add(42 * time.Second)
+		if got, want := s.next(after), cronTime(tt.want); !got.Equal(want) {
+			t.Errorf("%s after %s: %s, want %s", tt.spec, tt.after, got.Format("2006-01-02 15:04 Mon"), tt.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.next(cronTime("2024-01-01 00:00 Mon")); !got.IsZero() {
+		t.Errorf("February 30th runs at %s", got)
+	}
+}
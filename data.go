@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The data api lets support staff check what was loaded without psql access:
+// a page of the rows of a month, or the rows of one waybill.
+
+const (
+	defaultDataPageSize = 50
+	maxDataPageSize     = 500
+	dataQueryTimeout    = 30 * time.Second
+)
+
+// DataPage is what GET /data returns. HasMore is set when a next page has
+// rows; the total is not counted.
+type DataPage struct {
+	Table    string            `json:"table"`
+	Page     int               `json:"page"`
+	PageSize int               `json:"page_size"`
+	HasMore  bool              `json:"has_more"`
+	Rows     []json.RawMessage `json:"rows"`
+}
+
+// ShipmentRow is a row of a waybill and the table it is in.
+type ShipmentRow struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// dataFilter collects the conditions of a data query and the columns left
+// out of the rows it returns.
+type dataFilter struct {
+	conds    []string
+	args     []interface{}
+	redacted []string
+}
+
+func newDataFilter(plan *executionPlan) *dataFilter {
+	f := &dataFilter{redacted: []string{}}
+	for i, redact := range plan.redactedColumns() {
+		if redact {
+			f.redacted = append(f.redacted, plan.columns[i])
+		}
+	}
+	return f
+}
+
+// equal adds the condition that column i of plan is value, as given in a
+// request; false when the column does not keep values that can be compared.
+func (f *dataFilter) equal(plan *executionPlan, i int, value string) bool {
+	if c := plan.protection(i); c != nil {
+		if c.mode == protectMask {
+			return false
+		}
+		value = c.protect(cfg().PIIHashKey, value)
+	} else if plan.tokenize[i] == tokenizeOnImport {
+		value = tokenize(cfg().TokenizationKey, plan.tokenKinds[i], value)
+	}
+	f.args = append(f.args, value)
+	f.conds = append(f.conds, fmt.Sprintf("%s = $%d::text::%s", plan.columns[i], len(f.args), sqlTypes[plan.types[i]]))
+	return true
+}
+
+// month keeps to the month of s when the layout holds every month in one
+// table.
+func (f *dataFilter) month(settings *Config, s *importSpec) error {
+	plan := s.plan
+	i := plan.columnIndex(settings.PartitionColumn)
+	if !partitionedLayout(s.layout) || i < 0 || (plan.types[i] != "date" && plan.types[i] != "timestamp") {
+		return nil
+	}
+	month, ok := parseMonth(s.date.Month)
+	year, err := strconv.Atoi(s.date.Year)
+	if !ok || err != nil {
+		return fmt.Errorf("month and year must name a month with the %s layout", s.layout)
+	}
+	start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	f.args = append(f.args, start, start.AddDate(0, 1, 0))
+	f.conds = append(f.conds, fmt.Sprintf("%[1]s >= $%[2]d AND %[1]s < $%[3]d", settings.PartitionColumn, len(f.args)-1, len(f.args)))
+	return nil
+}
+
+func (f *dataFilter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// rows returns the query of the rows of table that pass f, as json objects,
+// and its arguments; a limit of 0 returns all of them.
+func (f *dataFilter) rows(table, order string, limit, offset int) (string, []interface{}) {
+	args := append(f.args[:len(f.args):len(f.args)], f.redacted)
+	q := fmt.Sprintf("SELECT to_jsonb(t) - $%d::text[] FROM %s t%s ORDER BY %s", len(args), table, f.where(), order)
+	if limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	}
+	return q, args
+}
+
+// the years an import or a data query may name; the next year is allowed so
+// a file for January can be loaded before new year
+const minDateYear = 1970
+
+// allMonths stands for every month where a query is not about one.
+var allMonths = DateParams{Month: "all", Year: "all"}
+
+// normalize checks the month and year of a request and rewrites them the one
+// way tables are named after : the english name of the month (may, 5 and 05
+// are May) and the year in four digits.
+func (d *DateParams) normalize() error {
+	month, year := strings.TrimSpace(d.Month), strings.TrimSpace(d.Year)
+	switch {
+	case month == "" && year == "":
+		return fmt.Errorf("month and year are required, e.g. month=May&year=2024")
+	case month == "":
+		return fmt.Errorf("month is required, e.g. month=May")
+	case year == "":
+		return fmt.Errorf("year is required, e.g. year=2024")
+	}
+
+	m, ok := time.Month(0), false
+	if strings.Trim(month, "0123456789") == "" {
+		n, _ := strconv.Atoi(month)
+		m, ok = time.Month(n), len(month) <= 2 && n >= 1 && n <= 12
+	} else {
+		m, ok = parseMonth(month)
+	}
+	if !ok {
+		return fmt.Errorf("month %q must be the name of a month (May), its first three letters (may) or 1 to 12 (05)", d.Month)
+	}
+
+	last := time.Now().Year() + 1
+	y, err := strconv.Atoi(year)
+	if err != nil || len(year) != 4 || y < minDateYear || y > last {
+		return fmt.Errorf("year %q must have four digits, from %d to %d", d.Year, minDateYear, last)
+	}
+
+	d.Month, d.Year = m.String(), strconv.Itoa(y)
+	return nil
+}
+
+// dataSpec resolves the table of the request's mapping, tenant and target
+// for date like an upload would.
+func dataSpec(c *gin.Context, date DateParams) (*importSpec, error) {
+	s := &importSpec{
+		date:       date,
+		everyMonth: date == allMonths,
+		mapping:    c.Query("mapping"),
+		mode:       importModeAppend,
+		tenant:     requestTenant(c),
+		database:   c.Query("target"),
+	}
+	if err := s.resolve(cfg()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// handleListData returns a page of the rows of a month, optionally of one
+// waybill or client.
+func handleListData(c *gin.Context) {
+	settings := cfg()
+	date := DateParams{Month: c.Query("month"), Year: c.Query("year")}
+	if err := date.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	s, err := dataSpec(c, date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	plan := s.plan
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "page must be a positive number"})
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultDataPageSize)))
+	if err != nil || size < 1 || size > maxDataPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("page_size must be between 1 and %d", maxDataPageSize)})
+		return
+	}
+
+	f := newDataFilter(plan)
+	if err := f.month(settings, s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if waybill := c.Query("waybill"); waybill != "" {
+		if plan.key < 0 || !f.equal(plan, plan.key, waybill) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable waybill column"})
+			return
+		}
+	}
+	if client := c.Query("client"); client != "" {
+		if i := plan.columnIndex(settings.ClientColumn); i < 0 || !f.equal(plan, i, client) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable client column " + settings.ClientColumn})
+			return
+		}
+	}
+
+	order := "ctid"
+	if plan.key >= 0 {
+		order = plan.columns[plan.key]
+	}
+	table := s.schema + "." + s.table
+
+	dbPool, releasePool, err := acquireImportPool(s.tenant, s.database)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dataQueryTimeout)
+	defer cancel()
+	// one row more tells whether there is a next page
+	query, args := f.rows(table, order, size+1, (page-1)*size)
+	rows, err := queryDataRows(ctx, dbPool, query, args)
+	if err != nil {
+		dataError(c, table, err)
+		return
+	}
+	result := DataPage{Table: table, Page: page, PageSize: size, Rows: rows}
+	if len(rows) > size {
+		result.Rows, result.HasMore = rows[:size], true
+	}
+	if result.Rows == nil {
+		result.Rows = []json.RawMessage{}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleGetShipment returns the rows of one waybill, from the tables of the
+// month given or else from those of every month.
+func handleGetShipment(c *gin.Context) {
+	settings := cfg()
+	date := DateParams{Month: c.Query("month"), Year: c.Query("year")}
+	searchAll := date.Month == "" && date.Year == ""
+	if searchAll {
+		// resolved for the mapping only, the tables are looked up below
+		date = allMonths
+	} else if err := date.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	s, err := dataSpec(c, date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	plan := s.plan
+	f := newDataFilter(plan)
+	if plan.key < 0 || !f.equal(plan, plan.key, c.Param("waybill")) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable waybill column"})
+		return
+	}
+
+	dbPool, releasePool, err := acquireImportPool(s.tenant, s.database)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dataQueryTimeout)
+	defer cancel()
+
+	tables := []string{s.schema + "." + s.table}
+	if searchAll {
+		if tables, err = monthTables(ctx, dbPool, settings, plan, s.tenant); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	found := []ShipmentRow{}
+	for _, table := range tables {
+		query, args := f.rows(table, "ctid", 0, 0)
+		rows, err := queryDataRows(ctx, dbPool, query, args)
+		if err != nil {
+			if searchAll && isUndefinedTable(err) {
+				// dropped since it was listed
+				continue
+			}
+			dataError(c, table, err)
+			return
+		}
+		for _, row := range rows {
+			found = append(found, ShipmentRow{Table: table, Row: row})
+		}
+	}
+	if len(found) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Waybill " + c.Param("waybill") + " not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"waybill": c.Param("waybill"), "rows": found})
+}
+
+// monthTables lists the tables the imports of plan load into for the
+// tenant, one per month unless the layout is partitioned.
+func monthTables(ctx context.Context, dbPool *pgxpool.Pool, settings *Config, plan *executionPlan, tenant string) ([]string, error) {
+	schema, table := settings.SchemaPattern, plan.table
+	if partitionedLayout(settings.TableLayout) {
+		schema = settings.PartitionSchema
+	}
+	if t := settings.tenant(tenant); t != nil {
+		schema, table = t.templates(schema, table)
+	}
+	like := strings.NewReplacer("_", `\_`, "%", `\%`, "{month}", "%", "{year}", "%")
+
+	rows, err := dbPool.Query(ctx, `SELECT table_schema || '.' || table_name FROM information_schema.tables
+		WHERE table_schema LIKE $1 AND table_name LIKE $2 ORDER BY 1`, like.Replace(schema), like.Replace(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+func queryDataRows(ctx context.Context, dbPool *pgxpool.Pool, query string, args []interface{}) ([]json.RawMessage, error) {
+	rows, err := dbPool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []json.RawMessage
+	for rows.Next() {
+		var row []byte
+		if err := rows.Scan(&row); err != nil {
+			return nil, err
+		}
+		result = append(result, json.RawMessage(row))
+	}
+	return result, rows.Err()
+}
+
+func isUndefinedTable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42P01"
+}
+
+func dataError(c *gin.Context, table string, err error) {
+	if isUndefinedTable(err) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Nothing was imported into " + table})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+}
@@ -0,0 +1,10 @@
+package main
+
+import "testing"
+
+func TestResolveRefusesEveryMonth(t *testing.T) {
+	s := importSpec{date: allMonths}
+	if err := s.resolve(defaultConfig()); err == nil {
+		t.Fatal("an upload of month=all&year=all resolved")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+)
+
+// decimal columns hold money exactly, as numeric, instead of in a float
+const typeDecimal = "decimal"
+
+// digits after the point of a decimal column without a scale, rupiah cents
+const defaultDecimalScale = 2
+
+// columnScale is the scale of a decimal column.
+func columnScale(col ColumnMapping) (int32, error) {
+	if col.Scale == nil {
+		return defaultDecimalScale, nil
+	}
+	if *col.Scale < 0 || *col.Scale > 18 {
+		return 0, fmt.Errorf("scale must be between 0 and 18")
+	}
+	return int32(*col.Scale), nil
+}
+
+// decimalParser parses a decimal rounded half away from zero to scale digits,
+// an empty field as 0 like ints and floats.
+func decimalParser(scale int32) fieldParser {
+	return func(s string) (interface{}, error) {
+		if s == "" {
+			return decimal.Zero, nil
+		}
+		d, err := decimal.NewFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		return d.Round(scale), nil
+	}
+}
+
+func compileDecimal(col ColumnMapping) (fieldParser, interface{}, error) {
+	scale, err := columnScale(col)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decimalParser(scale), decimal.Zero, nil
+}
+
+// numericType reports whether columns of mapping type t hold numbers that
+// can be summed.
+func numericType(t string) bool {
+	return t == "int" || t == "float" || t == typeDecimal
+}
+
+// numberValue returns a converted number as a float, for the totals kept
+// while loading; false for other values.
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case decimal.Decimal:
+		f, _ := v.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// readDecimals turns the numerics pgx reads back for the decimal columns of a
+// row of the table into decimals, as they were loaded.
+func (p *executionPlan) readDecimals(values []interface{}) {
+	for i, t := range p.types {
+		if t != typeDecimal || i >= len(values) {
+			continue
+		}
+		n, ok := values[i].(pgtype.Numeric)
+		if !ok {
+			continue
+		}
+		if text, err := n.Value(); err == nil && text != nil {
+			if d, err := decimal.NewFromString(text.(string)); err == nil {
+				values[i] = d
+			}
+		}
+	}
+}
+
+// decimalPlaces counts the digits after the point of a decimal field.
+func decimalPlaces(s string) int {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0
+	}
+	return len(strings.TrimRight(s[i+1:], "0"))
+}
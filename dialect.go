@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// delimiters a csv file is sniffed for, in order of preference
+var sniffedDelimiters = []rune{';', ',', '\t', '|'}
+
+// the delimiter of the cashback exports, used when sniffing finds none
+const defaultDelimiter = ';'
+
+// bytes and lines at the start of a file the delimiter is sniffed from
+const (
+	sniffBytes = 8 << 10
+	sniffLines = 50
+)
+
+const delimiterAuto = "auto"
+
+var errDelimiter = errors.New("delimiter must be auto, ;, ,, tab or |")
+
+// CSVDialect is how a csv file was read. Sniffed is set when the delimiter was
+// detected from the start of the file rather than given.
+type CSVDialect struct {
+	Delimiter string `json:"delimiter"`
+	Sniffed   bool   `json:"sniffed"`
+}
+
+// parseDelimiter reads a delimiter parameter; auto, or empty, is 0.
+func parseDelimiter(v string) (rune, error) {
+	switch v {
+	case "", delimiterAuto:
+		return 0, nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(v)
+	for _, d := range sniffedDelimiters {
+		if r == d && size == len(v) {
+			return r, nil
+		}
+	}
+	return 0, errDelimiter
+}
+
+func validDelimiter(v string) bool {
+	_, err := parseDelimiter(v)
+	return err == nil
+}
+
+// sniffDelimiter returns the delimiter of the csv sample, the one found in the
+// first line that splits most of the following lines into as many fields.
+// Decimal commas rarely are in a header, so ; files with them stay ;. It
+// reports false when no delimiter is in the first line.
+func sniffDelimiter(sample []byte, complete bool) (rune, bool) {
+	lines := sampleLines(sample, complete)
+	if len(lines) == 0 {
+		return defaultDelimiter, false
+	}
+
+	best, bestScore := rune(0), 0
+	for _, d := range sniffedDelimiters {
+		fields := countDelimiters(lines[0], d)
+		if fields == 0 {
+			continue
+		}
+		score := 0
+		for _, line := range lines {
+			if countDelimiters(line, d) == fields {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = d, score
+		}
+	}
+	if best == 0 {
+		return defaultDelimiter, false
+	}
+	return best, true
+}
+
+// sampleLines cuts sample into its non-empty lines, leaving line breaks in
+// quoted fields be and the last line out unless the sample is the whole file.
+func sampleLines(sample []byte, complete bool) [][]byte {
+	var lines [][]byte
+	quoted, start := false, 0
+	for i, b := range sample {
+		switch {
+		case b == '"':
+			quoted = !quoted
+		case b == '\n' && !quoted:
+			if line := bytes.TrimRight(sample[start:i], "\r"); len(line) > 0 {
+				lines = append(lines, line)
+			}
+			start = i + 1
+		}
+		if len(lines) == sniffLines {
+			return lines
+		}
+	}
+	if complete && start < len(sample) {
+		lines = append(lines, sample[start:])
+	}
+	return lines
+}
+
+// countDelimiters counts d in line outside quoted fields.
+func countDelimiters(line []byte, d rune) int {
+	n, quoted := 0, false
+	for _, r := range string(line) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == d && !quoted:
+			n++
+		}
+	}
+	return n
+}
+
+// sniffInput sniffs the delimiter of the csv file input starts with, without
+// consuming it.
+func sniffInput(input *bufio.Reader) (rune, bool) {
+	sample, err := input.Peek(sniffBytes)
+	return sniffDelimiter(sample, err != nil)
+}
+
+// detectDialect sets the delimiter of a csv import that was not given one
+// from the start of input.
+func (imp *Import) detectDialect(input *bufio.Reader) {
+	if imp.Format != inputFormatCSV {
+		return
+	}
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.delimiter == 0 {
+		imp.delimiter, imp.delimiterSniffed = sniffInput(input)
+	}
+}
+
+// dialect returns how the file of imp is read, nil when it is not csv or
+// the delimiter is not known yet.
+func (imp *Import) dialect() *CSVDialect {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.Format != inputFormatCSV || imp.delimiter == 0 {
+		return nil
+	}
+	return &CSVDialect{Delimiter: string(imp.delimiter), Sniffed: imp.delimiterSniffed}
+}
+
+// comma is the delimiter the csv readers of imp split fields at.
+func (imp *Import) comma() rune {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.delimiter == 0 {
+		return defaultDelimiter
+	}
+	return imp.delimiter
+}
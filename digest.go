@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// digest periods
+const (
+	digestDaily  = "day"
+	digestWeekly = "week"
+)
+
+// failed imports listed by name in a digest, the rest are only counted
+const digestFailedListed = 20
+
+// DatasetDigest sums up the imports of one mapping over a digest period.
+type DatasetDigest struct {
+	Mapping    string   `json:"mapping"`
+	Files      int64    `json:"files"`
+	RowsRead   int64    `json:"rows_read"`
+	Inserted   int64    `json:"inserted"`
+	Rejected   int64    `json:"rejected"`
+	Failed     int64    `json:"failed"`
+	AvgQuality *float64 `json:"avg_quality"`
+	MinQuality *float64 `json:"min_quality"`
+}
+
+// Digest aggregates the imports finished between From and To.
+type Digest struct {
+	Period   string          `json:"period"`
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Files    int64           `json:"files"`
+	RowsRead int64           `json:"rows_read"`
+	Failed   int64           `json:"failed"`
+	Datasets []DatasetDigest `json:"datasets"`
+	// ids of the failed imports, newest first
+	FailedImports []string `json:"failed_imports"`
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"value": func(f *float64) float64 { return *f },
+}).Parse(`Imports from {{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}}
+{{.Files}} files, {{.RowsRead}} rows read, {{.Failed}} failed
+{{- range .Datasets}}
+
+{{.Mapping}}: {{.Files}} files, {{.Inserted}} inserted, {{.Rejected}} rejected of {{.RowsRead}} rows, {{.Failed}} failed
+{{- if .AvgQuality}}
+  quality {{printf "%.1f" (value .AvgQuality)}} on average, {{printf "%.1f" (value .MinQuality)}} at worst{{end}}
+{{- end}}
+{{- if .FailedImports}}
+
+failed: {{range $i, $id := .FailedImports}}{{if $i}}, {{end}}{{$id}}{{end}}{{end}}`))
+
+func validDigestPeriod(period string) bool {
+	return period == digestDaily || period == digestWeekly
+}
+
+// runDigests sends the import digest to the notifiers whenever digest_cron is
+// due. The digest covers the day or week before it is sent.
+func runDigests() {
+	for {
+		now := sleepToNextMinute()
+		settings := cfg()
+		if settings.digestCron == nil || !settings.digestCron.matches(now) || len(settings.Notifiers) == 0 {
+			continue
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			d, err := buildDigest(ctx, settings.HistoryTable, settings.DigestPeriod, now)
+			if err != nil {
+				log.Println("Import digest not sent:", err)
+				return
+			}
+			subject, text, err := d.render()
+			if err != nil {
+				log.Println("Import digest not sent:", err)
+				return
+			}
+			broadcast(settings.Notifiers, subject, text)
+		}()
+	}
+}
+
+// buildDigest aggregates the import history of the period ending at to, per
+// mapping version.
+func buildDigest(ctx context.Context, table, period string, to time.Time) (*Digest, error) {
+	d := &Digest{Period: period, To: to, Datasets: []DatasetDigest{}, FailedImports: []string{}}
+	d.From = to.AddDate(0, 0, -1)
+	if period == digestWeekly {
+		d.From = to.AddDate(0, 0, -7)
+	}
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePool()
+
+	if err := ensureTable(ctx, dbPool, table, historyTableDDL); err != nil {
+		return nil, err
+	}
+
+	rows, err := dbPool.Query(ctx, `SELECT mapping_version, count(*), sum(rows_read)::bigint, sum(inserted)::bigint,
+		sum(rejected)::bigint, count(*) FILTER (WHERE status = $3), avg(quality_score), min(quality_score)
+		FROM `+table+` WHERE finished_at >= $1 AND finished_at < $2
+		GROUP BY mapping_version ORDER BY mapping_version`, d.From, d.To, importStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ds DatasetDigest
+		if err := rows.Scan(&ds.Mapping, &ds.Files, &ds.RowsRead, &ds.Inserted, &ds.Rejected, &ds.Failed, &ds.AvgQuality, &ds.MinQuality); err != nil {
+			return nil, err
+		}
+		d.Files += ds.Files
+		d.RowsRead += ds.RowsRead
+		d.Failed += ds.Failed
+		d.Datasets = append(d.Datasets, ds)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	failed, err := dbPool.Query(ctx, `SELECT import_id FROM `+table+`
+		WHERE finished_at >= $1 AND finished_at < $2 AND status = $3 ORDER BY finished_at DESC LIMIT $4`,
+		d.From, d.To, importStatusFailed, digestFailedListed)
+	if err != nil {
+		return nil, err
+	}
+	defer failed.Close()
+
+	for failed.Next() {
+		var id string
+		if err := failed.Scan(&id); err != nil {
+			return nil, err
+		}
+		d.FailedImports = append(d.FailedImports, id)
+	}
+	return d, failed.Err()
+}
+
+func (d *Digest) render() (string, string, error) {
+	var text bytes.Buffer
+	if err := digestTemplate.Execute(&text, d); err != nil {
+		return "", "", err
+	}
+	subject := fmt.Sprintf("Import digest %s: %d files, %d failed", d.To.Format("2006-01-02"), d.Files, d.Failed)
+	return subject, text.String(), nil
+}
+
+// handleDigestPreview returns the digest that would be sent now, as json and
+// as the message text, without sending it (?period=day or week).
+func handleDigestPreview(c *gin.Context) {
+	settings := cfg()
+	period := c.DefaultQuery("period", settings.DigestPeriod)
+	if !validDigestPeriod(period) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "period must be day or week"})
+		return
+	}
+
+	d, err := buildDigest(c.Request.Context(), settings.HistoryTable, period, time.Now())
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+	subject, text, err := d.render()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"digest": d, "subject": subject, "text": text})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// what a file or table drifting from the mapping does to the import: fail
+// stops it before any row is loaded, flag loads and reports it
+const (
+	driftFail = "fail"
+	driftFlag = "flag"
+)
+
+// SchemaDrift is how the header of a file and the target table differ from
+// the mapping of an import. Header fields are matched by name or alias
+// wherever they are, so a column inserted in the middle shows as added and
+// the fields after it as moved.
+type SchemaDrift struct {
+	OnDrift string `json:"on_drift"`
+	// header fields the mapping has no field for
+	Added []string `json:"added,omitempty"`
+	// mapping fields the header lacks
+	Removed []string       `json:"removed,omitempty"`
+	Renamed []RenamedField `json:"renamed,omitempty"`
+	Moved   []MovedField   `json:"moved,omitempty"`
+	// mapped columns the table does not have
+	MissingInTable []string `json:"missing_in_table,omitempty"`
+	// NOT NULL columns of the table without a default that no mapped column fills
+	UnmappedRequired []string `json:"unmapped_required,omitempty"`
+}
+
+// RenamedField is a mapping field whose place in the header holds an unknown
+// name.
+type RenamedField struct {
+	Field  string `json:"field"`
+	Header string `json:"header"`
+}
+
+// MovedField is a mapping field found at another position of the header,
+// counted from 1.
+type MovedField struct {
+	Field    string `json:"field"`
+	Expected int    `json:"expected"`
+	Found    int    `json:"found"`
+}
+
+func (d *SchemaDrift) drifted() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Renamed)+len(d.Moved)+len(d.MissingInTable)+len(d.UnmappedRequired) > 0
+}
+
+func (d *SchemaDrift) String() string {
+	var parts []string
+	list := func(what string, names []string) {
+		if len(names) > 0 {
+			parts = append(parts, what+" "+strings.Join(names, ", "))
+		}
+	}
+	list("added", d.Added)
+	list("removed", d.Removed)
+	for _, r := range d.Renamed {
+		parts = append(parts, fmt.Sprintf("%s renamed to %q", r.Field, r.Header))
+	}
+	for _, m := range d.Moved {
+		parts = append(parts, fmt.Sprintf("%s moved from field %d to %d", m.Field, m.Expected, m.Found))
+	}
+	list("not in the table", d.MissingInTable)
+	list("required by the table", d.UnmappedRequired)
+	return strings.Join(parts, "; ")
+}
+
+// headerDrift compares header with the file fields of p, nil when they match.
+func (p *executionPlan) headerDrift(header []string) *SchemaDrift {
+	found := make([]int, len(p.fields))
+	known := make([]bool, len(header))
+	for i := range p.fields {
+		found[i] = -1
+		if i < len(header) && p.headerMatches(i, header[i]) {
+			found[i], known[i] = i, true
+		}
+	}
+	for i := range p.fields {
+		for j := 0; found[i] < 0 && j < len(header); j++ {
+			if !known[j] && p.headerMatches(i, header[j]) {
+				found[i], known[j] = j, true
+			}
+		}
+	}
+
+	d := &SchemaDrift{OnDrift: p.onDrift}
+	for i, j := range found {
+		switch {
+		case j < 0 && i < len(header) && !known[i]:
+			known[i] = true
+			d.Renamed = append(d.Renamed, RenamedField{Field: p.fields[i], Header: normalizeHeaderField(header[i])})
+		case j < 0:
+			d.Removed = append(d.Removed, p.fields[i])
+		case j != i:
+			d.Moved = append(d.Moved, MovedField{Field: p.fields[i], Expected: i + 1, Found: j + 1})
+		}
+	}
+	for j, field := range header {
+		// a trailing delimiter leaves a field without a name
+		if name := normalizeHeaderField(field); !known[j] && name != "" {
+			d.Added = append(d.Added, name)
+		}
+	}
+	if !d.drifted() {
+		return nil
+	}
+	return d
+}
+
+// checkHeaderDrift records how header drifts from the mapping of imp, and
+// fails when the mapping says so. Of several files, the first drifting header
+// is kept.
+func (imp *Import) checkHeaderDrift(header []string) error {
+	d := imp.plan.headerDrift(header)
+	if d == nil {
+		return nil
+	}
+	imp.mergeDrift(d)
+	log.Println("Import", imp.ID, "header drifts from mapping", imp.plan.version+":", d)
+	imp.publish(ImportEvent{Type: eventMilestone, Message: "schema drift: " + d.String()})
+	if imp.plan.onDrift == driftFail {
+		return fmt.Errorf("header drifts from mapping %s: %s", imp.plan.version, d)
+	}
+	return nil
+}
+
+// mergeDrift adds the header or table drift in d to imp, the header drift of
+// a chunk among them.
+func (imp *Import) mergeDrift(d *SchemaDrift) {
+	if d == nil {
+		return
+	}
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.drift == nil {
+		imp.drift = &SchemaDrift{OnDrift: d.OnDrift}
+	}
+	if len(imp.drift.Added)+len(imp.drift.Removed)+len(imp.drift.Renamed)+len(imp.drift.Moved) == 0 {
+		imp.drift.Added, imp.drift.Removed, imp.drift.Renamed, imp.drift.Moved = d.Added, d.Removed, d.Renamed, d.Moved
+	}
+	if imp.drift.MissingInTable == nil && imp.drift.UnmappedRequired == nil {
+		imp.drift.MissingInTable, imp.drift.UnmappedRequired = d.MissingInTable, d.UnmappedRequired
+	}
+}
+
+// driftReport copies the drift of imp for a report, nil when there is none.
+func (imp *Import) driftReport() *SchemaDrift {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.drift == nil {
+		return nil
+	}
+	d := *imp.drift
+	return &d
+}
+
+// checkTableDrift compares the columns of the target table with the mapping
+// of imp before anything is loaded. A table that does not exist yet is left
+// to the statements creating it.
+func checkTableDrift(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	rows, err := dbPool.Query(ctx, `SELECT column_name, is_nullable = 'NO' AND column_default IS NULL
+		AND is_identity = 'NO' AND is_generated = 'NEVER'
+		FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`, imp.Schema, imp.Table)
+	if err != nil {
+		return fmt.Errorf("failed to read the columns of %s: %w", imp.target(), err)
+	}
+	defer rows.Close()
+
+	mapped := map[string]bool{}
+	for _, c := range imp.plan.columns {
+		mapped[c] = true
+	}
+	table := map[string]bool{}
+	d := &SchemaDrift{OnDrift: imp.plan.onDrift}
+	for rows.Next() {
+		var name string
+		var required bool
+		if err := rows.Scan(&name, &required); err != nil {
+			return fmt.Errorf("failed to read the columns of %s: %w", imp.target(), err)
+		}
+		table[name] = true
+		if required && !mapped[name] {
+			d.UnmappedRequired = append(d.UnmappedRequired, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read the columns of %s: %w", imp.target(), err)
+	}
+	if len(table) == 0 {
+		return nil
+	}
+	for _, c := range imp.plan.columns {
+		if !table[c] {
+			d.MissingInTable = append(d.MissingInTable, c)
+		}
+	}
+	if !d.drifted() {
+		return nil
+	}
+
+	imp.mergeDrift(d)
+	log.Println("Import", imp.ID, "table", imp.target(), "drifts from mapping", imp.plan.version+":", d)
+	if imp.plan.onDrift == driftFail {
+		return fmt.Errorf("table %s drifts from mapping %s: %s", imp.target(), imp.plan.version, d)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// what happens to rows whose key appeared before in the same file
+const (
+	duplicatesKeepFirst = "keep_first"
+	duplicatesKeepLast  = "keep_last"
+	duplicatesRejectAll = "reject_all"
+	duplicatesReport    = "report"
+)
+
+// DuplicateCheck finds rows of one file sharing the value of Column, the key
+// of the mapping by default. Keep decides which of them are loaded.
+type DuplicateCheck struct {
+	Column string `yaml:"column" json:"column,omitempty"`
+	Keep   string `yaml:"keep" json:"keep,omitempty"`
+}
+
+type duplicateSpec struct {
+	column int
+	keep   string
+}
+
+// DuplicateReport counts the rows whose key appeared earlier in the file and
+// the keys concerned. Unchecked is set once duplicate_keys_max keys were seen,
+// later new keys are no longer remembered.
+type DuplicateReport struct {
+	Column    string `json:"column"`
+	Keep      string `json:"keep"`
+	Rows      int64  `json:"rows"`
+	Keys      int    `json:"keys"`
+	Unchecked bool   `json:"unchecked,omitempty"`
+}
+
+// duplicateError rejects a row of a key loaded more than once with
+// reject_all.
+type duplicateError struct {
+	column, key string
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("%s %q appears more than once in the file", e.column, e.key)
+}
+
+// duplicateTracker remembers the keys of an import as 64 bit fingerprints,
+// and the keys seen twice in full.
+type duplicateTracker struct {
+	sync.Mutex
+	seen      map[uint64]struct{}
+	max       int
+	unchecked bool
+	rows      int64
+	keys      map[string]struct{}
+	// the last row of every duplicated key with keep_last
+	latest map[string][]interface{}
+}
+
+func newDuplicateTracker(max int) *duplicateTracker {
+	return &duplicateTracker{
+		seen:   map[uint64]struct{}{},
+		max:    max,
+		keys:   map[string]struct{}{},
+		latest: map[string][]interface{}{},
+	}
+}
+
+// compileDuplicates sets the duplicate check of p, columns being the mapped
+// ones.
+func (p *executionPlan) compileDuplicates(d *DuplicateCheck, columns []ColumnMapping) error {
+	column, i := d.Column, p.columnIndex(d.Column)
+	if column == "" {
+		if i = p.key; i < 0 {
+			return fmt.Errorf("duplicates: the mapping has no key, set column")
+		}
+		column = p.columns[i]
+	}
+	if i < 0 {
+		return fmt.Errorf("duplicates: unknown column %q", column)
+	}
+	if i < len(columns) && columns[i].Tokenize == tokenizeOnImport {
+		return fmt.Errorf("duplicates: column %s is tokenized", column)
+	}
+	if c := p.protection(i); c != nil && c.mode == protectMask {
+		return fmt.Errorf("duplicates: column %s is masked", column)
+	}
+	keep := d.Keep
+	switch keep {
+	case "":
+		keep = duplicatesKeepFirst
+	case duplicatesKeepFirst, duplicatesKeepLast, duplicatesRejectAll, duplicatesReport:
+	default:
+		return fmt.Errorf("duplicates: keep must be keep_first, keep_last, reject_all or report")
+	}
+	p.duplicates = &duplicateSpec{column: i, keep: keep}
+	return nil
+}
+
+// settlesDuplicates reports whether the duplicates of imp are only dealt with
+// once the file was read, in its staging table.
+func (imp *Import) settlesDuplicates() bool {
+	d := imp.plan.duplicates
+	return d != nil && (d.keep == duplicatesKeepLast || d.keep == duplicatesRejectAll)
+}
+
+// keepRow checks the key of a row about to be loaded and reports whether it
+// is loaded now.
+func (imp *Import) keepRow(values []interface{}) bool {
+	d := imp.plan.duplicates
+	if d == nil {
+		return true
+	}
+	key := formatValue(values[d.column])
+	if key == "" {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	t := imp.duplicates
+	t.Lock()
+	if _, ok := t.seen[sum]; !ok {
+		if len(t.seen) < t.max {
+			t.seen[sum] = struct{}{}
+		} else {
+			t.unchecked = true
+		}
+		t.Unlock()
+		return true
+	}
+	t.rows++
+	t.keys[key] = struct{}{}
+	if d.keep == duplicatesKeepLast {
+		t.latest[key] = values
+	}
+	t.Unlock()
+
+	switch d.keep {
+	case duplicatesReport:
+		return true
+	case duplicatesRejectAll:
+		imp.reject(values, &duplicateError{column: imp.plan.columns[d.column], key: key})
+	}
+	return false
+}
+
+// settleDuplicates replaces the first rows of the duplicated keys in the
+// staging table, by their last rows with keep_last and by nothing with
+// reject_all, those becoming rejects. An aborted import is left alone, its
+// staging table is dropped anyway.
+func settleDuplicates(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	imp.mu.Lock()
+	aborted := imp.abortReason != ""
+	imp.mu.Unlock()
+	if aborted {
+		return nil
+	}
+
+	d := imp.plan.duplicates
+	t := imp.duplicates
+	t.Lock()
+	keys := make([]string, 0, len(t.keys))
+	for key := range t.keys {
+		keys = append(keys, key)
+	}
+	latest := make([][]interface{}, 0, len(t.latest))
+	for _, values := range t.latest {
+		latest = append(latest, values)
+	}
+	t.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	column := imp.plan.columns[d.column]
+	rows, err := conn.Query(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1::text[]::%s[]) RETURNING %s",
+		imp.stagingTable, column, sqlTypes[imp.plan.types[d.column]], strings.Join(imp.plan.columns, ",")), keys)
+	if err != nil {
+		return fmt.Errorf("failed to remove duplicated keys from staging: %w", err)
+	}
+	var removed [][]interface{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		imp.plan.readDecimals(values)
+		removed = append(removed, values)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to remove duplicated keys from staging: %w", err)
+	}
+	atomic.AddInt64(&imp.inserted, -int64(len(removed)))
+	for _, values := range removed {
+		imp.countInserted(values, -1)
+	}
+
+	if d.keep == duplicatesRejectAll {
+		for _, values := range removed {
+			imp.reject(values, &duplicateError{column: column, key: formatValue(values[d.column])})
+		}
+		return nil
+	}
+
+	for i, err := range insertBatch(ctx, conn, imp.query, latest) {
+		if err != nil {
+			imp.reject(latest[i], err)
+		} else {
+			atomic.AddInt64(&imp.inserted, 1)
+			imp.countInserted(latest[i], 1)
+		}
+	}
+	return nil
+}
+
+func (imp *Import) duplicateReport() *DuplicateReport {
+	d := imp.plan.duplicates
+	if d == nil {
+		return nil
+	}
+	t := imp.duplicates
+	t.Lock()
+	defer t.Unlock()
+	return &DuplicateReport{
+		Column:    imp.plan.columns[d.column],
+		Keep:      d.keep,
+		Rows:      t.rows,
+		Keys:      len(t.keys),
+		Unchecked: t.unchecked,
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// import event types relayed to log subscribers
+const (
+	eventStarted     = "started"
+	eventWorkerError = "worker_error"
+	eventMilestone   = "milestone"
+	eventBatch       = "batch"
+	eventPaused      = "paused"
+	eventResumed     = "resumed"
+	eventFinished    = "finished"
+)
+
+// ImportEvent is a single log line of an import, delivered to live subscribers.
+type ImportEvent struct {
+	Type     string    `json:"type"`
+	ImportID string    `json:"import_id"`
+	Time     time.Time `json:"time"`
+	Worker   int       `json:"worker,omitempty"`
+	Rows     int64     `json:"rows,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// subscribe returns a channel receiving the import's events and a function
+// that must be called to stop the subscription.
+func (imp *Import) subscribe() (<-chan ImportEvent, func()) {
+	ch := make(chan ImportEvent, 64)
+
+	imp.mu.Lock()
+	imp.subscribers[ch] = struct{}{}
+	imp.mu.Unlock()
+
+	return ch, func() {
+		imp.mu.Lock()
+		delete(imp.subscribers, ch)
+		imp.mu.Unlock()
+	}
+}
+
+// publish fans an event out to every subscriber. Slow subscribers miss events
+// rather than holding up the import.
+func (imp *Import) publish(ev ImportEvent) {
+	ev.ImportID = imp.ID
+	ev.Time = time.Now()
+
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	for ch := range imp.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// lifetime of a link to the live logs, only needed to open the websocket
+const logsLinkTTL = 5 * time.Minute
+
+// handleCreateLogsLink returns a signed link to the live logs of an import,
+// valid for logsLinkTTL. Browsers cannot set the API key headers on a
+// websocket, so a dashboard fetches a link with its key and opens that.
+func handleCreateLogsLink(c *gin.Context) {
+	secret := cfg().URLSigningSecret
+	if secret == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"message": "Signed links are not configured, set url_signing_secret"})
+		return
+	}
+
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	expires := time.Now().Add(logsLinkTTL)
+	path := "/artifacts/imports/" + imp.ID + "/logs"
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signArtifactPath(secret, path, "", expires.Unix()))
+	c.JSON(http.StatusOK, gin.H{"url": path + "?" + query.Encode(), "expires_at": expires})
+}
+
+// checkLogsOrigin accepts the websocket handshake of clients sending no
+// Origin (not a browser), of pages of this server and of logs_origins, so
+// another site cannot open the logs with the credentials of a visitor.
+func checkLogsOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host == r.Host || slices.Contains(cfg().LogsOrigins, origin) {
+		config.Origin = u
+		return nil
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// handleImportLogs relays an import's events over a WebSocket as JSON
+// messages until the import finishes or the client disconnects.
+func handleImportLogs(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	websocket.Server{Handshake: checkLogsOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		events, unsubscribe := imp.subscribe()
+		defer unsubscribe()
+
+		// the dashboard never sends anything; reading only detects the close
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+
+		for {
+			select {
+			case ev := <-events:
+				if err := websocket.JSON.Send(ws, ev); err != nil {
+					return
+				}
+			case <-imp.done:
+				for len(events) > 0 {
+					websocket.JSON.Send(ws, <-events)
+				}
+				websocket.JSON.Send(ws, ImportEvent{Type: eventFinished, ImportID: imp.ID, Time: time.Now(), Rows: imp.progress().RowsRead})
+				return
+			case <-closed:
+				return
+			}
+		}
+	}}.ServeHTTP(c.Writer, c.Request)
+}
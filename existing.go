@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// what a staged import does with rows whose key is already in the target,
+// e.g. when a courier sends overlapping files
+const (
+	existingSkip   = "skip"
+	existingUpdate = "update"
+)
+
+func validExistingMode(mode string) bool {
+	return mode == "" || mode == existingSkip || mode == existingUpdate
+}
+
+// moveNewStagedRows moves the staged rows into the target inside tx, leaving
+// out those whose key the target already holds, after updating the target
+// rows with them when imp.Existing is update. It returns the number of staged
+// rows already loaded and of target rows updated.
+func moveNewStagedRows(ctx context.Context, tx pgx.Tx, imp *Import, staged int64) (int64, int64, error) {
+	key := imp.plan.columns[imp.plan.key]
+	target := imp.target()
+
+	var updated int64
+	if imp.Existing == existingUpdate {
+		var set []string
+		for _, column := range imp.plan.columns {
+			if column != key {
+				set = append(set, column+" = s."+column)
+			}
+		}
+		if len(set) > 0 {
+			tag, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s t SET %s FROM %s s WHERE t.%s = s.%s",
+				target, strings.Join(set, ", "), imp.stagingTable, key, key))
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to update the rows of %s already loaded: %w", target, err)
+			}
+			updated = tag.RowsAffected()
+		}
+	}
+
+	columns := strings.Join(imp.plan.columns, ",")
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM %[3]s s
+		WHERE NOT EXISTS (SELECT 1 FROM %[1]s t WHERE t.%[4]s = s.%[4]s)`, target, columns, imp.stagingTable, key))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to move staged rows into %s: %w", target, err)
+	}
+	return staged - tag.RowsAffected(), updated, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /export hands the rows of a month out as a file, for clients who get a
+// subset of their shipments without database access.
+
+// exportOptions are the settings of an export file from the request.
+type exportOptions struct {
+	// field separator of csv files
+	delimiter rune
+	// start csv files with a byte order mark, for spreadsheets that otherwise
+	// misread utf-8
+	bom bool
+}
+
+// exportWriter writes the rows of an export in one format. Values are those
+// of the database, tokens and time.Time included.
+type exportWriter interface {
+	write(values []interface{}) error
+	close() error
+}
+
+type exportFormat struct {
+	name        string
+	extension   string
+	contentType string
+	newWriter   func(w io.Writer, header, types []string, opts exportOptions) (exportWriter, error)
+}
+
+// export formats compiled into this binary, by name
+var exportFormats = map[string]*exportFormat{}
+
+func registerExportFormat(f *exportFormat) {
+	exportFormats[f.name] = f
+}
+
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerExportFormat(&exportFormat{
+		name:        "csv",
+		extension:   ".csv",
+		contentType: "text/csv; charset=utf-8",
+		newWriter:   newCSVExportWriter,
+	})
+}
+
+type csvExportWriter struct {
+	w      *csv.Writer
+	types  []string
+	record []string
+}
+
+func newCSVExportWriter(w io.Writer, header, types []string, opts exportOptions) (exportWriter, error) {
+	if opts.bom {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return nil, err
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.delimiter
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvExportWriter{w: cw, types: types, record: make([]string, len(header))}, nil
+}
+
+func (e *csvExportWriter) write(values []interface{}) error {
+	for i, v := range values {
+		e.record[i] = exportText(e.types[i], v)
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExportWriter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// exportText formats a value of a column of type typ; dates lose the time.
+func exportText(typ string, v interface{}) string {
+	if t, ok := v.(time.Time); ok && typ == "date" && !t.IsZero() {
+		return t.Format("2006-01-02")
+	}
+	return formatValue(v)
+}
+
+func exportDelimiter(v string) (rune, error) {
+	switch v {
+	case "", ",":
+		return ',', nil
+	case ";", "\t", "|":
+		r, _ := utf8.DecodeRuneInString(v)
+		return r, nil
+	}
+	return 0, fmt.Errorf("delimiter must be , ; | or a tab")
+}
+
+// compileExportFilter compiles the filter of an export over the columns the
+// export shows, so the values of redacted and tokenized columns cannot be
+// probed with it.
+func compileExportFilter(expr string, plan *executionPlan) (func([]interface{}) (bool, error), error) {
+	columns := make([]string, len(plan.columns))
+	redact := plan.redactedColumns()
+	for i, name := range plan.columns {
+		// an empty name matches no identifier
+		if !redact[i] && plan.tokenize[i] != tokenizeOnExport {
+			columns[i] = name
+		}
+	}
+	keep, err := compileFilter(expr, columns, plan.types)
+	if err != nil {
+		if _, full := compileFilter(expr, plan.columns, plan.types); full == nil {
+			return nil, fmt.Errorf("%w, redacted and tokenized columns cannot be filtered on", err)
+		}
+	}
+	return keep, err
+}
+
+// handleExport streams the rows of a month that pass the filters as csv, or
+// in another format of exportFormats, optionally compressed.
+func handleExport(c *gin.Context) {
+	settings := cfg()
+	date := DateParams{Month: c.Query("month"), Year: c.Query("year")}
+	if err := date.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	s, err := dataSpec(c, date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	plan := s.plan
+
+	format := exportFormats[strings.ToLower(c.DefaultQuery("format", "csv"))]
+	if format == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("format must be one of %v", exportFormatNames())})
+		return
+	}
+	cd, err := lookupCodec(c.Query("compression"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	opts := exportOptions{bom: c.Query("bom") == "true"}
+	if opts.delimiter, err = exportDelimiter(c.Query("delimiter")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	tokenKey := settings.TokenizationKey
+	if plan.tokenized && tokenKey == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"message": "The rows hold tokenized columns, set tokenization_key"})
+		return
+	}
+
+	f := newDataFilter(plan)
+	if err := f.month(settings, s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if waybill := c.Query("waybill"); waybill != "" {
+		if plan.key < 0 || !f.equal(plan, plan.key, waybill) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable waybill column"})
+			return
+		}
+	}
+	if client := c.Query("client"); client != "" {
+		if i := plan.columnIndex(settings.ClientColumn); i < 0 || !f.equal(plan, i, client) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable client column " + settings.ClientColumn})
+			return
+		}
+	}
+	// filter is a condition like those of the mapping filters, rows for which
+	// it holds are exported
+	var keep func([]interface{}) (bool, error)
+	if expr := c.Query("filter"); expr != "" {
+		if keep, err = compileExportFilter(expr, plan); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "filter: " + err.Error()})
+			return
+		}
+	}
+
+	var header, types []string
+	var columns []int
+	for i, redact := range plan.redactedColumns() {
+		if !redact {
+			header = append(header, plan.columns[i])
+			types = append(types, plan.types[i])
+			columns = append(columns, i)
+		}
+	}
+	order := "ctid"
+	if plan.key >= 0 {
+		order = plan.columns[plan.key]
+	}
+	table := s.schema + "." + s.table
+	query := fmt.Sprintf("SELECT %s FROM %s t%s ORDER BY %s", strings.Join(plan.columns, ", "), table, f.where(), order)
+
+	dbPool, releasePool, err := acquireImportPool(s.tenant, s.database)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	rows, err := dbPool.Query(c.Request.Context(), query, f.args...)
+	if err != nil {
+		dataError(c, table, err)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("%s_%s_%s%s", s.table, strings.ToLower(date.Month), strings.ToLower(date.Year), format.extension)
+	var out io.Writer = c.Writer
+	if cd != nil {
+		filename += cd.extension
+		c.Header("Content-Type", "application/"+cd.name)
+	} else {
+		c.Header("Content-Type", format.contentType)
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	if cd != nil {
+		zw, err := cd.newWriter(c.Writer)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		defer zw.Close()
+		out = zw
+	}
+	if plan.tokenized {
+		defer flushTokenVault()
+	}
+
+	w, err := format.newWriter(out, header, types, opts)
+	if err != nil {
+		log.Println("Export of", table, "failed:", err)
+		return
+	}
+	record := make([]interface{}, len(columns))
+	exported := 0
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			log.Println("Export of", table, "failed:", err)
+			return
+		}
+		plan.readDecimals(values)
+		if keep != nil {
+			if ok, err := keep(values); err != nil || !ok {
+				continue
+			}
+		}
+		for j, i := range columns {
+			record[j] = values[i]
+			if plan.tokenize[i] == tokenizeOnExport {
+				record[j] = vaultToken(tokenKey, plan.tokenKinds[i], formatValue(values[i]))
+			}
+		}
+		if err := w.write(record); err != nil {
+			log.Println("Export of", table, "failed:", err)
+			return
+		}
+		exported++
+	}
+	if err := rows.Err(); err != nil {
+		// the file is cut short, which the client sees as a broken download
+		log.Println("Export of", table, "failed:", err)
+		return
+	}
+	if err := w.close(); err != nil {
+		log.Println("Export of", table, "failed:", err)
+		return
+	}
+	auditRequest(c, auditExport, "", fmt.Sprintf("table=%s format=%s rows=%d", table, format.name, exported))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileExportFilterHidesColumns(t *testing.T) {
+	settings := defaultConfig()
+	settings.RedactColumns = []string{"nik"}
+	currentConfig.Store(settings)
+
+	plan := &executionPlan{
+		columns:  []string{"no_resi", "nik", "telepon", "cod"},
+		types:    []string{"text", "text", "text", typeDecimal},
+		tokenize: []string{"", "", tokenizeOnExport, ""},
+	}
+	for _, expr := range []string{"nik > '3200'", "telepon = '0812'", "cod > 0 and nik < '5'"} {
+		_, err := compileExportFilter(expr, plan)
+		if err == nil || !strings.Contains(err.Error(), "cannot be filtered on") {
+			t.Errorf("%s: %v, want the filter refused", expr, err)
+		}
+	}
+	if _, err := compileExportFilter("cod > 0 and no_resi = 'X1'", plan); err != nil {
+		t.Errorf("a filter on shown columns: %v", err)
+	}
+	if _, err := compileExportFilter("nope = 1", plan); err == nil || strings.Contains(err.Error(), "cannot be filtered on") {
+		t.Errorf("an unknown column: %v, want a plain unknown column error", err)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ComputedColumn is a column that is not in the file but computed per row
+// from the converted values, e.g. `total_biaya - diskon` or
+// `month(tgl_pengiriman)`. Type is inferred from the expression when left out.
+type ComputedColumn struct {
+	Name string `yaml:"name" json:"name,omitempty"`
+	Type string `yaml:"type" json:"type,omitempty"`
+	Expr string `yaml:"expr" json:"expr,omitempty"`
+}
+
+// static types of expression values
+const (
+	exprInt   = "int"
+	exprFloat = "float"
+	exprText  = "text"
+	exprTime  = "time"
+	exprBool  = "bool"
+)
+
+// exprFunc evaluates a compiled expression against the values of a row;
+// nil stands for a missing value and makes most results nil too.
+type exprFunc func(values []interface{}) (interface{}, error)
+
+type exprNode struct {
+	typ  string
+	eval exprFunc
+}
+
+var errDivisionByZero = errors.New("division by zero")
+
+// compileComputed compiles the expression of a computed column over the
+// columns before it, named by columns with their mapping types.
+func compileComputed(col ComputedColumn, columns, types []string) (exprFunc, string, error) {
+	p := &exprParser{columns: columns, types: types}
+	node, err := p.parse(col.Expr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	typ := col.Type
+	switch {
+	case typ == "" && node.typ == exprTime:
+		typ = "timestamp"
+	case typ == "" && node.typ != exprBool:
+		typ = node.typ
+	case typ == exprInt && node.typ == exprInt,
+		typ == exprFloat && (node.typ == exprInt || node.typ == exprFloat),
+		(typ == "" || typ == exprText) && node.typ == exprText,
+		(typ == "date" || typ == "timestamp") && node.typ == exprTime:
+	case node.typ == exprBool:
+		return nil, "", fmt.Errorf("a comparison is only a condition, use it in if()")
+	default:
+		return nil, "", fmt.Errorf("expression gives %s, not %s", node.typ, col.Type)
+	}
+
+	eval := node.eval
+	if typ == exprFloat && node.typ == exprInt {
+		eval = func(values []interface{}) (interface{}, error) {
+			v, err := node.eval(values)
+			if n, ok := v.(int64); ok {
+				return float64(n), err
+			}
+			return v, err
+		}
+	}
+	return eval, typ, nil
+}
+
+// compileFilter compiles a condition over the converted values of a row. A
+// condition on an empty value is false.
+func compileFilter(expr string, columns, types []string) (func(values []interface{}) (bool, error), error) {
+	p := &exprParser{columns: columns, types: types}
+	node, err := p.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	if node.typ != exprBool {
+		return nil, fmt.Errorf("expression gives %s, not a condition", node.typ)
+	}
+	return func(values []interface{}) (bool, error) {
+		v, err := node.eval(values)
+		return v == true, err
+	}, nil
+}
+
+type exprToken struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator or punctuation
+	text string
+	// byte offset in the expression
+	at int
+}
+
+// exprError is a mistake in an expression at a character of it, counted from
+// 1, so a long mapping expression shows where to look.
+type exprError struct {
+	at  int
+	err error
+}
+
+func (e *exprError) Error() string { return fmt.Sprintf("%v at character %d", e.err, e.at) }
+
+func (e *exprError) Unwrap() error { return e.err }
+
+// errorAt places err at token t, unless a deeper part of the expression
+// placed it already.
+func errorAt(t exprToken, err error) error {
+	var placed *exprError
+	if err == nil || errors.As(err, &placed) {
+		return err
+	}
+	return &exprError{at: t.at + 1, err: err}
+}
+
+type exprParser struct {
+	columns []string
+	types   []string
+	tokens  []exprToken
+	pos     int
+	end     int
+}
+
+func (p *exprParser) lex(src string) error {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return &exprError{at: i + 1, err: errors.New("unterminated string")}
+			}
+			p.tokens = append(p.tokens, exprToken{'s', src[i+1 : i+1+end], i})
+			i += end + 2
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			p.tokens = append(p.tokens, exprToken{'n', src[start:i], start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			p.tokens = append(p.tokens, exprToken{'i', src[start:i], start})
+		case strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">="):
+			p.tokens = append(p.tokens, exprToken{'o', src[i : i+2], i})
+			i += 2
+		case strings.IndexByte("+-*/%()<>,=", c) >= 0:
+			p.tokens = append(p.tokens, exprToken{'o', src[i : i+1], i})
+			i++
+		default:
+			return &exprError{at: i + 1, err: fmt.Errorf("unexpected %q", c)}
+		}
+	}
+	p.end = len(src)
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+	return nil
+}
+
+// parse compiles a whole expression.
+func (p *exprParser) parse(src string) (exprNode, error) {
+	if err := p.lex(src); err != nil {
+		return exprNode{}, err
+	}
+	node, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = errorAt(p.here(), fmt.Errorf("unexpected %q", p.tokens[p.pos].text))
+	}
+	return node, err
+}
+
+// here is the next token, one past the end of the expression when there is
+// none.
+func (p *exprParser) here() exprToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return exprToken{at: p.end}
+}
+
+// last is the token read last.
+func (p *exprParser) last() exprToken { return p.tokens[p.pos-1] }
+
+// accept consumes the next token when it is the operator op.
+func (p *exprParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'o' && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// keyword consumes the next token when it is the word w.
+func (p *exprParser) keyword(w string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'i' && p.tokens[p.pos].text == w {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.keyword("or") {
+		op := p.last()
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left, err = logical("or", left, right)
+			err = errorAt(op, err)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	for err == nil && p.keyword("and") {
+		op := p.last()
+		var right exprNode
+		if right, err = p.parseNot(); err == nil {
+			left, err = logical("and", left, right)
+			err = errorAt(op, err)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if !p.keyword("not") {
+		return p.parseCompare()
+	}
+	not := p.last()
+	operand, err := p.parseNot()
+	if err != nil {
+		return operand, err
+	}
+	if operand.typ != exprBool {
+		return exprNode{}, errorAt(not, fmt.Errorf("not needs a condition, got %s", operand.typ))
+	}
+	return exprNode{typ: exprBool, eval: func(values []interface{}) (interface{}, error) {
+		v, err := operand.eval(values)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return v != true, nil
+	}}, nil
+}
+
+// logical joins two conditions; an empty side counts as false.
+func logical(op string, left, right exprNode) (exprNode, error) {
+	if left.typ != exprBool || right.typ != exprBool {
+		return exprNode{}, fmt.Errorf("%s needs conditions, got %s and %s", op, left.typ, right.typ)
+	}
+	return exprNode{typ: exprBool, eval: func(values []interface{}) (interface{}, error) {
+		a, err := left.eval(values)
+		if err != nil {
+			return nil, err
+		}
+		if (a == true) == (op == "or") {
+			return a == true, nil
+		}
+		b, err := right.eval(values)
+		return b == true, err
+	}}, nil
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return left, err
+	}
+	for _, op := range []string{"==", "=", "!=", "<=", ">=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		if op == "=" {
+			op = "=="
+		}
+		at := p.last()
+		right, err := p.parseAdd()
+		if err != nil {
+			return right, err
+		}
+		node, err := compareNodes(op, left, right)
+		return node, errorAt(at, err)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdd() (exprNode, error) {
+	left, err := p.parseMul()
+	for err == nil {
+		var op string
+		switch {
+		case p.accept("+"):
+			op = "+"
+		case p.accept("-"):
+			op = "-"
+		default:
+			return left, nil
+		}
+		at := p.last()
+		var right exprNode
+		if right, err = p.parseMul(); err == nil {
+			left, err = arithmetic(op, left, right)
+			err = errorAt(at, err)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseMul() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		var op string
+		switch {
+		case p.accept("*"):
+			op = "*"
+		case p.accept("/"):
+			op = "/"
+		case p.accept("%"):
+			op = "%"
+		default:
+			return left, nil
+		}
+		at := p.last()
+		var right exprNode
+		if right, err = p.parseUnary(); err == nil {
+			left, err = arithmetic(op, left, right)
+			err = errorAt(at, err)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("-") {
+		at := p.last()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return operand, err
+		}
+		node, err := arithmetic("-", exprNode{typ: exprInt, eval: constant(int64(0))}, operand)
+		return node, errorAt(at, err)
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return exprNode{}, errorAt(p.here(), fmt.Errorf("unexpected end of expression"))
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case 'n':
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return exprNode{typ: exprInt, eval: constant(n)}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return exprNode{}, errorAt(t, fmt.Errorf("bad number %q", t.text))
+		}
+		return exprNode{typ: exprFloat, eval: constant(f)}, nil
+	case 's':
+		return exprNode{typ: exprText, eval: constant(t.text)}, nil
+	case 'i':
+		if p.accept("(") {
+			var args []exprNode
+			for !p.accept(")") {
+				if len(args) > 0 && !p.accept(",") {
+					return exprNode{}, errorAt(p.here(), fmt.Errorf("%s: expected , or )", t.text))
+				}
+				arg, err := p.parseOr()
+				if err != nil {
+					return arg, err
+				}
+				args = append(args, arg)
+			}
+			node, err := callFunction(t.text, args)
+			return node, errorAt(t, err)
+		}
+		for i, name := range p.columns {
+			if name == t.text {
+				return columnNode(i, p.types[i]), nil
+			}
+		}
+		return exprNode{}, errorAt(t, fmt.Errorf("unknown column %s", t.text))
+	}
+
+	if t.text == "(" {
+		node, err := p.parseOr()
+		if err == nil && !p.accept(")") {
+			err = errorAt(p.here(), fmt.Errorf("missing )"))
+		}
+		return node, err
+	}
+	return exprNode{}, errorAt(t, fmt.Errorf("unexpected %q", t.text))
+}
+
+func constant(v interface{}) exprFunc {
+	return func([]interface{}) (interface{}, error) { return v, nil }
+}
+
+func columnNode(i int, columnType string) exprNode {
+	typ := columnType
+	switch typ {
+	case "date", "timestamp":
+		typ = exprTime
+	case typeDecimal:
+		// expressions compute in floats
+		return exprNode{typ: exprFloat, eval: func(values []interface{}) (interface{}, error) {
+			if i >= len(values) || values[i] == nil {
+				return nil, nil
+			}
+			f, _ := numberValue(values[i])
+			return f, nil
+		}}
+	}
+	return exprNode{typ: typ, eval: func(values []interface{}) (interface{}, error) {
+		if i >= len(values) {
+			return nil, nil
+		}
+		return values[i], nil
+	}}
+}
+
+func numeric(typ string) bool { return typ == exprInt || typ == exprFloat }
+
+func toFloat(v interface{}) float64 {
+	if n, ok := v.(int64); ok {
+		return float64(n)
+	}
+	f, _ := v.(float64)
+	return f
+}
+
+// binary evaluates both operands and applies fn unless one of them is nil.
+func binary(left, right exprNode, fn func(a, b interface{}) (interface{}, error)) exprFunc {
+	return func(values []interface{}) (interface{}, error) {
+		a, err := left.eval(values)
+		if err != nil || a == nil {
+			return nil, err
+		}
+		b, err := right.eval(values)
+		if err != nil || b == nil {
+			return nil, err
+		}
+		return fn(a, b)
+	}
+}
+
+func arithmetic(op string, left, right exprNode) (exprNode, error) {
+	if op == "+" && left.typ == exprText && right.typ == exprText {
+		return exprNode{typ: exprText, eval: binary(left, right, func(a, b interface{}) (interface{}, error) {
+			return a.(string) + b.(string), nil
+		})}, nil
+	}
+	if !numeric(left.typ) || !numeric(right.typ) {
+		return exprNode{}, fmt.Errorf("%s needs numbers, got %s and %s", op, left.typ, right.typ)
+	}
+
+	if left.typ == exprInt && right.typ == exprInt && op != "/" {
+		return exprNode{typ: exprInt, eval: binary(left, right, func(a, b interface{}) (interface{}, error) {
+			x, y := a.(int64), b.(int64)
+			switch op {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			}
+			if y == 0 {
+				return nil, errDivisionByZero
+			}
+			return x % y, nil
+		})}, nil
+	}
+	if op == "%" {
+		return exprNode{}, fmt.Errorf("%% needs integers")
+	}
+
+	// / always divides as floats
+	return exprNode{typ: exprFloat, eval: binary(left, right, func(a, b interface{}) (interface{}, error) {
+		x, y := toFloat(a), toFloat(b)
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		if y == 0 {
+			return nil, errDivisionByZero
+		}
+		return x / y, nil
+	})}, nil
+}
+
+func compareNodes(op string, left, right exprNode) (exprNode, error) {
+	var cmp func(a, b interface{}) int
+	switch {
+	case numeric(left.typ) && numeric(right.typ):
+		cmp = func(a, b interface{}) int {
+			x, y := toFloat(a), toFloat(b)
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case left.typ == exprText && right.typ == exprText:
+		cmp = func(a, b interface{}) int { return strings.Compare(a.(string), b.(string)) }
+	case left.typ == exprTime && right.typ == exprTime:
+		cmp = func(a, b interface{}) int { return a.(time.Time).Compare(b.(time.Time)) }
+	default:
+		return exprNode{}, fmt.Errorf("cannot compare %s with %s", left.typ, right.typ)
+	}
+
+	return exprNode{typ: exprBool, eval: binary(left, right, func(a, b interface{}) (interface{}, error) {
+		c := cmp(a, b)
+		switch op {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	})}, nil
+}
+
+// commonType is the type two branches of if or coalesce share.
+func commonType(a, b string) (string, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case numeric(a) && numeric(b):
+		return exprFloat, true
+	}
+	return "", false
+}
+
+// promote turns the ints of a node into floats when typ is float.
+func promote(n exprNode, typ string) exprFunc {
+	if typ != exprFloat || n.typ != exprInt {
+		return n.eval
+	}
+	return func(values []interface{}) (interface{}, error) {
+		v, err := n.eval(values)
+		if v == nil {
+			return nil, err
+		}
+		return toFloat(v), err
+	}
+}
+
+func callFunction(name string, args []exprNode) (exprNode, error) {
+	want := func(n int, types ...string) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d arguments", name, n)
+		}
+		for i, t := range types {
+			if args[i].typ != t && !(t == exprFloat && args[i].typ == exprInt) {
+				return fmt.Errorf("%s needs %s, got %s", name, t, args[i].typ)
+			}
+		}
+		return nil
+	}
+	unary := func(typ string, fn func(v interface{}) interface{}) exprNode {
+		arg := args[0]
+		return exprNode{typ: typ, eval: func(values []interface{}) (interface{}, error) {
+			v, err := arg.eval(values)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			return fn(v), nil
+		}}
+	}
+
+	switch name {
+	case "year", "month", "day":
+		if err := want(1, exprTime); err != nil {
+			return exprNode{}, err
+		}
+		return unary(exprInt, func(v interface{}) interface{} {
+			t := v.(time.Time)
+			switch name {
+			case "year":
+				return int64(t.Year())
+			case "month":
+				return int64(t.Month())
+			}
+			return int64(t.Day())
+		}), nil
+	case "upper", "lower", "trim":
+		if err := want(1, exprText); err != nil {
+			return exprNode{}, err
+		}
+		fn := map[string]func(string) string{"upper": strings.ToUpper, "lower": strings.ToLower, "trim": strings.TrimSpace}[name]
+		return unary(exprText, func(v interface{}) interface{} { return fn(v.(string)) }), nil
+	case "text":
+		if len(args) != 1 {
+			return exprNode{}, fmt.Errorf("text takes 1 argument")
+		}
+		return unary(exprText, func(v interface{}) interface{} { return formatValue(v) }), nil
+	case "abs":
+		if err := want(1, exprFloat); err != nil {
+			return exprNode{}, err
+		}
+		return unary(args[0].typ, func(v interface{}) interface{} {
+			if n, ok := v.(int64); ok {
+				if n < 0 {
+					return -n
+				}
+				return n
+			}
+			return math.Abs(v.(float64))
+		}), nil
+	case "round":
+		if len(args) == 1 {
+			if err := want(1, exprFloat); err != nil {
+				return exprNode{}, err
+			}
+			return unary(exprInt, func(v interface{}) interface{} { return int64(math.Round(toFloat(v))) }), nil
+		}
+		if err := want(2, exprFloat, exprInt); err != nil {
+			return exprNode{}, err
+		}
+		return exprNode{typ: exprFloat, eval: binary(args[0], args[1], func(a, b interface{}) (interface{}, error) {
+			scale := math.Pow(10, float64(b.(int64)))
+			return math.Round(toFloat(a)*scale) / scale, nil
+		})}, nil
+	case "coalesce":
+		if len(args) == 0 {
+			return exprNode{}, fmt.Errorf("coalesce needs arguments")
+		}
+		typ := args[0].typ
+		for _, arg := range args[1:] {
+			t, ok := commonType(typ, arg.typ)
+			if !ok {
+				return exprNode{}, fmt.Errorf("coalesce mixes %s and %s", typ, arg.typ)
+			}
+			typ = t
+		}
+		evals := make([]exprFunc, len(args))
+		for i, arg := range args {
+			evals[i] = promote(arg, typ)
+		}
+		return exprNode{typ: typ, eval: func(values []interface{}) (interface{}, error) {
+			for _, eval := range evals {
+				if v, err := eval(values); err != nil || v != nil {
+					return v, err
+				}
+			}
+			return nil, nil
+		}}, nil
+	case "if":
+		if len(args) != 3 || args[0].typ != exprBool {
+			return exprNode{}, fmt.Errorf("if takes a comparison and two values")
+		}
+		typ, ok := commonType(args[1].typ, args[2].typ)
+		if !ok {
+			return exprNode{}, fmt.Errorf("if mixes %s and %s", args[1].typ, args[2].typ)
+		}
+		cond, then, otherwise := args[0].eval, promote(args[1], typ), promote(args[2], typ)
+		return exprNode{typ: typ, eval: func(values []interface{}) (interface{}, error) {
+			c, err := cond(values)
+			if err != nil {
+				return nil, err
+			}
+			if c == true {
+				return then(values)
+			}
+			return otherwise(values)
+		}}, nil
+	}
+	return exprNode{}, fmt.Errorf("unknown function %s", name)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// the columns the expressions of these tests run over
+var (
+	exprTestColumns = []string{"berat", "cod", "kat", "tgl", "kosong"}
+	exprTestTypes   = []string{exprInt, typeDecimal, exprText, "date", exprInt}
+	exprTestRow     = []interface{}{int64(2), 150.5, "REG", time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC), nil}
+)
+
+func TestComputedExpressions(t *testing.T) {
+	tests := []struct {
+		expr string
+		typ  string
+		want interface{}
+	}{
+		// precedence and associativity
+		{"1 + 2 * 3", exprInt, int64(7)},
+		{"(1 + 2) * 3", exprInt, int64(9)},
+		{"10 - 4 - 3", exprInt, int64(3)},
+		{"2 * 3 % 4", exprInt, int64(2)},
+		{"-2 * 3", exprInt, int64(-6)},
+		{"2 * -3", exprInt, int64(-6)},
+		{"- -2", exprInt, int64(2)},
+		// ints turn into floats with a float, and / always divides as floats
+		{"7 / 2", exprFloat, 3.5},
+		{"6 / 3", exprFloat, 2.0},
+		{"berat + 0.5", exprFloat, 2.5},
+		{"cod * 2", exprFloat, 301.0},
+		{"if(berat > 1, 1, 2.5)", exprFloat, 1.0},
+		{"abs(-3)", exprInt, int64(3)},
+		{"round(2.5)", exprInt, int64(3)},
+		{"round(cod, 0)", exprFloat, 151.0},
+		// text
+		{"kat + '-' + 'x'", exprText, "REG-x"},
+		{"text(berat) + 'kg'", exprText, "2kg"},
+		{"lower(kat)", exprText, "reg"},
+		{"upper(trim('  a '))", exprText, "A"},
+		// dates
+		{"year(tgl) * 100 + month(tgl)", exprInt, int64(202405)},
+		{"day(tgl)", exprInt, int64(17)},
+		// an empty value empties what is computed from it
+		{"kosong + 1", exprInt, nil},
+		{"upper(text(kosong))", exprText, nil},
+		{"coalesce(kosong, berat, 0)", exprInt, int64(2)},
+		{"coalesce(kosong, 0.5)", exprFloat, 0.5},
+		{"if(kosong > 0, 1, 2)", exprInt, int64(2)},
+	}
+	for _, tt := range tests {
+		eval, typ, err := compileComputed(ComputedColumn{Name: "x", Expr: tt.expr}, exprTestColumns, exprTestTypes)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if typ != tt.typ {
+			t.Errorf("%s: type %s, want %s", tt.expr, typ, tt.typ)
+		}
+		got, err := eval(exprTestRow)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %#v, %v; want %#v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestComputedType(t *testing.T) {
+	tests := []struct {
+		col  ComputedColumn
+		want string
+		err  bool
+	}{
+		{ComputedColumn{Expr: "berat * 2", Type: exprFloat}, exprFloat, false},
+		{ComputedColumn{Expr: "tgl"}, "timestamp", false},
+		{ComputedColumn{Expr: "tgl", Type: "date"}, "date", false},
+		{ComputedColumn{Expr: "cod", Type: exprInt}, "", true},
+		{ComputedColumn{Expr: "kat", Type: exprInt}, "", true},
+		{ComputedColumn{Expr: "berat > 1"}, "", true},
+	}
+	for _, tt := range tests {
+		eval, typ, err := compileComputed(tt.col, exprTestColumns, exprTestTypes)
+		if (err != nil) != tt.err || typ != tt.want {
+			t.Errorf("%s as %q: type %q, %v", tt.col.Expr, tt.col.Type, typ, err)
+		}
+		// a float column gets floats from an int expression
+		if tt.col.Type == exprFloat && err == nil {
+			if v, _ := eval(exprTestRow); v != 4.0 {
+				t.Errorf("%s as float = %#v, want 4.0", tt.col.Expr, v)
+			}
+		}
+	}
+}
+
+func TestFilterConditions(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"berat > 1 and kat = 'REG'", true},
+		{"berat == 2", true},
+		{"berat != 2", false},
+		{"berat <= 2 and berat >= 2 and berat < 3", true},
+		// and binds tighter than or, comparisons tighter than not
+		{"kat = 'REG' or berat > 5 and cod < 0", true},
+		{"(kat = 'REG' or berat > 5) and cod < 0", false},
+		{"not kat = 'X'", true},
+		{"not kat = 'REG' or berat = 2", true},
+		{"not not berat = 2", true},
+		// ints compare with floats and decimals
+		{"berat = 2.0", true},
+		{"cod > 150 and cod < 151", true},
+		{"berat + 1 > cod / 100", true},
+		// text compares by bytes
+		{"kat < 'b'", true},
+		{"kat > 'REF'", true},
+		// a condition on an empty value is false, negated or not
+		{"kosong > 0", false},
+		{"kosong = 0", false},
+		{"not kosong > 0", false},
+		{"kosong > 0 or berat = 2", true},
+		{"coalesce(kosong, 0) = 0", true},
+		{"upper(kat) = 'REG' and year(tgl) = 2024", true},
+	}
+	for _, tt := range tests {
+		keep, err := compileFilter(tt.expr, exprTestColumns, exprTestTypes)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got, err := keep(exprTestRow); err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "empty expression"},
+		{"berat >", "unexpected end of expression at character 8"},
+		{"berat > 'x'", "cannot compare int with text at character 7"},
+		{"kat = 1", "cannot compare text with int at character 5"},
+		{"nope = 1", "unknown column nope at character 1"},
+		{"berat = nope", "unknown column nope at character 9"},
+		{"kat = 'REG", "unterminated string at character 7"},
+		{"berat # 2", "unexpected '#' at character 7"},
+		{"(berat > 1", "missing ) at character 11"},
+		{"berat > 1 kat", `unexpected "kat" at character 11`},
+		{"berat > 1)", `unexpected ")" at character 10`},
+		{"1.2.3 > 0", `bad number "1.2.3" at character 1`},
+		{"kat + 1 > 0", "+ needs numbers, got text and int at character 5"},
+		{"berat % 1.5 > 0", "% needs integers at character 7"},
+		{"berat > 1 and kat", "and needs conditions, got bool and text at character 11"},
+		{"not berat", "not needs a condition, got int at character 1"},
+		{"upper(berat) = 'X'", "upper needs text, got int at character 1"},
+		{"berat > 0 and nope(1)", "unknown function nope at character 15"},
+		{"round(cod 2) > 0", "round: expected , or ) at character 11"},
+		{"if(berat, 1, 2) > 0", "if takes a comparison and two values at character 1"},
+		{"berat * 2", "expression gives int, not a condition"},
+	}
+	for _, tt := range tests {
+		_, err := compileFilter(tt.expr, exprTestColumns, exprTestTypes)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestExpressionRuntimeErrors(t *testing.T) {
+	for _, expr := range []string{"berat / 0", "berat % (berat - 2)", "cod / (berat - 2)"} {
+		eval, _, err := compileComputed(ComputedColumn{Name: "x", Expr: expr}, exprTestColumns, exprTestTypes)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if _, err := eval(exprTestRow); !errors.Is(err, errDivisionByZero) {
+			t.Errorf("%s: %v, want division by zero", expr, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// the jsonb column the fields past the mapped ones go to, see KeepExtraFields
+const extraFieldsColumn = "extra_fields"
+
+// compileExtraFields adds the extra_fields column to p, after the computed
+// and lookup columns.
+func (p *executionPlan) compileExtraFields() error {
+	if p.columnIndex(extraFieldsColumn) >= 0 {
+		return fmt.Errorf("keep_extra_fields: the mapping already has a column %s", extraFieldsColumn)
+	}
+	p.extras = len(p.columns)
+	p.columns = append(p.columns, extraFieldsColumn)
+	p.types = append(p.types, "jsonb")
+	p.layouts = append(p.layouts, "")
+	p.tokenize = append(p.tokenize, "")
+	p.tokenKinds = append(p.tokenKinds, extraFieldsColumn)
+	return nil
+}
+
+// addExtraFieldsColumn adds the extra_fields column to the target of imp when
+// it has none yet, so a mapping can start keeping extras on an existing table.
+func addExtraFieldsColumn(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	if _, err := dbPool.Exec(ctx, fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS %s jsonb", imp.target(), extraFieldsColumn)); err != nil {
+		return fmt.Errorf("failed to add %s to %s: %w", extraFieldsColumn, imp.target(), err)
+	}
+	return nil
+}
+
+// extraFields returns the non-empty fields of row past the mapped ones as a
+// json object keyed by their header name, or field_<position> when the header
+// has none, and nil when there are none. Empty fields are usually trailing
+// delimiters.
+func (p *executionPlan) extraFields(row []string, header *headerMatcher) interface{} {
+	if len(row) <= p.fileColumns {
+		return nil
+	}
+	extras := map[string]string{}
+	for k, v := range row[p.fileColumns:] {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		// combined columns take several file fields each
+		pos := len(p.fields) + k
+		name := ""
+		if header != nil && pos < len(header.fields) {
+			name = header.fields[pos]
+		}
+		if _, taken := extras[name]; name == "" || taken {
+			name = fmt.Sprintf("field_%d", pos+1)
+		}
+		extras[name] = v
+	}
+	if len(extras) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(extras)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FileReport is what one file of a multi-file import added to it.
+type FileReport struct {
+	Name     string `json:"name"`
+	Bytes    int64  `json:"bytes"`
+	RowsRead int64  `json:"rows_read"`
+	Inserted int64  `json:"inserted"`
+	Rejected int64  `json:"rejected"`
+	Error    string `json:"error,omitempty"`
+}
+
+// importFile is one of the files of an upload, a part of the request or an
+// entry of a zip archive.
+type importFile struct {
+	name  string
+	size  int64
+	entry bool
+	open  func() (io.ReadCloser, error)
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+// uploadFiles returns the files of an upload named name: the entries of a zip
+// archive in name order, or the upload itself. Directories, hidden files and
+// the __MACOSX folder of archives made on macOS are left out.
+func uploadFiles(name string, r io.ReaderAt, size int64) ([]importFile, error) {
+	head := make([]byte, len(zipMagic))
+	n, _ := r.ReadAt(head, 0)
+	if !bytes.Equal(head[:n], zipMagic) {
+		return []importFile{{name: name, size: size, open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(r, 0, size)), nil
+		}}}, nil
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	var files []importFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(path.Base(f.Name), ".") {
+			continue
+		}
+		files = append(files, importFile{name: f.Name, size: int64(f.UncompressedSize64), entry: true, open: f.Open})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s holds no file", name)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// multiFile reports whether files are loaded as several files rather than as
+// a plain upload.
+func multiFile(files []importFile) bool {
+	return len(files) > 1 || (len(files) == 1 && files[0].entry)
+}
+
+// filesSize is the size of files, the total bytes of their import.
+func filesSize(files []importFile) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	return size
+}
+
+func removeSpools(spools []string) {
+	for _, spool := range spools {
+		os.Remove(spool)
+	}
+}
+
+// loadFiles loads the files of a multi-file import one after the other, each
+// with its own header, and reports what each of them added. The files share
+// the dialect sniffed from the first one. A failing file stops the import.
+func loadFiles(ctx context.Context, cancel context.CancelFunc, imp *Import, dbPool *pgxpool.Pool, settings *Config) {
+	for _, f := range imp.inputFiles {
+		if ctx.Err() != nil || imp.abortedWith() != "" {
+			return
+		}
+		before := imp.progress()
+		fr := FileReport{Name: f.name, Bytes: f.size}
+		imp.mu.Lock()
+		imp.currentFile = f.name
+		imp.mu.Unlock()
+		imp.publish(ImportEvent{Type: eventMilestone, Message: "reading " + f.name})
+
+		err := loadFile(ctx, cancel, imp, dbPool, f, settings)
+		if err != nil {
+			log.Println("Import", imp.ID, "failed to read", f.name+":", err)
+			fr.Error = err.Error()
+			imp.abort(err)
+		} else if reason := imp.abortedWith(); reason != "" {
+			fr.Error = reason
+		}
+
+		after := imp.progress()
+		fr.RowsRead = after.RowsRead - before.RowsRead
+		fr.Inserted = after.Inserted - before.Inserted
+		fr.Rejected = after.Rejected - before.Rejected
+		imp.mu.Lock()
+		imp.files = append(imp.files, fr)
+		imp.mu.Unlock()
+	}
+}
+
+func loadFile(ctx context.Context, cancel context.CancelFunc, imp *Import, dbPool *pgxpool.Pool, f importFile, settings *Config) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, err := decompressUpload(&countingReader{r: r, imp: imp})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	loadRows(ctx, cancel, imp, dbPool, imp.inputReader(body), settings)
+	return nil
+}
+
+// errMultiFileStrict refuses strict imports of several files, which would
+// each be loaded in a transaction of their own.
+var errMultiFileStrict = errors.New("strict=true loads one file in one transaction, upload the files one by one")
+
+// inputReader buffers body for the row reader of imp, past the lines it skips,
+// sniffing the dialect of a csv file.
+func (imp *Import) inputReader(body io.Reader) *bufio.Reader {
+	if !imp.binaryInput() {
+		body = limitRowLength(body, cfg().MaxRowBytes)
+	}
+	input := bufio.NewReaderSize(body, rowSampleBytes)
+	skipLines(input, imp.skipRows)
+	imp.detectDialect(input)
+	return input
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// remoteFile is a file waiting in a watched location.
+type remoteFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// fileSource is a directory or bucket prefix scheduled imports pick files up
+// from. Names are relative to the watched location; archive moves a file into
+// a subdirectory of it so it is not picked up again.
+type fileSource interface {
+	list(ctx context.Context) ([]remoteFile, error)
+	open(ctx context.Context, name string) (io.ReadCloser, error)
+	archive(ctx context.Context, name, dir string) error
+	close()
+}
+
+// file source drivers compiled into this binary, by url scheme
+var fileSourceDrivers = map[string]func(ctx context.Context, u *url.URL) (fileSource, error){}
+
+func registerFileSourceDriver(scheme string, open func(ctx context.Context, u *url.URL) (fileSource, error)) {
+	fileSourceDrivers[scheme] = open
+}
+
+func fileSourceSchemes() []string {
+	schemes := make([]string, 0, len(fileSourceDrivers))
+	for scheme := range fileSourceDrivers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// parseSourceURL accepts a url or, for the local driver, a plain path.
+func parseSourceURL(source string) (*url.URL, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		return &url.URL{Scheme: "file", Path: source}, nil
+	}
+	if fileSourceDrivers[u.Scheme] == nil {
+		return nil, fmt.Errorf("source %q: scheme must be one of %v", source, fileSourceSchemes())
+	}
+	return u, nil
+}
+
+func openFileSource(ctx context.Context, source string) (fileSource, error) {
+	u, err := parseSourceURL(source)
+	if err != nil {
+		return nil, err
+	}
+	return fileSourceDrivers[u.Scheme](ctx, u)
+}
+
+func init() {
+	registerFileSourceDriver("file", openLocalSource)
+}
+
+// localSource watches a directory on this machine, e.g. one the courier's
+// sftp server writes into.
+type localSource struct {
+	dir string
+}
+
+func openLocalSource(ctx context.Context, u *url.URL) (fileSource, error) {
+	fi, err := os.Stat(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("source %s is not a directory", u.Path)
+	}
+	return &localSource{dir: u.Path}, nil
+}
+
+func (s *localSource) list(ctx context.Context) ([]remoteFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []remoteFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, remoteFile{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files, nil
+}
+
+func (s *localSource) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+func (s *localSource) archive(ctx context.Context, name, dir string) error {
+	if err := os.MkdirAll(filepath.Join(s.dir, dir), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.dir, name), filepath.Join(s.dir, dir, name))
+}
+
+func (s *localSource) close() {}
@@ -0,0 +1,79 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Google Cloud Storage sources need the storage client, so they are only
+// compiled in with `-tags gcs`. The url is gs://bucket/prefix; credentials
+// come from the usual Google application defaults.
+func init() {
+	registerFileSourceDriver("gs", openGCSSource)
+}
+
+type gcsSource struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func openGCSSource(ctx context.Context, u *url.URL) (fileSource, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &gcsSource{client: client, bucket: client.Bucket(u.Host), prefix: prefix}, nil
+}
+
+// list returns the objects directly under the prefix, like the s3 source.
+func (s *gcsSource) list(ctx context.Context) ([]remoteFile, error) {
+	var files []remoteFile
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the delimiter turns "subdirectories" into prefix-only entries
+		if attrs.Name == "" {
+			continue
+		}
+		name := strings.TrimPrefix(attrs.Name, s.prefix)
+		if name != "" {
+			files = append(files, remoteFile{Name: name, Size: attrs.Size, ModTime: attrs.Updated})
+		}
+	}
+}
+
+func (s *gcsSource) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.bucket.Object(s.prefix + name).NewReader(ctx)
+}
+
+func (s *gcsSource) archive(ctx context.Context, name, dir string) error {
+	src := s.bucket.Object(s.prefix + name)
+	if _, err := s.bucket.Object(s.prefix + dir + "/" + name).CopierFrom(src).Run(ctx); err != nil {
+		return err
+	}
+	return src.Delete(ctx)
+}
+
+func (s *gcsSource) close() {
+	s.client.Close()
+}
@@ -0,0 +1,94 @@
+//go:build s3
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 sources need the AWS SDK, so they are only compiled in with `-tags s3`.
+// The url is s3://bucket/prefix, ?region= overrides the region; credentials
+// come from the usual AWS environment, profile or instance role.
+func init() {
+	registerFileSourceDriver("s3", openS3Source)
+}
+
+type s3Source struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func openS3Source(ctx context.Context, u *url.URL) (fileSource, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region := u.Query().Get("region"); region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Source{client: s3.NewFromConfig(awsCfg), bucket: u.Host, prefix: prefix}, nil
+}
+
+// list returns the objects directly under the prefix; archived ones sit in
+// "subdirectories" and are left out by the delimiter.
+func (s *s3Source) list(ctx context.Context) ([]remoteFile, error) {
+	var files []remoteFile
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			if name == "" {
+				continue
+			}
+			files = append(files, remoteFile{Name: name, Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified)})
+		}
+	}
+	return files, nil
+}
+
+func (s *s3Source) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// archive copies the object under dir and deletes the original, S3 has no
+// rename.
+func (s *s3Source) archive(ctx context.Context, name, dir string) error {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		CopySource: aws.String((&url.URL{Path: s.bucket + "/" + s.prefix + name}).EscapedPath()),
+		Key:        aws.String(s.prefix + dir + "/" + name),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)})
+	return err
+}
+
+func (s *s3Source) close() {}
@@ -0,0 +1,469 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The grpc api needs google.golang.org/grpc, so it is only compiled in with
+// `-tags grpc`. The messages of proto/import.proto are read and written by
+// hand with protowire, so the build needs no protoc.
+func init() {
+	grpcServer = serveGRPC
+}
+
+func serveGRPC(settings *Config) (func(), error) {
+	l, err := net.Listen("tcp", settings.GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	s.RegisterService(&importServiceDesc, struct{}{})
+	log.Println("Listening for grpc on", l.Addr().String())
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Println("grpc:", err)
+		}
+	}()
+	return s.Stop, nil
+}
+
+var importServiceDesc = grpc.ServiceDesc{
+	ServiceName: "big_file_pgsql.v1.ImportService",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetStatus", Handler: handleGetStatusRPC},
+		{MethodName: "CancelImport", Handler: handleCancelImportRPC},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamRows", Handler: handleStreamRowsRPC, ClientStreams: true},
+	},
+	Metadata: "proto/import.proto",
+}
+
+// rpcCallerFrom authenticates the caller of ctx with the x-api-key metadata
+// or a bearer token.
+func rpcCallerFrom(ctx context.Context, role string) (*rpcCaller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	value := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	secret := value("x-api-key")
+	if secret == "" {
+		secret = strings.TrimPrefix(value("authorization"), "Bearer ")
+	}
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	caller, err := authenticateRPC(secret, role, ip, value("user-agent"))
+	return caller, rpcError(err)
+}
+
+func rpcError(err error) error {
+	var code codes.Code
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errRPCUnauthenticated):
+		code = codes.Unauthenticated
+	case errors.Is(err, errRPCForbidden):
+		code = codes.PermissionDenied
+	case errors.Is(err, errRPCInvalid):
+		code = codes.InvalidArgument
+	case errors.Is(err, errRPCNotFound):
+		code = codes.NotFound
+	case errors.Is(err, errRPCQuota):
+		code = codes.ResourceExhausted
+	case errors.Is(err, errImportIDTaken):
+		code = codes.AlreadyExists
+	case errors.Is(err, errImportFinished):
+		code = codes.FailedPrecondition
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// the handlers run without interceptors, none are installed
+
+func handleGetStatusRPC(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &getStatusRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	caller, err := rpcCallerFrom(ctx, roleUploader)
+	if err != nil {
+		return nil, err
+	}
+	imp, err := caller.findImport(req.importID)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &importStatusMessage{importRPCStatus(imp)}, nil
+}
+
+func handleCancelImportRPC(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &cancelImportRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	caller, err := rpcCallerFrom(ctx, roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	imp, err := caller.cancelImport(req.importID, req.reason)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &importStatusMessage{importRPCStatus(imp)}, nil
+}
+
+// handleStreamRowsRPC loads the rows or chunks of a client stream into one
+// import, which starts with the first of them.
+func handleStreamRowsRPC(_ interface{}, stream grpc.ServerStream) error {
+	caller, err := rpcCallerFrom(stream.Context(), roleUploader)
+	if err != nil {
+		return err
+	}
+
+	first := &streamRowsRequest{}
+	if err := stream.RecvMsg(first); err != nil {
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "the stream is empty")
+		}
+		return err
+	}
+	if first.params == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the params")
+	}
+	msg := first
+	for len(msg.rows) == 0 && len(msg.chunk) == 0 {
+		msg = &streamRowsRequest{}
+		if err := stream.RecvMsg(msg); err == io.EOF {
+			return status.Error(codes.InvalidArgument, "the stream carries no rows or chunks")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	rows := len(msg.rows) > 0
+	p, err := caller.startPushedImport(*first.params, rows)
+	if err != nil {
+		return rpcError(err)
+	}
+	var w *csv.Writer
+	if rows {
+		w = csv.NewWriter(p)
+		if p.imp.delimiter != 0 {
+			w.Comma = p.imp.delimiter
+		}
+	}
+
+	var broke error
+	for {
+		var err error
+		switch {
+		case rows && len(msg.chunk) > 0, !rows && len(msg.rows) > 0:
+			broke = status.Error(codes.InvalidArgument, "one import takes either rows or chunks")
+		case rows:
+			for _, row := range msg.rows {
+				if err = w.Write(row); err != nil {
+					break
+				}
+			}
+			w.Flush()
+			if err == nil {
+				err = w.Error()
+			}
+		default:
+			_, err = p.Write(msg.chunk)
+		}
+		// a write fails once the import stopped reading, it has its status
+		if broke != nil || err != nil {
+			break
+		}
+		msg = &streamRowsRequest{}
+		if err := stream.RecvMsg(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			broke = err
+			break
+		}
+	}
+	p.end(broke)
+	if s, ok := status.FromError(broke); ok && s.Code() == codes.InvalidArgument {
+		return broke
+	}
+
+	reply := importRPCStatus(p.imp)
+	if p.queued && !reply.Finished {
+		reply.Message = "Outside the import window, the rows will be loaded when it opens at " + p.startsAt.Format(time.RFC3339)
+	}
+	return stream.SendMsg(&importStatusMessage{reply})
+}
+
+// wireCodec encodes the messages of this file; grpc knows it as proto, the
+// codec clients use.
+type wireCodec struct{}
+
+type wireMarshaler interface{ marshal() []byte }
+
+type wireUnmarshaler interface{ unmarshal(b []byte) error }
+
+func (wireCodec) Name() string { return "proto" }
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot encode %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(wireUnmarshaler)
+	if !ok {
+		return fmt.Errorf("grpc: cannot decode %T", v)
+	}
+	return m.unmarshal(b)
+}
+
+// readFields calls field with each field of a message and the bytes after
+// its tag. field returns how many of them it consumed, or 0 to skip a field
+// it does not know.
+func readFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func readString(typ protowire.Type, b []byte, dst *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*dst = v
+	}
+	return n
+}
+
+func readBool(typ protowire.Type, b []byte, dst *bool) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*dst = protowire.DecodeBool(v)
+	}
+	return n
+}
+
+// readBytes copies the bytes out, grpc may reuse its buffer.
+func readBytes(typ protowire.Type, b []byte, dst *[]byte) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*dst = append([]byte(nil), v...)
+	}
+	return n
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// streamRowsRequest is a StreamRowsRequest; params is nil when the message
+// carries none.
+type streamRowsRequest struct {
+	params *rpcImportParams
+	rows   [][]string
+	chunk  []byte
+}
+
+func (m *streamRowsRequest) unmarshal(b []byte) error {
+	*m = streamRowsRequest{}
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var raw []byte
+		n := readBytes(typ, b, &raw)
+		if n <= 0 {
+			return n
+		}
+		switch num {
+		case 1:
+			m.params = &rpcImportParams{}
+			if err := readImportParams(raw, m.params); err != nil {
+				return -1
+			}
+		case 2:
+			var row []string
+			err := readFields(raw, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				var v string
+				n := 0
+				if num == 1 {
+					n = readString(typ, b, &v)
+				}
+				if n > 0 {
+					row = append(row, v)
+				}
+				return n
+			})
+			if err != nil {
+				return -1
+			}
+			m.rows = append(m.rows, row)
+		case 3:
+			m.chunk = raw
+		default:
+			return 0
+		}
+		return n
+	})
+}
+
+func readImportParams(b []byte, p *rpcImportParams) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return readString(typ, b, &p.Month)
+		case 2:
+			return readString(typ, b, &p.Year)
+		case 3:
+			return readString(typ, b, &p.Mapping)
+		case 4:
+			return readString(typ, b, &p.Template)
+		case 5:
+			return readString(typ, b, &p.Source)
+		case 6:
+			return readString(typ, b, &p.Mode)
+		case 7:
+			return readBool(typ, b, &p.Strict)
+		case 8:
+			return readBool(typ, b, &p.Transaction)
+		case 9:
+			return readString(typ, b, &p.Priority)
+		case 10:
+			return readString(typ, b, &p.Existing)
+		case 11:
+			return readString(typ, b, &p.Tenant)
+		case 12:
+			return readString(typ, b, &p.Target)
+		case 13:
+			return readString(typ, b, &p.Delimiter)
+		case 14:
+			return readString(typ, b, &p.ImportID)
+		case 15:
+			return readString(typ, b, &p.Format)
+		case 16:
+			return readString(typ, b, &p.Filename)
+		case 17:
+			return readString(typ, b, &p.PeriodCheck)
+		case 18:
+			return readString(typ, b, &p.MaxOutside)
+		}
+		return 0
+	})
+}
+
+type getStatusRequest struct {
+	importID string
+}
+
+func (m *getStatusRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return readString(typ, b, &m.importID)
+		}
+		return 0
+	})
+}
+
+type cancelImportRequest struct {
+	importID string
+	reason   string
+}
+
+func (m *cancelImportRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return readString(typ, b, &m.importID)
+		case 2:
+			return readString(typ, b, &m.reason)
+		}
+		return 0
+	})
+}
+
+type importStatusMessage struct {
+	rpcImportStatus
+}
+
+func (m *importStatusMessage) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.ImportID)
+	b = appendString(b, 2, m.State)
+	b = appendString(b, 3, m.Status)
+	b = appendInt(b, 4, m.RowsRead)
+	b = appendInt(b, 5, m.Inserted)
+	b = appendInt(b, 6, m.Rejected)
+	b = appendString(b, 7, m.Message)
+	if m.Finished {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if len(m.Report) > 0 {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Report)
+	}
+	return b
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// share of header fields that must match for a row to count as a repeated
+// header; concatenated exports sometimes rename or reorder a column or two
+const repeatedHeaderMatch = 0.8
+
+// headerMatcher recognises copies of the first header line further down the
+// file, as found in exports that were concatenated from several parts.
+type headerMatcher struct {
+	fields []string
+}
+
+func newHeaderMatcher(header []string) *headerMatcher {
+	fields := make([]string, len(header))
+	for i, f := range header {
+		fields[i] = normalizeHeaderField(f)
+	}
+	return &headerMatcher{fields: fields}
+}
+
+func normalizeHeaderField(f string) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(f, "\ufeff")), `"'`)
+}
+
+// matches reports whether row is the header again, exactly or with at least
+// repeatedHeaderMatch of its fields equal ignoring case, spaces, quotes and a
+// byte-order mark. Data rows usually differ in the first fields, so this gives
+// up early.
+func (h *headerMatcher) matches(row []string) bool {
+	if len(h.fields) == 0 || len(row) != len(h.fields) {
+		return false
+	}
+
+	allowed := len(h.fields) - int(math.Ceil(float64(len(h.fields))*repeatedHeaderMatch))
+	mismatches := 0
+	for i, f := range row {
+		if !strings.EqualFold(normalizeHeaderField(f), h.fields[i]) {
+			mismatches++
+			if mismatches > allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fieldCount returns why row does not have the fields of the header, empty
+// when it has. Longer rows are fine when their extra fields are kept.
+func (h *headerMatcher) fieldCount(row []string, extras bool) string {
+	if len(row) < len(h.fields) || len(row) > len(h.fields) && !extras {
+		return fmt.Sprintf("%d fields, header has %d", len(row), len(h.fields))
+	}
+	return ""
+}
+
+// padRow returns row with empty fields up to n, so a short row can still be
+// converted for its reject.
+func padRow(row []string, n int) []string {
+	if len(row) >= n {
+		return row
+	}
+	return append(append(make([]string, 0, n), row...), make([]string, n-len(row))...)
+}
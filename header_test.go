@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCSVReaderKeepsReadingPastShortRows(t *testing.T) {
+	reader := newCSVRowReader(strings.NewReader("a;b;c\n1;2;3\n4;5\n6;7;8\n"), &Import{})
+	header, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHeaderMatcher(header)
+
+	var malformed, loaded []string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading past a short row: %v", err)
+		}
+		if h.fieldCount(row, false) != "" {
+			malformed = append(malformed, strings.Join(row, ";"))
+		} else {
+			loaded = append(loaded, strings.Join(row, ";"))
+		}
+	}
+	if strings.Join(malformed, ",") != "4;5" || strings.Join(loaded, ",") != "1;2;3,6;7;8" {
+		t.Fatalf("malformed %v, loaded %v", malformed, loaded)
+	}
+}
+
+func TestFieldCount(t *testing.T) {
+	h := newHeaderMatcher([]string{"a", "b"})
+	for _, tc := range []struct {
+		row    []string
+		extras bool
+		ok     bool
+	}{
+		{[]string{"1", "2"}, false, true},
+		{[]string{"1"}, true, false},
+		{[]string{"1", "2", "3"}, false, false},
+		{[]string{"1", "2", "3"}, true, true},
+	} {
+		if got := h.fieldCount(tc.row, tc.extras) == ""; got != tc.ok {
+			t.Errorf("fieldCount(%v, extras=%v) ok = %v, want %v", tc.row, tc.extras, got, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SQLStep is one configured statement run around an import.
+type SQLStep struct {
+	Statement string  `json:"statement"`
+	Seconds   float64 `json:"seconds"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// placeholders of the configured statements
+const (
+	sqlTablePlaceholder    = "{table}"
+	sqlImportIDPlaceholder = "{import_id}"
+)
+
+// expandSQL fills the placeholders of a configured statement for imp.
+func expandSQL(stmt string, imp *Import) string {
+	return strings.NewReplacer(sqlTablePlaceholder, imp.target(), sqlImportIDPlaceholder, imp.ID).Replace(stmt)
+}
+
+// runSQLSteps runs statements one by one and appends their outcome to steps.
+// With stopOnError the first failure ends the run and is returned, otherwise
+// a failing statement is only recorded and the next one still runs.
+func runSQLSteps(dbPool *pgxpool.Pool, imp *Import, statements []string, steps *[]SQLStep, stopOnError bool) error {
+	ctx := context.Background()
+	for _, stmt := range statements {
+		stmt = expandSQL(stmt, imp)
+		started := time.Now()
+
+		step := SQLStep{Statement: stmt}
+		_, err := dbPool.Exec(ctx, stmt)
+		if err != nil {
+			log.Println("Import", imp.ID, "statement failed:", stmt, err)
+			step.Error = err.Error()
+		}
+		step.Seconds = seconds(time.Since(started))
+
+		imp.mu.Lock()
+		*steps = append(*steps, step)
+		imp.mu.Unlock()
+
+		if err != nil && stopOnError {
+			return fmt.Errorf("statement %q failed: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// runPreImportHooks runs pre_import_sql before anything is loaded. A failing
+// hook aborts the import.
+func runPreImportHooks(dbPool *pgxpool.Pool, imp *Import, statements []string) error {
+	if err := runSQLSteps(dbPool, imp, statements, &imp.preHooks, true); err != nil {
+		return fmt.Errorf("pre-import hook: %w", err)
+	}
+	return nil
+}
+
+// runPostImportHooks runs post_import_sql after every import whose pre-import
+// hooks ran, failed ones included, so hooks can undo what the pre-import
+// hooks set up.
+func runPostImportHooks(dbPool *pgxpool.Pool, imp *Import, statements []string) {
+	runSQLSteps(dbPool, imp, statements, &imp.postHooks, false)
+}
+
+// runMaintenance runs ANALYZE when asked and then maintenance_sql on the
+// target of an import that loaded rows, so reports on the new data get fresh
+// statistics right away. The import stays successful when a statement fails.
+func runMaintenance(dbPool *pgxpool.Pool, imp *Import, statements []string) {
+	r := imp.report()
+	if r.Status == importStatusFailed || r.RolledBack || r.Inserted == 0 {
+		return
+	}
+
+	if imp.Analyze {
+		statements = append([]string{"ANALYZE " + sqlTablePlaceholder}, statements...)
+	}
+	runSQLSteps(dbPool, imp, statements, &imp.maintenance, false)
+}
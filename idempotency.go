@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotentUpload is the upload a key was first used for; imp stays nil while
+// that request is still reading the file and resolving its import.
+type idempotentUpload struct {
+	imp     *Import
+	expires time.Time
+}
+
+// Idempotency-Key values seen on /upload, per caller and key
+var idempotencyKeys = struct {
+	sync.Mutex
+	byKey map[string]*idempotentUpload
+}{byKey: map[string]*idempotentUpload{}}
+
+// claimIdempotencyKey reserves the Idempotency-Key of an upload request. It
+// returns false when the request was answered because the key was used
+// before; otherwise bind attaches the new import to the key and release
+// frees the key again if the request fails before there is an import.
+func claimIdempotencyKey(c *gin.Context) (bind func(*Import), release func(), ok bool) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" {
+		return func(*Import) {}, func() {}, true
+	}
+	if len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": idempotencyHeader + " must be at most 255 characters"})
+		return nil, nil, false
+	}
+	// callers never see each other's imports
+	scoped := requestPrincipal(c) + "\x00" + key
+	now := time.Now()
+
+	idempotencyKeys.Lock()
+	for k, u := range idempotencyKeys.byKey {
+		if u.imp != nil && now.After(u.expires) {
+			delete(idempotencyKeys.byKey, k)
+		}
+	}
+	u, seen := idempotencyKeys.byKey[scoped]
+	if !seen {
+		u = &idempotentUpload{}
+		idempotencyKeys.byKey[scoped] = u
+	}
+	imp := u.imp
+	idempotencyKeys.Unlock()
+
+	if seen {
+		replayUpload(c, imp)
+		return nil, nil, false
+	}
+
+	bind = func(imp *Import) {
+		idempotencyKeys.Lock()
+		u.imp = imp
+		u.expires = now.Add(time.Duration(cfg().IdempotencyTTLHours) * time.Hour)
+		idempotencyKeys.Unlock()
+	}
+	release = func() {
+		idempotencyKeys.Lock()
+		if u.imp == nil && idempotencyKeys.byKey[scoped] == u {
+			delete(idempotencyKeys.byKey, scoped)
+		}
+		idempotencyKeys.Unlock()
+	}
+	return bind, release, true
+}
+
+// replayUpload answers a repeated upload with the import of its first request:
+// the report once it finished, its status while it runs.
+func replayUpload(c *gin.Context, imp *Import) {
+	c.Header("Idempotent-Replayed", "true")
+	if imp == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "The first request with this " + idempotencyHeader + " is still being received"})
+		return
+	}
+
+	select {
+	case <-imp.done:
+		report := imp.report()
+		c.JSON(report.httpStatus(), report)
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"import_id": imp.ID,
+			"status":    imp.status(),
+			"message":   "An import with this " + idempotencyHeader + " is in progress",
+		})
+	}
+}
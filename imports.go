@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var importIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// lifecycle states of an import
+const (
+	importStateQueued   = "queued"
+	importStateRunning  = "running"
+	importStatePaused   = "paused"
+	importStateFinished = "finished"
+)
+
+// registry of imports started by this process, keyed by import id
+var imports = struct {
+	sync.RWMutex
+	byID map[string]*Import
+}{byID: map[string]*Import{}}
+
+// Import tracks the live state of one upload while it is being processed.
+type Import struct {
+	ID             string
+	Month          string
+	Year           string
+	StartedAt      time.Time
+	TotalBytes     int64
+	Strict         bool
+	Transaction    bool
+	Priority       string
+	Mode           string
+	Staged         bool
+	Existing       string
+	RebuildIndexes bool
+	Analyze        bool
+	Schema         string
+	Table          string
+	Tenant         string
+	Database       string
+	Layout         string
+	Format         string
+	FileName       string
+	Checksum       string
+	Principal      string
+	SourceIP       string
+	UserAgent      string
+	APIKey         string
+	// the import whose rejects this one loads again, see handleRetryErrors
+	RetryOf string
+	// the source bundle the parameters came from
+	Source string
+
+	plan         *executionPlan
+	query        string
+	stagingTable string
+	partitions   *partitioner
+	// the reference tables of the lookup columns, read by loadLookups
+	lookups []map[string]interface{}
+	// the control totals sent with the upload and how they compared
+	totals         *controlTotals
+	reconciliation *Reconciliation
+	// the months of the rows, compared with the month of the import
+	period       *periodCounter
+	periodReport *PeriodReport
+	// how the header and the table differ from the mapping
+	drift *SchemaDrift
+	// totals of the anomaly_metrics columns and the anomalies found with them
+	metrics   *metricTotals
+	anomalies []Anomaly
+	// column statistics, kept when the import is profiled
+	profile *profiler
+	// the keys seen so far when the mapping checks duplicates
+	duplicates *duplicateTracker
+	// a plain csv file parsed in ranges, see readRanges
+	parseFile io.ReaderAt
+	parseSize int64
+	// the files of a multi-file import, see loadFiles
+	multiFile  bool
+	inputFiles []importFile
+
+	rowsRead        int64
+	inserted        int64
+	rejected        int64
+	skippedEmpty    int64
+	filtered        int64
+	alreadyLoaded   int64
+	updatedRows     int64
+	emptyCells      int64
+	repeatedHeaders int64
+	trailerRows     int64
+	trailerCount    int64
+	trailerCounted  int32
+	bytesRead       int64
+	batches         int64
+	mirroredRows    int64
+	mirrorFailed    int64
+	publishedRows   int64
+	publishFailed   int64
+
+	// the batch size and batches in flight with adaptive_batch
+	tuner *batchTuner
+
+	// jobs channel sizing and occupancy, see channelStats
+	chanCapacity     int64
+	chanRowBytes     int64
+	chanSends        int64
+	chanBlocked      int64
+	chanBlockedNanos int64
+	chanOccupancy    int64
+	chanMaxOccupancy int64
+
+	mu             sync.Mutex
+	state          string
+	finishedAt     time.Time
+	done           chan struct{}
+	rejects        []RejectedRow
+	rejectsByClass map[string]int64
+	rejectsByCode  map[string]int64
+	parseErrors    map[string]int64
+	suspicious     map[string]int64
+	filteredBy     map[string]int64
+	routedRows     map[string]int64
+	lookupMisses   map[string]int64
+	subscribers    map[chan ImportEvent]struct{}
+	abortReason    string
+	rolledBack     bool
+	limitExceeded  bool
+	targetBusy     bool
+	retries        []string
+	promotedAt     time.Time
+	revertedAt     time.Time
+	droppedIndexes []droppedIndex
+	indexRebuild   *IndexRebuild
+	preHooks       []SQLStep
+	postHooks      []SQLStep
+	maintenance    []SQLStep
+	viewRefreshes  []ViewRefresh
+	files          []FileReport
+	// closed by resume while the import is paused through the api, and by
+	// unpreempt while it lent its slot to an import of a higher priority
+	resumed   chan struct{}
+	preempted chan struct{}
+	// set while the reader waits for the next import window
+	outsideWindow    bool
+	pausedAt         time.Time
+	stateBeforePause string
+	// the file of a multi-file import being read
+	currentFile string
+	// leading lines and columns of a csv file left out
+	skipRows    int
+	skipColumns int
+	// field delimiter of a csv file, 0 until sniffed
+	delimiter        rune
+	delimiterSniffed bool
+	deviations       *DeviationReport
+	// cancelled by cancel, see runContext
+	runCtx    context.Context
+	cancelRun context.CancelFunc
+
+	// the import span and a context carrying it, see startTrace
+	trace context.Context
+	span  traceSpan
+}
+
+// ImportProgress is a point-in-time snapshot of an import.
+type ImportProgress struct {
+	ImportID   string      `json:"import_id"`
+	RowsRead   int64       `json:"rows_read"`
+	Inserted   int64       `json:"inserted"`
+	Rejected   int64       `json:"rejected"`
+	BytesRead  int64       `json:"bytes_read"`
+	TotalBytes int64       `json:"total_bytes"`
+	RowsPerSec float64     `json:"rows_per_sec"`
+	ETASeconds float64     `json:"eta_seconds"`
+	State      string      `json:"state"`
+	Lock       *LockStatus `json:"lock,omitempty"`
+	Priority   string      `json:"priority,omitempty"`
+	// place among the imports waiting for max_running_imports
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Channel       *ChannelStats `json:"channel,omitempty"`
+	Batching      *BatchTuning  `json:"batching,omitempty"`
+	Finished      bool          `json:"finished"`
+}
+
+var errImportIDTaken = errors.New("import id is in use")
+
+// registerImport makes imp findable by its id. A caller supplied id is used
+// when valid so that clients can subscribe to progress before the upload
+// request returns; it may only take over the id of a finished import of the
+// same tenant, as a retried upload does.
+func registerImport(imp *Import) error {
+	imports.Lock()
+	defer imports.Unlock()
+	if previous, ok := imports.byID[imp.ID]; ok {
+		switch {
+		case !previous.finished():
+			return fmt.Errorf("%w by an import that has not finished: %s", errImportIDTaken, imp.ID)
+		case previous.Tenant != imp.Tenant:
+			return fmt.Errorf("%w by another tenant: %s", errImportIDTaken, imp.ID)
+		}
+	}
+	evictFinishedImports(time.Now())
+	imports.byID[imp.ID] = imp
+	return nil
+}
+
+// evictFinishedImports forgets the imports that finished more than
+// finished_import_ttl_hours ago; imports must be locked.
+func evictFinishedImports(now time.Time) {
+	ttl := time.Duration(cfg().FinishedImportTTLHours) * time.Hour
+	for id, imp := range imports.byID {
+		imp.mu.Lock()
+		finishedAt := imp.finishedAt
+		imp.mu.Unlock()
+		if !finishedAt.IsZero() && now.Sub(finishedAt) > ttl {
+			delete(imports.byID, id)
+		}
+	}
+}
+
+func (imp *Import) finished() bool {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	return !imp.finishedAt.IsZero()
+}
+
+// undone reports whether the rows of imp were taken out again, by a rollback
+// of its replace or of its transaction.
+func (imp *Import) undone() bool {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	return imp.rolledBack || !imp.revertedAt.IsZero()
+}
+
+// allocImport creates an import without registering it, as the chunks
+// distributed workers load on behalf of an import of another node are.
+func allocImport(id string, date *DateParams, plan *executionPlan, query string, totalBytes int64) *Import {
+	if !importIDPattern.MatchString(id) {
+		id = generateImportID()
+	}
+
+	imp := &Import{
+		ID:         id,
+		Month:      date.Month,
+		Year:       date.Year,
+		StartedAt:  time.Now(),
+		TotalBytes: totalBytes,
+
+		plan:           plan,
+		query:          query,
+		state:          importStateRunning,
+		done:           make(chan struct{}),
+		rejectsByClass: map[string]int64{},
+		rejectsByCode:  map[string]int64{},
+		parseErrors:    map[string]int64{},
+		suspicious:     map[string]int64{},
+		filteredBy:     map[string]int64{},
+		routedRows:     map[string]int64{},
+		lookupMisses:   map[string]int64{},
+		subscribers:    map[chan ImportEvent]struct{}{},
+	}
+	if plan.duplicates != nil {
+		imp.duplicates = newDuplicateTracker(cfg().DuplicateKeysMax)
+	}
+	return imp
+}
+
+func generateImportID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+func findImport(id string) (*Import, bool) {
+	imports.RLock()
+	defer imports.RUnlock()
+	imp, ok := imports.byID[id]
+	return imp, ok
+}
+
+// abort records why an import was stopped; only the first reason is kept.
+func (imp *Import) abort(reason error) {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.abortReason == "" {
+		imp.abortReason = reason.Error()
+		imp.limitExceeded = errors.Is(reason, errLimitExceeded)
+		imp.targetBusy = errors.Is(reason, errTargetBusy)
+	}
+}
+
+// abortedWith returns why imp was aborted, empty while it was not.
+func (imp *Import) abortedWith() string {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	return imp.abortReason
+}
+
+// setStatus moves the import to state and returns the previous state.
+func (imp *Import) setStatus(state string) string {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	previous := imp.state
+	imp.state = state
+	return previous
+}
+
+func (imp *Import) status() string {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	return imp.state
+}
+
+// finishHooks run once when an import finishes, successful or not.
+var finishHooks []func(*Import)
+
+func (imp *Import) finish() {
+	imp.mu.Lock()
+	first := imp.finishedAt.IsZero()
+	if first {
+		imp.finishedAt = time.Now()
+		imp.state = importStateFinished
+		close(imp.done)
+	}
+	imp.mu.Unlock()
+
+	if first {
+		for _, hook := range finishHooks {
+			hook(imp)
+		}
+	}
+}
+
+func (imp *Import) progress() ImportProgress {
+	imp.mu.Lock()
+	finishedAt, state := imp.finishedAt, imp.state
+	imp.mu.Unlock()
+
+	p := ImportProgress{
+		State:      state,
+		ImportID:   imp.ID,
+		RowsRead:   atomic.LoadInt64(&imp.rowsRead),
+		Inserted:   atomic.LoadInt64(&imp.inserted),
+		Rejected:   atomic.LoadInt64(&imp.rejected),
+		BytesRead:  atomic.LoadInt64(&imp.bytesRead),
+		TotalBytes: imp.TotalBytes,
+		Priority:   imp.Priority,
+		Finished:   !finishedAt.IsZero(),
+		Channel:    imp.channelStats(),
+		Batching:   imp.batchTuning(),
+	}
+	if !p.Finished {
+		p.Lock = lockStatus(imp.lockKey(), imp.ID)
+		p.QueuePosition = slotQueuePosition(imp.ID)
+	}
+
+	end := time.Now()
+	if p.Finished {
+		end = finishedAt
+	}
+	elapsed := end.Sub(imp.StartedAt).Seconds()
+	if elapsed > 0 {
+		p.RowsPerSec = float64(p.Inserted+p.Rejected) / elapsed
+	}
+
+	// the file is read ahead of the inserts, so estimate from processed rows
+	// over the share of the file already consumed
+	if !p.Finished && p.BytesRead > 0 && p.TotalBytes > 0 && p.RowsRead > 0 && p.RowsPerSec > 0 {
+		expectedRows := float64(p.RowsRead) * float64(p.TotalBytes) / float64(p.BytesRead)
+		remaining := expectedRows - float64(p.Inserted+p.Rejected)
+		if remaining > 0 {
+			p.ETASeconds = remaining / p.RowsPerSec
+		}
+	}
+
+	return p
+}
+
+// countingReader records how many bytes of the upload have been consumed.
+type countingReader struct {
+	r   io.Reader
+	imp *Import
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.imp.bytesRead, int64(n))
+	return n, err
+}
+
+// handleImportProgress streams progress snapshots as Server-Sent Events until
+// the import finishes or the client goes away.
+func handleImportProgress(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("progress", imp.progress())
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-imp.done:
+			c.SSEvent("done", imp.progress())
+			return false
+		case <-ticker.C:
+			c.SSEvent("progress", imp.progress())
+			return true
+		}
+	})
+}
+
+// handleImportStatus returns the state of an import, with its report once it
+// has finished.
+func handleImportStatus(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	resp := gin.H{"progress": imp.progress()}
+	select {
+	case <-imp.done:
+		resp["report"] = imp.report()
+	default:
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
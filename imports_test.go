@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterImport(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	plan := &executionPlan{}
+	running := allocImport("dup-running", &DateParams{}, plan, "", 0)
+	if err := registerImport(running); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forgetImport(running.ID) })
+
+	again := allocImport("dup-running", &DateParams{}, plan, "", 0)
+	if err := registerImport(again); !errors.Is(err, errImportIDTaken) {
+		t.Fatalf("registering a running id again: %v, want errImportIDTaken", err)
+	}
+	if imp, _ := findImport("dup-running"); imp != running {
+		t.Fatal("the running import was replaced")
+	}
+
+	finishedAgo(running, 0)
+	other := allocImport("dup-running", &DateParams{}, plan, "", 0)
+	other.Tenant = "other"
+	if err := registerImport(other); !errors.Is(err, errImportIDTaken) {
+		t.Fatalf("taking over the id of another tenant: %v, want errImportIDTaken", err)
+	}
+	if err := registerImport(again); err != nil {
+		t.Fatalf("retrying the id of a finished import: %v", err)
+	}
+	if imp, _ := findImport("dup-running"); imp != again {
+		t.Fatal("the retry did not take over the id")
+	}
+}
+
+func TestEvictFinishedImports(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	plan := &executionPlan{}
+	old := allocImport("evict-old", &DateParams{}, plan, "", 0)
+	recent := allocImport("evict-recent", &DateParams{}, plan, "", 0)
+	running := allocImport("evict-running", &DateParams{}, plan, "", 0)
+	for _, imp := range []*Import{old, recent, running} {
+		if err := registerImport(imp); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { forgetImport(imp.ID) })
+	}
+	finishedAgo(old, 25*time.Hour)
+	finishedAgo(recent, time.Hour)
+
+	imports.Lock()
+	evictFinishedImports(time.Now())
+	imports.Unlock()
+
+	if _, ok := findImport(old.ID); ok {
+		t.Error("an import finished 25 hours ago is kept")
+	}
+	for _, imp := range []*Import{recent, running} {
+		if _, ok := findImport(imp.ID); !ok {
+			t.Errorf("%s was evicted", imp.ID)
+		}
+	}
+}
+
+// finishedAgo marks imp finished d ago without running the finish hooks.
+func finishedAgo(imp *Import, d time.Duration) {
+	imp.mu.Lock()
+	imp.finishedAt = time.Now().Add(-d)
+	imp.state = importStateFinished
+	imp.mu.Unlock()
+}
+
+func forgetImport(id string) {
+	imports.Lock()
+	delete(imports.byID, id)
+	imports.Unlock()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// IndexRebuild reports the indexes dropped for the load and how long dropping
+// and recreating them took.
+type IndexRebuild struct {
+	Dropped        []string `json:"dropped"`
+	DropSeconds    float64  `json:"drop_seconds"`
+	RebuildSeconds float64  `json:"rebuild_seconds"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// droppedIndex is an index removed before the load with the statement that
+// recreates it. kept is set when the statement is also in index_table.
+type droppedIndex struct {
+	name string
+	def  string
+	kept bool
+}
+
+// indexTableDDL keeps the definitions of the indexes dropped from a live
+// table until they are rebuilt, in the database of the table, so a crash
+// during the load does not lose them.
+const indexTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	index_name text PRIMARY KEY,
+	table_name text NOT NULL,
+	definition text NOT NULL,
+	import_id  text NOT NULL,
+	dropped_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// indexes that only speed up reads: primary keys, unique indexes and indexes
+// backing a constraint stay, so rows are still rejected one by one
+const droppableIndexesQuery = `SELECT x.indexrelid::regclass::text, pg_get_indexdef(x.indexrelid)
+	FROM pg_index x
+	WHERE x.indrelid = $1::regclass AND NOT x.indisprimary AND NOT x.indisunique
+	AND NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conindid = x.indexrelid)
+	ORDER BY 1`
+
+// loadTable is the table the rows of imp are inserted into.
+func (imp *Import) loadTable() string {
+	if imp.stagingTable != "" {
+		return imp.stagingTable
+	}
+	return imp.target()
+}
+
+// dropIndexes removes the droppable indexes of the load table and remembers
+// their definitions for rebuildIndexes. Those of the live table are written
+// to index_table first; indexes left there by an import that never rebuilt
+// them are recreated before.
+func dropIndexes(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	table := imp.loadTable()
+	started := time.Now()
+
+	keep := table == imp.target()
+	if keep {
+		if err := ensureTable(ctx, dbPool, cfg().IndexTable, indexTableDDL); err != nil {
+			return fmt.Errorf("failed to create %s: %w", cfg().IndexTable, err)
+		}
+		if err := restoreDroppedIndexes(ctx, dbPool, table); err != nil {
+			return err
+		}
+	}
+
+	rows, err := dbPool.Query(ctx, droppableIndexesQuery, table)
+	if err != nil {
+		return fmt.Errorf("failed to list indexes of %s: %w", table, err)
+	}
+	var indexes []droppedIndex
+	for rows.Next() {
+		var idx droppedIndex
+		if err := rows.Scan(&idx.name, &idx.def); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list indexes of %s: %w", table, err)
+		}
+		indexes = append(indexes, idx)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list indexes of %s: %w", table, err)
+	}
+
+	rebuild := &IndexRebuild{Dropped: []string{}}
+	imp.mu.Lock()
+	imp.indexRebuild = rebuild
+	imp.mu.Unlock()
+
+	for _, idx := range indexes {
+		if keep {
+			if _, err := dbPool.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (index_name, table_name, definition, import_id) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (index_name) DO UPDATE SET table_name = EXCLUDED.table_name, definition = EXCLUDED.definition, import_id = EXCLUDED.import_id, dropped_at = now()`,
+				cfg().IndexTable), idx.name, table, idx.def, imp.ID); err != nil {
+				return fmt.Errorf("failed to keep the definition of index %s: %w", idx.name, err)
+			}
+			idx.kept = true
+		}
+		if _, err := dbPool.Exec(ctx, "DROP INDEX "+idx.name); err != nil {
+			return fmt.Errorf("failed to drop index %s: %w", idx.name, err)
+		}
+		imp.mu.Lock()
+		imp.droppedIndexes = append(imp.droppedIndexes, idx)
+		rebuild.Dropped = append(rebuild.Dropped, idx.name)
+		imp.mu.Unlock()
+	}
+
+	imp.mu.Lock()
+	rebuild.DropSeconds = seconds(time.Since(started))
+	imp.mu.Unlock()
+
+	log.Println("=> import", imp.ID, "dropped", len(indexes), "indexes of", table)
+	return nil
+}
+
+// rebuildIndexes recreates the indexes dropped by dropIndexes. Indexes of the
+// live table are built concurrently so reads and writes go on meanwhile; the
+// staging table of a staged append is dropped anyway and gets none back.
+// Every index is attempted even after a failure, the first error is returned.
+func rebuildIndexes(dbPool *pgxpool.Pool, imp *Import) error {
+	imp.mu.Lock()
+	indexes, rebuild := imp.droppedIndexes, imp.indexRebuild
+	imp.droppedIndexes = nil
+	imp.mu.Unlock()
+
+	if len(indexes) == 0 || imp.Staged {
+		return nil
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	var firstErr error
+	for _, idx := range indexes {
+		stmt := idx.def
+		if imp.Mode == importModeAppend {
+			stmt = strings.Replace(stmt, "CREATE INDEX ", "CREATE INDEX CONCURRENTLY ", 1)
+		}
+		if _, err := dbPool.Exec(ctx, stmt); err != nil {
+			log.Println("Import", imp.ID, "failed to rebuild index", idx.name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to rebuild index %s: %w", idx.name, err)
+			}
+		}
+		// a failed rebuild is in the report, it is not attempted again
+		if idx.kept {
+			if _, err := dbPool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE index_name = $1 AND import_id = $2", cfg().IndexTable), idx.name, imp.ID); err != nil {
+				log.Println("Import", imp.ID, "failed to forget index", idx.name, err)
+			}
+		}
+	}
+
+	imp.mu.Lock()
+	rebuild.RebuildSeconds = seconds(time.Since(started))
+	if firstErr != nil {
+		rebuild.Error = firstErr.Error()
+	}
+	imp.mu.Unlock()
+
+	log.Println("=> import", imp.ID, "rebuilt", len(indexes), "indexes in", time.Since(started))
+	return firstErr
+}
+
+// restoreDroppedIndexes recreates the indexes of table kept in index_table
+// that do not exist, concurrently as rebuildIndexes does, and forgets them.
+// The caller holds the table like an import dropping its indexes does.
+func restoreDroppedIndexes(ctx context.Context, dbPool *pgxpool.Pool, table string) error {
+	// the indexes of a table dropped since are only forgotten
+	rows, err := dbPool.Query(ctx, fmt.Sprintf("SELECT index_name, definition, import_id, to_regclass(index_name) IS NOT NULL OR to_regclass(table_name) IS NULL FROM %s WHERE table_name = $1 ORDER BY 1", cfg().IndexTable), table)
+	if err != nil {
+		return fmt.Errorf("failed to read the dropped indexes of %s: %w", table, err)
+	}
+	type leftover struct {
+		droppedIndex
+		importID string
+		done     bool
+	}
+	var leftovers []leftover
+	for rows.Next() {
+		var l leftover
+		if err := rows.Scan(&l.name, &l.def, &l.importID, &l.done); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read the dropped indexes of %s: %w", table, err)
+		}
+		leftovers = append(leftovers, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read the dropped indexes of %s: %w", table, err)
+	}
+
+	for _, l := range leftovers {
+		if !l.done {
+			stmt := strings.Replace(l.def, "CREATE INDEX ", "CREATE INDEX CONCURRENTLY ", 1)
+			if _, err := dbPool.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to restore index %s dropped by import %s: %w", l.name, l.importID, err)
+			}
+			log.Println("=> restored index", l.name, "of", table, "dropped by import", l.importID)
+		}
+		if _, err := dbPool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE index_name = $1", cfg().IndexTable), l.name); err != nil {
+			return fmt.Errorf("failed to forget index %s: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+// restoreIndexes recreates at startup the indexes imports dropped from live
+// tables and never rebuilt, in every database imports load into. Each table
+// is held like an import rebuilding its indexes holds it, and skipped while
+// an import of another instance holds its advisory lock.
+func restoreIndexes(settings *Config) {
+	ctx := context.Background()
+	for _, d := range loadDatabases(settings) {
+		dbPool, releasePool, err := acquireImportPool(d.tenant, d.target)
+		if err != nil {
+			log.Println("Indexes not restored:", err)
+			continue
+		}
+		var tables []string
+		rows, err := dbPool.Query(ctx, fmt.Sprintf("SELECT DISTINCT table_name FROM %s", settings.IndexTable))
+		if err == nil {
+			tables, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+		// no index was ever dropped in this database when it is missing
+		if err != nil && !undefinedTable(err) {
+			log.Println("Indexes not restored:", err)
+		}
+		for _, table := range tables {
+			if err := restoreTableIndexes(ctx, dbPool, d.lockKey(table), table, settings.ImportLock != ""); err != nil {
+				log.Println("Indexes not restored:", err)
+			}
+		}
+		releasePool()
+	}
+}
+
+// restoreTableIndexes is restoreIndexes for one table, key being its lockKey.
+func restoreTableIndexes(ctx context.Context, dbPool *pgxpool.Pool, key, table string, advisory bool) error {
+	release, err := lockTarget(ctx, key, "restore-indexes", true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if advisory {
+		conn, err := dbPool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtextextended($1, 0))", table).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			log.Println("=> indexes of", table, "left alone, an import holds the table")
+			return nil
+		}
+		defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtextextended($1, 0))", table)
+	}
+
+	return restoreDroppedIndexes(ctx, dbPool, table)
+}
+
+func seconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formats of the files an import reads
+const (
+	inputFormatCSV  = "csv"
+	inputFormatJSON = "json"
+)
+
+// rowReader returns the fields of a file one row at a time, the header first.
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+type inputFormatSpec struct {
+	name string
+	// other names of the format parameter
+	aliases []string
+	// content types the format is recognised by
+	mediaTypes []string
+	// binary files have no lines, so their row length is not limited
+	binary    bool
+	newReader func(r io.Reader, imp *Import) rowReader
+}
+
+// input formats compiled into this binary, by name
+var inputFormats = map[string]*inputFormatSpec{}
+
+func registerInputFormat(f *inputFormatSpec) {
+	inputFormats[f.name] = f
+}
+
+func inputFormatNames() []string {
+	names := make([]string, 0, len(inputFormats))
+	for name := range inputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerInputFormat(&inputFormatSpec{
+		name:       inputFormatCSV,
+		mediaTypes: []string{"text/csv"},
+		newReader:  newCSVRowReader,
+	})
+	// json covers both a json array of objects and newline-delimited objects
+	registerInputFormat(&inputFormatSpec{
+		name:       inputFormatJSON,
+		aliases:    []string{"ndjson", "jsonl"},
+		mediaTypes: []string{"application/json", "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines"},
+		newReader: func(r io.Reader, imp *Import) rowReader {
+			return newJSONRowReader(r, imp.plan)
+		},
+	})
+}
+
+// inputFormat returns the format of an import from the format parameter, or
+// else from the content type of the file, csv when neither names one.
+func inputFormat(param, contentType string) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, f := range inputFormats {
+		if param == "" {
+			for _, t := range f.mediaTypes {
+				if t == mediaType {
+					return f.name, nil
+				}
+			}
+			continue
+		}
+		for _, name := range append([]string{f.name}, f.aliases...) {
+			if strings.EqualFold(param, name) {
+				return f.name, nil
+			}
+		}
+	}
+	if param != "" {
+		return "", fmt.Errorf("format must be one of %v", inputFormatNames())
+	}
+	return inputFormatCSV, nil
+}
+
+// newRowReader reads r in the format of imp, without the columns it skips.
+func (imp *Import) newRowReader(r io.Reader) rowReader {
+	reader := inputFormats[imp.Format].newReader(r, imp)
+	if imp.skipColumns > 0 {
+		return columnOffsetReader{rowReader: reader, n: imp.skipColumns}
+	}
+	return reader
+}
+
+// columnOffsetReader drops the first n fields of every row, the leading
+// columns some exports put before the data.
+type columnOffsetReader struct {
+	rowReader
+	n int
+}
+
+func (r columnOffsetReader) Read() ([]string, error) {
+	row, err := r.rowReader.Read()
+	return dropColumns(row, r.n), err
+}
+
+func dropColumns(row []string, n int) []string {
+	if len(row) <= n {
+		return row[:0]
+	}
+	return row[n:]
+}
+
+// parseSkip reads the skip_rows or skip_columns parameter name, 0 when empty.
+func parseSkip(name, v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a count", name)
+	}
+	return n, nil
+}
+
+// skipLines discards the first n lines of input, the title banners and report
+// metadata before the header of some exports.
+func skipLines(input *bufio.Reader, n int) {
+	for ; n > 0; n-- {
+		for {
+			_, err := input.ReadSlice('\n')
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return
+			}
+		}
+	}
+}
+
+// binaryInput reports whether the file of imp is in a binary format.
+func (imp *Import) binaryInput() bool {
+	return inputFormats[imp.Format].binary
+}
+
+func newCSVRowReader(r io.Reader, imp *Import) rowReader {
+	reader := csv.NewReader(r)
+	reader.Comma = imp.comma()
+	// field counts are checked row by row, so one short row does not end the
+	// read
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// jsonRowReader turns json objects into rows of the file fields of a mapping,
+// found by name or alias like header fields. The first row is the names of
+// the fields. Keys the mapping does not know are ignored; strings are taken
+// as they are, null as an empty field and other values as their json text.
+type jsonRowReader struct {
+	plan   *executionPlan
+	fields map[string]int
+	header bool
+
+	// the objects of an array are decoded one by one, newline-delimited ones
+	// line by line
+	array   *json.Decoder
+	lines   *bufio.Reader
+	started bool
+}
+
+func newJSONRowReader(r io.Reader, plan *executionPlan) *jsonRowReader {
+	fields := map[string]int{}
+	for i := range plan.fields {
+		for _, name := range append([]string{plan.fields[i]}, plan.aliases[i]...) {
+			if _, ok := fields[headerKey(name)]; !ok {
+				fields[headerKey(name)] = i
+			}
+		}
+	}
+	return &jsonRowReader{plan: plan, fields: fields, lines: bufio.NewReader(r)}
+}
+
+func (j *jsonRowReader) Read() ([]string, error) {
+	if !j.header {
+		j.header = true
+		return append([]string(nil), j.plan.fields...), nil
+	}
+	if !j.started {
+		j.started = true
+		if err := j.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	var object map[string]json.RawMessage
+	if j.array != nil {
+		if !j.array.More() {
+			return nil, io.EOF
+		}
+		if err := j.array.Decode(&object); err != nil {
+			return nil, err
+		}
+	} else {
+		for object == nil {
+			line, err := j.lines.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				if jsonErr := json.Unmarshal(line, &object); jsonErr != nil {
+					return nil, fmt.Errorf("json line: %w", jsonErr)
+				}
+				if object == nil {
+					object = map[string]json.RawMessage{}
+				}
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	row := make([]string, len(j.plan.fields))
+	for key, raw := range object {
+		i, ok := j.fields[headerKey(key)]
+		if !ok {
+			continue
+		}
+		row[i] = jsonField(raw)
+	}
+	return row, nil
+}
+
+// start finds out whether the input is an array, skipping a byte order mark.
+func (j *jsonRowReader) start() error {
+	for {
+		r, _, err := j.lines.ReadRune()
+		if err != nil {
+			return err
+		}
+		switch {
+		case r == '\ufeff' || r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			continue
+		case r == '[':
+			if err := j.lines.UnreadRune(); err != nil {
+				return err
+			}
+			// the decoder reads the bracket itself to know it is in an array
+			j.array = json.NewDecoder(j.lines)
+			_, err = j.array.Token()
+			return err
+		}
+		return j.lines.UnreadRune()
+	}
+}
+
+func jsonField(raw json.RawMessage) string {
+	var s string
+	switch {
+	case bytes.Equal(raw, []byte("null")):
+		return ""
+	case json.Unmarshal(raw, &s) == nil:
+		return s
+	}
+	return string(raw)
+}
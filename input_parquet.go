@@ -0,0 +1,219 @@
+//go:build parquet
+
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquet files need github.com/parquet-go/parquet-go, so they are only read
+// with `-tags parquet`. The footer of a parquet file is at its end, so the
+// file is spooled to disk before the first row is read.
+func init() {
+	registerInputFormat(&inputFormatSpec{
+		name:       "parquet",
+		mediaTypes: []string{"application/vnd.apache.parquet", "application/x-parquet"},
+		binary:     true,
+		newReader: func(r io.Reader, imp *Import) rowReader {
+			return &parquetRowReader{src: r, plan: imp.plan}
+		},
+	})
+}
+
+// rows read from a row group at a time
+const parquetReadRows = 256
+
+// a leaf column of a parquet file and the file field it fills, -1 for none
+type parquetColumn struct {
+	field  int
+	typ    parquet.Type
+	layout string
+}
+
+// parquetRowReader turns the rows of a parquet file into rows of the file
+// fields of a mapping, the columns being matched by name or alias like
+// header fields. Dates and timestamps are written in the layout of their
+// column, so they parse like csv values.
+type parquetRowReader struct {
+	src  io.Reader
+	plan *executionPlan
+
+	spool   *os.File
+	columns []parquetColumn
+	groups  []parquet.RowGroup
+	rows    parquet.Rows
+	buf     []parquet.Row
+	pending []parquet.Row
+	err     error
+}
+
+func (p *parquetRowReader) Read() ([]string, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.spool == nil {
+		if err := p.open(); err != nil {
+			return nil, p.fail(err)
+		}
+		return append([]string(nil), p.plan.fields...), nil
+	}
+
+	for len(p.pending) == 0 {
+		if p.rows == nil {
+			if len(p.groups) == 0 {
+				return nil, p.fail(io.EOF)
+			}
+			p.rows, p.groups = p.groups[0].Rows(), p.groups[1:]
+		}
+		n, err := p.rows.ReadRows(p.buf)
+		p.pending = p.buf[:n]
+		if err == io.EOF {
+			p.rows.Close()
+			p.rows = nil
+		} else if err != nil {
+			return nil, p.fail(err)
+		}
+	}
+
+	row := make([]string, len(p.plan.fields))
+	set := make([]bool, len(row))
+	for _, v := range p.pending[0] {
+		c := p.columns[v.Column()]
+		// repeated columns keep their first value
+		if c.field < 0 || set[c.field] {
+			continue
+		}
+		row[c.field], set[c.field] = parquetField(v, c.typ, c.layout), true
+	}
+	p.pending = p.pending[1:]
+	return row, nil
+}
+
+// open spools the file and matches its columns to the fields of the mapping.
+func (p *parquetRowReader) open() error {
+	spool, err := createSpoolFile()
+	if err != nil {
+		return err
+	}
+	p.spool = spool
+	size, err := io.Copy(spool, p.src)
+	if err != nil {
+		return err
+	}
+	file, err := parquet.OpenFile(spool, size)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]int{}
+	for i := range p.plan.fields {
+		for _, name := range append([]string{p.plan.fields[i]}, p.plan.aliases[i]...) {
+			if _, ok := fields[headerKey(name)]; !ok {
+				fields[headerKey(name)] = i
+			}
+		}
+	}
+	schema := file.Schema()
+	paths := schema.Columns()
+	p.columns = make([]parquetColumn, len(paths))
+	for _, path := range paths {
+		leaf, _ := schema.Lookup(path...)
+		c := parquetColumn{field: -1, typ: leaf.Node.Type()}
+		if i, ok := fields[headerKey(strings.Join(path, "_"))]; ok {
+			c.field = i
+			// combined columns take their fields as text
+			if !p.plan.combined {
+				c.layout = p.plan.layouts[i]
+			}
+		}
+		p.columns[leaf.ColumnIndex] = c
+	}
+	p.groups = file.RowGroups()
+	p.buf = make([]parquet.Row, parquetReadRows)
+	return nil
+}
+
+// fail ends the read with err and removes the spooled file.
+func (p *parquetRowReader) fail(err error) error {
+	if p.rows != nil {
+		p.rows.Close()
+		p.rows = nil
+	}
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+	}
+	p.err = err
+	return err
+}
+
+// parquetField writes a value of a column of type t as a csv export would.
+func parquetField(v parquet.Value, t parquet.Type, layout string) string {
+	if v.IsNull() {
+		return ""
+	}
+	if lt := t.LogicalType(); lt != nil {
+		switch {
+		case lt.Date != nil:
+			if layout == "" {
+				layout = dateLayout
+			}
+			return time.Unix(int64(v.Int32())*86400, 0).UTC().Format(layout)
+		case lt.Timestamp != nil:
+			if layout == "" {
+				layout = timestampLayout
+			}
+			var ts time.Time
+			switch unit := lt.Timestamp.Unit; {
+			case unit.Millis != nil:
+				ts = time.UnixMilli(v.Int64())
+			case unit.Micros != nil:
+				ts = time.UnixMicro(v.Int64())
+			default:
+				ts = time.Unix(0, v.Int64())
+			}
+			return ts.UTC().Format(layout)
+		case lt.Decimal != nil && v.Kind() == parquet.Int32:
+			return decimalText(int64(v.Int32()), int(lt.Decimal.Scale))
+		case lt.Decimal != nil && v.Kind() == parquet.Int64:
+			return decimalText(v.Int64(), int(lt.Decimal.Scale))
+		}
+	}
+	switch v.Kind() {
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(v.ByteArray())
+	case parquet.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case parquet.Int32:
+		return strconv.FormatInt(int64(v.Int32()), 10)
+	case parquet.Int64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case parquet.Float:
+		return strconv.FormatFloat(float64(v.Float()), 'f', -1, 32)
+	case parquet.Double:
+		return strconv.FormatFloat(v.Double(), 'f', -1, 64)
+	}
+	return v.String()
+}
+
+// decimalText writes the unscaled decimal n with scale digits after the point.
+func decimalText(n int64, scale int) string {
+	if scale <= 0 {
+		return strconv.FormatInt(n, 10)
+	}
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	digits := strconv.FormatInt(n, 10)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// room left for the multipart envelope around the file itself
+const multipartOverhead = 1 << 20
+
+// errLimitExceeded wraps every error caused by a configured upload limit.
+var errLimitExceeded = errors.New("upload limit exceeded")
+
+// limitUploadBody rejects an upload larger than max_upload_bytes before it is
+// read, and caps the body so a missing or lying Content-Length cannot make the
+// server buffer more than the limit. It reports whether the request may go on.
+func limitUploadBody(c *gin.Context) bool {
+	limit := cfg().MaxUploadBytes
+	if limit <= 0 {
+		return true
+	}
+
+	if c.Request.ContentLength > limit+multipartOverhead {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Upload is larger than the limit of %d bytes", limit)})
+		return false
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+multipartOverhead)
+	return true
+}
+
+// uploadTooLarge reports whether err comes from the body cap of limitUploadBody.
+func uploadTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// rowLengthLimiter fails the read as soon as a line grows past max bytes,
+// before the csv reader buffers the whole line.
+type rowLengthLimiter struct {
+	r       io.Reader
+	max     int
+	current int
+	line    int64
+}
+
+func limitRowLength(r io.Reader, max int) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &rowLengthLimiter{r: r, max: max, line: 1}
+}
+
+func (l *rowLengthLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+
+	chunk := p[:n]
+	for len(chunk) > 0 {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			l.current += len(chunk)
+			break
+		}
+		l.current += i
+		if l.current > l.max {
+			break
+		}
+		l.current = 0
+		l.line++
+		chunk = chunk[i+1:]
+	}
+
+	if l.current > l.max {
+		return n, fmt.Errorf("%w: line %d is longer than %d bytes", errLimitExceeded, l.line, l.max)
+	}
+	return n, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// permissions of listen_socket: the service user and its group may connect
+const socketFileMode = 0660
+
+// listeners opens where the server accepts requests. Sockets passed by
+// systemd take the place of listen_addr and listen_socket; otherwise both are
+// opened when set.
+func listeners(settings *Config) ([]net.Listener, error) {
+	activated, err := activationListeners()
+	if err != nil || len(activated) > 0 {
+		return activated, err
+	}
+
+	var ls []net.Listener
+	if settings.ListenAddr != "" {
+		l, err := net.Listen("tcp", settings.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if settings.ListenSocket != "" {
+		l, err := listenUnix(settings.ListenSocket)
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) == 0 {
+		return nil, errors.New("nothing to listen on: set listen_addr or listen_socket")
+	}
+	return ls, nil
+}
+
+// listenUnix listens on a socket file, replacing one left behind by a
+// previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen_socket %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketFileMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// activationListeners returns the sockets passed with LISTEN_FDS by systemd,
+// none when the process was started otherwise.
+func activationListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	ls := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(ls)
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func closeListeners(ls []net.Listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// serve handles requests on every listener until one of them fails.
+func serve(handler http.Handler, ls []net.Listener) error {
+	server := &http.Server{Handler: handler}
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		log.Println("Listening on", l.Addr().Network(), l.Addr().String())
+		go func(l net.Listener) { errs <- server.Serve(l) }(l)
+	}
+	return <-errs
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// how imports of one target on different instances are kept apart
+const (
+	importLockWait   = "wait"
+	importLockReject = "reject"
+)
+
+// errTargetBusy is returned when import_lock is reject and another import
+// holds the advisory lock of the target.
+var errTargetBusy = errors.New("another import is loading the target table")
+
+// lockRequest is a place in the queue of a target table. Replace imports (and
+// rollbacks) need the target for themselves, append imports can share it.
+type lockRequest struct {
+	owner     string
+	exclusive bool
+	granted   bool
+	ready     chan struct{}
+}
+
+// LockStatus describes where an import stands in the queue of its target.
+type LockStatus struct {
+	Target    string   `json:"target"`
+	Mode      string   `json:"mode"`
+	State     string   `json:"state"`
+	BlockedBy []string `json:"blocked_by,omitempty"`
+}
+
+// queues of lock requests per target table, in arrival order
+var targetLocks = struct {
+	sync.Mutex
+	queues map[string][]*lockRequest
+}{queues: map[string][]*lockRequest{}}
+
+// lockTarget waits until owner may write to target and returns the function
+// releasing it. Requests are granted in arrival order: an exclusive request
+// waits for everything queued before it, and everything queued after an
+// exclusive request waits for it, so a replace and the appends around it
+// always apply in the order they were submitted.
+func lockTarget(ctx context.Context, target, owner string, exclusive bool) (func(), error) {
+	r := &lockRequest{owner: owner, exclusive: exclusive, ready: make(chan struct{})}
+
+	targetLocks.Lock()
+	targetLocks.queues[target] = append(targetLocks.queues[target], r)
+	grantLocked(target)
+	targetLocks.Unlock()
+
+	release := func() {
+		targetLocks.Lock()
+		defer targetLocks.Unlock()
+
+		queue := targetLocks.queues[target]
+		for i, q := range queue {
+			if q == r {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(targetLocks.queues, target)
+			return
+		}
+		targetLocks.queues[target] = queue
+		grantLocked(target)
+	}
+
+	select {
+	case <-r.ready:
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// grantLocked grants every request of target that no longer has to wait. The
+// caller holds the targetLocks lock.
+func grantLocked(target string) {
+	for i, r := range targetLocks.queues[target] {
+		if r.exclusive && i > 0 {
+			return
+		}
+		if !r.granted {
+			r.granted = true
+			close(r.ready)
+		}
+		if r.exclusive {
+			return
+		}
+	}
+}
+
+// lockStatus returns the queue position of owner on target, nil when it holds
+// no lock and is not waiting for one.
+func lockStatus(target, owner string) *LockStatus {
+	targetLocks.Lock()
+	defer targetLocks.Unlock()
+
+	var blockers []string
+	for _, r := range targetLocks.queues[target] {
+		if r.owner != owner {
+			blockers = append(blockers, r.owner)
+			continue
+		}
+
+		s := &LockStatus{Target: target, Mode: "shared", State: "held"}
+		if r.exclusive {
+			s.Mode = "exclusive"
+		}
+		if !r.granted {
+			s.State = "waiting"
+			s.BlockedBy = blockers
+		}
+		return s
+	}
+	return nil
+}
+
+// lockTarget queues the import for its target table, showing it as queued
+// until the lock is granted. With import_lock the import then also takes the
+// advisory lock of the target, which other instances sharing the database see.
+func (imp *Import) lockTarget(ctx context.Context) (func(), error) {
+	previous := imp.setStatus(importStateQueued)
+	defer imp.setStatus(previous)
+
+	// dropping the indexes of the live table must not overlap other appends
+	exclusive := imp.Mode == importModeReplace || (imp.RebuildIndexes && !imp.Staged)
+	release, err := lockTarget(ctx, imp.lockKey(), imp.ID, exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := cfg().ImportLock
+	if mode == "" {
+		return release, nil
+	}
+	unlock, err := imp.advisoryLock(ctx, mode == importLockWait)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// advisoryLock takes the session advisory lock of the import's schema and
+// table on a connection held until the returned function is called, waiting
+// for it or failing with errTargetBusy.
+func (imp *Import) advisoryLock(ctx context.Context, wait bool) (func(), error) {
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		releasePool()
+		return nil, err
+	}
+
+	key := imp.target()
+	if wait {
+		_, err = conn.Exec(ctx, "SELECT pg_advisory_lock(hashtextextended($1, 0))", key)
+	} else {
+		var locked bool
+		err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtextextended($1, 0))", key).Scan(&locked)
+		if err == nil && !locked {
+			err = fmt.Errorf("%w %s", errTargetBusy, key)
+		}
+	}
+	if err != nil {
+		conn.Release()
+		releasePool()
+		return nil, err
+	}
+
+	return func() {
+		// a connection whose unlock failed is closed, which drops the lock
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtextextended($1, 0))", key); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+		releasePool()
+	}, nil
+}
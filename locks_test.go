@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockGranted reports whether the lock request ch resolved within a moment.
+func lockGranted(ch <-chan func()) (func(), bool) {
+	select {
+	case release := <-ch:
+		return release, true
+	case <-time.After(50 * time.Millisecond):
+		return nil, false
+	}
+}
+
+// queueLock requests the lock of target in the background, after the
+// requests queued before it.
+func queueLock(t *testing.T, ctx context.Context, target, owner string, exclusive bool) <-chan func() {
+	t.Helper()
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := lockTarget(ctx, target, owner, exclusive)
+		if err == nil {
+			ch <- release
+		}
+	}()
+	// wait until it is queued, so the order of the requests is known
+	for lockStatus(target, owner) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return ch
+}
+
+func TestLockTargetOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// the requests in arrival order, true for exclusive
+		exclusive []bool
+		// the requests granted right away, then after each release in order
+		granted [][]int
+	}{
+		{"appends share", []bool{false, false, false}, [][]int{{0, 1, 2}}},
+		{"replace waits for earlier appends", []bool{false, false, true}, [][]int{{0, 1}, {}, {2}}},
+		{"later appends wait for the replace", []bool{true, false, false}, [][]int{{0}, {1, 2}}},
+		{"replaces one after the other", []bool{true, true}, [][]int{{0}, {1}}},
+		{"an append between replaces", []bool{false, true, false, true}, [][]int{{0}, {1}, {2}, {3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "test.lock_order"
+			var requests []<-chan func()
+			for i, exclusive := range tt.exclusive {
+				requests = append(requests, queueLock(t, context.Background(), target, string(rune('a'+i)), exclusive))
+			}
+
+			releases := make([]func(), len(requests))
+			done := 0
+			for step, want := range tt.granted {
+				if step > 0 {
+					releases[done]()
+					done++
+				}
+				for _, i := range want {
+					release, ok := lockGranted(requests[i])
+					if !ok {
+						t.Fatalf("step %d: request %d was not granted", step, i)
+					}
+					releases[i] = release
+				}
+				for i := range requests {
+					if releases[i] != nil || i < done {
+						continue
+					}
+					if _, ok := lockGranted(requests[i]); ok {
+						t.Fatalf("step %d: request %d was granted out of order", step, i)
+					}
+				}
+			}
+			for i := done; i < len(releases); i++ {
+				releases[i]()
+			}
+			if lockStatus(target, "a") != nil {
+				t.Fatal("the queue was not emptied")
+			}
+		})
+	}
+}
+
+func TestLockTargetCancel(t *testing.T) {
+	target := "test.lock_cancel"
+	holder, err := lockTarget(context.Background(), target, "holder", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := lockTarget(ctx, target, "cancelled", false)
+		waiting <- err
+	}()
+	for lockStatus(target, "cancelled") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	after := queueLock(t, context.Background(), target, "after", false)
+
+	cancel()
+	if err := <-waiting; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request: %v, want context.Canceled", err)
+	}
+	if lockStatus(target, "cancelled") != nil {
+		t.Fatal("the cancelled request stayed in the queue")
+	}
+	if _, ok := lockGranted(after); ok {
+		t.Fatal("a request was granted while the exclusive lock is held")
+	}
+
+	holder()
+	release, ok := lockGranted(after)
+	if !ok {
+		t.Fatal("the request after the cancelled one was not granted")
+	}
+	release()
+}
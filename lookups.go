@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// what a lookup does with a row whose key is not in its table
+const (
+	lookupMissReject = "reject"
+	lookupMissNull   = "null"
+)
+
+// LookupColumn is a column filled from a reference table read when the import
+// starts: the value of From is looked up in Key of Table and the Value found
+// is loaded, e.g. agen_tujuan to the id of its region.
+type LookupColumn struct {
+	Name   string `yaml:"name" json:"name,omitempty"`
+	Type   string `yaml:"type" json:"type,omitempty"`
+	From   string `yaml:"from" json:"from,omitempty"`
+	Table  string `yaml:"table" json:"table,omitempty"`
+	Key    string `yaml:"key" json:"key,omitempty"`
+	Value  string `yaml:"value" json:"value,omitempty"`
+	OnMiss string `yaml:"on_miss" json:"on_miss,omitempty"`
+}
+
+type lookupSpec struct {
+	name   string
+	from   int
+	column int
+	query  string
+	parse  fieldParser
+	reject bool
+}
+
+// lookupMissError rejects a row whose key is missing from a reference table.
+type lookupMissError struct {
+	lookup, key string
+}
+
+func (e *lookupMissError) Error() string {
+	return fmt.Sprintf("lookup %s: no %q in its table", e.lookup, e.key)
+}
+
+// compileLookups appends the lookup columns to p.
+func (p *executionPlan) compileLookups(lookups []LookupColumn) error {
+	for _, l := range lookups {
+		if l.Name == "" || p.columnIndex(l.Name) >= 0 {
+			return fmt.Errorf("lookup column %q: needs a name of its own", l.Name)
+		}
+		from := p.columnIndex(l.From)
+		switch {
+		case from < 0:
+			return fmt.Errorf("lookup column %s: unknown column %q", l.Name, l.From)
+		case !tableNamePattern.MatchString(l.Table):
+			return fmt.Errorf("lookup column %s: invalid table %q", l.Name, l.Table)
+		case !identifierPattern.MatchString(l.Key) || !identifierPattern.MatchString(l.Value):
+			return fmt.Errorf("lookup column %s: key and value must be column names", l.Name)
+		}
+		col := ColumnMapping{Name: l.Name, Type: l.Type}
+		parse, _, err := compileParser(col)
+		if err != nil {
+			return fmt.Errorf("lookup column %s: %w", l.Name, err)
+		}
+		spec := lookupSpec{
+			name:   l.Name,
+			from:   from,
+			column: len(p.columns),
+			query:  fmt.Sprintf("SELECT %s::text, %s::text FROM %s WHERE %s IS NOT NULL", l.Key, l.Value, l.Table, l.Key),
+			parse:  parse,
+		}
+		switch l.OnMiss {
+		case "", lookupMissReject:
+			spec.reject = true
+		case lookupMissNull:
+		default:
+			return fmt.Errorf("lookup column %s: on_miss must be reject or null", l.Name)
+		}
+
+		p.columns = append(p.columns, col.Name)
+		p.types = append(p.types, columnType(col))
+		p.layouts = append(p.layouts, columnLayout(col))
+		p.tokenize = append(p.tokenize, "")
+		p.tokenKinds = append(p.tokenKinds, col.Name)
+		p.lookups = append(p.lookups, spec)
+	}
+	return nil
+}
+
+// loadLookups reads the reference tables of the mapping, keyed by the trimmed
+// text of their key column.
+func (imp *Import) loadLookups(ctx context.Context, dbPool *pgxpool.Pool) error {
+	imp.lookups = make([]map[string]interface{}, len(imp.plan.lookups))
+	for i, l := range imp.plan.lookups {
+		rows, err := dbPool.Query(ctx, l.query)
+		if err != nil {
+			return fmt.Errorf("failed to read the table of lookup %s: %w", l.name, err)
+		}
+		table := map[string]interface{}{}
+		for rows.Next() {
+			var key string
+			var raw *string
+			if err = rows.Scan(&key, &raw); err != nil {
+				break
+			}
+			var value interface{}
+			if raw != nil {
+				if value, err = l.parse(*raw); err != nil {
+					break
+				}
+			}
+			table[strings.TrimSpace(key)] = value
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the table of lookup %s: %w", l.name, err)
+		}
+		imp.lookups[i] = table
+	}
+	return nil
+}
+
+// lookup fills the lookup columns of values. It returns the names of the
+// lookups that missed and the error rejecting the row, if one of them does.
+// An empty key is no miss, the column is just empty.
+func (imp *Import) lookup(values []interface{}) ([]string, error) {
+	var missed []string
+	var reject error
+	for i, l := range imp.plan.lookups {
+		key := strings.TrimSpace(formatValue(values[l.from]))
+		if key == "" {
+			continue
+		}
+		value, ok := imp.lookups[i][key]
+		if !ok {
+			missed = append(missed, l.name)
+			if l.reject && reject == nil {
+				reject = &lookupMissError{lookup: l.name, key: imp.plan.shown(l.from, key)}
+			}
+			continue
+		}
+		values[l.column] = value
+	}
+	return missed, reject
+}
+
+// countLookupMisses counts the keys the named lookups did not find.
+func (imp *Import) countLookupMisses(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	for _, name := range names {
+		imp.lookupMisses[name]++
+	}
+}
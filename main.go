@@ -1,65 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
 
 	"github.com/gin-gonic/gin"
-	pgxpool "github.com/jackc/pgx/v4/pgxpool"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
-	dbConnString   = "user=postgres dbname=test sslmode=disable" // Replace with your PostgreSQL connection details
-	schemaName     = "cashback_may_2023"
-	dbMaxIdleConns = 4
-	dbMaxConns     = 50
-	totalWorker    = 100
-	csvFile        = "sample.csv"
-	dataHeaders    = []string{
-		"no_waybill",
-		"tgl_pengiriman",
-		"drop_point_outgoing",
-		"sprinter_pickup",
-		"tempat_tujuan",
-		"keterangan",
-		"berat_yang_ditagih",
-		"cod",
-		"biaya_asuransi",
-		"biaya_kirim",
-		"biaya_lainnya",
-		"total_biaya",
-		"klien_pengiriman",
-		"metode_pembayaran",
-		"nama_pengirim",
-		"sumber_waybill",
-		"paket_retur",
-		"waktu_ttd",
-		"layanan",
-		"diskon",
-		"total_biaya_setelah_diskon",
-		"agen_tujuan",
-		"nik",
-		"kode_promo",
-		"kat",
-	}
-
-	router       = gin.Default()
-	errorLogFile = "error.log"
+	configFile = "config.yaml"
+	csvFile    = "sample.csv"
+
+	router = gin.Default()
 )
 
 type DateParams struct {
@@ -67,38 +37,25 @@ type DateParams struct {
 	Year  string `form:"year"`
 }
 
-// Define a struct to hold the data elements
-type DataElement struct {
-	NoWaybill               string
-	TglPengiriman           time.Time
-	DropPointOutgoing       string
-	SprinterPickup          string
-	TempatTujuan            string
-	Keterangan              string
-	BeratYangDitagih        float64
-	Cod                     int64
-	BiayaAsuransi           float64
-	BiayaKirim              int64
-	BiayaLainnya            int64
-	TotalBiaya              float64
-	KlienPengiriman         string
-	MetodePembayaran        string
-	NamaPengirim            string
-	SumberWayBill           string
-	PaketRetur              string
-	WaktuTTD                time.Time
-	Layanan                 string
-	Diskon                  int64
-	TotalBiayaSetelahDiscon int64
-	AgenTujuan              string
-	Nik                     string
-	KodePromo               string
-	Kategori                string
-}
-
 func main() {
+	if v := os.Getenv("CONFIG_FILE"); v != "" {
+		configFile = v
+	}
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentConfig.Store(config)
+
+	// the client ip of an upload comes from X-Forwarded-For only when sent
+	// by one of these proxies
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create or open the error log file
-	errorLog, err := os.OpenFile(errorLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	errorLog, err := os.OpenFile(config.ErrorLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -107,29 +64,512 @@ func main() {
 	// Set the logger's output to the error log file
 	log.SetOutput(errorLog)
 
-	router.POST("/upload", handleUpload)
+	if err := loadMappings(config.MappingDir); err != nil {
+		log.Fatal(err)
+	}
+
+	// `big_file_pgsql benchmark ...` runs the insert benchmark instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		if err := runBenchmarkCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// `big_file_pgsql backfill ...` imports a directory of historical files
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfillCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// `big_file_pgsql mirror-replay ...` loads a mirror_file into a database
+	if len(os.Args) > 1 && os.Args[1] == "mirror-replay" {
+		if err := runMirrorReplayCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := loadAPIKeys(config.APIKeysFile); err != nil {
+		log.Fatal(err)
+	}
+
+	cleanSpoolDir(config.SpoolDir)
+
+	stopTracing, err := initTracing(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopMirror, err := startMirror(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopBroker, err := startBroker(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopCheckpoints, err := startCheckpointStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopGRPC, err := startGRPC(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// worker nodes only load chunks and answer the admin endpoints
+	if config.NodeRole != nodeRoleWorker {
+		apiRoutes(router.Group("/", requireAPIKey, requireRole(roleUploader), selectTenant, validateRequest))
+
+		// the same for one tenant, picked by path by keys not bound to a tenant
+		importRoutes(router.Group("/tenants/:tenant", requireAPIKey, requireRole(roleUploader), selectTenant, validateRequest))
+
+		// client teams generate their sdks from the spec
+		router.GET("/openapi.json", handleOpenAPI)
 
-	router.Run(":8080")
+		// tus clients discover the server before authenticating
+		router.OPTIONS("/uploads", handleTusOptions)
+		router.OPTIONS("/uploads/:id", handleTusOptions)
+
+		// shared links carry their own signature instead of an API key
+		router.GET("/artifacts/imports/:id/rejects", requireSignedURL, handleDownloadRejects)
+		router.GET("/artifacts/imports/:id/logs", requireSignedURL, handleImportLogs)
+	}
+
+	admin := router.Group("/admin", requireAdmin)
+	admin.GET("/config", handleAdminConfig)
+	admin.PATCH("/config", handleUpdateConfig)
+	admin.GET("/keys", handleListAPIKeys)
+	admin.POST("/keys", handleCreateAPIKey)
+	admin.DELETE("/keys/:id", handleDeleteAPIKey)
+	admin.GET("/warehouse", handleWarehouseStatus)
+	admin.GET("/pool", handlePoolStats)
+	admin.GET("/capabilities", handleCapabilities)
+	admin.GET("/schedules", handleScheduleStatus)
+	admin.GET("/sources", handleListSources)
+	admin.GET("/digest", handleDigestPreview)
+	admin.POST("/tokens/tokenize", handleTokenize)
+	admin.POST("/tokens/detokenize", handleDetokenize)
+	admin.POST("/benchmark", handleBenchmark)
+	admin.GET("/tenants", handleTenantUsage)
+	admin.GET("/templates", handleListTemplates)
+	admin.GET("/templates/:name", handleGetTemplate)
+	admin.PUT("/templates/:name", handleSaveTemplate)
+	admin.DELETE("/templates/:name", handleDeleteTemplate)
+	admin.GET("/migrations", handleMigrations)
+	admin.POST("/migrations", handleApplyMigrations)
+	admin.POST("/schemas", handleCreateSchema)
+
+	if config.NodeRole != nodeRoleWorker {
+		checkOpenAPIRoutes(router.Routes())
+	}
+
+	// connect eagerly so a bad database_url shows up at startup; handlers
+	// retry on their own if the database is not reachable yet
+	if _, releasePool, err := acquirePool(); err != nil {
+		log.Println("Database not reachable:", err)
+	} else {
+		releasePool()
+	}
+	// indexes dropped by imports a crash or restart interrupted
+	go restoreIndexes(config)
+	go restoreSnapshots(config)
+	if config.MigrateOnStart {
+		if err := migrateOnStart(config); err != nil {
+			log.Fatal("Migrations failed: ", err)
+		}
+	}
+
+	if config.NodeRole != nodeRoleWorker {
+		go runWarehouseExporter()
+		go runScheduler()
+		go runDigests()
+		go runTusCleanup()
+	}
+	if config.DistributedImports && config.NodeRole != nodeRoleAPI {
+		runChunkWorkers(config)
+	}
+
+	ls, err := listeners(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = serve(router, ls)
+	stopGRPC()
+	stopCheckpoints()
+	stopBroker()
+	stopMirror()
+	stopTracing()
+	log.Fatal(err)
+}
+
+// importSpec describes an import before it starts; resolve checks it against
+// the settings and works out where the rows go.
+type importSpec struct {
+	date           DateParams
+	mapping        string
+	template       string
+	mode           string
+	strict         bool
+	transaction    bool
+	priority       string
+	staged         bool
+	existing       string
+	profile        bool
+	controls       controlRequest
+	rebuildIndexes bool
+	analyze        bool
+	tenant         string
+	database       string
+	// inputFormatCSV or inputFormatJSON, csv when empty
+	format string
+	// field delimiter of csv files, csv_delimiter when empty
+	delimiter string
+	// several files, or a zip of them, are loaded as one import
+	multiFile bool
+	// lines before the header and columns before the data left out of csv
+	// files, none when empty
+	skipRows    string
+	skipColumns string
+	// the source whose bundle applies, see applySource
+	source string
+	// off, verify or infer, period_check.mode when empty, and the share of
+	// rows allowed outside the month
+	periodCheck    string
+	maxOutside     string
+	periodInferred bool
+
+	plan         *executionPlan
+	layout       string
+	schema       string
+	table        string
+	stagingTable string
+	totals       *controlSpec
+	period       *periodSpec
+	// date is allMonths, only for the reads of handleGetShipment; an upload
+	// of month=all is refused by normalize
+	everyMonth bool
+}
+
+func (s *importSpec) resolve(settings *Config) error {
+	if !s.everyMonth {
+		if err := s.date.normalize(); err != nil {
+			return err
+		}
+	}
+	if s.template != "" {
+		if s.mapping != "" {
+			return fmt.Errorf("mapping and template cannot be used together")
+		}
+		version, err := resolveTemplate(s.template)
+		if err != nil {
+			return err
+		}
+		s.mapping = version
+	}
+	plan, err := planForVersion(s.mapping)
+	if err != nil {
+		return err
+	}
+	s.plan = plan
+	if plan.tokenized && settings.TokenizationKey == "" {
+		return fmt.Errorf("mapping %s tokenizes columns, set tokenization_key", plan.version)
+	}
+	if plan.hashed && settings.PIIHashKey == "" {
+		return fmt.Errorf("mapping %s hashes columns, set pii_hash_key", plan.version)
+	}
+
+	if s.format == "" {
+		s.format = inputFormatCSV
+	} else if inputFormats[s.format] == nil {
+		return fmt.Errorf("format must be one of %v", inputFormatNames())
+	}
+	if s.delimiter == "" {
+		s.delimiter = settings.CSVDelimiter
+	}
+	if _, err := parseDelimiter(s.delimiter); err != nil {
+		return err
+	}
+
+	for name, v := range map[string]string{"skip_rows": s.skipRows, "skip_columns": s.skipColumns} {
+		n, err := parseSkip(name, v)
+		if err != nil {
+			return err
+		}
+		if n > 0 && s.format != inputFormatCSV {
+			return fmt.Errorf("%s only applies to csv files", name)
+		}
+	}
+	if s.multiFile && s.strict {
+		return errMultiFileStrict
+	}
+	switch {
+	case s.transaction && s.strict:
+		return fmt.Errorf("strict=true already loads in one transaction, transaction=true only applies without it")
+	case s.transaction && s.multiFile:
+		return fmt.Errorf("transaction=true loads one file in one transaction, upload the files one by one")
+	}
+
+	if err := checkPriority(s.priority); err != nil {
+		return err
+	}
+	if !validImportMode(s.mode) {
+		return fmt.Errorf("mode must be append or replace")
+	}
+	if s.existing != "" {
+		switch {
+		case !validExistingMode(s.existing):
+			return fmt.Errorf("existing must be skip or update")
+		case s.mode != importModeAppend:
+			return fmt.Errorf("existing=%s only applies to mode=append", s.existing)
+		case plan.key < 0:
+			return fmt.Errorf("mapping %s has no key column to find existing rows by", plan.version)
+		}
+		// rows are compared with the target when moved out of staging
+		s.staged = true
+	}
+
+	s.layout = settings.TableLayout
+	s.schema = settings.monthSchema(s.date)
+	if partitionedLayout(s.layout) {
+		if s.mode == importModeReplace {
+			return fmt.Errorf("mode=replace is not supported with the %s layout", s.layout)
+		}
+		if err := checkPartitionColumn(plan, s.layout, settings.partitionColumn(s.layout)); err != nil {
+			return err
+		}
+		// indexes of a partitioned table cannot be built concurrently
+		if s.rebuildIndexes && !s.staged {
+			return fmt.Errorf("rebuild_indexes needs staging=true with the %s layout", s.layout)
+		}
+		s.schema = settings.PartitionSchema
+	}
+
+	s.table = plan.table
+	if s.tenant != "" {
+		t := settings.tenant(s.tenant)
+		if t == nil {
+			return fmt.Errorf("unknown tenant %s", s.tenant)
+		}
+		if s.schema, s.table, err = t.names(s.schema, plan.table, s.date); err != nil {
+			return err
+		}
+	}
+	if err := settings.checkDatabase(s.tenant, s.database); err != nil {
+		return err
+	}
+	if d := plan.duplicates; d != nil && (d.keep == duplicatesKeepLast || d.keep == duplicatesRejectAll) && s.mode != importModeReplace && !s.staged {
+		return fmt.Errorf("mapping %s keeps duplicates with %s, which needs mode=replace or staging=true", plan.version, d.keep)
+	}
+	if s.totals, err = compileControls(s.controls, plan); err != nil {
+		return err
+	}
+	if s.period, err = s.compilePeriod(settings, plan); err != nil {
+		return err
+	}
+	if len(plan.routeTables) > 0 {
+		switch {
+		case s.mode == importModeReplace || s.staged:
+			return fmt.Errorf("mapping %s routes rows, it only appends without staging", plan.version)
+		case s.strict || s.transaction:
+			return fmt.Errorf("mapping %s routes rows, strict=true and transaction=true are not supported", plan.version)
+		case partitionedLayout(s.layout):
+			return fmt.Errorf("mapping %s routes rows, not supported with the %s layout", plan.version, s.layout)
+		case s.tenant != "" && settings.tenant(s.tenant).TableTemplate != "":
+			return fmt.Errorf("mapping %s routes rows, not supported for tenants with a table_template", plan.version)
+		}
+	}
+
+	if len(plan.references) > 0 && s.transaction {
+		return fmt.Errorf("mapping %s checks references, transaction=true is not supported", plan.version)
+	}
+
+	if len(plan.rollups) > 0 {
+		switch {
+		case s.mode == importModeReplace:
+			return fmt.Errorf("mapping %s keeps rollups, which mode=replace would not match", plan.version)
+		case s.strict || s.transaction:
+			return fmt.Errorf("mapping %s keeps rollups, strict=true and transaction=true are not supported", plan.version)
+		case s.existing == existingUpdate:
+			return fmt.Errorf("mapping %s keeps rollups, existing=update is not supported", plan.version)
+		case len(plan.routeTables) > 0:
+			return fmt.Errorf("mapping %s keeps rollups, it cannot route rows", plan.version)
+		}
+	}
+
+	switch {
+	case s.mode == importModeReplace:
+		s.stagingTable = s.schema + "." + s.table + replaceStagingSuffix
+	case s.staged:
+		s.stagingTable = s.schema + "." + s.table + "_stg_" + randomHex(4)
+	}
+	return nil
+}
+
+// apiRoutes registers the endpoints openapi.json describes.
+func apiRoutes(api *gin.RouterGroup) {
+	importRoutes(api)
+	uploads := api.Group("/uploads", requireTusResumable)
+	uploads.POST("", handleTusCreate)
+	uploads.HEAD("/:id", handleTusHead)
+	uploads.PATCH("/:id", handleTusPatch)
+	uploads.DELETE("/:id", handleTusDelete)
+	api.POST("/jobs/:id/rollback", requireRole(roleAdmin), handleRollback)
+	api.GET("/audit", requireRole(roleApprover), handleListAudit)
+}
+
+// importRoutes registers the upload and import endpoints on g.
+func importRoutes(g *gin.RouterGroup) {
+	g.POST("/upload", handleUpload)
+	g.PUT("/imports/:dataset/stream", handleStreamImport)
+	g.GET("/imports/:id", handleImportStatus)
+	g.GET("/imports/:id/progress", handleImportProgress)
+	g.GET("/imports/:id/profile", handleImportProfile)
+	g.POST("/imports/:id/retry-rejects", handleRetryRejects)
+	g.POST("/imports/:id/retry-errors", handleRetryErrors)
+	g.GET("/imports/:id/logs", handleImportLogs)
+	g.POST("/imports/:id/logs/link", handleCreateLogsLink)
+	g.GET("/imports/:id/rejects", handleDownloadRejects)
+	g.POST("/imports/:id/rejects/link", handleCreateRejectsLink)
+	g.POST("/imports/:id/rollback", requireRole(roleAdmin), handleRollback)
+	g.POST("/imports/:id/pause", requireRole(roleAdmin), handlePauseImport)
+	g.POST("/imports/:id/resume", requireRole(roleAdmin), handleResumeImport)
+	g.POST("/imports/:id/cancel", requireRole(roleAdmin), handleCancelImport)
+	g.GET("/data", handleListData)
+	g.GET("/data/:waybill", handleGetShipment)
+	g.GET("/summary", handleSummary)
+	g.GET("/export", handleExport)
+	g.GET("/stats/quality", handleQualityStats)
+	g.GET("/stats/sources", handleSourceStats)
+}
+
+// newImport registers the import of a resolved spec; its span continues the
+// trace in ctx. It fails with errImportIDTaken while an unfinished import has
+// the id.
+func (s *importSpec) newImport(ctx context.Context, id string, size int64) (*Import, error) {
+	imp := s.build(id, size)
+	if err := registerImport(imp); err != nil {
+		return nil, err
+	}
+	imp.startTrace(ctx)
+	return imp, nil
+}
+
+// build creates the import of a resolved spec without registering it.
+func (s *importSpec) build(id string, size int64) *Import {
+	query := s.plan.insertQuery(s.schema + "." + s.table)
+	if s.stagingTable != "" {
+		query = s.plan.insertQuery(s.stagingTable)
+	}
+
+	imp := allocImport(id, &s.date, s.plan, query, size)
+	imp.Strict = s.strict
+	imp.Transaction = s.transaction
+	imp.Priority = s.priority
+	imp.Source = s.source
+	if imp.Priority == "" {
+		imp.Priority = priorityNormal
+	}
+	imp.Mode = s.mode
+	imp.Staged = s.staged && s.mode == importModeAppend
+	imp.Existing = s.existing
+	imp.RebuildIndexes = s.rebuildIndexes
+	imp.Analyze = s.analyze
+	imp.stagingTable = s.stagingTable
+	imp.Schema = s.schema
+	imp.Table = s.table
+	imp.Tenant = s.tenant
+	imp.Database = s.database
+	imp.Layout = s.layout
+	imp.Format = s.format
+	imp.delimiter, _ = parseDelimiter(s.delimiter)
+	imp.multiFile = s.multiFile
+	imp.skipRows, _ = parseSkip("skip_rows", s.skipRows)
+	imp.skipColumns, _ = parseSkip("skip_columns", s.skipColumns)
+	if s.totals != nil {
+		imp.totals = newControlTotals(s.totals)
+	}
+	if s.period != nil {
+		imp.period = newPeriodCounter(s.period, s.date)
+		imp.period.inferred = s.periodInferred
+	}
+	if !imp.distributed() {
+		if s.profile {
+			imp.profile = newProfiler(s.plan)
+		}
+		imp.metrics = newMetricTotals(cfg(), s.plan)
+	}
+	return imp
+}
+
+// queryFlag reads a true/false query parameter, def when it is absent.
+func queryFlag(c *gin.Context, name string, def bool) bool {
+	if v := c.Query(name); v != "" {
+		return v == "true"
+	}
+	return def
 }
 
 func handleUpload(c *gin.Context) {
 	start := time.Now()
 
-	dbPool, err := openDbConnectionPool()
-	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+	if !limitUploadBody(c) {
 		return
 	}
-	defer dbPool.Close()
-
-	file, _, err := c.Request.FormFile("file")
+	bindKey, releaseKey, ok := claimIdempotencyKey(c)
+	if !ok {
+		return
+	}
+	defer releaseKey()
+
+	// the file parts are read straight off the request, spilling to disk past
+	// upload_memory_bytes
+	var uploads []*spillBuffer
+	var names []string
+	trace := requestTrace(c)
+	_, receive := startSpan(trace, "upload.receive")
+	mr, err := c.Request.MultipartReader()
+	if err == nil {
+		uploads, names, err = readUploadParts(mr, cfg().UploadMemoryBytes)
+	}
 	if err != nil {
+		receive.end(err)
 		log.Println(err.Error())
+		if uploadTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Upload is larger than the limit of %d bytes", cfg().MaxUploadBytes)})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to read the uploaded file"})
 		return
 	}
-	defer file.Close()
+	defer closeUploads(uploads)
+	var size int64
+	spilled := false
+	for _, upload := range uploads {
+		size += upload.size
+		spilled = spilled || upload.file != nil
+	}
+	receive.end(nil, attr("upload.bytes", size), attr("upload.files", len(uploads)), attr("upload.spilled", spilled))
+
+	if limit := cfg().MaxUploadBytes; limit > 0 && size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Upload is larger than the limit of %d bytes", limit)})
+		return
+	}
+
+	// several parts, or a zip of several files, are loaded one file at a time
+	var files []importFile
+	for i, upload := range uploads {
+		found, err := uploadFiles(names[i], upload.readerAt(), upload.size)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		files = append(files, found...)
+	}
+	filename := strings.Join(names, ",")
 
 	var dateParams DateParams
 	if err := c.ShouldBindQuery(&dateParams); err != nil {
@@ -137,19 +577,431 @@ func handleUpload(c *gin.Context) {
 		return
 	}
 
-	csvReader := csv.NewReader(file)
+	format, err := inputFormat(c.Query("format"), uploads[0].contentType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
 
-	jobs := make(chan []interface{}, 0)
-	wg := new(sync.WaitGroup)
+	settings := cfg()
+	spec := importSpec{
+		date:           dateParams,
+		mapping:        c.Query("mapping"),
+		template:       c.Query("template"),
+		mode:           c.DefaultQuery("mode", importModeAppend),
+		strict:         c.Query("strict") == "true",
+		transaction:    c.Query("transaction") == "true",
+		priority:       c.Query("priority"),
+		staged:         queryFlag(c, "staging", settings.StagingLoad),
+		existing:       c.Query("existing"),
+		profile:        queryFlag(c, "profile", settings.ProfileImports),
+		controls:       requestControls(c),
+		rebuildIndexes: queryFlag(c, "rebuild_indexes", settings.RebuildIndexes),
+		analyze:        queryFlag(c, "analyze", settings.AnalyzeAfterImport),
+		tenant:         requestTenant(c),
+		database:       c.Query("target"),
+		format:         format,
+		delimiter:      c.Query("delimiter"),
+		skipRows:       c.Query("skip_rows"),
+		skipColumns:    c.Query("skip_columns"),
+		multiFile:      multiFile(files),
+		source:         c.Query("source"),
+		periodCheck:    c.Query("period_check"),
+		maxOutside:     c.Query("max_outside_percent"),
+	}
+	err = spec.applySource(settings, queryGiven(c))
+	// without month and year the file tells which month it is of
+	if err == nil && spec.infersDate(settings) {
+		err = spec.inferDate(settings, files)
+	}
+	if err == nil {
+		err = spec.resolve(settings)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
 
-	go dispatchWorkers(dbPool, jobs, wg, &dateParams)
-	readCsvFilePerLineThenSendToWorker(csvReader, jobs, wg)
+	release, err := reserveImportQuota(requestAPIKey(c), spec.tenant, size)
+	if err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		return
+	}
 
-	wg.Wait()
+	imp, err := spec.newImport(trace, c.Query("import_id"), filesSize(files))
+	if err != nil {
+		release()
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	bindKey(imp)
+	imp.FileName = filename
+	imp.Checksum = uploadsChecksum(uploads)
+	imp.Principal = requestPrincipal(c)
+	imp.SourceIP = c.ClientIP()
+	imp.UserAgent = c.Request.UserAgent()
+	if key := requestAPIKey(c); key != nil {
+		imp.APIKey = key.Name
+	}
+
+	// outside the import windows the upload is kept on disk and loaded later
+	if windows := cfg().windows; !windowOpen(windows, start) {
+		spools := make([]string, 0, len(uploads))
+		for _, upload := range uploads {
+			spool, err := upload.detach()
+			if err != nil {
+				release()
+				removeSpools(spools)
+				log.Println(err.Error())
+				imp.abort(err)
+				imp.finish()
+				c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the uploaded file"})
+				return
+			}
+			spools = append(spools, spool)
+		}
+
+		imp.setStatus(importStateQueued)
+		go runQueuedImport(imp, spools, names, release)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"import_id": imp.ID,
+			"status":    importStateQueued,
+			"starts_at": nextWindowOpen(windows, start),
+			"message":   "Outside the import window, the file will be loaded when it opens",
+		})
+		return
+	}
+	defer release()
+
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+		imp.finish()
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	var body io.ReadCloser
+	if imp.multiFile {
+		imp.inputFiles = files
+	} else {
+		file, err := uploads[0].reader()
+		if err != nil {
+			log.Println(err.Error())
+			imp.abort(err)
+			imp.finish()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the uploaded file"})
+			return
+		}
+		if body, err = decompressUpload(&countingReader{r: file, imp: imp}); err != nil {
+			imp.abort(err)
+			imp.finish()
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": err.Error()})
+			return
+		}
+		defer body.Close()
+	}
+
+	imp.publish(ImportEvent{Type: eventStarted, Message: filename})
+	runImport(imp, dbPool, body)
 
-	duration := time.Since(start)
+	report := imp.report()
+	log.Println("=> import", imp.ID, report.Status, "in", time.Since(start))
 
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Data inserted successfully in %d seconds for month %s, year %d", int(math.Ceil(duration.Seconds())), dateParams.Month, dateParams.Year)})
+	c.JSON(report.httpStatus(), report)
+}
+
+// fileChecksum returns the SHA-256 of an upload and rewinds it.
+func fileChecksum(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// spoolUpload copies an upload to a temporary file so it outlives the request.
+func spoolUpload(r io.Reader) (string, error) {
+	f, err := createSpoolFile()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// runQueuedImport waits for the next import window, then loads the spooled
+// upload in the background. The spools of a multi-file import are its parts,
+// named by names.
+func runQueuedImport(imp *Import, spools, names []string, release func()) {
+	defer release()
+	defer removeSpools(spools)
+
+	fail := func(err error) {
+		log.Println("=> queued import", imp.ID, "failed:", err)
+		imp.abort(err)
+		imp.finish()
+	}
+
+	_, wait := imp.startSpan("import.window_wait")
+	ctx, _ := imp.runContext()
+	err := sleepUntilWindow(ctx)
+	wait.end(err)
+	if err != nil {
+		fail(err)
+		return
+	}
+	imp.setStatus(importStateRunning)
+
+	opened := make([]*os.File, 0, len(spools))
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	for _, spool := range spools {
+		f, err := os.Open(spool)
+		if err != nil {
+			fail(err)
+			return
+		}
+		opened = append(opened, f)
+	}
+
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer releasePool()
+
+	var body io.ReadCloser
+	if imp.multiFile {
+		for i, f := range opened {
+			fi, err := f.Stat()
+			if err == nil {
+				var files []importFile
+				files, err = uploadFiles(names[i], f, fi.Size())
+				imp.inputFiles = append(imp.inputFiles, files...)
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+	} else {
+		// ranges of a plain file are counted as they are parsed
+		f := opened[0]
+		body = f
+		if size, ok := imp.parseInRanges(f); ok {
+			imp.parseFile, imp.parseSize = f, size
+		} else if body, err = decompressUpload(&countingReader{r: f, imp: imp}); err != nil {
+			fail(err)
+			return
+		}
+		defer body.Close()
+	}
+
+	imp.publish(ImportEvent{Type: eventStarted, Message: strings.Join(names, ",")})
+	runImport(imp, dbPool, body)
+
+	log.Println("=> queued import", imp.ID, imp.report().Status)
+}
+
+// runImport reads body through the import's mapping, loads the rows with the
+// worker pool (a single transaction in strict mode, chunks for the queue
+// workers when distributed) and finishes imp. A multi-file import reads its
+// inputFiles instead of body.
+func runImport(imp *Import, dbPool *pgxpool.Pool, body io.Reader) {
+	ctx, cancel := imp.runContext()
+	defer cancel()
+
+	releaseSlot, err := imp.acquireSlot(ctx)
+	if err != nil {
+		imp.abort(err)
+		imp.finish()
+		return
+	}
+	defer releaseSlot()
+
+	releaseTarget, err := imp.lockTarget(ctx)
+	if err != nil {
+		imp.abort(err)
+		imp.finish()
+		return
+	}
+	defer releaseTarget()
+
+	if partitionedLayout(imp.Layout) {
+		if imp.partitions, err = newPartitioner(ctx, dbPool, imp, cfg().partitionColumn(imp.Layout)); err != nil {
+			log.Println(err.Error())
+			imp.abort(err)
+			imp.finish()
+			return
+		}
+	}
+
+	// the statements of this run, even if the config changes meanwhile
+	settings := cfg()
+	if !partitionedLayout(imp.Layout) && settings.MonthDDL.AutoCreate {
+		if err := createImportMonth(ctx, dbPool, imp, settings); err != nil {
+			log.Println(err.Error())
+			imp.abort(err)
+			imp.finish()
+			return
+		}
+	}
+	if err := runPreImportHooks(dbPool, imp, settings.PreImportSQL); err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+		runPostImportHooks(dbPool, imp, settings.PostImportSQL)
+		imp.finish()
+		return
+	}
+
+	// the staging and route tables copy the columns of the target
+	if imp.plan.extras >= 0 {
+		err = addExtraFieldsColumn(ctx, dbPool, imp)
+	}
+	if err == nil && imp.plan.metadata >= 0 {
+		err = addMetadataColumns(ctx, dbPool, imp)
+	}
+	if err == nil {
+		err = checkTableDrift(ctx, dbPool, imp)
+	}
+	switch {
+	case err != nil:
+	case imp.Mode == importModeReplace:
+		err = prepareStaging(ctx, dbPool, imp)
+	case imp.Staged:
+		err = prepareAppendStaging(ctx, dbPool, imp)
+	case imp.routed():
+		err = prepareRoutes(ctx, dbPool, imp)
+	}
+	if err == nil && len(imp.plan.rollups) > 0 {
+		err = prepareRollups(ctx, dbPool, imp)
+	}
+	if err == nil && len(imp.plan.lookups) > 0 {
+		// read after the pre hooks, which may refresh the reference tables
+		err = imp.loadLookups(ctx, dbPool)
+	}
+	if err == nil && imp.RebuildIndexes {
+		if err = dropIndexes(ctx, dbPool, imp); err != nil && imp.Mode == importModeAppend {
+			// put back what was dropped before the failure
+			rebuildIndexes(dbPool, imp)
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+		runPostImportHooks(dbPool, imp, settings.PostImportSQL)
+		imp.finish()
+		return
+	}
+
+	switch {
+	case imp.inputFiles != nil:
+		loadFiles(ctx, cancel, imp, dbPool, settings)
+	case imp.distributed():
+		runChunks(ctx, imp, imp.inputReader(body))
+	default:
+		loadRows(ctx, cancel, imp, dbPool, imp.inputReader(body), settings)
+	}
+	if imp.settlesDuplicates() {
+		if err := settleDuplicates(context.Background(), dbPool, imp); err != nil {
+			log.Println(err.Error())
+			imp.abort(err)
+		}
+	}
+	// checked before the move out of staging, so a mismatch can still roll back
+	if imp.totals != nil || imp.reconcilesTrailer() {
+		imp.reconcile()
+	}
+	if imp.period != nil {
+		imp.checkPeriod()
+	}
+
+	switch {
+	case imp.Mode == importModeReplace:
+		err = finishReplace(dbPool, imp)
+	case imp.Staged:
+		err = finishStagedAppend(dbPool, imp)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+	}
+	// the rows are in, a failed rebuild is only reported with the indexes
+	if imp.Mode == importModeAppend {
+		rebuildIndexes(dbPool, imp)
+	}
+	runPostImportHooks(dbPool, imp, settings.PostImportSQL)
+	runMaintenance(dbPool, imp, settings.MaintenanceSQL)
+	refreshViews(dbPool, imp)
+	imp.detectAnomalies()
+	imp.finish()
+}
+
+// loadRows reads input through the mapping of imp into its table, with the
+// worker pool or a single transaction in strict mode. Failures abort imp;
+// cancel stops the reader.
+func loadRows(ctx context.Context, cancel context.CancelFunc, imp *Import, dbPool *pgxpool.Pool, input *bufio.Reader, settings *Config) {
+	// a buffer lets the reader run ahead instead of handing over row by row
+	capacity, rowBytes := jobBufferSize(input, len(imp.plan.columns), settings)
+	atomic.StoreInt64(&imp.chanRowBytes, int64(rowBytes))
+	atomic.StoreInt64(&imp.chanCapacity, int64(capacity))
+	jobs := make(chan []interface{}, capacity)
+	wg := new(sync.WaitGroup)
+
+	// strict imports run in a single transaction so they can be rolled back
+	txResult := make(chan error, 1)
+	switch {
+	case imp.Strict:
+		go func() { txResult <- runStrictWorker(ctx, cancel, dbPool, jobs, wg, imp.query, imp) }()
+	case imp.Transaction:
+		go func() { txResult <- runTransactionWorker(ctx, cancel, dbPool, jobs, wg, imp.query, imp) }()
+	default:
+		go dispatchWorkers(dbPool, jobs, wg, imp.query, imp)
+	}
+
+	// the parse span ends when the last row was handed over, time the reader
+	// spent waiting on the workers is in queue.blocked_seconds
+	_, parse := imp.startSpan("import.parse", attr("queue.capacity", capacity))
+	var err error
+	if imp.parseFile != nil {
+		err = readRanges(ctx, imp.parseFile, imp.parseSize, imp.plan, jobs, wg, imp, settings.ParseWorkers)
+	} else {
+		err = readCsvFilePerLineThenSendToWorker(ctx, imp.newRowReader(input), imp.plan, jobs, wg, imp)
+	}
+	parse.end(err,
+		attr("rows_read", atomic.LoadInt64(&imp.rowsRead)),
+		attr("queue.blocked_sends", atomic.LoadInt64(&imp.chanBlocked)),
+		attr("queue.blocked_seconds", time.Duration(atomic.LoadInt64(&imp.chanBlockedNanos)).Seconds()),
+	)
+	if err != nil {
+		imp.abort(err)
+		cancel()
+	}
+
+	_, drain := imp.startSpan("import.drain")
+	wg.Wait()
+	drain.end(nil)
+	if imp.oneTransaction() {
+		if err := <-txResult; err != nil {
+			imp.abort(err)
+		}
+	}
 }
 
 // trimBOM trims the UTF-8 byte-order mark (BOM) from the beginning of the reader.
@@ -166,25 +1018,58 @@ func trimBOM(r io.Reader) io.Reader {
 	return bytes.NewReader(b)
 }
 
-func openDbConnectionPool() (*pgxpool.Pool, error) {
+// openDbConnectionPool opens a pool for settings and checks it connects,
+// within poolOpenTimeout at most.
+func openDbConnectionPool(ctx context.Context, settings *Config) (*pgxpool.Pool, error) {
 	log.Println("=> open db connection pool")
 
-	config, err := pgxpool.ParseConfig(dbConnString)
+	ctx, cancel := context.WithTimeout(ctx, poolOpenTimeout)
+	defer cancel()
+
+	config, err := pgxpool.ParseConfig(settings.DatabaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	config.MaxConns = int32(dbMaxConns)
-	config.MinConns = int32(dbMaxIdleConns)
+	config.MaxConns = int32(settings.DBMaxConns)
+	config.MinConns = int32(settings.DBMinConns)
 
-	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, err
 	}
+	// the pool connects on first use, fail here while the database is down
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
 
 	return pool, nil
 }
 
+// tables created by ensureTable since startup
+var createdTables = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// ensureTable runs the CREATE TABLE IF NOT EXISTS statement ddl for table once
+// per process.
+func ensureTable(ctx context.Context, dbPool *pgxpool.Pool, table, ddl string) error {
+	createdTables.Lock()
+	defer createdTables.Unlock()
+	key := poolKey(dbPool, table)
+	if createdTables.names[key] {
+		return nil
+	}
+
+	if _, err := dbPool.Exec(ctx, fmt.Sprintf(ddl, table)); err != nil {
+		return err
+	}
+	createdTables.names[key] = true
+	return nil
+}
+
 func openCsvFile() (*csv.Reader, *os.File, error) {
 	log.Println("=> open csv file")
 
@@ -207,23 +1092,127 @@ func openCsvFile() (*csv.Reader, *os.File, error) {
 	return reader, f, nil
 }
 
-func dispatchWorkers(pool *pgxpool.Pool, jobs <-chan []interface{}, wg *sync.WaitGroup, date *DateParams) {
-	for workerIndex := 0; workerIndex <= totalWorker; workerIndex++ {
+func dispatchWorkers(pool *pgxpool.Pool, jobs <-chan []interface{}, wg *sync.WaitGroup, query string, imp *Import) {
+	settings := cfg()
+	mirrored, published := imp.mirrored(), imp.published()
+	routed, queries := imp.routed(), imp.routeQueries(query)
+	checked := len(imp.plan.references) > 0
+	rolledUp := imp.rollsUpBatches()
+	var tuner *batchTuner
+	if settings.AdaptiveBatch.Enabled {
+		tuner = newBatchTuner(settings)
+		imp.mu.Lock()
+		imp.tuner = tuner
+		imp.mu.Unlock()
+	}
+
+	for workerIndex := 0; workerIndex <= settings.Workers; workerIndex++ {
 		go func(workerIndex int, pool *pgxpool.Pool, jobs <-chan []interface{}, wg *sync.WaitGroup) {
 			counter := 0
 
 			for job := range jobs {
+				// a paused import keeps its workers between batches
+				imp.waitResume(context.Background())
+				size := settings.BatchSize
+				if tuner != nil {
+					size = tuner.batchSize()
+				}
+				batch := collectBatch(job, jobs, size)
+				if tuner != nil {
+					tuner.acquire()
+				}
+				started := time.Now()
+				batchNumber := atomic.AddInt64(&imp.batches, 1)
+				batchCtx, span := imp.startSpan("import.batch",
+					attr("batch", batchNumber),
+					attr("batch.rows", len(batch)),
+					attr("worker", workerIndex),
+				)
+
+				_, acquire := startSpan(batchCtx, "db.acquire")
 				conn, err := pool.Acquire(context.Background())
+				acquire.end(err)
 				if err != nil {
+					span.end(err)
 					log.Println("Worker", workerIndex, "failed to acquire connection:", err)
+					if tuner != nil {
+						tuner.release(len(batch), len(batch), time.Since(started))
+					}
+					for _, values := range batch {
+						imp.reject(values, err)
+						wg.Done()
+					}
+					imp.publish(ImportEvent{Type: eventWorkerError, Worker: workerIndex, Message: err.Error()})
 					continue
 				}
 
-				doTheJob(workerIndex, counter, conn, job, date)
+				rows, merge := batch, func(errs []error) []error { return errs }
+				if checked {
+					_, check := startSpan(batchCtx, "db.check_references")
+					rows, merge = imp.checkReferences(context.Background(), conn, batch)
+					check.end(nil, attr("batch.refused", len(batch)-len(rows)))
+				}
 
+				_, insert := startSpan(batchCtx, "db.insert")
+				var errs []error
+				switch {
+				case len(rows) == 0:
+				case routed:
+					errs = imp.insertRouted(context.Background(), conn, queries, rows)
+				case rolledUp:
+					errs = imp.insertRolledUp(context.Background(), conn, query, rows)
+				case len(rows) == 1:
+					errs = []error{doTheJob(imp, workerIndex, batchNumber, counter, conn, rows[0], query)}
+				default:
+					errs = insertBatch(context.Background(), conn, query, rows)
+				}
+				errs = merge(errs)
 				conn.Release()
-				wg.Done()
-				counter++
+				failed := 0
+				for _, err := range errs {
+					if err != nil {
+						failed++
+					}
+				}
+				if tuner != nil {
+					tuner.release(len(batch), failed, time.Since(started))
+				}
+				insert.end(nil)
+				span.end(nil, attr("batch.rejected", failed))
+
+				if mirrored || published {
+					committed := make([][]interface{}, 0, len(batch)-failed)
+					for i, err := range errs {
+						if err == nil {
+							committed = append(committed, batch[i])
+						}
+					}
+					if mirrored {
+						mirrorCtx, mirrorSpan := startSpan(batchCtx, "mirror.insert", attr("batch.rows", len(committed)))
+						imp.mirrorBatch(mirrorCtx, committed)
+						mirrorSpan.end(nil)
+					}
+					if published {
+						publishCtx, publishSpan := startSpan(batchCtx, "broker.publish", attr("batch.rows", len(committed)))
+						imp.publishBatch(publishCtx, batchNumber, committed)
+						publishSpan.end(nil)
+					}
+				}
+
+				for i, err := range errs {
+					if err != nil {
+						imp.reject(batch[i], err)
+						imp.publish(ImportEvent{Type: eventWorkerError, Worker: workerIndex, Message: err.Error()})
+					} else {
+						imp.countInserted(batch[i], 1)
+						if n := atomic.AddInt64(&imp.inserted, 1); n%settings.MilestoneEvery == 0 {
+							imp.publish(ImportEvent{Type: eventMilestone, Rows: n, Message: fmt.Sprintf("%d rows inserted", n)})
+						}
+					}
+					wg.Done()
+					counter++
+				}
+				imp.publish(ImportEvent{Type: eventBatch, Worker: workerIndex, Rows: int64(len(batch) - failed), Message: fmt.Sprintf("batch %d committed, %d rows rejected", batchNumber, failed)})
 			}
 		}(workerIndex, pool, jobs, wg)
 	}
@@ -236,289 +1225,198 @@ func handleError(err error) {
 	}
 }
 
-func readCsvFilePerLineThenSendToWorker(csvReader *csv.Reader, jobs chan<- []interface{}, wg *sync.WaitGroup) {
-	isHeader := true
-
-	// Read all records
-	csvReader.Comma = ';'
-
-	// records, err := csvReader.ReadAll()
-	// handleError(err)
+// readCsvFilePerLineThenSendToWorker feeds converted rows to the workers. In
+// strict mode the first row with a parse error stops the read and is returned;
+// reading also stops once ctx is cancelled.
+func readCsvFilePerLineThenSendToWorker(ctx context.Context, csvReader rowReader, plan *executionPlan, jobs chan<- []interface{}, wg *sync.WaitGroup, imp *Import) error {
+	defer close(jobs)
+	return readRows(ctx, csvReader, plan, jobs, wg, imp, nil)
+}
 
-	// log.Println("=> records : ", len(records))
+// readRows is the loop of readCsvFilePerLineThenSendToWorker. Without a header
+// the first row is taken as the header line; with one, csvReader starts on the
+// data rows, as the ranges of a file parsed in parallel do.
+func readRows(ctx context.Context, csvReader rowReader, plan *executionPlan, jobs chan<- []interface{}, wg *sync.WaitGroup, imp *Import, header *headerMatcher) error {
+	isHeader := header == nil
+	maxRows := cfg().MaxRows
+	tokenKey, hashKey := cfg().TokenizationKey, cfg().PIIHashKey
+	var metadata []interface{}
+	if plan.metadata >= 0 {
+		metadata = imp.metadataValues()
+	}
 
 	for {
 		row, err := csvReader.Read()
 
+		if err != nil {
+			if errors.Is(err, errLimitExceeded) {
+				return err
+			}
+			if err != io.EOF {
+				log.Println("Error reading "+imp.Format+":", err)
+				if imp.Strict {
+					imp.deviate(Deviation{Row: atomic.LoadInt64(&imp.rowsRead) + 1, Kind: deviationMalformed, Message: err.Error()})
+				} else if _, ok := err.(*csv.ParseError); ok && !isHeader {
+					// the reader resumes on the next line, only this one is lost
+					atomic.AddInt64(&imp.rowsRead, 1)
+					imp.reject(nil, &malformedRowError{reason: err.Error()})
+					continue
+				} else {
+					return err
+				}
+			}
+			if n := imp.deviationCount(); n > 0 {
+				return fmt.Errorf("strict import found %d deviations from mapping %s", n, plan.version)
+			}
+
+			return nil
+		}
+
 		if isHeader {
 			isHeader = false
+			header = newHeaderMatcher(row)
+			if imp.Strict {
+				imp.checkHeader(plan, row)
+			}
+			if err := imp.checkHeaderDrift(row); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if len(row) == 0 {
+		if imp.trailer(row) {
 			continue
 		}
 
-		if err != nil {
-			if err == io.EOF {
-				err = nil
+		if header.matches(row) {
+			atomic.AddInt64(&imp.repeatedHeaders, 1)
+			if imp.Strict {
+				imp.deviate(Deviation{Row: atomic.LoadInt64(&imp.rowsRead) + 1, Kind: deviationRepeatedHeader})
 			}
+			continue
+		}
+
+		if len(row) == 0 {
+			continue
+		}
 
-			// log.Println("\n==========START===============\n row => ", row)
-			// log.Println("\nERROR EOF => ", err)
-			// log.Println("\n=============END============\n")
-			break
+		if plan.combined {
+			row = plan.combine(row)
 		}
 
-		for i, field := range row {
-			// Apply field replacement operations to each field
-			field = strings.ReplaceAll(field, "\xE2\x80\x8B", "")
-			field = strings.ReplaceAll(field, "\xEF\xBB\xBF", "")
-			field = regexp.MustCompile(`[^(\x20-\x7F)]*`).ReplaceAllString(field, "")
-			field = strings.ReplaceAll(field, "\r\n", "")
-			field = strings.ReplaceAll(field, "\n\";", "\";")
-			field = strings.ReplaceAll(field, "\"", "")
-			field = strings.ReplaceAll(field, ",", ".")
-			field = strings.ReplaceAll(field, ";;", ";0;")
-			field = strings.ReplaceAll(field, ";", ",")
+		// Apply field replacement operations to each field
+		plan.clean(row)
 
-			// Update the field in the row with the modified value
-			row[i] = field
+		rowNumber := atomic.AddInt64(&imp.rowsRead, 1)
+		if maxRows > 0 && rowNumber > maxRows {
+			return fmt.Errorf("%w: more than %d rows", errLimitExceeded, maxRows)
 		}
 
 		// Check if the record is empty (contains only semicolons)
-		isEmpty := true
+		blank := 0
 		for _, field := range row {
-			if strings.TrimSpace(field) != "" {
-				isEmpty = false
+			if strings.TrimSpace(field) == "" {
+				blank++
 			}
 		}
 
-		if isEmpty {
-			break
-			// close(jobs)
-			// continue
-		}
-
-		if len(row) > 1 {
-			row = []string{strings.Join(row, ";")}
-		}
-
-		// Join the row values using a space separator
-		rowData := strings.Join(row, "")
-		// rowData = strings.ReplaceAll(rowData, ";;;;;;;;;;;;;;;;;;;;;;;;;", "")
-		// rowData = strings.ReplaceAll(rowData, ";;;;;;;;;;;;;;;;;;;;;;;;;;;\r\n", "")
-		// Replace consecutive semicolons with ;null; before splitting
-		// rowData = strings.ReplaceAll(rowData, "\xE2\x80\x8B", "")
-		// rowData = strings.ReplaceAll(rowData, "\xEF\xBB\xBF", "")
-		// rowData = regexp.MustCompile(`[^(\x20-\x7F)]*`).ReplaceAllString(rowData, "")
-		// rowData = strings.ReplaceAll(rowData, "\r\n", "")
-		// rowData = strings.ReplaceAll(rowData, "\n\";", "\";")
-		// rowData = strings.ReplaceAll(rowData, "\"", "")
-		// rowData = strings.ReplaceAll(rowData, ",", ".")
-		// rowData = strings.ReplaceAll(rowData, ";;", ";0;")
-		// rowData = strings.ReplaceAll(rowData, ";", ",")
-
-		row = strings.Split(rowData, ";")
-
-		//check if no waybill is not 0 or nil
-		// if row[0] == "0" {
-		// 	continue
-		// }
-
-		//skiped no data
-		// if len(row) < 25 {
-		// 	continue
-		// }
-
-		var element DataElement
-		if len(row) >= 25 { // Adjust the index based on your CSV structure
-			row = row[:len(row)-2]
-			element.NoWaybill = row[0]
-			// element.TglPengiriman = row[1]
-			// element.WaktuTTD = row[17]
-			if row[1] == "" {
-				row[1] = "0000-00-00"
-			}
-			TglPengiriman, err := time.Parse("2006-01-02", row[1])
-			if err == nil {
-				element.TglPengiriman = TglPengiriman
-			} else {
-				log.Println("\n==========START===============\n row => ", row)
-				log.Println("\n column count : ", len(row))
-				log.Println("Error parsing TglPengiriman:", err)
-			}
-			element.DropPointOutgoing = row[2]
-			element.SprinterPickup = row[3]
-			element.TempatTujuan = row[4]
-			element.Keterangan = row[5]
-			// element.BeratYangDitagih = row[6]
-
-			if row[6] == "" {
-				row[6] = "0"
-			}
-			// Convert string to float64 and assign to BeratYangDitagih field
-			beratYangDitagih, err := strconv.ParseFloat(row[6], 64)
-			if err == nil {
-				element.BeratYangDitagih = beratYangDitagih
-			} else {
-				log.Println("Error parsing BeratYangDitagih:", err)
-			}
+		if blank == len(row) {
+			atomic.AddInt64(&imp.skippedEmpty, 1)
+			continue
+		}
 
-			if row[7] == "" {
-				row[7] = "0"
-			}
-			// element.Cod = row[7]
-			cod, err := strconv.ParseInt(row[7], 10, 64)
-			if err == nil {
-				element.Cod = cod
-			} else {
-				log.Println("Error parsing Cod:", err)
-			}
-			// element.BiayaAsuransi = row[8]
-			if row[8] == "" {
-				row[8] = "0"
+		// strict imports check the field count against the mapping instead
+		if !imp.Strict {
+			if reason := header.fieldCount(row, plan.extras >= 0); reason != "" {
+				values, _ := plan.convert(padRow(row, plan.fileColumns))
+				imp.reject(values, &malformedRowError{reason: fmt.Sprintf("row %d: %s", rowNumber, reason)})
+				continue
 			}
+		}
 
-			biaya_asuransi, err := strconv.ParseFloat(row[8], 64)
-			if err == nil {
-				element.BiayaAsuransi = biaya_asuransi
-			} else {
-				log.Println("Error parsing BiayaAsuransi:", err)
-			}
+		// filtered rows count neither towards the quality nor as errors
+		values, failed := plan.convert(row)
+		if plan.extras >= 0 {
+			values[plan.extras] = plan.extraFields(row, header)
+		}
+		if plan.metadata >= 0 {
+			copy(values[plan.metadata:], metadata)
+		}
+		missed, lookupErr := imp.lookup(values)
+		if name := plan.filtered(values); name != "" {
+			imp.countFiltered(name)
+			continue
+		}
+		imp.countLookupMisses(missed)
 
-			// element.BiayaAsuransi = row[9]
-			if row[9] == "" {
-				row[9] = "0"
-			}
-			biaya_kirim, err := strconv.ParseInt(row[9], 10, 64)
-			if err == nil {
-				element.BiayaKirim = biaya_kirim
-			} else {
-				log.Println("Error parsing BiayaKirim:", err)
-			}
+		if missing := plan.fileColumns - len(row); missing > 0 {
+			blank += missing
+		}
+		atomic.AddInt64(&imp.emptyCells, int64(blank))
 
-			// element.BiayaLainnya = row[10]
-			if row[10] == "" {
-				row[10] = "0"
-			}
-			biaya_lainnya, err := strconv.ParseInt(row[10], 10, 64)
-			if err == nil {
-				element.BiayaLainnya = biaya_lainnya
-			} else {
-				log.Println("Error parsing BiayaLainnya:", err)
-			}
+		flagged := plan.suspicious(row)
+		if len(flagged) > 0 {
+			imp.countSuspicious(plan, flagged)
+			log.Println("Row", rowNumber, "suspicious value in", plan.columns[flagged[0]], "(leading zeros stripped?)")
+		}
 
-			// element.TotalBiaya = row[11]
-			if row[11] == "" {
-				row[11] = "0"
-			}
-			total_biaya, err := strconv.ParseFloat(row[11], 64)
-			if err == nil {
-				element.TotalBiaya = total_biaya
-			} else {
-				log.Println("Error parsing TotalBiaya:", err)
+		imp.countParseErrors(plan, failed)
+		if plan.tokenized {
+			plan.tokenizeValues(values, tokenKey)
+		}
+		plan.protectValues(values, hashKey)
+
+		// nothing more is loaded once a strict import deviated, the rest of the
+		// file is only checked
+		if imp.Strict {
+			imp.checkRow(plan, rowNumber, row, failed, flagged)
+			if imp.deviationCount() > 0 {
+				if ctx.Err() != nil {
+					return nil
+				}
+				continue
 			}
+		}
 
-			element.KlienPengiriman = row[12]
-			element.MetodePembayaran = row[13]
-			element.NamaPengirim = row[14]
-			element.SumberWayBill = row[15]
-			element.PaketRetur = row[16]
-
-			// element.WaktuTTD = row[17]
-			if row[17] == "" {
-				row[17] = "0000-00-00"
-			}
-			waktuTTD, err := time.Parse("2006-01-02 15:04:05", row[17])
-			if err == nil {
-				element.WaktuTTD = waktuTTD
-			} else {
-				log.Println("Error parsing WaktuTTD:", err)
-			}
+		if lookupErr != nil {
+			imp.reject(values, lookupErr)
+			continue
+		}
+		if !imp.keepRow(values) {
+			continue
+		}
+		if imp.profile != nil {
+			imp.profile.add(plan, row, values)
+		}
+		if imp.period != nil {
+			imp.period.count(values)
+		}
 
-			element.Layanan = row[18]
-			// element.Diskon = row[19]
-			if row[19] == "" {
-				row[19] = "0"
-			}
-			diskon, err := strconv.ParseInt(row[19], 10, 64)
-			if err == nil {
-				element.TotalBiayaSetelahDiscon = diskon
-			} else {
-				log.Println("Error parsing Diskon:", err)
-			}
-			// element.TotalBiayaSetelahDiscon = row[20]
-			// Convert string to int64 and assign to Diskon field
-			if row[20] == "" {
-				row[20] = "0"
-			}
-			total_biaya_setelah_diskon, err := strconv.ParseInt(row[20], 10, 64)
-			if err == nil {
-				element.TotalBiayaSetelahDiscon = total_biaya_setelah_diskon
-			} else {
-				log.Println("Error parsing TotalBiayaSetelahDiscon:", err)
+		if imp.partitions != nil {
+			if err := imp.partitions.ensure(ctx, values); err != nil {
+				return err
 			}
+		}
 
-			element.AgenTujuan = row[21]
-			element.Nik = row[22]
-			element.KodePromo = row[23]
-			element.Kategori = row[24]
-		}
-
-		// rowOrdered := make([]interface{}, 0)
-		// for _, each := range element {
-		// 	rowOrdered = append(rowOrdered, each)
-		// }
-
-		// Populate rowOrdered with struct fields
-		rowOrdered := []interface{}{
-			element.NoWaybill,
-			element.TglPengiriman,
-			element.DropPointOutgoing,
-			element.SprinterPickup,
-			element.TempatTujuan,
-			element.Keterangan,
-			element.BeratYangDitagih,
-			element.Cod,
-			element.BiayaAsuransi,
-			element.BiayaKirim,
-			element.BiayaLainnya,
-			element.TotalBiaya,
-			element.KlienPengiriman,
-			element.MetodePembayaran,
-			element.NamaPengirim,
-			element.SumberWayBill,
-			element.PaketRetur,
-			element.WaktuTTD,
-			element.Layanan,
-			element.Diskon,
-			element.TotalBiayaSetelahDiscon,
-			element.AgenTujuan,
-			element.Nik,
-			element.KodePromo,
-			element.Kategori,
+		if err := imp.waitForWindow(ctx); err != nil {
+			return nil
+		}
+		if err := imp.waitResume(ctx); err != nil {
+			return nil
 		}
 
 		wg.Add(1)
-		jobs <- rowOrdered
+		if !imp.sendJob(ctx, jobs, values) {
+			wg.Done()
+			return nil
+		}
 	}
-	close(jobs)
 }
 
-func doTheJob(workerIndex, counter int, conn *pgxpool.Conn, values []interface{}, date *DateParams) {
-	schemaName = fmt.Sprintf("cashback_%s_%s", strings.ToLower(date.Month), strings.ToLower(date.Year))
-	query := fmt.Sprintf("INSERT INTO %s.domain (%s) VALUES (%s)",
-		schemaName,
-		strings.Join(dataHeaders, ","),
-		strings.Join(generateQuestionsMark(len(dataHeaders)), ","),
-	)
-
-	_, err := conn.Exec(context.Background(), query, values...)
+func doTheJob(imp *Import, workerIndex int, batchNumber int64, counter int, conn *pgxpool.Conn, values []interface{}, query string) error {
+	_, err := conn.Exec(context.Background(), prepareInsert(context.Background(), conn, query), values...)
 	if err != nil {
-		log.Println("\n==========START===============\n Values : ", values)
-		log.Println("Worker", workerIndex, "error:", err)
-		log.Println("\n=============END============\n")
+		imp.logRejectedRow(workerIndex, batchNumber, values, err)
 	}
 
 	if counter%100 == 0 {
@@ -527,6 +1425,8 @@ func doTheJob(workerIndex, counter int, conn *pgxpool.Conn, values []interface{}
 	//  else {
 	// 	log.Println("=> worker", workerIndex, "inserted", counter, "data executed")
 	// }
+
+	return err
 }
 
 func generateQuestionsMark(n int) []string {
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultMappingVersion = "default"
+
+// Mapping describes how the columns of an uploaded file are cleaned, converted
+// and written into the destination table. A mapping is identified by its
+// version; once a version has been compiled it is treated as immutable.
+// NullTokens are values that mean empty, like "-" or "NULL", compared after
+// trimming spaces. Computed columns follow the mapped ones in the table.
+// Rows matching one of the Filters are skipped and counted per filter, the
+// others go to the table of the first of the Routes they match. Lookups add
+// columns read from reference tables. Duplicates finds rows repeating a key
+// within the file. Trailer recognises the summary rows at the end of a file.
+// Key is the column identifying a row across files, no_waybill unless set.
+type Mapping struct {
+	Version    string           `yaml:"version" json:"version,omitempty"`
+	Table      string           `yaml:"table" json:"table,omitempty"`
+	Key        string           `yaml:"key" json:"key,omitempty"`
+	Transforms []TransformSpec  `yaml:"transforms" json:"transforms,omitempty"`
+	Columns    []ColumnMapping  `yaml:"columns" json:"columns,omitempty"`
+	NullTokens []string         `yaml:"null_tokens" json:"null_tokens,omitempty"`
+	Computed   []ComputedColumn `yaml:"computed" json:"computed,omitempty"`
+	Filters    []RowFilter      `yaml:"filters" json:"filters,omitempty"`
+	Routes     []RowRoute       `yaml:"routes" json:"routes,omitempty"`
+	Lookups    []LookupColumn   `yaml:"lookups" json:"lookups,omitempty"`
+	Duplicates *DuplicateCheck  `yaml:"duplicates" json:"duplicates,omitempty"`
+	Rollups    []Rollup         `yaml:"rollups" json:"rollups,omitempty"`
+	Trailer    *Trailer         `yaml:"trailer" json:"trailer,omitempty"`
+	// file fields past the mapped ones are kept in a jsonb extra_fields column
+	KeepExtraFields bool `yaml:"keep_extra_fields" json:"keep_extra_fields,omitempty"`
+	// periode_month, periode_year and source_file on every row
+	MetadataColumns bool `yaml:"metadata_columns" json:"metadata_columns,omitempty"`
+	// fail or flag (the default) a header or table that drifted from the mapping
+	OnDrift string `yaml:"on_drift" json:"on_drift,omitempty"`
+	// materialized views built on the table, refreshed after every load
+	MaterializedViews []string `yaml:"materialized_views" json:"materialized_views,omitempty"`
+}
+
+// ColumnMapping maps one positional CSV field to a destination column.
+//
+// StrictText marks identifiers (waybill numbers, NIK) that must be kept
+// verbatim: numeric transforms are never applied to them. MinLength flags
+// all-digit values shorter than expected, the usual sign of leading zeros
+// stripped by a spreadsheet, and PadLength optionally restores them.
+//
+// A column with Sources takes one file field per source name and builds its
+// value from them with the Combine expression, before any transform or type
+// conversion.
+//
+// Tokenize replaces identifiers with vault tokens, either before they are
+// stored ("import") or only in the files handed out ("export"). Columns with
+// the same TokenKind (the column name by default) share their tokens.
+//
+// Protect stores a keyed hash ("hash") or a masked copy ("mask") of personal
+// data instead of the value; a mask leaves MaskVisible characters at the end.
+//
+// Aliases are other header names a strict import accepts for the column.
+//
+// Locale "id" lets a date or timestamp column also take the day first dates
+// of Indonesian exports, "17/05/2023 14:30" or "17 Mei 2023".
+//
+// Scale is the number of digits a decimal column keeps after the point, 2
+// unless set; decimals are stored as numeric, without the rounding of floats.
+//
+// References names the table and column values must exist in, checked per
+// batch before the insert.
+type ColumnMapping struct {
+	Name        string          `yaml:"name" json:"name,omitempty"`
+	Type        string          `yaml:"type" json:"type,omitempty"`
+	Layout      string          `yaml:"layout" json:"layout,omitempty"`
+	Locale      string          `yaml:"locale" json:"locale,omitempty"`
+	Scale       *int            `yaml:"scale" json:"scale,omitempty"`
+	StrictText  bool            `yaml:"strict_text" json:"strict_text,omitempty"`
+	MinLength   int             `yaml:"min_length" json:"min_length,omitempty"`
+	PadLength   int             `yaml:"pad_length" json:"pad_length,omitempty"`
+	Transforms  []TransformSpec `yaml:"transforms" json:"transforms,omitempty"`
+	Sources     []string        `yaml:"sources" json:"sources,omitempty"`
+	Combine     string          `yaml:"combine" json:"combine,omitempty"`
+	Tokenize    string          `yaml:"tokenize" json:"tokenize,omitempty"`
+	TokenKind   string          `yaml:"token_kind" json:"token_kind,omitempty"`
+	Protect     string          `yaml:"protect" json:"protect,omitempty"`
+	MaskVisible int             `yaml:"mask_visible" json:"mask_visible,omitempty"`
+	Aliases     []string        `yaml:"aliases" json:"aliases,omitempty"`
+	References  string          `yaml:"references" json:"references,omitempty"`
+}
+
+// RowFilter skips the rows for which SkipIf, a condition over the converted
+// values like `kat = 'TEST' or cod = 0`, holds.
+type RowFilter struct {
+	Name   string `yaml:"name" json:"name,omitempty"`
+	SkipIf string `yaml:"skip_if" json:"skip_if,omitempty"`
+}
+
+// TransformSpec is a single cleanup step applied to a raw field value.
+// Numeric steps (e.g. decimal comma to dot) are skipped for strict text.
+type TransformSpec struct {
+	Op      string `yaml:"op" json:"op,omitempty"`
+	Old     string `yaml:"old" json:"old,omitempty"`
+	New     string `yaml:"new" json:"new,omitempty"`
+	Pattern string `yaml:"pattern" json:"pattern,omitempty"`
+	Numeric bool   `yaml:"numeric" json:"numeric,omitempty"`
+	// unicode form of normalize, nfc unless set
+	Form string `yaml:"form" json:"form,omitempty"`
+	// characters trim removes from both ends
+	Chars string `yaml:"chars" json:"chars,omitempty"`
+}
+
+// registered mappings by version, loaded once at startup
+var mappings = struct {
+	sync.RWMutex
+	byVersion map[string]*Mapping
+}{byVersion: map[string]*Mapping{}}
+
+// compiled execution plans by mapping version, shared by all imports
+var planCache = struct {
+	sync.RWMutex
+	plans map[string]*executionPlan
+}{plans: map[string]*executionPlan{}}
+
+// defaultMapping reproduces the layout of the courier cashback export.
+func defaultMapping() *Mapping {
+	return &Mapping{
+		Version: defaultMappingVersion,
+		Table:   "domain",
+		Transforms: []TransformSpec{
+			{Op: "replace", Old: "\xE2\x80\x8B"},
+			{Op: "replace", Old: "\xEF\xBB\xBF"},
+			{Op: "normalize"},
+			{Op: "collapse_space"},
+			{Op: "remove_regex", Pattern: `[\p{Cc}\p{Cf}]+`},
+			{Op: "replace", Old: "\r\n"},
+			{Op: "replace", Old: "\n\";", New: "\";"},
+			{Op: "replace", Old: "\""},
+			{Op: "replace", Old: ",", New: ".", Numeric: true},
+			{Op: "replace", Old: ";;", New: ";0;"},
+			{Op: "replace", Old: ";", New: ","},
+		},
+		Columns: []ColumnMapping{
+			{Name: "no_waybill", Type: "text", StrictText: true, MinLength: 10},
+			{Name: "tgl_pengiriman", Type: "date", Layout: "2006-01-02", Locale: localeID},
+			{Name: "drop_point_outgoing", Type: "text"},
+			{Name: "sprinter_pickup", Type: "text"},
+			{Name: "tempat_tujuan", Type: "text"},
+			{Name: "keterangan", Type: "text"},
+			{Name: "berat_yang_ditagih", Type: "float"},
+			{Name: "cod", Type: "int"},
+			{Name: "biaya_asuransi", Type: "float"},
+			{Name: "biaya_kirim", Type: "int"},
+			{Name: "biaya_lainnya", Type: "int"},
+			{Name: "total_biaya", Type: "float"},
+			{Name: "klien_pengiriman", Type: "text"},
+			{Name: "metode_pembayaran", Type: "text"},
+			{Name: "nama_pengirim", Type: "text"},
+			{Name: "sumber_waybill", Type: "text"},
+			{Name: "paket_retur", Type: "text"},
+			{Name: "waktu_ttd", Type: "timestamp", Layout: "2006-01-02 15:04:05", Locale: localeID},
+			{Name: "layanan", Type: "text"},
+			{Name: "diskon", Type: "int"},
+			{Name: "total_biaya_setelah_diskon", Type: "int"},
+			{Name: "agen_tujuan", Type: "text"},
+			{Name: "nik", Type: "text", StrictText: true, MinLength: 16},
+			{Name: "kode_promo", Type: "text"},
+			{Name: "kat", Type: "text"},
+		},
+	}
+}
+
+// loadMappings registers the built-in mapping plus every *.yaml file found in
+// dir, and compiles each of them so that bad mappings fail at startup.
+func loadMappings(dir string) error {
+	all := []*Mapping{defaultMapping()}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		m := new(Mapping)
+		if err := yaml.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("mapping %s: %w", file, err)
+		}
+		if m.Version == "" {
+			return fmt.Errorf("mapping %s: version is required", file)
+		}
+
+		all = append(all, m)
+	}
+
+	for _, m := range all {
+		if _, err := compilePlan(m); err != nil {
+			return fmt.Errorf("mapping %s: %w", m.Version, err)
+		}
+
+		mappings.Lock()
+		mappings.byVersion[m.Version] = m
+		mappings.Unlock()
+
+		log.Println("=> mapping loaded:", m.Version)
+	}
+
+	return nil
+}
+
+// planForVersion returns the cached execution plan of a registered mapping.
+func planForVersion(version string) (*executionPlan, error) {
+	if version == "" {
+		version = defaultMappingVersion
+	}
+
+	mappings.RLock()
+	m, ok := mappings.byVersion[version]
+	mappings.RUnlock()
+	if !ok {
+		m, ok = templateMapping(version)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown mapping version %q", version)
+	}
+
+	return compilePlan(m)
+}
+
+// compilePlan returns the execution plan for m, compiling it on first use.
+func compilePlan(m *Mapping) (*executionPlan, error) {
+	planCache.RLock()
+	plan, ok := planCache.plans[m.Version]
+	planCache.RUnlock()
+	if ok {
+		return plan, nil
+	}
+
+	plan, err := buildPlan(m)
+	if err != nil {
+		return nil, err
+	}
+
+	planCache.Lock()
+	defer planCache.Unlock()
+	if existing, ok := planCache.plans[m.Version]; ok {
+		return existing, nil
+	}
+	planCache.plans[m.Version] = plan
+
+	return plan, nil
+}
+
+type fieldTransform func(string) string
+
+type fieldParser func(string) (interface{}, error)
+
+// executionPlan is the compiled, read-only form of a Mapping. It holds no
+// per-import state and is safe for concurrent use.
+type executionPlan struct {
+	version string
+	table   string
+	columns []string
+	types   []string
+	layouts []string
+	// digits after the point of the decimal columns taken from the file
+	scales         []int32
+	transforms     []fieldTransform
+	textTransforms []fieldTransform
+	columnFns      [][]fieldTransform
+	strictText     []bool
+	minLength      []int
+	padLength      []int
+	parsers        []fieldParser
+	zeroValues     []interface{}
+
+	// file fields, which differ from the columns when some are combined
+	fields    []string
+	aliases   [][]string
+	spans     []int
+	combiners []fieldCombiner
+	combined  bool
+
+	tokenize   []string
+	tokenKinds []string
+	tokenized  bool
+
+	protections []columnProtection
+	// some column is protected with protectHash
+	hashed bool
+
+	nullTokens map[string]bool
+
+	// columns taken from the file; the computed ones follow them in columns
+	fileColumns int
+	computed    []exprFunc
+	lookups     []lookupSpec
+
+	references []referenceCheck
+	duplicates *duplicateSpec
+	// index of the key column, -1 when the mapping has none
+	key int
+
+	filterNames []string
+	filters     []func(values []interface{}) (bool, error)
+
+	routeTables []string
+	routes      []func(values []interface{}) (bool, error)
+
+	rollups []rollupSpec
+	views   []string
+	trailer *trailerSpec
+	// index of the extra_fields column, -1 when the mapping has none
+	extras int
+	// index of periode_month, the first metadata column, -1 without them
+	metadata int
+	onDrift  string
+}
+
+func buildPlan(m *Mapping) (*executionPlan, error) {
+	if len(m.Columns) == 0 {
+		return nil, fmt.Errorf("no columns defined")
+	}
+
+	plan := &executionPlan{
+		version:  m.Version,
+		table:    m.Table,
+		extras:   -1,
+		metadata: -1,
+	}
+	if plan.table == "" {
+		plan.table = "domain"
+	}
+	switch m.OnDrift {
+	case "":
+		plan.onDrift = driftFlag
+	case driftFail, driftFlag:
+		plan.onDrift = m.OnDrift
+	default:
+		return nil, fmt.Errorf("on_drift must be fail or flag")
+	}
+
+	transforms, err := compileTransforms(m.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	plan.transforms = transforms
+
+	var textSpecs []TransformSpec
+	for _, spec := range m.Transforms {
+		if !spec.Numeric {
+			textSpecs = append(textSpecs, spec)
+		}
+	}
+	if plan.textTransforms, err = compileTransforms(textSpecs); err != nil {
+		return nil, err
+	}
+
+	if len(m.NullTokens) > 0 {
+		plan.nullTokens = make(map[string]bool, len(m.NullTokens))
+		for _, token := range m.NullTokens {
+			plan.nullTokens[strings.TrimSpace(token)] = true
+		}
+	}
+
+	for _, col := range m.Columns {
+		if col.StrictText {
+			if col.Type != "" && col.Type != "text" {
+				return nil, fmt.Errorf("column %s: strict_text requires type text", col.Name)
+			}
+			for _, spec := range col.Transforms {
+				if spec.Numeric {
+					return nil, fmt.Errorf("column %s: numeric transform on a strict_text column", col.Name)
+				}
+			}
+		}
+
+		fns, err := compileTransforms(col.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+
+		parser, zero, err := compileParser(col)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+
+		var combiner fieldCombiner
+		if len(col.Sources) > 0 {
+			if combiner, err = compileCombine(col.Sources, col.Combine); err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			if len(col.Aliases) > 0 {
+				return nil, fmt.Errorf("column %s: aliases cannot be used with sources", col.Name)
+			}
+			plan.fields = append(plan.fields, col.Sources...)
+			plan.aliases = append(plan.aliases, make([][]string, len(col.Sources))...)
+			plan.spans = append(plan.spans, len(col.Sources))
+			plan.combined = true
+		} else {
+			if col.Combine != "" {
+				return nil, fmt.Errorf("column %s: combine needs sources", col.Name)
+			}
+			plan.fields = append(plan.fields, col.Name)
+			plan.aliases = append(plan.aliases, col.Aliases)
+			plan.spans = append(plan.spans, 1)
+		}
+		plan.combiners = append(plan.combiners, combiner)
+
+		switch col.Tokenize {
+		case "":
+		case tokenizeOnImport, tokenizeOnExport:
+			if columnType(col) != "text" {
+				return nil, fmt.Errorf("column %s: only text columns can be tokenized", col.Name)
+			}
+			plan.tokenized = true
+		default:
+			return nil, fmt.Errorf("column %s: tokenize must be import or export", col.Name)
+		}
+		kind := col.TokenKind
+		if kind == "" {
+			kind = col.Name
+		}
+		plan.tokenize = append(plan.tokenize, col.Tokenize)
+		plan.tokenKinds = append(plan.tokenKinds, kind)
+
+		plan.columns = append(plan.columns, col.Name)
+		plan.types = append(plan.types, columnType(col))
+		plan.layouts = append(plan.layouts, columnLayout(col))
+		scale, _ := columnScale(col)
+		plan.scales = append(plan.scales, scale)
+		plan.columnFns = append(plan.columnFns, fns)
+		plan.strictText = append(plan.strictText, col.StrictText)
+		plan.minLength = append(plan.minLength, col.MinLength)
+		plan.padLength = append(plan.padLength, col.PadLength)
+		plan.parsers = append(plan.parsers, parser)
+		plan.zeroValues = append(plan.zeroValues, zero)
+	}
+
+	plan.fileColumns = len(plan.columns)
+	for i, col := range m.Columns {
+		if err := plan.compileProtection(i, col); err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		if col.References == "" {
+			continue
+		}
+		if col.Tokenize == tokenizeOnImport || col.Protect != "" {
+			return nil, fmt.Errorf("column %s: references cannot be checked on tokens or protected values", col.Name)
+		}
+		if err := plan.compileReference(i, col.References); err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+	}
+	for _, col := range m.Computed {
+		if col.Name == "" || plan.columnIndex(col.Name) >= 0 {
+			return nil, fmt.Errorf("computed column %q: needs a name of its own", col.Name)
+		}
+		fn, typ, err := compileComputed(col, plan.columns, plan.types)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %s: %w", col.Name, err)
+		}
+		plan.columns = append(plan.columns, col.Name)
+		plan.types = append(plan.types, typ)
+		plan.layouts = append(plan.layouts, columnLayout(ColumnMapping{Type: typ}))
+		plan.tokenize = append(plan.tokenize, "")
+		plan.tokenKinds = append(plan.tokenKinds, col.Name)
+		plan.computed = append(plan.computed, fn)
+	}
+	if err := plan.compileLookups(m.Lookups); err != nil {
+		return nil, err
+	}
+	if m.KeepExtraFields {
+		if err := plan.compileExtraFields(); err != nil {
+			return nil, err
+		}
+	}
+	if m.MetadataColumns {
+		if err := plan.compileMetadataColumns(); err != nil {
+			return nil, err
+		}
+	}
+	if plan.key = plan.columnIndex(m.Key); m.Key == "" {
+		plan.key = plan.columnIndex("no_waybill")
+	} else if plan.key < 0 {
+		return nil, fmt.Errorf("key: unknown column %q", m.Key)
+	}
+	if m.Duplicates != nil {
+		if err := plan.compileDuplicates(m.Duplicates, m.Columns); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, f := range m.Filters {
+		name := f.Name
+		if name == "" {
+			name = fmt.Sprintf("filter_%d", i+1)
+		}
+		fn, err := compileFilter(f.SkipIf, plan.columns, plan.types)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", name, err)
+		}
+		plan.filterNames = append(plan.filterNames, name)
+		plan.filters = append(plan.filters, fn)
+	}
+	if err := plan.compileRoutes(m.Routes); err != nil {
+		return nil, err
+	}
+	if err := plan.compileRollups(m.Rollups); err != nil {
+		return nil, err
+	}
+	if err := plan.compileViews(m.MaterializedViews); err != nil {
+		return nil, err
+	}
+	if m.Trailer != nil {
+		if err := plan.compileTrailer(m.Trailer); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// columnLayout is the time layout of a date or timestamp column.
+func columnLayout(col ColumnMapping) string {
+	switch {
+	case col.Layout != "":
+		return col.Layout
+	case col.Type == "date":
+		return dateLayout
+	case col.Type == "timestamp":
+		return timestampLayout
+	}
+	return ""
+}
+
+// columnType is the mapping type of col, text when left out.
+func columnType(col ColumnMapping) string {
+	if col.Type == "" {
+		return "text"
+	}
+	return col.Type
+}
+
+// columnIndex returns the position of the named column, -1 if unmapped.
+func (p *executionPlan) columnIndex(name string) int {
+	for i, c := range p.columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func compileTransforms(specs []TransformSpec) ([]fieldTransform, error) {
+	fns := make([]fieldTransform, 0, len(specs))
+
+	for _, spec := range specs {
+		spec := spec
+
+		switch spec.Op {
+		case "replace":
+			fns = append(fns, func(s string) string { return strings.ReplaceAll(s, spec.Old, spec.New) })
+		case "remove_regex":
+			re, err := regexp.Compile(spec.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			fns = append(fns, func(s string) string { return re.ReplaceAllString(s, "") })
+		case "trim_space":
+			fns = append(fns, strings.TrimSpace)
+		case "trim":
+			if spec.Chars == "" {
+				return nil, fmt.Errorf("transform trim needs chars")
+			}
+			fns = append(fns, func(s string) string { return strings.Trim(s, spec.Chars) })
+		case "normalize":
+			form, ok := normalForms[strings.ToLower(spec.Form)]
+			if !ok {
+				return nil, fmt.Errorf("transform normalize: form must be nfc, nfkc, nfd or nfkd")
+			}
+			fns = append(fns, func(s string) string {
+				if form.IsNormalString(s) {
+					return s
+				}
+				return form.String(s)
+			})
+		case "collapse_space":
+			fns = append(fns, collapseSpace)
+		case "upper":
+			fns = append(fns, strings.ToUpper)
+		case "lower":
+			fns = append(fns, strings.ToLower)
+		default:
+			return nil, fmt.Errorf("unknown transform %q", spec.Op)
+		}
+	}
+
+	return fns, nil
+}
+
+// forms of the normalize transform; nfc composes accented letters, so "e" and
+// a combining accent are stored like the single letter
+var normalForms = map[string]norm.Form{"": norm.NFC, "nfc": norm.NFC, "nfkc": norm.NFKC, "nfd": norm.NFD, "nfkd": norm.NFKD}
+
+// collapseSpace turns every run of unicode spaces, tabs and line breaks
+// included, into a single space and trims both ends.
+func collapseSpace(s string) string {
+	prev := true
+	for _, r := range s {
+		space := unicode.IsSpace(r)
+		if space && (prev || r != ' ') {
+			return strings.Join(strings.Fields(s), " ")
+		}
+		prev = space
+	}
+	if prev && s != "" {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return s
+}
+
+func compileParser(col ColumnMapping) (fieldParser, interface{}, error) {
+	switch col.Type {
+	case "", "text":
+		return func(s string) (interface{}, error) { return s, nil }, "", nil
+	case "int":
+		return func(s string) (interface{}, error) {
+			if s == "" {
+				s = "0"
+			}
+			v, err := strconv.ParseInt(s, 10, 64)
+			return v, err
+		}, int64(0), nil
+	case "float":
+		return func(s string) (interface{}, error) {
+			if s == "" {
+				s = "0"
+			}
+			v, err := strconv.ParseFloat(s, 64)
+			return v, err
+		}, float64(0), nil
+	case typeDecimal:
+		return compileDecimal(col)
+	case "date", "timestamp":
+		if col.Locale != "" && col.Locale != localeID {
+			return nil, nil, fmt.Errorf("unknown locale %q", col.Locale)
+		}
+		parse := localeTimeParser(columnLayout(col), col.Locale)
+		return func(s string) (interface{}, error) {
+			if s == "" {
+				s = "0000-00-00"
+			}
+			v, err := parse(s)
+			return v, err
+		}, time.Time{}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown type %q", col.Type)
+}
+
+// clean runs the global and column transforms over every field of row.
+func (p *executionPlan) clean(row []string) {
+	for i, field := range row {
+		if p.nullTokens[strings.TrimSpace(field)] {
+			row[i] = ""
+			continue
+		}
+		transforms := p.transforms
+		if i < len(p.strictText) && p.strictText[i] {
+			transforms = p.textTransforms
+		}
+		for _, fn := range transforms {
+			field = fn(field)
+		}
+		if i < len(p.columnFns) {
+			for _, fn := range p.columnFns[i] {
+				field = fn(field)
+			}
+			if n := p.padLength[i]; n > 0 && len(field) < n && isDigits(field) {
+				field = strings.Repeat("0", n-len(field)) + field
+			}
+		}
+		row[i] = field
+	}
+}
+
+var scientificNotationPattern = regexp.MustCompile(`^[0-9]([.,][0-9]+)?[eE]\+?[0-9]+$`)
+
+// suspicious returns the indexes of identifier fields that look mangled by a
+// spreadsheet: all digits but shorter than min_length, or scientific notation.
+func (p *executionPlan) suspicious(row []string) []int {
+	var flagged []int
+	for i, minLen := range p.minLength {
+		if i >= len(row) || row[i] == "" || !p.strictText[i] {
+			continue
+		}
+		field := row[i]
+		if (minLen > 0 && len(field) < minLen && isDigits(field)) || scientificNotationPattern.MatchString(field) {
+			flagged = append(flagged, i)
+		}
+	}
+	return flagged
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// convert turns a cleaned row into insert values ordered like p.columns.
+// Conversion failures are logged and leave the zero value in place; the
+// indexes of the failed columns are returned so they can be counted.
+func (p *executionPlan) convert(row []string) ([]interface{}, []int) {
+	values := make([]interface{}, len(p.columns))
+	copy(values, p.zeroValues)
+
+	if len(row) < p.fileColumns {
+		return values, nil
+	}
+
+	var failed []int
+	for i, parse := range p.parsers {
+		value, err := parse(row[i])
+		if err != nil {
+			log.Println("Error parsing "+p.columns[i]+":", err)
+			failed = append(failed, i)
+			continue
+		}
+		values[i] = value
+	}
+
+	for j, compute := range p.computed {
+		i := p.fileColumns + j
+		value, err := compute(values)
+		if err != nil {
+			log.Println("Error computing "+p.columns[i]+":", err)
+			failed = append(failed, i)
+			continue
+		}
+		values[i] = value
+	}
+
+	return values, failed
+}
+
+// filtered returns the name of the first filter matching values, "" when the
+// row is to be loaded. A filter that fails on a row does not skip it.
+func (p *executionPlan) filtered(values []interface{}) string {
+	for i, skip := range p.filters {
+		if ok, err := skip(values); err != nil {
+			log.Println("Error evaluating filter "+p.filterNames[i]+":", err)
+		} else if ok {
+			return p.filterNames[i]
+		}
+	}
+	return ""
+}
+
+// insertQuery builds the parameterised INSERT statement for a qualified table.
+func (p *executionPlan) insertQuery(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table,
+		strings.Join(p.columns, ","),
+		strings.Join(generateQuestionsMark(len(p.columns)), ","),
+	)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// the columns MetadataColumns adds, in this order, after every other one
+var metadataColumns = []struct{ name, typ string }{
+	{"periode_month", "int"},
+	{"periode_year", "int"},
+	{"source_file", "text"},
+}
+
+// compileMetadataColumns adds the metadata columns to p.
+func (p *executionPlan) compileMetadataColumns() error {
+	p.metadata = len(p.columns)
+	for _, c := range metadataColumns {
+		if p.columnIndex(c.name) >= 0 {
+			return fmt.Errorf("metadata_columns: the mapping already has a column %s", c.name)
+		}
+		p.columns = append(p.columns, c.name)
+		p.types = append(p.types, c.typ)
+		p.layouts = append(p.layouts, "")
+		p.tokenize = append(p.tokenize, "")
+		p.tokenKinds = append(p.tokenKinds, c.name)
+	}
+	return nil
+}
+
+// addMetadataColumns adds the metadata columns to the target of imp and to
+// the route tables created by earlier imports, which copied the target.
+func addMetadataColumns(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	tables := []string{imp.target()}
+	if imp.routed() {
+		tables = imp.routeTargets()
+	}
+	for _, table := range tables {
+		for _, c := range metadataColumns {
+			if _, err := dbPool.Exec(ctx, fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS %s %s", table, c.name, sqlTypes[c.typ])); err != nil {
+				return fmt.Errorf("failed to add %s to %s: %w", c.name, table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// metadataValues are the metadata column values of the rows imp reads from
+// now on: the month and year of the upload, NULL when they are not a month
+// and a year, and the name of the file being read.
+func (imp *Import) metadataValues() []interface{} {
+	var month, year interface{}
+	if m, ok := parseMonth(imp.Month); ok {
+		month = int64(m)
+	}
+	if y, err := strconv.ParseInt(imp.Year, 10, 64); err == nil {
+		year = y
+	}
+	imp.mu.Lock()
+	file := imp.FileName
+	if imp.currentFile != "" {
+		file = imp.currentFile
+	}
+	imp.mu.Unlock()
+	return []interface{}{month, year, file}
+}
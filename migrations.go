@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// versions below this one are kept for the built-in migrations
+const firstFileMigration = 100
+
+const migrationTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	version integer NOT NULL,
+	target text NOT NULL DEFAULT '',
+	name text NOT NULL,
+	checksum text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (version, target)
+)`
+
+// migration is one versioned schema change. A domain migration runs once for
+// every month table of the default mapping, {table} standing for it, and for
+// the month tables created after it on the next run.
+type migration struct {
+	version int
+	name    string
+	sql     string
+	domain  bool
+}
+
+// checksum identifies the statements of m, to notice a file edited after it
+// was applied.
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.sql))
+	return hex.EncodeToString(sum[:8])
+}
+
+// builtinMigrations create the tables of the service itself, with the
+// statements the first use of each table runs.
+func builtinMigrations(settings *Config) []migration {
+	return []migration{
+		{version: 1, name: "import_history", sql: fmt.Sprintf(historyTableDDL, settings.HistoryTable)},
+		{version: 2, name: "audit_log", sql: fmt.Sprintf(auditTableDDL, settings.AuditTable)},
+	}
+}
+
+// migrationFilePattern names the files of migrations_dir: 0100_add_kode_pos.sql,
+// or 0101_add_kode_pos.domain.sql for the month tables
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+?)(\.domain)?\.sql$`)
+
+// loadMigrations returns the built-in migrations and those of migrations_dir
+// by version. {history_table} and {audit_table} in a file stand for the
+// tables of the config.
+func loadMigrations(settings *Config) ([]migration, error) {
+	all := builtinMigrations(settings)
+	byVersion := map[int]string{}
+	for _, m := range all {
+		byVersion[m.version] = m.name
+	}
+
+	entries, err := os.ReadDir(settings.MigrationsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	tables := strings.NewReplacer("{history_table}", settings.HistoryTable, "{audit_table}", settings.AuditTable)
+	for _, e := range entries {
+		match := migrationFilePattern.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		if version < firstFileMigration {
+			return nil, fmt.Errorf("migration %s: versions below %d are reserved", e.Name(), firstFileMigration)
+		}
+		if name, ok := byVersion[version]; ok {
+			return nil, fmt.Errorf("migration %d is both %s and %s", version, name, match[2])
+		}
+		data, err := os.ReadFile(filepath.Join(settings.MigrationsDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := migration{version: version, name: match[2], sql: tables.Replace(string(data)), domain: match[3] != ""}
+		if m.domain && !strings.Contains(m.sql, "{table}") {
+			return nil, fmt.Errorf("migration %s: a domain migration names its table {table}", e.Name())
+		}
+		byVersion[version] = m.name
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].version < all[j].version })
+	return all, nil
+}
+
+// MigrationStatus is a migration and where it was applied.
+type MigrationStatus struct {
+	Version int      `json:"version"`
+	Name    string   `json:"name"`
+	Domain  bool     `json:"domain,omitempty"`
+	Applied []string `json:"applied,omitempty"`
+	Pending []string `json:"pending,omitempty"`
+	// the statements changed since they were applied
+	Changed bool `json:"changed,omitempty"`
+}
+
+// migrationStatus compares the migrations with those applied to dbPool. The
+// target of a migration that is not for the domain tables is "".
+func migrationStatus(ctx context.Context, dbPool *pgxpool.Pool, settings *Config, tenant string) ([]MigrationStatus, []migration, error) {
+	all, err := loadMigrations(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ensureTable(ctx, dbPool, settings.MigrationTable, migrationTableDDL); err != nil {
+		return nil, nil, err
+	}
+
+	type key struct {
+		version int
+		target  string
+	}
+	applied := map[key]string{}
+	rows, err := dbPool.Query(ctx, fmt.Sprintf("SELECT version, target, checksum FROM %s", settings.MigrationTable))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k key
+		var checksum string
+		if err := rows.Scan(&k.version, &k.target, &checksum); err != nil {
+			return nil, nil, err
+		}
+		applied[k] = checksum
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var domainTables []string
+	for _, m := range all {
+		if m.domain {
+			plan, err := planForVersion("")
+			if err != nil {
+				return nil, nil, err
+			}
+			if domainTables, err = monthTables(ctx, dbPool, settings, plan, tenant); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+
+	status := make([]MigrationStatus, len(all))
+	for i, m := range all {
+		s := MigrationStatus{Version: m.version, Name: m.name, Domain: m.domain}
+		targets := []string{""}
+		if m.domain {
+			targets = domainTables
+		}
+		for _, t := range targets {
+			checksum, ok := applied[key{m.version, t}]
+			switch {
+			case !ok:
+				s.Pending = append(s.Pending, t)
+			default:
+				s.Applied = append(s.Applied, t)
+				s.Changed = s.Changed || checksum != m.checksum()
+			}
+		}
+		status[i] = s
+	}
+	return status, all, nil
+}
+
+// migrate applies the pending migrations to dbPool in version order, each
+// migration and target in a transaction of its own, and stops at the first
+// failure. Nodes starting together take turns on an advisory lock.
+func migrate(ctx context.Context, dbPool *pgxpool.Pool, settings *Config, tenant string) ([]MigrationStatus, error) {
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	lockKey := "migrations:" + settings.MigrationTable
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock(hashtextextended($1, 0))", lockKey); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtextextended($1, 0))", lockKey); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+
+	status, all, err := migrationStatus(ctx, dbPool, settings, tenant)
+	if err != nil {
+		return nil, err
+	}
+	var done []MigrationStatus
+	for i, m := range all {
+		if len(status[i].Pending) == 0 {
+			continue
+		}
+		ran := MigrationStatus{Version: m.version, Name: m.name, Domain: m.domain}
+		for _, target := range status[i].Pending {
+			statements := strings.ReplaceAll(m.sql, "{table}", target)
+			tx, err := conn.Begin(ctx)
+			if err == nil {
+				if _, err = tx.Exec(ctx, statements); err == nil {
+					_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (version, target, name, checksum) VALUES ($1, $2, $3, $4)", settings.MigrationTable),
+						m.version, target, m.name, m.checksum())
+				}
+				if err == nil {
+					err = tx.Commit(ctx)
+				} else {
+					tx.Rollback(context.Background())
+				}
+			}
+			if err != nil {
+				if target != "" {
+					return done, fmt.Errorf("migration %d %s on %s: %w", m.version, m.name, target, err)
+				}
+				return done, fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+			}
+			log.Println("=> migration applied:", m.version, m.name, target)
+			ran.Applied = append(ran.Applied, target)
+		}
+		done = append(done, ran)
+	}
+	return done, nil
+}
+
+// migrateOnStart applies the pending migrations of the shared database before
+// the server takes requests.
+func migrateOnStart(settings *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+	_, err = migrate(ctx, dbPool, settings, "")
+	return err
+}
+
+// handleMigrations lists the migrations of the shared database, or of the
+// database of ?tenant= or ?database=, with where each is applied or pending.
+func handleMigrations(c *gin.Context) {
+	dbPool, releasePool, err := acquireImportPool(c.Query("tenant"), c.Query("database"))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	status, _, err := migrationStatus(c.Request.Context(), dbPool, cfg(), c.Query("tenant"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"migrations": status})
+}
+
+// handleApplyMigrations applies the pending migrations, like migrate_on_start
+// but for any database.
+func handleApplyMigrations(c *gin.Context) {
+	dbPool, releasePool, err := acquireImportPool(c.Query("tenant"), c.Query("database"))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	applied, err := migrate(c.Request.Context(), dbPool, cfg(), c.Query("tenant"))
+	var versions []string
+	for _, m := range applied {
+		versions = append(versions, strconv.Itoa(m.Version))
+	}
+	auditRequest(c, auditMigrate, "", fmt.Sprintf("tenant=%s database=%s applied=%s", c.Query("tenant"), c.Query("database"), strings.Join(versions, ",")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "applied": applied})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"applied": applied})
+}
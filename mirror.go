@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// mirror gets a copy of every batch committed to the live tables of the shared
+// database: mirror_database_url receives the same inserts, mirror_file keeps
+// them as json lines (written before the mirror insert, so a batch the mirror
+// missed can be replayed with `big_file_pgsql mirror-replay`).
+var mirror struct {
+	pool *pgxpool.Pool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// mirrorRecord is one line of mirror_file.
+type mirrorRecord struct {
+	ImportID string          `json:"import_id"`
+	Table    string          `json:"table"`
+	Columns  []string        `json:"columns"`
+	Rows     [][]interface{} `json:"rows"`
+	At       time.Time       `json:"at"`
+}
+
+// startMirror opens the mirror database and file. The mirror connects lazily,
+// a mirror that is down fails its batches instead of the startup.
+func startMirror(settings *Config) (func(), error) {
+	if settings.MirrorDatabaseURL != "" {
+		config, err := pgxpool.ParseConfig(settings.MirrorDatabaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("mirror_database_url: %w", err)
+		}
+		config.MaxConns = int32(settings.DBMaxConns)
+		if mirror.pool, err = pgxpool.NewWithConfig(context.Background(), config); err != nil {
+			return nil, fmt.Errorf("mirror_database_url: %w", err)
+		}
+		log.Println("=> mirroring batches to", redactDSN(settings.MirrorDatabaseURL))
+	}
+	if settings.MirrorFile != "" {
+		f, err := os.OpenFile(settings.MirrorFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			if mirror.pool != nil {
+				mirror.pool.Close()
+			}
+			return nil, fmt.Errorf("mirror_file: %w", err)
+		}
+		mirror.file = f
+		log.Println("=> writing batches to", settings.MirrorFile)
+	}
+
+	return func() {
+		if mirror.pool != nil {
+			mirror.pool.Close()
+		}
+		mirror.mu.Lock()
+		if mirror.file != nil {
+			mirror.file.Close()
+			mirror.file = nil
+		}
+		mirror.mu.Unlock()
+	}, nil
+}
+
+// mirrored reports whether the batches of imp are mirrored. Only rows written
+// straight into a live table of the shared database are: strict, staged and
+// replace imports commit theirs all at once at the end, and targets and tenant
+// databases have tables the mirror does not know.
+func (imp *Import) mirrored() bool {
+	if mirror.pool == nil && mirror.file == nil {
+		return false
+	}
+	if imp.oneTransaction() || imp.Staged || imp.Mode != importModeAppend || imp.routed() {
+		return false
+	}
+	_, name := importDatabase(cfg(), imp.Tenant, imp.Database)
+	return name == ""
+}
+
+// mirrorBatch copies rows, which were just committed, to the mirror.
+func (imp *Import) mirrorBatch(ctx context.Context, rows [][]interface{}) {
+	if len(rows) == 0 {
+		return
+	}
+	failed := func(err error) {
+		atomic.AddInt64(&imp.mirrorFailed, int64(len(rows)))
+		log.Println("Mirror of import", imp.ID, "failed:", err)
+	}
+
+	if mirror.file != nil {
+		if err := writeMirrorRecord(mirrorRecord{ImportID: imp.ID, Table: imp.target(), Columns: imp.plan.columns, Rows: rows, At: time.Now()}); err != nil {
+			failed(err)
+			return
+		}
+	}
+	if mirror.pool != nil {
+		conn, err := mirror.pool.Acquire(ctx)
+		if err != nil {
+			failed(err)
+			return
+		}
+		errs := insertBatch(ctx, conn, imp.plan.insertQuery(imp.target()), rows)
+		conn.Release()
+		if err := errors.Join(errs...); err != nil {
+			failed(err)
+			return
+		}
+	}
+	atomic.AddInt64(&imp.mirroredRows, int64(len(rows)))
+}
+
+func writeMirrorRecord(r mirrorRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+	if mirror.file == nil {
+		return errors.New("mirror file is closed")
+	}
+	_, err = mirror.file.Write(append(line, '\n'))
+	return err
+}
+
+// replayMirrorFile inserts the batches of a mirror_file into dbPool, skipping
+// the first skip lines. It returns the number of batches and rows replayed.
+func replayMirrorFile(ctx context.Context, dbPool *pgxpool.Pool, r io.Reader, skip int) (int, int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1<<20), 1<<30)
+
+	line, batches, rows := 0, 0, int64(0)
+	for scanner.Scan() {
+		line++
+		if line <= skip {
+			continue
+		}
+		var rec mirrorRecord
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		// whole numbers go back in as int64 for the int columns
+		dec.UseNumber()
+		if err := dec.Decode(&rec); err != nil {
+			return batches, rows, fmt.Errorf("line %d: %w", line, err)
+		}
+		for _, values := range rec.Rows {
+			for i, v := range values {
+				if n, ok := v.(json.Number); ok {
+					values[i] = jsonNumberValue(n)
+				}
+			}
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", rec.Table, strings.Join(rec.Columns, ","), strings.Join(generateQuestionsMark(len(rec.Columns)), ","))
+		conn, err := dbPool.Acquire(ctx)
+		if err != nil {
+			return batches, rows, err
+		}
+		errs := insertBatch(ctx, conn, query, rec.Rows)
+		conn.Release()
+		if err := errors.Join(errs...); err != nil {
+			return batches, rows, fmt.Errorf("line %d (import %s): %w", line, rec.ImportID, err)
+		}
+		batches++
+		rows += int64(len(rec.Rows))
+	}
+	return batches, rows, scanner.Err()
+}
+
+func jsonNumberValue(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// runMirrorReplayCommand is `big_file_pgsql mirror-replay`, loading a
+// mirror_file into a database, e.g. to catch a replica up after an outage.
+func runMirrorReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("mirror-replay", flag.ContinueOnError)
+	file := fs.String("file", cfg().MirrorFile, "mirror file to replay")
+	databaseURL := fs.String("database-url", cfg().MirrorDatabaseURL, "database to insert the batches into")
+	skip := fs.Int("skip", 0, "number of lines already replayed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" || *databaseURL == "" {
+		return errors.New("mirror-replay needs -file and -database-url")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	settings := *cfg()
+	settings.DatabaseURL = *databaseURL
+	dbPool, err := openDbConnectionPool(context.Background(), &settings)
+	if err != nil {
+		return err
+	}
+	defer dbPool.Close()
+
+	batches, rows, err := replayMirrorFile(context.Background(), dbPool, f, *skip)
+	fmt.Printf("replayed %d batches, %d rows\n", batches, rows)
+	if err != nil {
+		return fmt.Errorf("stopped after line %d: %w", *skip+batches, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotifierConfig configures one notification channel. Slack and Teams post
+// to an incoming webhook, email goes through an SMTP relay.
+type NotifierConfig struct {
+	Type       string   `yaml:"type" json:"type"`
+	WebhookURL string   `yaml:"webhook_url" json:"webhook_url,omitempty"`
+	SMTPAddr   string   `yaml:"smtp_addr" json:"smtp_addr,omitempty"`
+	Username   string   `yaml:"username" json:"username,omitempty"`
+	Password   string   `yaml:"password" json:"password,omitempty"`
+	From       string   `yaml:"from" json:"from,omitempty"`
+	To         []string `yaml:"to" json:"to,omitempty"`
+}
+
+// notifier delivers one rendered message.
+type notifier interface {
+	send(ctx context.Context, subject, text string) error
+}
+
+// notifier types compiled into this binary, by name
+var notifierTypes = map[string]func(NotifierConfig) (notifier, error){
+	"slack": newChatNotifier,
+	"teams": newChatNotifier,
+	"email": newEmailNotifier,
+}
+
+func notifierTypeNames() []string {
+	names := make([]string, 0, len(notifierTypes))
+	for name := range notifierTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkNotifier verifies nc can be opened.
+func checkNotifier(nc NotifierConfig) error {
+	open, ok := notifierTypes[nc.Type]
+	if !ok {
+		return fmt.Errorf("notifier type %q must be one of %v", nc.Type, notifierTypeNames())
+	}
+	_, err := open(nc)
+	return err
+}
+
+const defaultNotifyTemplate = `Import {{.ImportID}} of {{.Month}} {{.Year}} into {{.Target}}: {{.Status}}
+{{.Inserted}} inserted, {{.Rejected}} rejected of {{.RowsRead}} rows ({{printf "%.1f" .ErrorPercent}}% errors)
+{{- if .AbortReason}}
+{{.AbortReason}}{{end}}
+{{- range .Anomalies}}
+Unusual {{.Metric}}: {{.Value}} against {{.Baseline}} on average over {{.Months}} months{{end}}
+{{- if .ReportURL}}
+Report: {{.ReportURL}}{{end}}
+{{- if .RejectsURL}}
+Rejects: {{.RejectsURL}}{{end}}`
+
+// how long the rejects link of a notification keeps working
+const notifyRejectsLinkTTL = maxSignedURLTTL
+
+// notification is what message templates are rendered with.
+type notification struct {
+	ImportReport
+	Target       string
+	ErrorPercent float64
+	ReportURL    string
+	RejectsURL   string
+}
+
+func init() {
+	finishHooks = append(finishHooks, notifyImport)
+}
+
+// notifyImport alerts every notifier about an import that failed, whose
+// share of rejected rows reached notify_error_rate or whose month looks
+// unusual.
+func notifyImport(imp *Import) {
+	settings := cfg()
+	notifiers, errorRate := settings.sourceNotifiers(imp.Source)
+	if len(notifiers) == 0 {
+		return
+	}
+
+	r := imp.report()
+	n := notification{ImportReport: r, Target: imp.target()}
+	if r.RowsRead > 0 {
+		n.ErrorPercent = float64(r.Rejected) / float64(r.RowsRead) * 100
+	}
+	if r.Status != importStatusFailed && len(r.Anomalies) == 0 && (errorRate <= 0 || n.ErrorPercent < errorRate*100) {
+		return
+	}
+
+	if base := strings.TrimRight(settings.PublicURL, "/"); base != "" {
+		n.ReportURL = base + "/imports/" + imp.ID
+		if settings.URLSigningSecret != "" && r.Rejected > 0 {
+			n.RejectsURL = base + signedRejectsPath(settings.URLSigningSecret, imp.ID, "", time.Now().Add(notifyRejectsLinkTTL))
+		}
+	}
+
+	tmpl, err := template.New("notify").Parse(settings.notifyTemplate())
+	if err != nil {
+		log.Println("Notification of import", imp.ID, "not sent:", err)
+		return
+	}
+	var text bytes.Buffer
+	if err := tmpl.Execute(&text, n); err != nil {
+		log.Println("Notification of import", imp.ID, "not sent:", err)
+		return
+	}
+	broadcast(notifiers, fmt.Sprintf("Import %s %s", imp.ID, r.Status), text.String())
+}
+
+// broadcast sends a message to every notifier in the background.
+func broadcast(notifiers []NotifierConfig, subject, text string) {
+	for _, nc := range notifiers {
+		go func(nc NotifierConfig) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			nt, err := notifierTypes[nc.Type](nc)
+			if err == nil {
+				err = nt.send(ctx, subject, text)
+			}
+			if err != nil {
+				log.Println("Notification", subject, "to", nc.Type, "failed:", err)
+			}
+		}(nc)
+	}
+}
+
+func (c *Config) notifyTemplate() string {
+	if c.NotifyTemplate != "" {
+		return c.NotifyTemplate
+	}
+	return defaultNotifyTemplate
+}
+
+// chatNotifier posts to a Slack or Teams incoming webhook; both accept a
+// plain {"text": ...} payload.
+type chatNotifier struct {
+	url string
+}
+
+func newChatNotifier(nc NotifierConfig) (notifier, error) {
+	if nc.WebhookURL == "" {
+		return nil, fmt.Errorf("%s notifier needs a webhook_url", nc.Type)
+	}
+	return &chatNotifier{url: nc.WebhookURL}, nil
+}
+
+func (n *chatNotifier) send(ctx context.Context, subject, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// emailNotifier sends a plain text mail, authenticating when a username is
+// set.
+type emailNotifier struct {
+	NotifierConfig
+}
+
+func newEmailNotifier(nc NotifierConfig) (notifier, error) {
+	if nc.SMTPAddr == "" || nc.From == "" || len(nc.To) == 0 {
+		return nil, fmt.Errorf("email notifier needs smtp_addr, from and to")
+	}
+	return &emailNotifier{nc}, nil
+}
+
+func (n *emailNotifier) send(ctx context.Context, subject, text string) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.SMTPAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + strings.Join(n.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(text, "\n", "\r\n") + "\r\n"
+	return smtp.SendMail(n.SMTPAddr, auth, n.From, n.To, []byte(msg))
+}
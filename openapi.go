@@ -0,0 +1,369 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openapi.json describes the api clients use; the admin endpoints are left
+// out. It is served at /openapi.json and the query of every request it
+// describes is checked against it.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// the response schemas written from the go types when the document loads, so
+// they follow the types instead of being kept up by hand
+var openAPITypes = map[string]interface{}{
+	"ImportReport":   ImportReport{},
+	"ImportProgress": ImportProgress{},
+	"Summary":        Summary{},
+	"AuditEntry":     AuditEntry{},
+}
+
+type openAPISchema struct {
+	Type                 string         `json:"type"`
+	Format               string         `json:"format"`
+	Enum                 []string       `json:"enum"`
+	Pattern              string         `json:"pattern"`
+	Minimum              *float64       `json:"minimum"`
+	Maximum              *float64       `json:"maximum"`
+	Items                *openAPISchema `json:"items"`
+	AdditionalProperties *openAPISchema `json:"additionalProperties"`
+
+	pattern *regexp.Regexp
+}
+
+type openAPIParameter struct {
+	Ref      string        `json:"$ref"`
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required"`
+	Style    string        `json:"style"`
+	Schema   openAPISchema `json:"schema"`
+}
+
+type openAPIOperation struct {
+	Parameters []openAPIParameter `json:"parameters"`
+}
+
+var openAPI struct {
+	// the document as served, with the schemas of openAPITypes
+	document []byte
+	// by method and route, "POST /upload"
+	operations map[string]*openAPIOperation
+}
+
+func init() {
+	if err := loadOpenAPI(); err != nil {
+		panic("openapi.json: " + err.Error())
+	}
+}
+
+var openAPIPathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+func loadOpenAPI() error {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Parameters map[string]openAPIParameter `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		return err
+	}
+	resolve := func(params []openAPIParameter) ([]openAPIParameter, error) {
+		for i, p := range params {
+			if p.Ref != "" {
+				shared, ok := doc.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+				if !ok {
+					return nil, errors.New("unknown parameter " + p.Ref)
+				}
+				p = shared
+			}
+			if err := p.Schema.compile(); err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+			}
+			params[i] = p
+		}
+		return params, nil
+	}
+
+	operations := map[string]*openAPIOperation{}
+	for path, item := range doc.Paths {
+		var shared []openAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		route := openAPIPathParam.ReplaceAllString(path, ":$1")
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			op := &openAPIOperation{}
+			if err := json.Unmarshal(raw, op); err != nil {
+				return fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			params, err := resolve(append(slices.Clone(shared), op.Parameters...))
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			op.Parameters = params
+			operations[strings.ToUpper(method)+" "+route] = op
+		}
+	}
+
+	var served map[string]interface{}
+	if err := json.Unmarshal(openAPIDocument, &served); err != nil {
+		return err
+	}
+	components, _ := served["components"].(map[string]interface{})
+	schemas, _ := components["schemas"].(map[string]interface{})
+	if schemas == nil {
+		return errors.New("components.schemas is missing")
+	}
+	for name, v := range openAPITypes {
+		schemas[name] = jsonSchema(reflect.TypeOf(v), map[reflect.Type]bool{})
+	}
+	document, err := json.MarshalIndent(served, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	openAPI.document, openAPI.operations = document, operations
+	return nil
+}
+
+func (s *openAPISchema) compile() error {
+	var err error
+	if s.Pattern != "" {
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		err = s.Items.compile()
+	}
+	if err == nil && s.AdditionalProperties != nil {
+		err = s.AdditionalProperties.compile()
+	}
+	return err
+}
+
+// check tells why v, a query value, does not fit s.
+func (s *openAPISchema) check(v string) error {
+	switch s.Type {
+	case "array":
+		if s.Items != nil {
+			return s.Items.check(v)
+		}
+	case "object":
+		if s.AdditionalProperties != nil {
+			return s.AdditionalProperties.check(v)
+		}
+	case "boolean":
+		if v != "true" && v != "false" {
+			return errors.New("must be true or false")
+		}
+	case "integer":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		return s.checkBounds(float64(n))
+	case "number":
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		return s.checkBounds(n)
+	case "string":
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+			return errors.New("must be one of " + strings.Join(s.Enum, ", "))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return errors.New("has an invalid format")
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return errors.New("must be an RFC 3339 timestamp")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *openAPISchema) checkBounds(n float64) error {
+	switch {
+	case s.Minimum != nil && s.Maximum != nil && (n < *s.Minimum || n > *s.Maximum):
+		return fmt.Errorf("must be between %v and %v", *s.Minimum, *s.Maximum)
+	case s.Minimum != nil && n < *s.Minimum:
+		return fmt.Errorf("must be at least %v", *s.Minimum)
+	case s.Maximum != nil && n > *s.Maximum:
+		return fmt.Errorf("must be at most %v", *s.Maximum)
+	}
+	return nil
+}
+
+// queryParameter finds the query parameter of op a query key belongs to;
+// expected_sum[total_biaya] belongs to the deepObject expected_sum.
+func (op *openAPIOperation) queryParameter(key string) *openAPIParameter {
+	for i := range op.Parameters {
+		p := &op.Parameters[i]
+		if p.In != "query" {
+			continue
+		}
+		if p.Name == key || p.Style == "deepObject" && strings.HasPrefix(key, p.Name+"[") && strings.HasSuffix(key, "]") {
+			return p
+		}
+	}
+	return nil
+}
+
+// validateRequest checks the query of a request against the parameters of its
+// operation in openapi.json: an unknown parameter, a value of the wrong type
+// or a missing required one answers 400 before the handler runs. An empty
+// value stands for a parameter left out, as the handlers read it.
+func validateRequest(c *gin.Context) {
+	route := strings.TrimPrefix(c.FullPath(), "/tenants/:tenant")
+	op := openAPI.operations[c.Request.Method+" "+route]
+	if op == nil {
+		c.Next()
+		return
+	}
+
+	query := c.Request.URL.Query()
+	for key, values := range query {
+		p := op.queryParameter(key)
+		if p == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown query parameter " + key})
+			return
+		}
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+			if err := p.Schema.check(v); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": key + " " + err.Error()})
+				return
+			}
+		}
+	}
+	for _, p := range op.Parameters {
+		if p.In == "query" && p.Required && query.Get(p.Name) == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": p.Name + " is required"})
+			return
+		}
+	}
+	c.Next()
+}
+
+func handleOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPI.document)
+}
+
+// checkOpenAPIRoutes logs the operations of openapi.json no route serves,
+// e.g. after an endpoint was renamed.
+func checkOpenAPIRoutes(routes gin.RoutesInfo) {
+	served := map[string]bool{}
+	for _, r := range routes {
+		served[r.Method+" "+r.Path] = true
+	}
+	for key := range openAPI.operations {
+		if !served[key] {
+			log.Println("openapi.json:", key, "matches no route")
+		}
+	}
+}
+
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// jsonSchema describes how encoding/json writes a value of type t; seen
+// breaks cycles of nested types.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(jsonMarshaler) || reflect.PointerTo(t).Implements(jsonMarshaler):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		properties := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if !f.IsExported() || tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" {
+				if embedded := jsonSchema(f.Type, seen)["properties"]; embedded != nil {
+					for k, v := range embedded.(map[string]interface{}) {
+						properties[k] = v
+					}
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			schema := jsonSchema(f.Type, seen)
+			if !strings.Contains(opts, "omitempty") {
+				if f.Type.Kind() == reflect.Pointer {
+					schema["nullable"] = true
+				} else {
+					required = append(required, name)
+				}
+			}
+			properties[name] = schema
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
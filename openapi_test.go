@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestOpenAPIRoutes keeps openapi.json and the routes of apiRoutes in step:
+// every route is described and every operation is served.
+func TestOpenAPIRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	apiRoutes(router.Group("/"))
+
+	served := map[string]bool{}
+	for _, r := range router.Routes() {
+		key := r.Method + " " + r.Path
+		served[key] = true
+		if openAPI.operations[key] == nil {
+			t.Errorf("%s is not described in openapi.json", key)
+		}
+	}
+	for key := range openAPI.operations {
+		if !served[key] {
+			t.Errorf("openapi.json: %s matches no route", key)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// smallest range worth a reader of its own
+const minParseRangeBytes = 4 << 20
+
+// parseInRanges reports whether the spooled file f is parsed in parallel
+// ranges, and its size. That needs parse_workers, a plain (not compressed)
+// csv file of at least parallel_parse_min_bytes and an import whose rows may
+// be loaded in any order, so not a strict one.
+func (imp *Import) parseInRanges(f *os.File) (int64, bool) {
+	settings := cfg()
+	if settings.ParseWorkers < 2 || imp.Format != inputFormatCSV || imp.skipRows > 0 || imp.Strict || imp.distributed() || imp.plan.duplicates != nil {
+		return 0, false
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < settings.ParallelParseMinBytes {
+		return 0, false
+	}
+	head := make([]byte, 4)
+	n, _ := f.ReadAt(head, 0)
+	if compressed(head[:n]) {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// readRanges parses a plain csv file with up to parts readers side by side,
+// each on a byte range that starts after a line break, and closes jobs when
+// all of them are done. A quoted field spanning a line break at a range
+// boundary would be split, such files need parse_workers: 1.
+func readRanges(ctx context.Context, r io.ReaderAt, size int64, plan *executionPlan, jobs chan<- []interface{}, wg *sync.WaitGroup, imp *Import, parts int) error {
+	defer close(jobs)
+
+	headerEnd, err := nextLine(r, 0, size)
+	if err != nil {
+		return err
+	}
+	line := make([]byte, headerEnd)
+	if _, err := r.ReadAt(line, 0); err != nil && err != io.EOF {
+		return err
+	}
+	headerReader := csv.NewReader(bytes.NewReader(line))
+	headerReader.Comma = imp.comma()
+	headerRow, err := headerReader.Read()
+	if err != nil {
+		// an empty file has no rows either
+		return nil
+	}
+	headerRow = dropColumns(headerRow, imp.skipColumns)
+	if err := imp.checkHeaderDrift(headerRow); err != nil {
+		return err
+	}
+	header := newHeaderMatcher(headerRow)
+	imp.addBytesRead(headerEnd)
+
+	parts = min(parts, int((size-headerEnd)/minParseRangeBytes)+1)
+	bounds, err := splitRanges(r, headerEnd, size, parts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var first error
+	var readers sync.WaitGroup
+	for i := 0; i+1 < len(bounds); i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			section := io.NewSectionReader(r, bounds[i], bounds[i+1]-bounds[i])
+			input := bufio.NewReaderSize(limitRowLength(&countingReader{r: section, imp: imp}, cfg().MaxRowBytes), rowSampleBytes)
+			_, span := imp.startSpan("import.parse_range", attr("range", i), attr("range.bytes", bounds[i+1]-bounds[i]))
+			err := readRows(ctx, imp.newRowReader(input), plan, jobs, wg, imp, header)
+			span.end(err)
+			if err != nil {
+				mu.Lock()
+				if first == nil {
+					first = fmt.Errorf("range %d: %w", i, err)
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(i)
+	}
+	readers.Wait()
+	return first
+}
+
+// splitRanges cuts [start, size) of r into up to parts ranges, each starting
+// right after a line break, and returns their boundaries.
+func splitRanges(r io.ReaderAt, start, size int64, parts int) ([]int64, error) {
+	bounds := []int64{start}
+	for i := 1; i < parts; i++ {
+		pos := start + (size-start)*int64(i)/int64(parts)
+		if pos <= bounds[len(bounds)-1] {
+			continue
+		}
+		next, err := nextLine(r, pos, size)
+		if err != nil {
+			return nil, err
+		}
+		if next >= size {
+			break
+		}
+		if next > bounds[len(bounds)-1] {
+			bounds = append(bounds, next)
+		}
+	}
+	return append(bounds, size), nil
+}
+
+// nextLine returns the offset after the first line break at or after pos, or
+// size when there is none.
+func nextLine(r io.ReaderAt, pos, size int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for pos < size {
+		n, err := r.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// addBytesRead counts bytes consumed outside a countingReader.
+func (imp *Import) addBytesRead(n int64) {
+	atomic.AddInt64(&imp.bytesRead, n)
+}
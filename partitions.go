@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// destination layouts: a copy of the table in one schema per month, one
+// table range partitioned by month on the partition column, or one table list
+// partitioned by client on the client column
+const (
+	layoutSchemaPerMonth    = "schema_per_month"
+	layoutPartitioned       = "partitioned"
+	layoutClientPartitioned = "partitioned_by_client"
+)
+
+func validLayout(layout string) bool {
+	return layout == layoutSchemaPerMonth || layout == layoutPartitioned || layout == layoutClientPartitioned
+}
+
+// partitionedLayout reports whether layout loads one partitioned table.
+func partitionedLayout(layout string) bool {
+	return layout == layoutPartitioned || layout == layoutClientPartitioned
+}
+
+// partitionColumn is the partition key of layout.
+func (c *Config) partitionColumn(layout string) string {
+	if layout == layoutClientPartitioned {
+		return c.ClientColumn
+	}
+	return c.PartitionColumn
+}
+
+// SQL types of the mapping column types
+var sqlTypes = map[string]string{
+	"text":      "text",
+	"int":       "bigint",
+	"float":     "double precision",
+	typeDecimal: "numeric",
+	"jsonb":     "jsonb",
+	"date":      "date",
+	"timestamp": "timestamp",
+}
+
+// partitions created or found by this process
+var partitions = struct {
+	sync.Mutex
+	created map[string]bool
+}{created: map[string]bool{}}
+
+// partitioner creates the partition of every row before it is sent to the
+// workers.
+type partitioner struct {
+	pool   *pgxpool.Pool
+	target string
+	layout string
+	index  int
+}
+
+// checkPartitionColumn verifies the mapping can be loaded into the
+// partitioned layout.
+func checkPartitionColumn(plan *executionPlan, layout, column string) error {
+	i := plan.columnIndex(column)
+	if i < 0 {
+		return fmt.Errorf("mapping %s has no partition column %s", plan.version, column)
+	}
+	t := plan.types[i]
+	switch {
+	case layout == layoutClientPartitioned && t != "text":
+		return fmt.Errorf("client column %s must be text, mapping %s has %s", column, plan.version, t)
+	case layout == layoutPartitioned && t != "date" && t != "timestamp":
+		return fmt.Errorf("partition column %s must be a date or timestamp, mapping %s has %s", column, plan.version, t)
+	}
+	return nil
+}
+
+// newPartitioner creates the partitioned table of imp, with a default
+// partition for rows without a usable key, when it does not exist yet.
+func newPartitioner(ctx context.Context, dbPool *pgxpool.Pool, imp *Import, column string) (*partitioner, error) {
+	if err := checkPartitionColumn(imp.plan, imp.Layout, column); err != nil {
+		return nil, err
+	}
+	method := "RANGE"
+	if imp.Layout == layoutClientPartitioned {
+		method = "LIST"
+	}
+
+	columns := make([]string, len(imp.plan.columns))
+	for i, name := range imp.plan.columns {
+		columns[i] = name + " " + sqlTypes[imp.plan.types[i]]
+	}
+
+	ddl := fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s;
+CREATE TABLE IF NOT EXISTS %%[1]s (%s) PARTITION BY %s (%s);
+CREATE TABLE IF NOT EXISTS %%[1]s_default PARTITION OF %%[1]s DEFAULT`, imp.Schema, strings.Join(columns, ", "), method, column)
+
+	target := imp.target()
+	if err := ensureTable(ctx, dbPool, target, ddl); err != nil {
+		return nil, fmt.Errorf("failed to create partitioned table %s: %w", target, err)
+	}
+
+	return &partitioner{pool: dbPool, target: target, layout: imp.Layout, index: imp.plan.columnIndex(column)}, nil
+}
+
+// ensure creates the partition of the row's partition value when this
+// process has not seen it yet.
+func (p *partitioner) ensure(ctx context.Context, values []interface{}) error {
+	name, bounds, ok := p.partitionOf(values[p.index])
+	if !ok {
+		return nil
+	}
+
+	partitions.Lock()
+	defer partitions.Unlock()
+	key := poolKey(p.pool, name)
+	if partitions.created[key] {
+		return nil
+	}
+
+	_, err := p.pool.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES %s", name, p.target, bounds))
+	if err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+
+	partitions.created[key] = true
+	return nil
+}
+
+// partitionOf names the partition of a partition value and its bounds. Rows
+// without a date (zero values of unparsable fields) or without a client go to
+// the default partition.
+func (p *partitioner) partitionOf(value interface{}) (string, string, bool) {
+	if p.layout == layoutClientPartitioned {
+		client, ok := value.(string)
+		if !ok || client == "" {
+			return "", "", false
+		}
+		return p.target + "_" + clientPartitionSuffix(client), "IN ('" + strings.ReplaceAll(client, "'", "''") + "')", true
+	}
+
+	t, ok := value.(time.Time)
+	if !ok || t.Year() < 1000 {
+		return "", "", false
+	}
+	from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	name := fmt.Sprintf("%s_%04d_%02d", p.target, t.Year(), int(t.Month()))
+	return name, fmt.Sprintf("FROM ('%s') TO ('%s')", from.Format(dateLayout), to.Format(dateLayout)), true
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// readable part of a client partition name, the table name stays well below
+// the 63 bytes Postgres keeps of an identifier
+const clientPartitionNameLength = 20
+
+// clientPartitionSuffix turns a client name into a readable, unique table
+// name suffix: "PT Maju Jaya" becomes "pt_maju_jaya_" plus a hash of the
+// exact name, as names differing only in case or punctuation are separate
+// clients.
+func clientPartitionSuffix(client string) string {
+	slug := strings.Trim(nonIdentifierChars.ReplaceAllString(strings.ToLower(client), "_"), "_")
+	if len(slug) > clientPartitionNameLength {
+		slug = slug[:clientPartitionNameLength]
+	}
+	sum := sha256.Sum256([]byte(client))
+	return slug + "_" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errImportFinished  = errors.New("import has already finished")
+	errImportPaused    = errors.New("import is already paused")
+	errImportNotPaused = errors.New("import is not paused")
+	errImportQueued    = errors.New("import has not started yet")
+	errPauseOneTx      = errors.New("strict and transaction imports keep their transaction open, they cannot be paused")
+)
+
+// pause stops imp from handing out more rows: the reader stops where it is,
+// each worker finishes its current batch and waits before taking the next
+// one, and a distributed import stops queueing chunks after its checkpoint.
+func (imp *Import) pause() error {
+	if imp.oneTransaction() {
+		return errPauseOneTx
+	}
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	switch {
+	case !imp.finishedAt.IsZero():
+		return errImportFinished
+	case imp.resumed != nil:
+		return errImportPaused
+	case imp.state == importStateQueued:
+		return errImportQueued
+	}
+	imp.enterPauseLocked()
+	imp.resumed = make(chan struct{})
+	return nil
+}
+
+// resume lets a paused imp continue from where it stopped, unless it is also
+// preempted.
+func (imp *Import) resume() (time.Duration, error) {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.resumed == nil {
+		return 0, errImportNotPaused
+	}
+	close(imp.resumed)
+	imp.resumed = nil
+	paused := time.Since(imp.pausedAt)
+	imp.leavePauseLocked()
+	return paused, nil
+}
+
+// preempt pauses imp like pause while it lends its slot to the import by.
+func (imp *Import) preempt(by string) {
+	imp.mu.Lock()
+	if imp.preempted == nil {
+		imp.enterPauseLocked()
+		imp.preempted = make(chan struct{})
+	}
+	imp.mu.Unlock()
+	imp.publish(ImportEvent{Type: eventPaused, Rows: atomic.LoadInt64(&imp.rowsRead), Message: "preempted by import " + by})
+}
+
+// unpreempt gives imp its slot back.
+func (imp *Import) unpreempt() {
+	imp.mu.Lock()
+	if imp.preempted == nil {
+		imp.mu.Unlock()
+		return
+	}
+	close(imp.preempted)
+	imp.preempted = nil
+	imp.leavePauseLocked()
+	imp.mu.Unlock()
+	imp.publish(ImportEvent{Type: eventResumed, Rows: atomic.LoadInt64(&imp.rowsRead), Message: "slot given back"})
+}
+
+// enterPauseLocked shows imp as paused while the api, a preemption or a
+// closed import window holds it. The caller holds imp.mu.
+func (imp *Import) enterPauseLocked() {
+	if imp.resumed != nil || imp.preempted != nil || imp.outsideWindow {
+		return
+	}
+	imp.pausedAt = time.Now()
+	imp.stateBeforePause = imp.state
+	imp.state = importStatePaused
+}
+
+// leavePauseLocked restores the state of imp once nothing holds it anymore.
+// The caller holds imp.mu.
+func (imp *Import) leavePauseLocked() {
+	if imp.resumed == nil && imp.preempted == nil && !imp.outsideWindow && imp.finishedAt.IsZero() {
+		imp.state = imp.stateBeforePause
+	}
+}
+
+// waitResume blocks while imp is paused through the api or preempted.
+func (imp *Import) waitResume(ctx context.Context) error {
+	for {
+		imp.mu.Lock()
+		gate := imp.resumed
+		if gate == nil {
+			gate = imp.preempted
+		}
+		imp.mu.Unlock()
+		if gate == nil {
+			return nil
+		}
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func pauseStatus(err error) int {
+	if errors.Is(err, errPauseOneTx) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusConflict
+}
+
+// handlePauseImport pauses a running import, e.g. while the database is busy
+// with peak traffic. The rows already handed to the workers are inserted
+// first, so the progress settles within a batch per worker.
+func handlePauseImport(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+	if err := imp.pause(); err != nil {
+		c.JSON(pauseStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	p := imp.progress()
+	imp.publish(ImportEvent{Type: eventPaused, Rows: p.RowsRead, Message: "paused by " + requestPrincipal(c)})
+	auditRequest(c, auditPause, imp.ID, "")
+	c.JSON(http.StatusOK, gin.H{"progress": p})
+}
+
+// handleResumeImport continues an import paused with handlePauseImport.
+func handleResumeImport(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+	paused, err := imp.resume()
+	if err != nil {
+		c.JSON(pauseStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	p := imp.progress()
+	imp.publish(ImportEvent{Type: eventResumed, Rows: p.RowsRead, Message: "resumed by " + requestPrincipal(c) + " after " + paused.Round(time.Second).String()})
+	auditRequest(c, auditResume, imp.ID, "paused="+paused.Round(time.Second).String())
+	c.JSON(http.StatusOK, gin.H{"progress": p})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// what ?period_check= does with the months of the rows
+const (
+	periodCheckOff    = "off"
+	periodCheckVerify = "verify"
+	// verify, and take month and year from the file when an upload leaves
+	// them out
+	periodCheckInfer = "infer"
+)
+
+func validPeriodCheck(mode string) bool {
+	return mode == periodCheckOff || mode == periodCheckVerify || mode == periodCheckInfer
+}
+
+// PeriodCheck compares the months of the rows of an import, read from a date
+// column of its mapping, with the month and year it is loaded for, so a May
+// file does not end up in the June schema.
+type PeriodCheck struct {
+	// off, verify or infer, the default of ?period_check=
+	Mode   string `yaml:"mode" json:"mode"`
+	Column string `yaml:"column" json:"column"`
+	// share of the dated rows allowed outside the month, the default of
+	// ?max_outside_percent=
+	MaxOutsidePercent float64 `yaml:"max_outside_percent" json:"max_outside_percent"`
+	// fail or flag
+	OnMismatch string `yaml:"on_mismatch" json:"on_mismatch"`
+}
+
+func defaultPeriodCheck() PeriodCheck {
+	return PeriodCheck{Mode: periodCheckOff, Column: "tgl_pengiriman", MaxOutsidePercent: 5, OnMismatch: controlMismatchFail}
+}
+
+func (p PeriodCheck) check() error {
+	switch {
+	case !validPeriodCheck(p.Mode):
+		return fmt.Errorf("period_check.mode must be off, verify or infer")
+	case p.Column == "":
+		return fmt.Errorf("period_check.column must name a date column")
+	case p.MaxOutsidePercent < 0 || p.MaxOutsidePercent > 100:
+		return fmt.Errorf("period_check.max_outside_percent must be between 0 and 100")
+	case p.OnMismatch != controlMismatchFail && p.OnMismatch != controlMismatchFlag:
+		return fmt.Errorf("period_check.on_mismatch must be fail or flag")
+	}
+	return nil
+}
+
+// periodMode is the period check of s, period_check.mode unless the upload
+// or its source chose one.
+func (s *importSpec) periodMode(settings *Config) string {
+	if s.periodCheck != "" {
+		return s.periodCheck
+	}
+	return settings.PeriodCheck.Mode
+}
+
+// infersDate tells whether the month and year of s are to be read from its
+// file.
+func (s *importSpec) infersDate(settings *Config) bool {
+	return s.periodMode(settings) == periodCheckInfer && s.date.Month == "" && s.date.Year == ""
+}
+
+// periodSpec is a checked period check.
+type periodSpec struct {
+	column     int
+	maxOutside float64
+	onMismatch string
+}
+
+// compilePeriod checks the period check of s against plan, nil when it is
+// off. The default of the config skips mappings without its column, one the
+// upload asked for fails.
+func (s *importSpec) compilePeriod(settings *Config, plan *executionPlan) (*periodSpec, error) {
+	mode := s.periodMode(settings)
+	if !validPeriodCheck(mode) {
+		return nil, fmt.Errorf("period_check must be off, verify or infer")
+	}
+	if mode == periodCheckOff {
+		return nil, nil
+	}
+	column := settings.PeriodCheck.Column
+	i := plan.columnIndex(column)
+	if i < 0 || i >= plan.fileColumns || (plan.types[i] != "date" && plan.types[i] != "timestamp") {
+		if s.periodCheck == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("period_check: %s is not a date column of mapping %s", column, plan.version)
+	}
+
+	p := &periodSpec{column: i, maxOutside: settings.PeriodCheck.MaxOutsidePercent, onMismatch: settings.PeriodCheck.OnMismatch}
+	if s.maxOutside != "" {
+		v, err := strconv.ParseFloat(s.maxOutside, 64)
+		if err != nil || v < 0 || v > 100 {
+			return nil, fmt.Errorf("max_outside_percent must be between 0 and 100")
+		}
+		p.maxOutside = v
+	}
+	return p, nil
+}
+
+// periodCounter counts the rows of an import by the month of their date
+// column.
+type periodCounter struct {
+	sync.Mutex
+	spec     *periodSpec
+	declared string
+	inferred bool
+	months   map[string]int64
+	undated  int64
+}
+
+const periodKeyLayout = "2006-01"
+
+func newPeriodCounter(spec *periodSpec, date DateParams) *periodCounter {
+	t := &periodCounter{spec: spec, months: map[string]int64{}}
+	if month, ok := parseMonth(date.Month); ok {
+		if year, err := strconv.Atoi(date.Year); err == nil {
+			t.declared = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Format(periodKeyLayout)
+		}
+	}
+	return t
+}
+
+// count adds the row of values to the month of its date column.
+func (t *periodCounter) count(values []interface{}) {
+	d, _ := values[t.spec.column].(time.Time)
+	t.Lock()
+	defer t.Unlock()
+	if d.IsZero() {
+		t.undated++
+		return
+	}
+	t.months[d.Format(periodKeyLayout)]++
+}
+
+// dominant is the month most rows fall in, the earlier one of a tie.
+func (t *periodCounter) dominant() (string, int64) {
+	var month string
+	var rows int64
+	for m, n := range t.months {
+		if n > rows || n == rows && m < month {
+			month, rows = m, n
+		}
+	}
+	return month, rows
+}
+
+// PeriodReport compares the months of the rows with the month and year of
+// the import.
+type PeriodReport struct {
+	Column   string `json:"column"`
+	Declared string `json:"declared"`
+	// month and year were taken from the file
+	Inferred bool `json:"inferred"`
+	// the month most rows fall in
+	Dominant          string           `json:"dominant"`
+	Rows              int64            `json:"rows"`
+	Outside           int64            `json:"outside"`
+	OutsidePercent    float64          `json:"outside_percent"`
+	MaxOutsidePercent float64          `json:"max_outside_percent"`
+	Undated           int64            `json:"undated"`
+	Months            map[string]int64 `json:"months"`
+	Matched           bool             `json:"matched"`
+	OnMismatch        string           `json:"on_mismatch"`
+}
+
+func (t *periodCounter) report(column string) *PeriodReport {
+	t.Lock()
+	defer t.Unlock()
+	r := &PeriodReport{
+		Column:            column,
+		Declared:          t.declared,
+		Inferred:          t.inferred,
+		MaxOutsidePercent: t.spec.maxOutside,
+		Undated:           t.undated,
+		Months:            make(map[string]int64, len(t.months)),
+		OnMismatch:        t.spec.onMismatch,
+	}
+	for m, n := range t.months {
+		r.Months[m] = n
+		r.Rows += n
+	}
+	r.Dominant, _ = t.dominant()
+	r.Outside = r.Rows - t.months[t.declared]
+	if r.Rows > 0 {
+		r.OutsidePercent = math.Round(float64(r.Outside)*10000/float64(r.Rows)) / 100
+	}
+	r.Matched = r.OutsidePercent <= r.MaxOutsidePercent
+	return r
+}
+
+// checkPeriod compares the months of the rows read with the month of the
+// import once they are in, aborting it when too many fall outside and its
+// on_mismatch is fail.
+func (imp *Import) checkPeriod() {
+	r := imp.period.report(imp.plan.columns[imp.period.spec.column])
+	imp.mu.Lock()
+	imp.periodReport = r
+	imp.mu.Unlock()
+
+	if !r.Matched && r.OnMismatch == controlMismatchFail {
+		err := fmt.Errorf("%v%% of the rows are outside %s, at most %v%% may be", r.OutsidePercent, r.Declared, r.MaxOutsidePercent)
+		if r.Dominant != r.Declared {
+			err = fmt.Errorf("%w, most are of %s", err, r.Dominant)
+		}
+		imp.abort(err)
+	}
+}
+
+// inferDate sets the month and year of s to the month most rows of files fall
+// in, reading them once through the mapping before the import.
+func (s *importSpec) inferDate(settings *Config, files []importFile) error {
+	probe := *s
+	now := time.Now()
+	probe.date = DateParams{Month: now.Month().String(), Year: strconv.Itoa(now.Year())}
+	if err := probe.resolve(settings); err != nil {
+		return err
+	}
+	if probe.period == nil {
+		return fmt.Errorf("period_check=infer needs month and year, mapping %s has no date column %s", probe.plan.version, settings.PeriodCheck.Column)
+	}
+
+	imp := probe.build("", 0)
+	for _, f := range files {
+		if err := imp.scanPeriod(f); err != nil {
+			return fmt.Errorf("period_check=infer: %s: %w", f.name, err)
+		}
+	}
+	month, _ := imp.period.dominant()
+	if month == "" {
+		return fmt.Errorf("period_check=infer found no %s in the file, send month and year", settings.PeriodCheck.Column)
+	}
+	d, _ := time.Parse(periodKeyLayout, month)
+	s.date = DateParams{Month: d.Month().String(), Year: strconv.Itoa(d.Year())}
+	s.periodInferred = true
+	return nil
+}
+
+// scanPeriod counts the rows of f by month into the period counter of imp.
+// Only the date column is parsed, so rows the filters of the mapping skip
+// are counted too; the scan stops where reading the file would.
+func (imp *Import) scanPeriod(f importFile) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, err := decompressUpload(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	plan, column := imp.plan, imp.period.spec.column
+	rows := imp.newRowReader(imp.inputReader(body))
+	var header *headerMatcher
+	for {
+		row, err := rows.Read()
+		if err != nil {
+			// a broken file fails once it is loaded
+			return nil
+		}
+		if header == nil {
+			header = newHeaderMatcher(row)
+			continue
+		}
+		if imp.trailer(row) || header.matches(row) || len(row) == 0 {
+			continue
+		}
+		if plan.combined {
+			row = plan.combine(row)
+		}
+		if len(row) < plan.fileColumns {
+			continue
+		}
+		plan.clean(row)
+		values := make([]interface{}, len(plan.columns))
+		values[column], _ = plan.parsers[column](row[column])
+		imp.period.count(values)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// how a column holding personal data is protected before it is stored; unlike
+// a token neither can be turned back into the value
+const (
+	protectHash = "hash"
+	protectMask = "mask"
+)
+
+// characters a masked value keeps visible at its end by default
+const defaultMaskVisible = 4
+
+type columnProtection struct {
+	column  int
+	mode    string
+	visible int
+}
+
+// compileProtection adds the protection of column i of p.
+func (p *executionPlan) compileProtection(i int, col ColumnMapping) error {
+	switch col.Protect {
+	case "":
+		if col.MaskVisible != 0 {
+			return fmt.Errorf("mask_visible needs protect: mask")
+		}
+		return nil
+	case protectHash, protectMask:
+	default:
+		return fmt.Errorf("protect must be hash or mask")
+	}
+	switch {
+	case columnType(col) != "text":
+		return fmt.Errorf("only text columns can be protected")
+	case col.Tokenize != "":
+		return fmt.Errorf("a column is either tokenized or protected")
+	case col.MaskVisible < 0 || (col.MaskVisible > 0 && col.Protect != protectMask):
+		return fmt.Errorf("mask_visible must be positive and needs protect: mask")
+	}
+	visible := col.MaskVisible
+	if visible == 0 {
+		visible = defaultMaskVisible
+	}
+	p.protections = append(p.protections, columnProtection{column: i, mode: col.Protect, visible: visible})
+	if col.Protect == protectHash {
+		p.hashed = true
+	}
+	return nil
+}
+
+// protection returns how column i is protected, nil when it is not.
+func (p *executionPlan) protection(i int) *columnProtection {
+	for j := range p.protections {
+		if p.protections[j].column == i {
+			return &p.protections[j]
+		}
+	}
+	return nil
+}
+
+// protect returns value as column c stores it. Empty values stay empty.
+func (c *columnProtection) protect(key, value string) string {
+	if value == "" {
+		return ""
+	}
+	if c.mode == protectHash {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	runes := []rune(value)
+	visible := c.visible
+	if visible >= len(runes) {
+		visible = 0
+	}
+	return strings.Repeat("*", len(runes)-visible) + string(runes[len(runes)-visible:])
+}
+
+// protectValues replaces the values of the protected columns, before a row
+// can reach the database, the rejects or the log.
+func (p *executionPlan) protectValues(values []interface{}, key string) {
+	for j := range p.protections {
+		c := &p.protections[j]
+		if s, ok := values[c.column].(string); ok {
+			values[c.column] = c.protect(key, s)
+		}
+	}
+}
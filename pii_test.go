@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestColumnProtection(t *testing.T) {
+	hash := func(key, value string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		mode    string
+		visible int
+		in      string
+		want    string
+	}{
+		{protectMask, 4, "081234567890", "********7890"},
+		{protectMask, 2, "081234567890", "**********90"},
+		// runes, not bytes, are masked
+		{protectMask, 2, "Jl. Sudirman né", "*************né"},
+		// a value no longer than what stays visible is masked whole
+		{protectMask, 4, "1234", "****"},
+		{protectMask, 4, "12", "**"},
+		{protectMask, 4, "", ""},
+		{protectHash, 0, "081234567890", hash("secret", "081234567890")},
+		{protectHash, 0, "", ""},
+	}
+	for _, tt := range tests {
+		c := &columnProtection{mode: tt.mode, visible: tt.visible}
+		if got := c.protect("secret", tt.in); got != tt.want {
+			t.Errorf("%s/%d %q: %q, want %q", tt.mode, tt.visible, tt.in, got, tt.want)
+		}
+	}
+
+	c := &columnProtection{mode: protectHash}
+	if c.protect("secret", "a") == c.protect("other", "a") {
+		t.Error("the hash does not depend on the key")
+	}
+}
+
+func TestProtectValues(t *testing.T) {
+	p := &executionPlan{protections: []columnProtection{
+		{column: 0, mode: protectMask, visible: 2},
+		{column: 2, mode: protectHash},
+	}}
+	values := []interface{}{"12345", "kept", nil}
+	p.protectValues(values, "secret")
+	if values[0] != "***45" || values[1] != "kept" || values[2] != nil {
+		t.Fatalf("protected values: %v", values)
+	}
+}
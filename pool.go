@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// poolLease is a connection pool together with the users currently borrowing
+// it, so it is only closed once the last of them is done.
+type poolLease struct {
+	pool     *pgxpool.Pool
+	settings string
+	users    sync.WaitGroup
+}
+
+// sharedPool is the connection pool of the process, opened on first use and
+// replaced when the database settings change. Retired pools are closed in the
+// background once their imports have finished.
+var sharedPool struct {
+	sync.Mutex
+	current  *poolLease
+	retiring int
+	// pools of the database targets and of the tenants with their own
+	// database_url, see importDatabase
+	named map[string]*poolLease
+}
+
+func init() {
+	configHooks = append(configHooks, reconfigurePool)
+}
+
+func poolSettings(c *Config) string {
+	return fmt.Sprintf("%s|%d|%d", c.DatabaseURL, c.DBMinConns, c.DBMaxConns)
+}
+
+// poolOpenTimeout bounds connecting and pinging a new pool, so a database
+// that does not answer fails the caller instead of blocking it.
+const poolOpenTimeout = 10 * time.Second
+
+// acquirePool returns the shared pool and the function to call once the
+// caller no longer uses it. Connections are still acquired from the pool as
+// usual; this only keeps the pool open while it is in use.
+func acquirePool() (*pgxpool.Pool, func(), error) {
+	return acquirePoolContext(context.Background())
+}
+
+// acquirePoolContext is acquirePool giving up on opening a pool once ctx is
+// done.
+func acquirePoolContext(ctx context.Context) (*pgxpool.Pool, func(), error) {
+	return acquireLease(ctx, "", cfg)
+}
+
+// acquireImportPool is acquirePool for an import of tenant into the database
+// target named database, either of which may be empty. Targets and tenants
+// with their own database_url get a pool of their own.
+func acquireImportPool(tenant, database string) (*pgxpool.Pool, func(), error) {
+	_, name := importDatabase(cfg(), tenant, database)
+	if name == "" {
+		return acquirePool()
+	}
+	return acquireLease(context.Background(), name, func() *Config {
+		settings, _ := importDatabase(cfg(), tenant, database)
+		return settings
+	})
+}
+
+// acquireLease borrows the pool of the lease called name ("" for the shared
+// one), opened for the settings returned by settingsOf. A missing or outdated
+// pool is opened and pinged without the sharedPool lock, so a slow database
+// does not hold up the callers of the other pools, and swapped in afterwards
+// unless another caller was faster or the settings changed meanwhile.
+func acquireLease(ctx context.Context, name string, settingsOf func() *Config) (*pgxpool.Pool, func(), error) {
+	for {
+		settings := settingsOf()
+		key := poolSettings(settings)
+
+		sharedPool.Lock()
+		if lease := leaseLocked(name); lease != nil && lease.settings == key {
+			lease.users.Add(1)
+			sharedPool.Unlock()
+			return lease.pool, lease.users.Done, nil
+		}
+		sharedPool.Unlock()
+
+		pool, err := openDbConnectionPool(ctx, settings)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sharedPool.Lock()
+		if poolSettings(settingsOf()) != key {
+			// opened for settings replaced while connecting
+			sharedPool.Unlock()
+			pool.Close()
+			continue
+		}
+		lease := leaseLocked(name)
+		if lease != nil && lease.settings == key {
+			// another caller opened one first
+			lease.users.Add(1)
+			sharedPool.Unlock()
+			pool.Close()
+			return lease.pool, lease.users.Done, nil
+		}
+		if lease != nil {
+			retirePoolLocked(lease)
+		}
+		lease = &poolLease{pool: pool, settings: key}
+		if name == "" {
+			sharedPool.current = lease
+		} else {
+			if sharedPool.named == nil {
+				sharedPool.named = map[string]*poolLease{}
+			}
+			sharedPool.named[name] = lease
+		}
+		lease.users.Add(1)
+		sharedPool.Unlock()
+		return lease.pool, lease.users.Done, nil
+	}
+}
+
+// leaseLocked returns the lease called name, nil if there is none. The caller
+// holds the sharedPool lock.
+func leaseLocked(name string) *poolLease {
+	if name == "" {
+		return sharedPool.current
+	}
+	return sharedPool.named[name]
+}
+
+// poolKey names a table of one database, for the caches of what was created.
+func poolKey(dbPool *pgxpool.Pool, table string) string {
+	return fmt.Sprintf("%p/%s", dbPool, table)
+}
+
+// retirePoolLocked closes lease once its users are done. The caller holds the
+// sharedPool lock.
+func retirePoolLocked(lease *poolLease) {
+	sharedPool.retiring++
+
+	// the new settings may point at another database
+	createdTables.Lock()
+	createdTables.names = map[string]bool{}
+	createdTables.Unlock()
+	partitions.Lock()
+	partitions.created = map[string]bool{}
+	partitions.Unlock()
+
+	go func() {
+		lease.users.Wait()
+		lease.pool.Close()
+		log.Println("=> closed retired db connection pool")
+
+		sharedPool.Lock()
+		sharedPool.retiring--
+		sharedPool.Unlock()
+	}()
+}
+
+// reconfigurePool swaps in a pool for the new settings right away, so that a
+// bad database_url is reported when it is set rather than on the next upload.
+func reconfigurePool(old, next *Config) {
+	// pools of removed targets and tenants, the changed ones are replaced on
+	// their next use
+	sharedPool.Lock()
+	for name, lease := range sharedPool.named {
+		if !namedDatabaseExists(next, name) {
+			retirePoolLocked(lease)
+			delete(sharedPool.named, name)
+		}
+	}
+	sharedPool.Unlock()
+
+	if poolSettings(old) == poolSettings(next) {
+		return
+	}
+
+	_, releasePool, err := acquirePool()
+	if err != nil {
+		log.Println("Failed to open db connection pool for the new settings:", err)
+		return
+	}
+	releasePool()
+}
+
+// handlePoolStats reports the usage of the shared connection pool.
+func handlePoolStats(c *gin.Context) {
+	sharedPool.Lock()
+	lease, retiring := sharedPool.current, sharedPool.retiring
+	named := make(gin.H, len(sharedPool.named))
+	for name, l := range sharedPool.named {
+		stat := l.pool.Stat()
+		named[name] = gin.H{"total_conns": stat.TotalConns(), "acquired_conns": stat.AcquiredConns(), "max_conns": stat.MaxConns()}
+	}
+	sharedPool.Unlock()
+
+	if lease == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Database pool is not open", "retiring_pools": retiring})
+		return
+	}
+
+	stat := lease.pool.Stat()
+	c.JSON(http.StatusOK, gin.H{
+		"total_conns":            stat.TotalConns(),
+		"acquired_conns":         stat.AcquiredConns(),
+		"idle_conns":             stat.IdleConns(),
+		"constructing_conns":     stat.ConstructingConns(),
+		"max_conns":              stat.MaxConns(),
+		"acquire_count":          stat.AcquireCount(),
+		"acquire_duration_ms":    stat.AcquireDuration().Milliseconds(),
+		"empty_acquire_count":    stat.EmptyAcquireCount(),
+		"canceled_acquire_count": stat.CanceledAcquireCount(),
+		"new_conns_count":        stat.NewConnsCount(),
+		"retiring_pools":         retiring,
+		"database_pools":         named,
+		"statement_cache":        statementCacheStats(),
+	})
+}
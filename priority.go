@@ -0,0 +1,28 @@
+package main
+
+import "fmt"
+
+// priorities of an import, in the order the slots of max_running_imports go
+// to them
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorityRanks = map[string]int{priorityLow: 0, priorityNormal: 1, priorityHigh: 2}
+
+// priorityRank orders priorities, an empty one being normal.
+func priorityRank(priority string) int {
+	if priority == "" {
+		return priorityRanks[priorityNormal]
+	}
+	return priorityRanks[priority]
+}
+
+func checkPriority(priority string) error {
+	if _, ok := priorityRanks[priority]; priority != "" && !ok {
+		return fmt.Errorf("priority must be high, normal or low")
+	}
+	return nil
+}
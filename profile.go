@@ -0,0 +1,295 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+// A profile describes the values of every column an import loaded: how many
+// were empty, about how many distinct ones there were, their range and, for
+// text, the most frequent ones. Analysts check it before reconciling a load.
+
+const (
+	// hyperloglog registers per column, about 2.3% error on distinct counts
+	profileRegisterBits = 11
+	profileRegisters    = 1 << profileRegisterBits
+	// values counted per text column; the top ones are estimates, counted
+	// with the Misra-Gries summary
+	profileCounters  = 100
+	profileTopValues = 10
+)
+
+// ColumnProfile holds the statistics of one column. Min and Max are those of
+// numbers and times, MinLength and MaxLength those of text.
+type ColumnProfile struct {
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Values    int64           `json:"values"`
+	Nulls     int64           `json:"nulls"`
+	NullRate  float64         `json:"null_rate"`
+	Distinct  int64           `json:"distinct_estimate"`
+	Min       interface{}     `json:"min,omitempty"`
+	Max       interface{}     `json:"max,omitempty"`
+	MinLength int             `json:"min_length,omitempty"`
+	MaxLength int             `json:"max_length,omitempty"`
+	Buckets   []ProfileBucket `json:"buckets,omitempty"`
+	TopValues []ProfileValue  `json:"top_values,omitempty"`
+}
+
+// ProfileBucket counts the numbers within an order of magnitude.
+type ProfileBucket struct {
+	Range string `json:"range"`
+	Count int64  `json:"count"`
+}
+
+// ProfileValue is a frequent value with a lower bound of its count.
+type ProfileValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// ImportProfile is what GET /imports/:id/profile returns.
+type ImportProfile struct {
+	ImportID string          `json:"import_id"`
+	State    string          `json:"state"`
+	Rows     int64           `json:"rows"`
+	Columns  []ColumnProfile `json:"columns"`
+}
+
+type columnStats struct {
+	values, nulls        int64
+	registers            [profileRegisters]uint8
+	min, max             float64
+	minTime, maxTime     time.Time
+	minLength, maxLength int
+	buckets              map[int]int64
+	counters             map[string]int64
+}
+
+type profiler struct {
+	sync.Mutex
+	rows    int64
+	columns []columnStats
+}
+
+func newProfiler(plan *executionPlan) *profiler {
+	p := &profiler{columns: make([]columnStats, len(plan.columns))}
+	for i := range p.columns {
+		p.columns[i].buckets = map[int]int64{}
+		p.columns[i].counters = map[string]int64{}
+	}
+	return p
+}
+
+// add counts a row about to be loaded; row holds the cleaned fields of the
+// file, values all columns.
+func (p *profiler) add(plan *executionPlan, row []string, values []interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	p.rows++
+	for i, value := range values {
+		s := &p.columns[i]
+		if i < plan.fileColumns && (i >= len(row) || strings.TrimSpace(row[i]) == "") {
+			// ints and floats convert empty fields to 0
+			s.nulls++
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+			s.nulls++
+			continue
+		case int64, float64, decimal.Decimal:
+			n, _ := numberValue(v)
+			s.number(n)
+		case time.Time:
+			if v.IsZero() {
+				s.nulls++
+				continue
+			}
+			if s.values == 0 || v.Before(s.minTime) {
+				s.minTime = v
+			}
+			if s.values == 0 || v.After(s.maxTime) {
+				s.maxTime = v
+			}
+		case string:
+			s.text(v)
+		}
+		s.values++
+		s.distinct(formatValue(value))
+	}
+}
+
+func (s *columnStats) number(v float64) {
+	if s.values == 0 || v < s.min {
+		s.min = v
+	}
+	if s.values == 0 || v > s.max {
+		s.max = v
+	}
+	s.buckets[magnitude(v)]++
+}
+
+func (s *columnStats) text(v string) {
+	n := len([]rune(v))
+	if s.values == 0 || n < s.minLength {
+		s.minLength = n
+	}
+	if n > s.maxLength {
+		s.maxLength = n
+	}
+
+	if _, ok := s.counters[v]; ok || len(s.counters) < profileCounters {
+		s.counters[v]++
+		return
+	}
+	for k := range s.counters {
+		if s.counters[k]--; s.counters[k] == 0 {
+			delete(s.counters, k)
+		}
+	}
+}
+
+func (s *columnStats) distinct(v string) {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	x := h.Sum64()
+	// fnv leaves the high bits of similar keys alike, mix them
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	idx := x >> (64 - profileRegisterBits)
+	rank := uint8(bits.LeadingZeros64(x<<profileRegisterBits|1<<(profileRegisterBits-1)) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+func (s *columnStats) estimateDistinct() int64 {
+	m := float64(profileRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	if n := float64(s.values); estimate > n {
+		estimate = n
+	}
+	return int64(math.Round(estimate))
+}
+
+// magnitude is the power of ten below v, -1 for numbers below 1 and -2 for
+// negative ones.
+func magnitude(v float64) int {
+	switch {
+	case v < 0:
+		return -2
+	case v < 1:
+		return -1
+	}
+	return int(math.Floor(math.Log10(v)))
+}
+
+func magnitudeRange(m int) string {
+	switch m {
+	case -2:
+		return "< 0"
+	case -1:
+		return "0 - 1"
+	}
+	low := strconv.FormatFloat(math.Pow10(m), 'f', -1, 64)
+	high := strconv.FormatFloat(math.Pow10(m+1), 'f', -1, 64)
+	return low + " - " + high
+}
+
+// snapshot returns the profile so far.
+func (p *profiler) snapshot(plan *executionPlan) ([]ColumnProfile, int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	columns := make([]ColumnProfile, len(p.columns))
+	for i := range p.columns {
+		s := &p.columns[i]
+		c := ColumnProfile{
+			Name:     plan.columns[i],
+			Type:     plan.types[i],
+			Values:   s.values,
+			Nulls:    s.nulls,
+			Distinct: s.estimateDistinct(),
+		}
+		if total := s.values + s.nulls; total > 0 {
+			c.NullRate = math.Round(float64(s.nulls)/float64(total)*10000) / 10000
+		}
+		if s.values > 0 {
+			switch plan.types[i] {
+			case "int":
+				c.Min, c.Max = int64(s.min), int64(s.max)
+			case "float", typeDecimal:
+				c.Min, c.Max = s.min, s.max
+			case "date", "timestamp":
+				c.Min, c.Max = s.minTime, s.maxTime
+			default:
+				c.MinLength, c.MaxLength = s.minLength, s.maxLength
+			}
+		}
+
+		var magnitudes []int
+		for m := range s.buckets {
+			magnitudes = append(magnitudes, m)
+		}
+		sort.Ints(magnitudes)
+		for _, m := range magnitudes {
+			c.Buckets = append(c.Buckets, ProfileBucket{Range: magnitudeRange(m), Count: s.buckets[m]})
+		}
+
+		for v, n := range s.counters {
+			c.TopValues = append(c.TopValues, ProfileValue{Value: v, Count: n})
+		}
+		sort.Slice(c.TopValues, func(a, b int) bool {
+			if c.TopValues[a].Count != c.TopValues[b].Count {
+				return c.TopValues[a].Count > c.TopValues[b].Count
+			}
+			return c.TopValues[a].Value < c.TopValues[b].Value
+		})
+		if len(c.TopValues) > profileTopValues {
+			c.TopValues = c.TopValues[:profileTopValues]
+		}
+		columns[i] = c
+	}
+	return columns, p.rows
+}
+
+// handleImportProfile returns the column statistics of an import, while it
+// runs too.
+func handleImportProfile(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+	if imp.profile == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import was not profiled, upload with profile=true"})
+		return
+	}
+	columns, rows := imp.profile.snapshot(imp.plan)
+	c.JSON(http.StatusOK, ImportProfile{ImportID: imp.ID, State: imp.status(), Rows: rows, Columns: columns})
+}
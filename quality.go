@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QualityScore rates an import from 0 to 100. Score is the mean of the four
+// sub-scores:
+//   - completeness: share of non-empty cells
+//   - validity: share of cells that parsed and did not look mangled
+//   - uniqueness: share of rows that were not rejected as duplicates
+//   - consistency: share of rows the database accepted otherwise
+type QualityScore struct {
+	Score        float64 `json:"score"`
+	Completeness float64 `json:"completeness"`
+	Validity     float64 `json:"validity"`
+	Uniqueness   float64 `json:"uniqueness"`
+	Consistency  float64 `json:"consistency"`
+}
+
+// SQLSTATE of a unique constraint violation
+const uniqueViolation = "23505"
+
+const historyTableDDL = `CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	import_id text NOT NULL,
+	month text NOT NULL,
+	year text NOT NULL,
+	mapping_version text NOT NULL,
+	mode text NOT NULL,
+	status text NOT NULL,
+	rows_read bigint NOT NULL,
+	inserted bigint NOT NULL,
+	rejected bigint NOT NULL,
+	skipped_empty bigint NOT NULL,
+	started_at timestamptz NOT NULL,
+	finished_at timestamptz NOT NULL,
+	quality_score double precision,
+	completeness double precision,
+	validity double precision,
+	uniqueness double precision,
+	consistency double precision,
+	parse_errors jsonb,
+	suspicious_values jsonb,
+	rejects_by_class jsonb,
+	rejects_by_code jsonb,
+	principal text,
+	source_ip text,
+	user_agent text,
+	api_key text,
+	tenant text,
+	metrics jsonb,
+	recorded_at timestamptz NOT NULL DEFAULT clock_timestamp()
+);
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS parse_errors jsonb,
+	ADD COLUMN IF NOT EXISTS suspicious_values jsonb,
+	ADD COLUMN IF NOT EXISTS rejects_by_class jsonb,
+	ADD COLUMN IF NOT EXISTS rejects_by_code jsonb,
+	ADD COLUMN IF NOT EXISTS principal text,
+	ADD COLUMN IF NOT EXISTS source_ip text,
+	ADD COLUMN IF NOT EXISTS user_agent text,
+	ADD COLUMN IF NOT EXISTS api_key text,
+	ADD COLUMN IF NOT EXISTS tenant text,
+	ADD COLUMN IF NOT EXISTS metrics jsonb,
+	ADD COLUMN IF NOT EXISTS recorded_at timestamptz NOT NULL DEFAULT clock_timestamp()`
+
+func init() {
+	finishHooks = append(finishHooks, recordHistory)
+}
+
+// quality scores a report; nil when no data row was read.
+func (imp *Import) quality(r ImportReport) *QualityScore {
+	rows := r.RowsRead - r.SkippedEmpty - r.Filtered
+	if rows <= 0 {
+		return nil
+	}
+	cells := float64(rows) * float64(len(imp.plan.columns))
+
+	var invalid int64
+	for _, n := range r.ParseErrors {
+		invalid += n
+	}
+	for _, n := range r.Suspicious {
+		invalid += n
+	}
+	duplicates := r.RejectsByCode[uniqueViolation]
+	uniqueness := duplicates
+	if d := r.Duplicates; d != nil && d.Keep != duplicatesRejectAll {
+		// repeated keys the mapping dropped or only reported
+		uniqueness += d.Rows
+	}
+
+	q := &QualityScore{
+		Completeness: percent(1 - float64(atomic.LoadInt64(&imp.emptyCells))/cells),
+		Validity:     percent(1 - float64(invalid)/cells),
+		Uniqueness:   percent(1 - float64(uniqueness)/float64(rows)),
+		Consistency:  percent(1 - float64(r.Rejected-duplicates)/float64(rows)),
+	}
+	q.Score = math.Round((q.Completeness+q.Validity+q.Uniqueness+q.Consistency)/4*10) / 10
+	return q
+}
+
+func percent(ratio float64) float64 {
+	return math.Round(math.Max(0, math.Min(1, ratio))*1000) / 10
+}
+
+// recordHistory stores the outcome and quality of a finished import.
+func recordHistory(imp *Import) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r := imp.report()
+	table := cfg().HistoryTable
+
+	imp.mu.Lock()
+	finishedAt := imp.finishedAt
+	imp.mu.Unlock()
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		log.Println("History of import", imp.ID, "not recorded:", err)
+		return
+	}
+	defer releasePool()
+
+	if err := ensureTable(ctx, dbPool, table, historyTableDDL); err != nil {
+		log.Println("History of import", imp.ID, "not recorded:", err)
+		return
+	}
+
+	var score, completeness, validity, uniqueness, consistency *float64
+	if q := r.Quality; q != nil {
+		score, completeness, validity, uniqueness, consistency = &q.Score, &q.Completeness, &q.Validity, &q.Uniqueness, &q.Consistency
+	}
+	// what the anomaly check of later imports compares with
+	var metrics *string
+	if imp.metrics != nil {
+		b, _ := json.Marshal(imp.metrics.values(imp.plan, r.Inserted))
+		s := string(b)
+		metrics = &s
+	}
+
+	_, err = dbPool.Exec(ctx, "INSERT INTO "+table+` (import_id, month, year, mapping_version, mode, status, rows_read,
+		inserted, rejected, skipped_empty, started_at, finished_at, quality_score, completeness, validity, uniqueness, consistency,
+		parse_errors, suspicious_values, rejects_by_class, rejects_by_code, principal, source_ip, user_agent, api_key, tenant, metrics)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27)`,
+		imp.ID, imp.Month, imp.Year, r.MappingVersion, imp.Mode, r.Status, r.RowsRead,
+		r.Inserted, r.Rejected, r.SkippedEmpty, imp.StartedAt, finishedAt,
+		score, completeness, validity, uniqueness, consistency,
+		jsonText(r.ParseErrors), jsonText(r.Suspicious), jsonText(r.RejectsByClass), jsonText(r.RejectsByCode),
+		imp.Principal, imp.SourceIP, imp.UserAgent, imp.APIKey, imp.Tenant, metrics,
+	)
+	if err != nil {
+		log.Println("History of import", imp.ID, "not recorded:", err)
+	}
+}
+
+// jsonText encodes per-column counts for a jsonb column.
+func jsonText(counts map[string]int64) string {
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// QualityTrend is the average quality of the imports of one period.
+type QualityTrend struct {
+	Month        string    `json:"month"`
+	Year         string    `json:"year"`
+	Source       *string   `json:"source,omitempty"`
+	Imports      int64     `json:"imports"`
+	Score        float64   `json:"score"`
+	MinScore     float64   `json:"min_score"`
+	Completeness float64   `json:"completeness"`
+	Validity     float64   `json:"validity"`
+	Uniqueness   float64   `json:"uniqueness"`
+	Consistency  float64   `json:"consistency"`
+	LastImportAt time.Time `json:"last_import_at"`
+}
+
+// handleQualityStats returns the quality trend per month/year period, oldest
+// first, for the last ?periods= periods (12 by default), optionally for one
+// ?mapping= version. With ?by= every period is split per upload source. A
+// tenant only sees its own imports.
+func handleQualityStats(c *gin.Context) {
+	periods, err := strconv.Atoi(c.DefaultQuery("periods", "12"))
+	if err != nil || periods < 1 || periods > 120 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "periods must be between 1 and 120"})
+		return
+	}
+
+	source := "NULL::text"
+	if by := c.Query("by"); by != "" {
+		column, ok := sourceColumn(by)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "by must be one of " + sourceDimensionNames()})
+			return
+		}
+		source = "coalesce(h." + column + ", '')"
+	}
+
+	table := cfg().HistoryTable
+	query := `WITH periods AS (
+			SELECT month, year, max(finished_at) AS last_at FROM ` + table + `
+			WHERE quality_score IS NOT NULL AND ($1 = '' OR mapping_version = $1) AND ($3 = '' OR tenant = $3)
+			GROUP BY month, year ORDER BY last_at DESC LIMIT $2
+		)
+		SELECT h.month, h.year, ` + source + `, count(*), avg(h.quality_score), min(h.quality_score), avg(h.completeness),
+		avg(h.validity), avg(h.uniqueness), avg(h.consistency), max(h.finished_at)
+		FROM ` + table + ` h JOIN periods p ON p.month = h.month AND p.year = h.year
+		WHERE h.quality_score IS NOT NULL AND ($1 = '' OR h.mapping_version = $1) AND ($3 = '' OR h.tenant = $3)
+		GROUP BY h.month, h.year, 3 ORDER BY min(p.last_at), 3`
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	ctx := c.Request.Context()
+	if err := ensureTable(ctx, dbPool, table, historyTableDDL); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+
+	rows, err := dbPool.Query(ctx, query, c.Query("mapping"), periods, requestTenant(c))
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+	defer rows.Close()
+
+	trend := []QualityTrend{}
+	for rows.Next() {
+		var t QualityTrend
+		if err := rows.Scan(&t.Month, &t.Year, &t.Source, &t.Imports, &t.Score, &t.MinScore, &t.Completeness, &t.Validity, &t.Uniqueness, &t.Consistency, &t.LastImportAt); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+			return
+		}
+		for _, v := range []*float64{&t.Score, &t.Completeness, &t.Validity, &t.Uniqueness, &t.Consistency} {
+			*v = math.Round(*v*10) / 10
+		}
+		trend = append(trend, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"periods": trend})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// node roles: api nodes take uploads, worker nodes load the chunks of
+// distributed imports, all does both
+const (
+	nodeRoleAll    = "all"
+	nodeRoleAPI    = "api"
+	nodeRoleWorker = "worker"
+)
+
+// states of a chunk in the checkpoint store
+const (
+	chunkQueued  = "queued"
+	chunkRunning = "running"
+	chunkDone    = "done"
+	chunkFailed  = "failed"
+)
+
+// chunkSpec is what a worker needs to load a chunk the way the api node would
+// have; the names are checked against its own resolution.
+type chunkSpec struct {
+	Month    string `json:"month"`
+	Year     string `json:"year"`
+	Mapping  string `json:"mapping"`
+	Tenant   string `json:"tenant,omitempty"`
+	Database string `json:"database,omitempty"`
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	// the delimiter of the file, sniffed once by the api node
+	Delimiter string `json:"delimiter,omitempty"`
+	// the leading lines are skipped by the api node, the columns by the workers
+	SkipColumns int `json:"skip_columns,omitempty"`
+	// the upload, for the source_file column
+	FileName string `json:"file_name,omitempty"`
+}
+
+// chunkReject is a stored reject of a chunk, with its values.
+type chunkReject struct {
+	Values []interface{} `json:"values"`
+	Class  string        `json:"class"`
+	Code   string        `json:"code,omitempty"`
+	Error  string        `json:"error"`
+}
+
+// chunkResult is what a worker reports back for a chunk.
+type chunkResult struct {
+	Report     ImportReport  `json:"report"`
+	EmptyCells int64         `json:"empty_cells"`
+	Rejects    []chunkReject `json:"rejects,omitempty"`
+}
+
+// distributed reports whether imp is loaded by the queue workers. Strict,
+// staged and replace imports need all their rows in one place and stay local,
+// json files because chunks are cut at csv records.
+func (imp *Import) distributed() bool {
+	return cfg().DistributedImports && imp.Format == inputFormatCSV && !imp.multiFile && !imp.oneTransaction() && !imp.Staged && imp.Mode == importModeAppend && imp.plan.duplicates == nil && imp.totals == nil && imp.period == nil
+}
+
+// runChunks cuts input into chunks of about chunk_bytes, queues them in the
+// checkpoint store and waits for the workers, adding their results to imp. An
+// import retried with the same id and file continues after the chunks its
+// first attempt queued.
+func runChunks(ctx context.Context, imp *Import, input *bufio.Reader) {
+	settings := cfg()
+	store := checkpoints
+
+	cp, err := store.loadCheckpoint(ctx, imp.ID)
+	if err != nil {
+		imp.abort(fmt.Errorf("failed to read the checkpoint: %w", err))
+		return
+	}
+	switch {
+	case cp == nil:
+		cp = &ImportCheckpoint{ImportID: imp.ID, Checksum: imp.Checksum}
+	case imp.Checksum == "" || cp.Checksum != imp.Checksum:
+		imp.abort(fmt.Errorf("import id %s already has chunks of another file queued", imp.ID))
+		return
+	default:
+		log.Println("=> import", imp.ID, "resumes after chunk", cp.Batches, "at byte", cp.Offset)
+		imp.publish(ImportEvent{Type: eventResumed, Message: fmt.Sprintf("%d chunks were queued before", cp.Batches)})
+	}
+
+	spec, err := json.Marshal(chunkSpec{Month: imp.Month, Year: imp.Year, Mapping: imp.plan.version, Tenant: imp.Tenant, Database: imp.Database, Schema: imp.Schema, Table: imp.Table, Delimiter: string(imp.comma()), SkipColumns: imp.skipColumns, FileName: imp.FileName})
+	if err != nil {
+		imp.abort(err)
+		return
+	}
+	resumed := cp.Batches
+	err = splitChunks(input, imp.comma(), settings.ChunkBytes, cp.Offset, func(data []byte, end int64) error {
+		if err := imp.waitResume(ctx); err != nil {
+			return err
+		}
+		b := &BatchCheckpoint{ImportID: imp.ID, Batch: cp.Batches + 1, Spec: spec, Data: data}
+		if err := store.queueBatch(ctx, b); err != nil {
+			return err
+		}
+		cp.Batches, cp.Offset = b.Batch, end
+		return store.saveCheckpoint(ctx, *cp)
+	})
+	if err != nil {
+		// the chunks already queued are still loaded, so they are waited for
+		imp.abort(fmt.Errorf("failed to queue chunk %d: %w", cp.Batches+1, err))
+	}
+	imp.publish(ImportEvent{Type: eventMilestone, Message: fmt.Sprintf("%d chunks queued", cp.Batches-resumed)})
+
+	for {
+		time.Sleep(time.Second)
+		if err := collectChunks(ctx, store, imp); err != nil {
+			log.Println("Failed to collect chunks of import", imp.ID, err)
+			continue
+		}
+		n, err := store.pending(ctx, imp.ID)
+		if err != nil {
+			log.Println("Failed to collect chunks of import", imp.ID, err)
+			continue
+		}
+		if n == 0 {
+			break
+		}
+	}
+	// one more pass for the chunks finished since the last one
+	if err := collectChunks(ctx, store, imp); err != nil {
+		log.Println("Failed to collect chunks of import", imp.ID, err)
+	}
+	if err := store.forget(ctx, imp.ID); err != nil {
+		log.Println("Failed to drop the checkpoint of import", imp.ID, err)
+	}
+}
+
+// splitChunks calls queue with every chunk of about size bytes of input after
+// offset skip, and the offset the chunk ends at. Chunks end with a whole csv
+// record, so quoted line breaks stay in their chunk, and start with the header
+// line.
+func splitChunks(input io.Reader, comma rune, size, skip int64, queue func(data []byte, end int64) error) error {
+	var buf bytes.Buffer
+	reader := csv.NewReader(io.TeeReader(input, &buf))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var header []byte
+	var start int64
+	flush := func(end int64) error {
+		data := buf.Next(int(end - start))
+		start = end
+		if len(data) == 0 {
+			return nil
+		}
+		return queue(append(append([]byte(nil), header...), data...), end)
+	}
+
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			return flush(reader.InputOffset())
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return err
+		}
+		offset := reader.InputOffset()
+		switch {
+		case header == nil:
+			header = append([]byte(nil), buf.Next(int(offset))...)
+			start = offset
+		case offset <= skip:
+			// queued by an earlier attempt
+			buf.Next(int(offset - start))
+			start = offset
+		case offset-start >= size:
+			if err := flush(offset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// collectChunks adds the finished chunks of imp to it; chunks whose worker
+// stopped renewing its lease are failed, their rows may be partly loaded.
+func collectChunks(ctx context.Context, store CheckpointStore, imp *Import) error {
+	finished, err := store.takeFinished(ctx, imp.ID)
+	if err != nil {
+		return err
+	}
+	for _, b := range finished {
+		if b.Result != nil {
+			var r chunkResult
+			if err := json.Unmarshal(b.Result, &r); err != nil {
+				imp.abort(fmt.Errorf("chunk %d: %w", b.Batch, err))
+				continue
+			}
+			imp.mergeChunk(&r)
+		}
+		if b.State == chunkFailed {
+			imp.abort(fmt.Errorf("chunk %d failed: %s", b.Batch, b.Error))
+		}
+		if b.Worker != "" {
+			imp.publish(ImportEvent{Type: eventMilestone, Message: fmt.Sprintf("chunk %d %s on %s", b.Batch, b.State, b.Worker)})
+		}
+	}
+	return nil
+}
+
+// mergeChunk adds the counts and rejects of a chunk to imp.
+func (imp *Import) mergeChunk(r *chunkResult) {
+	atomic.AddInt64(&imp.rowsRead, r.Report.RowsRead)
+	atomic.AddInt64(&imp.inserted, r.Report.Inserted)
+	atomic.AddInt64(&imp.rejected, r.Report.Rejected)
+	atomic.AddInt64(&imp.skippedEmpty, r.Report.SkippedEmpty)
+	atomic.AddInt64(&imp.filtered, r.Report.Filtered)
+	atomic.AddInt64(&imp.repeatedHeaders, r.Report.RepeatedHeaders)
+	imp.mergeTrailer(r.Report.Trailer)
+	imp.mergeDrift(r.Report.Drift)
+	atomic.AddInt64(&imp.emptyCells, r.EmptyCells)
+	atomic.AddInt64(&imp.mirroredRows, r.Report.Mirrored)
+	atomic.AddInt64(&imp.mirrorFailed, r.Report.MirrorFailed)
+	atomic.AddInt64(&imp.publishedRows, r.Report.Published)
+	atomic.AddInt64(&imp.publishFailed, r.Report.PublishFailed)
+
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	addCounts(imp.parseErrors, r.Report.ParseErrors)
+	addCounts(imp.suspicious, r.Report.Suspicious)
+	addCounts(imp.filteredBy, r.Report.FilteredBy)
+	addCounts(imp.routedRows, r.Report.Routes)
+	addCounts(imp.lookupMisses, r.Report.LookupMisses)
+	addCounts(imp.rejectsByClass, r.Report.RejectsByClass)
+	addCounts(imp.rejectsByCode, r.Report.RejectsByCode)
+	for _, rej := range r.Rejects {
+		if len(imp.rejects) >= cfg().MaxStoredRejects {
+			break
+		}
+		imp.rejects = append(imp.rejects, RejectedRow{Values: rej.Values, Class: rej.Class, Code: rej.Code, Error: rej.Error})
+	}
+	if r.Report.LimitExceeded {
+		imp.limitExceeded = true
+	}
+}
+
+func addCounts(dst, src map[string]int64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// runChunkWorkers starts queue_workers loops claiming chunks of distributed
+// imports, from this node or any other sharing the database.
+func runChunkWorkers(settings *Config) {
+	host, _ := os.Hostname()
+	for i := 0; i < settings.QueueWorkers; i++ {
+		name := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), i)
+		go runChunkWorker(name)
+	}
+	log.Println("=> loading queued chunks with", settings.QueueWorkers, "workers")
+}
+
+func runChunkWorker(name string) {
+	for {
+		claimed, err := claimChunk(name)
+		switch {
+		case err != nil:
+			log.Println("Chunk worker", name, err)
+			time.Sleep(5 * time.Second)
+		case !claimed:
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// claimChunk loads the oldest queued chunk, if there is one, renewing the
+// lease on it while it loads.
+func claimChunk(worker string) (bool, error) {
+	lease := time.Duration(cfg().ChunkTimeoutMinutes) * time.Minute
+	ctx := context.Background()
+	b, err := checkpoints.claimBatch(ctx, worker, lease)
+	if err != nil || b == nil {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := checkpoints.renewLease(ctx, b.ImportID, b.Batch, worker, lease); err != nil {
+					log.Println("Chunk worker", worker, "failed to renew its lease:", err)
+				}
+			}
+		}
+	}()
+	result, loadErr := loadChunk(b.ImportID, b.Batch, b.Spec, b.Data)
+	close(done)
+
+	b.State, b.Error = chunkDone, ""
+	if loadErr != nil {
+		b.State, b.Error = chunkFailed, loadErr.Error()
+	} else if result.Report.AbortReason != "" {
+		b.State, b.Error = chunkFailed, result.Report.AbortReason
+	}
+	if result != nil {
+		if b.Result, err = json.Marshal(result); err != nil {
+			return true, err
+		}
+	}
+	return true, checkpoints.finishBatch(ctx, b)
+}
+
+// loadChunk loads one chunk into the table of its import, with the mapping,
+// tenants and targets of this node.
+func loadChunk(importID string, chunk int, encodedSpec, data []byte) (*chunkResult, error) {
+	var cs chunkSpec
+	if err := json.Unmarshal(encodedSpec, &cs); err != nil {
+		return nil, err
+	}
+	settings := cfg()
+	spec := importSpec{
+		date:        DateParams{Month: cs.Month, Year: cs.Year},
+		mapping:     cs.Mapping,
+		mode:        importModeAppend,
+		tenant:      cs.Tenant,
+		database:    cs.Database,
+		delimiter:   cs.Delimiter,
+		skipColumns: strconv.Itoa(cs.SkipColumns),
+		// imports checking the period are not distributed
+		periodCheck: periodCheckOff,
+	}
+	if err := spec.resolve(settings); err != nil {
+		return nil, err
+	}
+	if spec.schema != cs.Schema || spec.table != cs.Table {
+		return nil, fmt.Errorf("this worker loads into %s.%s, not %s.%s; its configuration differs from the api node", spec.schema, spec.table, cs.Schema, cs.Table)
+	}
+
+	imp := spec.build(importID, int64(len(data)))
+	imp.FileName = cs.FileName
+	imp.trace, imp.span = startSpan(nil, "import.chunk", attr("import_id", importID), attr("chunk", chunk))
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		imp.span.end(err)
+		return nil, err
+	}
+	defer releasePool()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if partitionedLayout(imp.Layout) {
+		if imp.partitions, err = newPartitioner(ctx, dbPool, imp, settings.partitionColumn(imp.Layout)); err != nil {
+			imp.span.end(err)
+			return nil, err
+		}
+	}
+
+	if err := imp.loadLookups(ctx, dbPool); err != nil {
+		imp.span.end(err)
+		return nil, err
+	}
+	if err := prepareRollups(ctx, dbPool, imp); err != nil {
+		imp.span.end(err)
+		return nil, err
+	}
+
+	input := bufio.NewReaderSize(limitRowLength(bytes.NewReader(data), settings.MaxRowBytes), rowSampleBytes)
+	loadRows(ctx, cancel, imp, dbPool, input, settings)
+
+	r := &chunkResult{Report: imp.report(), EmptyCells: atomic.LoadInt64(&imp.emptyCells)}
+	for _, rej := range imp.takeRejects("") {
+		r.Rejects = append(r.Rejects, chunkReject{Values: rej.Values, Class: rej.Class, Code: rej.Code, Error: rej.Error})
+	}
+	imp.span.end(nil, attr("rows_read", r.Report.RowsRead), attr("inserted", r.Report.Inserted))
+	return r, nil
+}
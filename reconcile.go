@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// what a mismatch of the control totals does to the import
+const (
+	controlMismatchFail = "fail"
+	controlMismatchFlag = "flag"
+)
+
+// controlRequest holds the control totals of an upload as sent:
+// ?expected_rows=, ?expected_sum[total_biaya]= and ?on_mismatch=.
+type controlRequest struct {
+	rows       string
+	sums       map[string]string
+	onMismatch string
+}
+
+func requestControls(c *gin.Context) controlRequest {
+	return controlRequest{
+		rows:       c.Query("expected_rows"),
+		sums:       c.QueryMap("expected_sum"),
+		onMismatch: c.Query("on_mismatch"),
+	}
+}
+
+// controlSpec is a checked controlRequest.
+type controlSpec struct {
+	rows       int64
+	hasRows    bool
+	columns    []int
+	sums       []float64
+	onMismatch string
+}
+
+// compileControls checks the control totals of r against plan, nil when none
+// were sent.
+func compileControls(r controlRequest, plan *executionPlan) (*controlSpec, error) {
+	if r.rows == "" && len(r.sums) == 0 {
+		return nil, nil
+	}
+	s := &controlSpec{onMismatch: r.onMismatch}
+	switch s.onMismatch {
+	case "":
+		s.onMismatch = controlMismatchFail
+	case controlMismatchFail, controlMismatchFlag:
+	default:
+		return nil, fmt.Errorf("on_mismatch must be fail or flag")
+	}
+	if r.rows != "" {
+		n, err := strconv.ParseInt(r.rows, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("expected_rows must be a row count")
+		}
+		s.rows, s.hasRows = n, true
+	}
+	for column, value := range r.sums {
+		i := plan.columnIndex(column)
+		if i < 0 || !numericType(plan.types[i]) {
+			return nil, fmt.Errorf("expected_sum[%s]: not a numeric column of mapping %s", column, plan.version)
+		}
+		sum, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected_sum[%s]: %q is not a number", column, value)
+		}
+		s.columns = append(s.columns, i)
+		s.sums = append(s.sums, sum)
+	}
+	return s, nil
+}
+
+// controlTotals adds up the control columns of the rows an import inserted.
+type controlTotals struct {
+	sync.Mutex
+	spec *controlSpec
+	sums []float64
+}
+
+func newControlTotals(spec *controlSpec) *controlTotals {
+	return &controlTotals{spec: spec, sums: make([]float64, len(spec.columns))}
+}
+
+// count adds the values of an inserted row, or takes them off with sign -1.
+func (t *controlTotals) count(values []interface{}, sign float64) {
+	t.Lock()
+	defer t.Unlock()
+	for j, i := range t.spec.columns {
+		if v, ok := numberValue(values[i]); ok {
+			t.sums[j] += sign * v
+		}
+	}
+}
+
+// Reconciliation compares the control totals of an upload with what the
+// import inserted.
+type Reconciliation struct {
+	Matched    bool           `json:"matched"`
+	OnMismatch string         `json:"on_mismatch"`
+	Checks     []ControlCheck `json:"checks"`
+}
+
+// ControlCheck is one control total, `rows` or `sum(<column>)`.
+type ControlCheck struct {
+	Name     string  `json:"name"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+	Matched  bool    `json:"matched"`
+}
+
+// reconcile checks the control totals, and the row count of the trailer when
+// the mapping reconciles it, once the rows are in. A mismatch aborts the
+// import when its on_mismatch is fail; sums match within half a cent.
+func (imp *Import) reconcile() {
+	r := &Reconciliation{Matched: true}
+	var failed []string
+	fail := false
+	mismatch := func(check ControlCheck, onMismatch, message string) {
+		r.Checks = append(r.Checks, check)
+		if !check.Matched {
+			r.Matched = false
+			failed = append(failed, message)
+			fail = fail || onMismatch == controlMismatchFail
+		}
+	}
+
+	if t := imp.totals; t != nil {
+		t.Lock()
+		r.OnMismatch = t.spec.onMismatch
+		if t.spec.hasRows {
+			inserted := atomic.LoadInt64(&imp.inserted)
+			check := ControlCheck{Name: "rows", Expected: float64(t.spec.rows), Actual: float64(inserted), Matched: inserted == t.spec.rows}
+			mismatch(check, t.spec.onMismatch, checkMessage(check))
+		}
+		for j, i := range t.spec.columns {
+			check := ControlCheck{
+				Name:     "sum(" + imp.plan.columns[i] + ")",
+				Expected: t.spec.sums[j],
+				Actual:   math.Round(t.sums[j]*100) / 100,
+				Matched:  math.Abs(t.sums[j]-t.spec.sums[j]) < 0.005,
+			}
+			mismatch(check, t.spec.onMismatch, checkMessage(check))
+		}
+		t.Unlock()
+	}
+	if imp.reconcilesTrailer() {
+		onMismatch := imp.plan.trailer.onMismatch
+		if r.OnMismatch == "" {
+			r.OnMismatch = onMismatch
+		}
+		check := imp.trailerCheck()
+		message := checkMessage(check)
+		if t := imp.trailerReport(); t == nil || t.Count == nil {
+			message = "no trailer declares the rows of the file"
+		}
+		mismatch(check, onMismatch, message)
+	}
+
+	imp.mu.Lock()
+	imp.reconciliation = r
+	imp.mu.Unlock()
+
+	if fail {
+		imp.abort(fmt.Errorf("control totals do not match: %s", strings.Join(failed, ", ")))
+	}
+}
+
+func checkMessage(check ControlCheck) string {
+	return fmt.Sprintf("%s is %v, expected %v", check.Name, check.Actual, check.Expected)
+}
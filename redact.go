@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// what a column of redact_columns shows instead of its value
+const redactedValue = "[redacted]"
+
+// redactedColumns flags the columns of p listed in redact_columns.
+func (p *executionPlan) redactedColumns() []bool {
+	redact := make([]bool, len(p.columns))
+	for _, name := range cfg().RedactColumns {
+		if i := p.columnIndex(name); i >= 0 {
+			redact[i] = true
+		}
+	}
+	return redact
+}
+
+// shown returns a field of column i as reports and errors may show it:
+// protected, or left out when the column is redacted.
+func (p *executionPlan) shown(i int, value string) string {
+	for _, name := range cfg().RedactColumns {
+		if i < len(p.columns) && p.columns[i] == name {
+			return redactedValue
+		}
+	}
+	if c := p.protection(i); c != nil {
+		return c.protect(cfg().PIIHashKey, value)
+	}
+	return value
+}
+
+// logRejectedRow writes a row the database refused to the error log, as
+// column=value pairs with the redacted columns left out, or only where it was
+// and why when log_row_values is off.
+func (imp *Import) logRejectedRow(worker int, batch int64, values []interface{}, err error) {
+	if !cfg().LogRowValues {
+		log.Println("Import", imp.ID, "worker", worker, "batch", batch, "row rejected:", err)
+		return
+	}
+	redact := imp.plan.redactedColumns()
+	fields := make([]string, len(values))
+	for i, v := range values {
+		name, value := fmt.Sprint(i), formatValue(v)
+		if i < len(imp.plan.columns) {
+			name = imp.plan.columns[i]
+			if redact[i] {
+				value = redactedValue
+			}
+		}
+		fields[i] = name + "=" + value
+	}
+	log.Println("Import", imp.ID, "worker", worker, "batch", batch, "row rejected:", err, "\n Values :", strings.Join(fields, ", "))
+}
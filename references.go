@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// rejectCodeForeignKey is the SQLSTATE of foreign_key_violation, also given to
+// rows refused by a reference check so both count alike.
+const rejectCodeForeignKey = "23503"
+
+// references of a column, `schema.table(column)` like in sql
+var referencePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)?)\(([A-Za-z_][A-Za-z0-9_]*)\)$`)
+
+type referenceCheck struct {
+	column     int
+	references string
+	query      string
+}
+
+// referenceError refuses a row whose value is missing from the referenced
+// table.
+type referenceError struct {
+	column, references, value string
+}
+
+func (e *referenceError) Error() string {
+	return fmt.Sprintf("%s %q is not in %s", e.column, e.value, e.references)
+}
+
+// compileReference adds the check of column i against references, e.g.
+// `ref.klien(nama)`.
+func (p *executionPlan) compileReference(i int, references string) error {
+	m := referencePattern.FindStringSubmatch(references)
+	if m == nil {
+		return fmt.Errorf("references must look like schema.table(column), not %q", references)
+	}
+	typ := p.types[i]
+	if typ != "text" && typ != "int" {
+		return fmt.Errorf("references needs a text or int column")
+	}
+	p.references = append(p.references, referenceCheck{
+		column:     i,
+		references: references,
+		query:      fmt.Sprintf("SELECT DISTINCT %[2]s::text FROM %[1]s WHERE %[2]s = ANY($1::text[]::%[3]s[])", m[1], m[2], sqlTypes[typ]),
+	})
+	return nil
+}
+
+// checkReferences looks the referenced values of batch up, one query per
+// reference. It returns the rows to insert and the function giving the errors
+// of their insert back indexed like batch, refused rows carrying their
+// referenceError. A check that fails lets the rows through, the constraint in
+// the database still applies.
+func (imp *Import) checkReferences(ctx context.Context, conn *pgxpool.Conn, batch [][]interface{}) ([][]interface{}, func([]error) []error) {
+	var refused []error
+	for _, ref := range imp.plan.references {
+		var keys []string
+		seen := map[string]bool{}
+		for _, values := range batch {
+			if key := formatValue(values[ref.column]); key != "" && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		found, err := referencedKeys(ctx, conn, ref.query, keys)
+		if err != nil {
+			log.Println("Checking references to "+ref.references+" failed:", err)
+			continue
+		}
+		for i, values := range batch {
+			key := formatValue(values[ref.column])
+			if key == "" || found[key] || (refused != nil && refused[i] != nil) {
+				continue
+			}
+			if refused == nil {
+				refused = make([]error, len(batch))
+			}
+			refused[i] = &referenceError{column: imp.plan.columns[ref.column], references: ref.references, value: key}
+		}
+	}
+	if refused == nil {
+		return batch, func(errs []error) []error { return errs }
+	}
+
+	rows := make([][]interface{}, 0, len(batch))
+	for i, values := range batch {
+		if refused[i] == nil {
+			rows = append(rows, values)
+		}
+	}
+	return rows, func(errs []error) []error {
+		j := 0
+		for i := range refused {
+			if refused[i] == nil {
+				refused[i] = errs[j]
+				j++
+			}
+		}
+		return refused
+	}
+}
+
+func referencedKeys(ctx context.Context, conn *pgxpool.Conn, query string, keys []string) (map[string]bool, error) {
+	rows, err := conn.Query(ctx, query, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool, len(keys))
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		found[key] = true
+	}
+	return found, rows.Err()
+}
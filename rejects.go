@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// reject classes, derived from the SQLSTATE of the failed insert
+const (
+	rejectClassTransient = "transient"
+	rejectClassData      = "data"
+	rejectClassSchema    = "schema"
+	rejectClassOther     = "other"
+)
+
+// rejectCodeLookupMiss stands in for the SQLSTATE of rows rejected before the
+// insert because a lookup key was missing.
+const rejectCodeLookupMiss = "lookup_miss"
+
+// rejectCodeMalformed stands in for the SQLSTATE of rows rejected while
+// reading, for a wrong field count or broken quoting. Their values are not
+// what the file meant, so they are not retried.
+const rejectCodeMalformed = "malformed_row"
+
+// malformedRowError rejects a row the reader could not split into the fields
+// of the header.
+type malformedRowError struct {
+	reason string
+}
+
+func (e *malformedRowError) Error() string {
+	return "malformed row: " + e.reason
+}
+
+// RejectedRow is a row that could not be inserted, kept so it can be replayed.
+type RejectedRow struct {
+	Values []interface{} `json:"-"`
+	Class  string        `json:"class"`
+	Code   string        `json:"code,omitempty"`
+	Error  string        `json:"error"`
+}
+
+// classifyError maps an insert error to a reject class. Transient errors are
+// the ones worth retrying unchanged; data errors need the row to be fixed.
+func classifyError(err error) (class, code string) {
+	var miss *lookupMissError
+	if errors.As(err, &miss) {
+		return rejectClassData, rejectCodeLookupMiss
+	}
+	var malformed *malformedRowError
+	if errors.As(err, &malformed) {
+		return rejectClassData, rejectCodeMalformed
+	}
+	var refused *referenceError
+	if errors.As(err, &refused) {
+		return rejectClassData, rejectCodeForeignKey
+	}
+	var duplicate *duplicateError
+	if errors.As(err, &duplicate) {
+		return rejectClassData, uniqueViolation
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		if pgconn.Timeout(err) || pgconn.SafeToRetry(err) || errors.Is(err, context.DeadlineExceeded) {
+			return rejectClassTransient, ""
+		}
+		return rejectClassOther, ""
+	}
+
+	code = pgErr.Code
+	switch {
+	case code == "40001", code == "40P01", code == "55P03", code == "57014",
+		strings.HasPrefix(code, "08"), strings.HasPrefix(code, "53"), strings.HasPrefix(code, "57P"):
+		return rejectClassTransient, code
+	case strings.HasPrefix(code, "22"), strings.HasPrefix(code, "23"):
+		return rejectClassData, code
+	case strings.HasPrefix(code, "42"), strings.HasPrefix(code, "3F"):
+		return rejectClassSchema, code
+	}
+
+	return rejectClassOther, code
+}
+
+// reject records a failed row against the import.
+func (imp *Import) reject(values []interface{}, err error) {
+	atomic.AddInt64(&imp.rejected, 1)
+
+	class, code := classifyError(err)
+
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	imp.rejectsByClass[class]++
+	if code != "" {
+		imp.rejectsByCode[code]++
+	}
+	if len(imp.rejects) < cfg().MaxStoredRejects {
+		imp.rejects = append(imp.rejects, RejectedRow{Values: values, Class: class, Code: code, Error: err.Error()})
+	}
+}
+
+// takeRejects removes and returns the stored rejects of the given class, or
+// all of them when class is empty. Malformed rows stay, there is nothing to
+// replay of them.
+func (imp *Import) takeRejects(class string) []RejectedRow {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	var taken, kept []RejectedRow
+	for _, r := range imp.rejects {
+		if (class == "" || r.Class == class) && r.Code != rejectCodeMalformed {
+			taken = append(taken, r)
+			imp.rejectsByClass[r.Class]--
+			if r.Code != "" {
+				imp.rejectsByCode[r.Code]--
+			}
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	imp.rejects = kept
+	atomic.AddInt64(&imp.rejected, -int64(len(taken)))
+
+	return taken
+}
+
+// putBackRejects stores rows taken with takeRejects again, when they could
+// not be retried after all.
+func (imp *Import) putBackRejects(rows []RejectedRow) {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	for _, r := range rows {
+		imp.rejectsByClass[r.Class]++
+		if r.Code != "" {
+			imp.rejectsByCode[r.Code]++
+		}
+	}
+	imp.rejects = append(imp.rejects, rows...)
+	atomic.AddInt64(&imp.rejected, int64(len(rows)))
+}
+
+// rejectCounts returns the number of rejects per class, omitting empty ones.
+func (imp *Import) rejectCounts() map[string]int64 {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	counts := make(map[string]int64, len(imp.rejectsByClass))
+	for class, n := range imp.rejectsByClass {
+		if n > 0 {
+			counts[class] = n
+		}
+	}
+	return counts
+}
+
+// handleRetryRejects replays the stored rejects of one class (all classes if
+// none is given) against the import's destination table.
+func handleRetryRejects(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	select {
+	case <-imp.done:
+	default:
+		c.JSON(http.StatusConflict, gin.H{"message": "Import is still running"})
+		return
+	}
+	if imp.undone() {
+		c.JSON(http.StatusConflict, gin.H{"message": "Import was rolled back, its rejects cannot be retried"})
+		return
+	}
+	if imp.Existing != "" {
+		// replayed rows would skip the comparison with the rows already loaded
+		c.JSON(http.StatusConflict, gin.H{"message": "Import checked existing rows with existing=" + imp.Existing + ", use retry-errors"})
+		return
+	}
+
+	class := c.Query("class")
+	switch class {
+	case "", rejectClassTransient, rejectClassData, rejectClassSchema, rejectClassOther:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown reject class " + class})
+		return
+	}
+
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	rows := imp.takeRejects(class)
+	inserted := 0
+	for _, r := range rows {
+		if err := imp.insertRow(context.Background(), dbPool, r.Values); err != nil {
+			imp.reject(r.Values, err)
+			continue
+		}
+		atomic.AddInt64(&imp.inserted, 1)
+		inserted++
+	}
+	auditRequest(c, auditRetryRejects, imp.ID, fmt.Sprintf("class=%s retried=%d inserted=%d", class, len(rows), inserted))
+
+	c.JSON(http.StatusOK, gin.H{
+		"import_id":        imp.ID,
+		"class":            class,
+		"retried":          len(rows),
+		"inserted":         inserted,
+		"still_rejected":   len(rows) - inserted,
+		"rejects_by_class": imp.rejectCounts(),
+	})
+}
+
+// handleDownloadRejects streams the stored rejects of an import as CSV, with
+// optional gzip or zstd compression (?compression=).
+func handleDownloadRejects(c *gin.Context) {
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	cd, err := lookupCodec(c.Query("compression"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	tokenKey := cfg().TokenizationKey
+	if imp.plan.tokenized && tokenKey == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"message": "The rejects hold tokenized columns, set tokenization_key"})
+		return
+	}
+
+	imp.mu.Lock()
+	rows := imp.rejects[:len(imp.rejects):len(imp.rejects)]
+	imp.mu.Unlock()
+
+	filename := "rejects_" + imp.ID + ".csv"
+	var out io.Writer = c.Writer
+	if cd != nil {
+		filename += cd.extension
+		c.Header("Content-Type", "application/"+cd.name)
+	} else {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	if cd != nil {
+		zw, err := cd.newWriter(c.Writer)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		defer zw.Close()
+		out = zw
+	}
+
+	w := csv.NewWriter(out)
+	defer w.Flush()
+	if imp.plan.tokenized {
+		defer flushTokenVault()
+	}
+
+	header := append(append([]string{}, imp.plan.columns...), "error_class", "error_code", "error")
+	w.Write(header)
+
+	record := make([]string, len(header))
+	redact := imp.plan.redactedColumns()
+	for _, r := range rows {
+		for i := range imp.plan.columns {
+			record[i] = ""
+			if i < len(r.Values) {
+				record[i] = formatValue(r.Values[i])
+			}
+			if imp.plan.tokenize[i] == tokenizeOnExport {
+				record[i] = vaultToken(tokenKey, imp.plan.tokenKinds[i], record[i])
+			}
+			if redact[i] {
+				record[i] = redactedValue
+			}
+		}
+		n := len(imp.plan.columns)
+		record[n], record[n+1], record[n+2] = r.Class, r.Code, r.Error
+		if err := w.Write(record); err != nil {
+			return
+		}
+	}
+}
+
+// formatValue renders an insert value back into its CSV text form.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format("2006-01-02 15:04:05")
+	case map[string]interface{}:
+		// jsonb read back, like extra_fields
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
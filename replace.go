@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// import modes: append inserts into the live table, replace loads a staging
+// copy and swaps it in once the load succeeded
+const (
+	importModeAppend  = "append"
+	importModeReplace = "replace"
+)
+
+const (
+	replaceStagingSuffix  = "_next"
+	replacePreviousSuffix = "_prev"
+)
+
+// replacement is the snapshot kept after a replace import was promoted. Only
+// the latest replacement of a table can be rolled back.
+type replacement struct {
+	importID   string
+	tenant     string
+	database   string
+	key        string
+	table      string
+	name       string
+	promotedAt time.Time
+	expiry     *time.Timer
+}
+
+// replacements by lockKey of the target table. The entry of a table is only
+// changed by whoever holds the lock of that table.
+var replacements = struct {
+	sync.Mutex
+	byTarget map[string]*replacement
+}{byTarget: map[string]*replacement{}}
+
+// snapshots of the database, in the database of the table, so a restart
+// keeps them for rollback and still expires them
+const snapshotTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	table_name  text PRIMARY KEY,
+	import_id   text NOT NULL,
+	tenant      text,
+	promoted_at timestamptz NOT NULL,
+	expires_at  timestamptz NOT NULL
+)`
+
+func validImportMode(mode string) bool {
+	return mode == importModeAppend || mode == importModeReplace
+}
+
+// target is the qualified table the import ends up in.
+func (imp *Import) target() string {
+	return imp.Schema + "." + imp.Table
+}
+
+// prepareStaging recreates the staging table of a replace import as an empty
+// copy of the target.
+func prepareStaging(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	staging := imp.stagingTable
+	if _, err := dbPool.Exec(ctx, "DROP TABLE IF EXISTS "+staging); err != nil {
+		return fmt.Errorf("failed to drop staging table: %w", err)
+	}
+	if _, err := dbPool.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", staging, imp.target())); err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+	return nil
+}
+
+// finishReplace promotes the staging table of a loaded replace import, keeping
+// the current table as the rollback snapshot. A failed or empty load only
+// drops the staging table and leaves the target untouched.
+func finishReplace(dbPool *pgxpool.Pool, imp *Import) error {
+	ctx := context.Background()
+	target := imp.target()
+	staging := imp.stagingTable
+
+	imp.mu.Lock()
+	aborted := imp.abortReason != ""
+	imp.mu.Unlock()
+
+	if aborted || imp.progress().Inserted == 0 {
+		if _, err := dbPool.Exec(ctx, "DROP TABLE IF EXISTS "+staging); err != nil {
+			log.Println("Replace import", imp.ID, "failed to drop staging table:", err)
+		}
+		return nil
+	}
+
+	// a table missing an index is not promoted
+	if err := rebuildIndexes(dbPool, imp); err != nil {
+		return err
+	}
+
+	if err := ensureTable(ctx, dbPool, cfg().SnapshotTable, snapshotTableDDL); err != nil {
+		return fmt.Errorf("failed to create %s: %w", cfg().SnapshotTable, err)
+	}
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin promotion: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	promotedAt := time.Now()
+	expires := promotedAt.Add(time.Duration(cfg().RollbackRetentionHours) * time.Hour)
+	statements := []string{
+		"DROP TABLE IF EXISTS " + target + replacePreviousSuffix,
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", target, imp.Table+replacePreviousSuffix),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", staging, imp.Table),
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to promote staging table: %w", err)
+		}
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (table_name, import_id, tenant, promoted_at, expires_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		ON CONFLICT (table_name) DO UPDATE SET import_id = EXCLUDED.import_id, tenant = EXCLUDED.tenant, promoted_at = EXCLUDED.promoted_at, expires_at = EXCLUDED.expires_at`,
+		cfg().SnapshotTable), target, imp.ID, imp.Tenant, promotedAt, expires)
+	if err != nil {
+		return fmt.Errorf("failed to keep the snapshot of %s: %w", target, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to promote staging table: %w", err)
+	}
+
+	imp.mu.Lock()
+	imp.promotedAt = promotedAt
+	imp.mu.Unlock()
+	// retried rejects go to the promoted table from now on
+	imp.query = imp.plan.insertQuery(target)
+
+	keepSnapshot(&replacement{
+		importID:   imp.ID,
+		tenant:     imp.Tenant,
+		database:   imp.Database,
+		key:        imp.lockKey(),
+		table:      target,
+		name:       imp.Table,
+		promotedAt: promotedAt,
+	}, expires)
+	return nil
+}
+
+// keepSnapshot registers the replacement r for rollback, superseding the
+// previous one of its table, and drops its snapshot once expires has passed.
+// The caller holds the lock of the table.
+func keepSnapshot(r *replacement, expires time.Time) {
+	replacements.Lock()
+	defer replacements.Unlock()
+
+	if old, ok := replacements.byTarget[r.key]; ok {
+		old.expiry.Stop()
+	}
+	r.expiry = time.AfterFunc(time.Until(expires), func() { dropSnapshot(r) })
+	replacements.byTarget[r.key] = r
+}
+
+// dropSnapshot removes the previous table of the replacement r if r is still
+// the latest one. The table lock keeps a promotion or rollback from changing
+// the snapshot meanwhile; the replacements lock is only held to look it up,
+// not while the table is dropped.
+func dropSnapshot(r *replacement) {
+	releaseTarget, err := lockTarget(context.Background(), r.key, "expire:"+r.importID, true)
+	if err != nil {
+		return
+	}
+	defer releaseTarget()
+
+	replacements.Lock()
+	latest := replacements.byTarget[r.key] == r
+	if latest {
+		delete(replacements.byTarget, r.key)
+	}
+	replacements.Unlock()
+	if !latest {
+		return
+	}
+
+	target := r.table
+	dbPool, releasePool, err := acquireImportPool(r.tenant, r.database)
+	if err != nil {
+		log.Println("Failed to drop snapshot of", target, err)
+		return
+	}
+	defer releasePool()
+
+	ctx := context.Background()
+	tx, err := dbPool.Begin(ctx)
+	if err == nil {
+		defer tx.Rollback(ctx)
+		_, err = tx.Exec(ctx, "DROP TABLE IF EXISTS "+target+replacePreviousSuffix)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE table_name = $1 AND import_id = $2", cfg().SnapshotTable), target, r.importID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		// the row stays, the next start tries again
+		log.Println("Failed to drop snapshot of", target, err)
+		return
+	}
+	log.Println("=> snapshot of", target, "from import", r.importID, "expired")
+}
+
+// restoreSnapshots registers at startup the snapshots of snapshot_table in
+// every database imports load into, so they can still be rolled back; those
+// past their retention are dropped.
+func restoreSnapshots(settings *Config) {
+	ctx := context.Background()
+	for _, d := range loadDatabases(settings) {
+		dbPool, releasePool, err := acquireImportPool(d.tenant, d.target)
+		if err != nil {
+			log.Println("Snapshots not restored:", err)
+			continue
+		}
+		rows, err := dbPool.Query(ctx, fmt.Sprintf("SELECT table_name, import_id, coalesce(tenant, ''), promoted_at, expires_at FROM %s", settings.SnapshotTable))
+		if err != nil {
+			// no replace import was ever promoted in this database when it is missing
+			if !undefinedTable(err) {
+				log.Println("Snapshots not restored:", err)
+			}
+			releasePool()
+			continue
+		}
+		for rows.Next() {
+			r := &replacement{database: d.target}
+			var expires time.Time
+			if err := rows.Scan(&r.table, &r.importID, &r.tenant, &r.promotedAt, &expires); err != nil {
+				log.Println("Snapshots not restored:", err)
+				break
+			}
+			r.key = d.lockKey(r.table)
+			r.name = r.table[strings.LastIndex(r.table, ".")+1:]
+			replacements.Lock()
+			_, newer := replacements.byTarget[r.key]
+			replacements.Unlock()
+			if !newer {
+				keepSnapshot(r, expires)
+			}
+		}
+		rows.Close()
+		releasePool()
+	}
+}
+
+// findReplacement returns the replacement made by the import id, for a
+// rollback after a restart forgot the import itself.
+func findReplacement(id, tenant string) (*replacement, bool) {
+	replacements.Lock()
+	defer replacements.Unlock()
+	for _, r := range replacements.byTarget {
+		if r.importID == id && (tenant == "" || r.tenant == tenant) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// handleRollback restores the table a replace import replaced, as long as the
+// import is the latest replacement of its table and its snapshot is still
+// within the retention window. The import itself is not needed, its snapshot
+// can still be rolled back after a restart.
+func handleRollback(c *gin.Context) {
+	id := c.Param("id")
+	imp, found := findRequestImport(c)
+	var key string
+	if found {
+		if imp.Mode != importModeReplace {
+			c.JSON(http.StatusConflict, gin.H{"message": "Only replace imports can be rolled back"})
+			return
+		}
+		imp.mu.Lock()
+		promoted, reverted := !imp.promotedAt.IsZero(), !imp.revertedAt.IsZero()
+		imp.mu.Unlock()
+		if !promoted || reverted {
+			c.JSON(http.StatusConflict, gin.H{"message": "Import has not replaced any data"})
+			return
+		}
+		key = imp.lockKey()
+	} else {
+		r, ok := findReplacement(id, requestTenant(c))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+			return
+		}
+		key = r.key
+	}
+
+	// wait for imports of the target queued before the rollback; holding the
+	// target lock, the replacement of the target cannot change
+	releaseTarget, err := lockTarget(c.Request.Context(), key, "rollback:"+id, true)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Rollback cancelled while waiting for " + key})
+		return
+	}
+	defer releaseTarget()
+
+	replacements.Lock()
+	r, ok := replacements.byTarget[key]
+	replacements.Unlock()
+	switch {
+	case !ok:
+		c.JSON(http.StatusGone, gin.H{"message": "The snapshot of " + key + " has expired"})
+		return
+	case r.importID != id:
+		c.JSON(http.StatusConflict, gin.H{"message": "Import was superseded by import " + r.importID})
+		return
+	}
+	target := r.table
+
+	dbPool, releasePool, err := acquireImportPool(r.tenant, r.database)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	ctx := c.Request.Context()
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to roll back: " + err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	statements := []string{
+		"DROP TABLE " + target,
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", target+replacePreviousSuffix, r.name),
+	}
+	for _, stmt := range statements {
+		if _, err = tx.Exec(ctx, stmt); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE table_name = $1", cfg().SnapshotTable), target)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to roll back: " + err.Error()})
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to roll back: " + err.Error()})
+		return
+	}
+
+	replacements.Lock()
+	r.expiry.Stop()
+	delete(replacements.byTarget, key)
+	replacements.Unlock()
+
+	if found {
+		imp.mu.Lock()
+		imp.revertedAt = time.Now()
+		imp.mu.Unlock()
+	}
+
+	log.Println("=> import", id, "rolled back,", target, "restored")
+	auditRequest(c, auditRollback, id, "target="+target)
+
+	c.JSON(http.StatusOK, gin.H{
+		"import_id": id,
+		"target":    target,
+		"message":   "Previous data of " + target + " restored",
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forgetReplacement drops the replacement of key without touching a database.
+func forgetReplacement(key string) {
+	replacements.Lock()
+	if r, ok := replacements.byTarget[key]; ok {
+		r.expiry.Stop()
+		delete(replacements.byTarget, key)
+	}
+	replacements.Unlock()
+}
+
+func TestKeepSnapshotSupersedes(t *testing.T) {
+	key := "test.supersede"
+	t.Cleanup(func() { forgetReplacement(key) })
+	expires := time.Now().Add(time.Hour)
+
+	first := &replacement{importID: "first", tenant: "acme", key: key, table: key}
+	keepSnapshot(first, expires)
+	second := &replacement{importID: "second", tenant: "acme", key: key, table: key}
+	keepSnapshot(second, expires)
+
+	if first.expiry.Stop() {
+		t.Error("the expiry of the superseded snapshot is still running")
+	}
+	if _, ok := findReplacement("first", ""); ok {
+		t.Error("the superseded import can still be found")
+	}
+	if r, ok := findReplacement("second", "acme"); !ok || r != second {
+		t.Error("the latest import is not found for its tenant")
+	}
+	if _, ok := findReplacement("second", "other"); ok {
+		t.Error("the latest import is found for another tenant")
+	}
+}
+
+func TestHandleRollbackRefuses(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/imports/:id/rollback", handleRollback)
+
+	register := func(id, mode string, promoted, reverted bool) *Import {
+		imp := allocImport(id, &DateParams{}, &executionPlan{}, "", 0)
+		imp.Mode = mode
+		imp.Schema, imp.Table = "test", id
+		if promoted {
+			imp.promotedAt = time.Now()
+		}
+		if reverted {
+			imp.revertedAt = time.Now()
+		}
+		if err := registerImport(imp); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { forgetImport(id) })
+		return imp
+	}
+	snapshot := func(key, importID string) {
+		keepSnapshot(&replacement{importID: importID, key: key, table: key}, time.Now().Add(time.Hour))
+		t.Cleanup(func() { forgetReplacement(key) })
+	}
+
+	register("rb-append", importModeAppend, false, false)
+	register("rb-unpromoted", importModeReplace, false, false)
+	register("rb-reverted", importModeReplace, true, true)
+	register("rb-expired", importModeReplace, true, false)
+	superseded := register("rb-superseded", importModeReplace, true, false)
+	snapshot(superseded.lockKey(), "rb-newer")
+
+	tests := []struct {
+		id   string
+		want int
+	}{
+		// neither the import nor a snapshot of it is known
+		{"rb-unknown", http.StatusNotFound},
+		{"rb-append", http.StatusConflict},
+		{"rb-unpromoted", http.StatusConflict},
+		{"rb-reverted", http.StatusConflict},
+		// the retention window passed and the snapshot was dropped
+		{"rb-expired", http.StatusGone},
+		// only the latest replace of a table can be rolled back
+		{"rb-superseded", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/imports/"+tt.id+"/rollback", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.id, w.Code, w.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// import outcomes reported to the uploader
+const (
+	importStatusCompleted           = "completed"
+	importStatusCompletedWithErrors = "completed_with_errors"
+	importStatusFailed              = "failed"
+)
+
+// ImportReport summarises a finished import for the upload response.
+type ImportReport struct {
+	ImportID        string           `json:"import_id"`
+	Status          string           `json:"status"`
+	Message         string           `json:"message"`
+	Month           string           `json:"month"`
+	Year            string           `json:"year"`
+	MappingVersion  string           `json:"mapping_version"`
+	Strict          bool             `json:"strict"`
+	Transaction     bool             `json:"transaction,omitempty"`
+	Mode            string           `json:"mode"`
+	Source          string           `json:"source,omitempty"`
+	SourceIP        string           `json:"source_ip"`
+	UserAgent       string           `json:"user_agent,omitempty"`
+	APIKey          string           `json:"api_key,omitempty"`
+	Tenant          string           `json:"tenant,omitempty"`
+	Database        string           `json:"database,omitempty"`
+	Staged          bool             `json:"staged,omitempty"`
+	Existing        string           `json:"existing,omitempty"`
+	AlreadyLoaded   int64            `json:"already_loaded,omitempty"`
+	Updated         int64            `json:"updated,omitempty"`
+	Promoted        bool             `json:"promoted,omitempty"`
+	Reverted        bool             `json:"reverted,omitempty"`
+	RolledBack      bool             `json:"rolled_back,omitempty"`
+	AbortReason     string           `json:"abort_reason,omitempty"`
+	RetryOf         string           `json:"retry_of,omitempty"`
+	Retries         []string         `json:"retries,omitempty"`
+	LimitExceeded   bool             `json:"limit_exceeded,omitempty"`
+	TargetBusy      bool             `json:"target_busy,omitempty"`
+	RowsRead        int64            `json:"rows_read"`
+	Inserted        int64            `json:"inserted"`
+	SkippedEmpty    int64            `json:"skipped_empty"`
+	Filtered        int64            `json:"filtered"`
+	FilteredBy      map[string]int64 `json:"filtered_by,omitempty"`
+	Routes          map[string]int64 `json:"routes,omitempty"`
+	LookupMisses    map[string]int64 `json:"lookup_misses,omitempty"`
+	Duplicates      *DuplicateReport `json:"duplicates,omitempty"`
+	Reconciliation  *Reconciliation  `json:"reconciliation,omitempty"`
+	Period          *PeriodReport    `json:"period,omitempty"`
+	Anomalies       []Anomaly        `json:"anomalies,omitempty"`
+	RepeatedHeaders int64            `json:"repeated_headers"`
+	Trailer         *TrailerReport   `json:"trailer,omitempty"`
+	Drift           *SchemaDrift     `json:"drift,omitempty"`
+	Rejected        int64            `json:"rejected"`
+	Mirrored        int64            `json:"mirrored,omitempty"`
+	MirrorFailed    int64            `json:"mirror_failed,omitempty"`
+	Published       int64            `json:"published,omitempty"`
+	PublishFailed   int64            `json:"publish_failed,omitempty"`
+	RejectsByClass  map[string]int64 `json:"rejects_by_class"`
+	RejectsByCode   map[string]int64 `json:"rejects_by_code"`
+	ParseErrors     map[string]int64 `json:"parse_errors"`
+	Suspicious      map[string]int64 `json:"suspicious_values"`
+	Quality         *QualityScore    `json:"quality,omitempty"`
+	Deviations      *DeviationReport `json:"deviations,omitempty"`
+	Indexes         *IndexRebuild    `json:"indexes,omitempty"`
+	Channel         *ChannelStats    `json:"channel,omitempty"`
+	Batching        *BatchTuning     `json:"batching,omitempty"`
+	PreImportHooks  []SQLStep        `json:"pre_import_hooks,omitempty"`
+	PostImportHooks []SQLStep        `json:"post_import_hooks,omitempty"`
+	Maintenance     []SQLStep        `json:"maintenance,omitempty"`
+	ViewRefreshes   []ViewRefresh    `json:"view_refreshes,omitempty"`
+	Dialect         *CSVDialect      `json:"dialect,omitempty"`
+	Files           []FileReport     `json:"files,omitempty"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	RowsPerSec      float64          `json:"rows_per_sec"`
+}
+
+// countParseErrors adds the failed columns of one row to the import totals.
+func (imp *Import) countParseErrors(plan *executionPlan, failed []int) {
+	imp.countColumns(imp.parseErrors, plan, failed)
+}
+
+// countInserted adds an inserted row to the control totals and metrics of the
+// import, or takes it off again with sign -1.
+func (imp *Import) countInserted(values []interface{}, sign float64) {
+	if imp.totals != nil {
+		imp.totals.count(values, sign)
+	}
+	if imp.metrics != nil {
+		imp.metrics.count(values, sign)
+	}
+}
+
+// countFiltered counts a row skipped by the named filter of the mapping.
+func (imp *Import) countFiltered(name string) {
+	atomic.AddInt64(&imp.filtered, 1)
+	imp.mu.Lock()
+	imp.filteredBy[name]++
+	imp.mu.Unlock()
+}
+
+// countSuspicious adds identifier values flagged by the mapping validation.
+func (imp *Import) countSuspicious(plan *executionPlan, flagged []int) {
+	imp.countColumns(imp.suspicious, plan, flagged)
+}
+
+func (imp *Import) countColumns(counts map[string]int64, plan *executionPlan, columns []int) {
+	if len(columns) == 0 {
+		return
+	}
+
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	for _, i := range columns {
+		counts[plan.columns[i]]++
+	}
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(counts))
+	for k, n := range counts {
+		if n > 0 {
+			out[k] = n
+		}
+	}
+	return out
+}
+
+func (imp *Import) report() ImportReport {
+	p := imp.progress()
+
+	imp.mu.Lock()
+	byCode := copyCounts(imp.rejectsByCode)
+	parseErrors := copyCounts(imp.parseErrors)
+	suspicious := copyCounts(imp.suspicious)
+	filteredBy := copyCounts(imp.filteredBy)
+	routes := copyCounts(imp.routedRows)
+	reconciliation, anomalies := imp.reconciliation, imp.anomalies
+	period := imp.periodReport
+	lookupMisses := copyCounts(imp.lookupMisses)
+	duration := imp.finishedAt.Sub(imp.StartedAt)
+	rolledBack, abortReason, limitExceeded, targetBusy := imp.rolledBack, imp.abortReason, imp.limitExceeded, imp.targetBusy
+	promoted, reverted := !imp.promotedAt.IsZero(), !imp.revertedAt.IsZero()
+	var indexes *IndexRebuild
+	if imp.indexRebuild != nil {
+		copied := *imp.indexRebuild
+		copied.Dropped = append([]string(nil), copied.Dropped...)
+		indexes = &copied
+	}
+	preHooks := append([]SQLStep(nil), imp.preHooks...)
+	postHooks := append([]SQLStep(nil), imp.postHooks...)
+	maintenance := append([]SQLStep(nil), imp.maintenance...)
+	viewRefreshes := append([]ViewRefresh(nil), imp.viewRefreshes...)
+	files := append([]FileReport(nil), imp.files...)
+	retries := append([]string(nil), imp.retries...)
+	imp.mu.Unlock()
+
+	r := ImportReport{
+		ImportID:        imp.ID,
+		Month:           imp.Month,
+		Year:            imp.Year,
+		MappingVersion:  imp.plan.version,
+		Strict:          imp.Strict,
+		Transaction:     imp.Transaction,
+		Mode:            imp.Mode,
+		Source:          imp.Source,
+		SourceIP:        imp.SourceIP,
+		UserAgent:       imp.UserAgent,
+		APIKey:          imp.APIKey,
+		Tenant:          imp.Tenant,
+		Database:        imp.Database,
+		Staged:          imp.Staged,
+		Existing:        imp.Existing,
+		AlreadyLoaded:   atomic.LoadInt64(&imp.alreadyLoaded),
+		Updated:         atomic.LoadInt64(&imp.updatedRows),
+		Promoted:        promoted,
+		Reverted:        reverted,
+		RolledBack:      rolledBack,
+		AbortReason:     abortReason,
+		RetryOf:         imp.RetryOf,
+		Retries:         retries,
+		LimitExceeded:   limitExceeded,
+		TargetBusy:      targetBusy,
+		RowsRead:        p.RowsRead,
+		Inserted:        p.Inserted,
+		SkippedEmpty:    atomic.LoadInt64(&imp.skippedEmpty),
+		Filtered:        atomic.LoadInt64(&imp.filtered),
+		FilteredBy:      filteredBy,
+		Routes:          routes,
+		LookupMisses:    lookupMisses,
+		Duplicates:      imp.duplicateReport(),
+		Reconciliation:  reconciliation,
+		Period:          period,
+		Anomalies:       anomalies,
+		RepeatedHeaders: atomic.LoadInt64(&imp.repeatedHeaders),
+		Trailer:         imp.trailerReport(),
+		Drift:           imp.driftReport(),
+		Rejected:        p.Rejected,
+		Mirrored:        atomic.LoadInt64(&imp.mirroredRows),
+		MirrorFailed:    atomic.LoadInt64(&imp.mirrorFailed),
+		Published:       atomic.LoadInt64(&imp.publishedRows),
+		PublishFailed:   atomic.LoadInt64(&imp.publishFailed),
+		RejectsByClass:  imp.rejectCounts(),
+		RejectsByCode:   byCode,
+		ParseErrors:     parseErrors,
+		Suspicious:      suspicious,
+		Indexes:         indexes,
+		Channel:         p.Channel,
+		Batching:        p.Batching,
+		Deviations:      imp.deviationReport(),
+		PreImportHooks:  preHooks,
+		PostImportHooks: postHooks,
+		Maintenance:     maintenance,
+		ViewRefreshes:   viewRefreshes,
+		Files:           files,
+		Dialect:         imp.dialect(),
+		DurationSeconds: math.Round(duration.Seconds()*1000) / 1000,
+		RowsPerSec:      math.Round(p.RowsPerSec*10) / 10,
+	}
+
+	r.Quality = imp.quality(r)
+
+	switch {
+	case r.AbortReason != "" && r.RolledBack:
+		r.Status = importStatusFailed
+		r.Message = fmt.Sprintf("Import aborted and rolled back for month %s, year %s: %s", r.Month, r.Year, r.AbortReason)
+	case r.AbortReason != "":
+		r.Status = importStatusFailed
+		r.Message = fmt.Sprintf("Import aborted for month %s, year %s: %s", r.Month, r.Year, r.AbortReason)
+	case r.Inserted == 0 && r.Rejected > 0:
+		r.Status = importStatusFailed
+		r.Message = fmt.Sprintf("No rows inserted, all %d rows were rejected for month %s, year %s", r.Rejected, r.Month, r.Year)
+	case r.Reconciliation != nil && !r.Reconciliation.Matched:
+		r.Status = importStatusCompletedWithErrors
+		r.Message = fmt.Sprintf("%d rows inserted for month %s, year %s, the control totals do not match", r.Inserted, r.Month, r.Year)
+	case r.Period != nil && !r.Period.Matched:
+		r.Status = importStatusCompletedWithErrors
+		r.Message = fmt.Sprintf("%d rows inserted for month %s, year %s, %v%% of them are of other months", r.Inserted, r.Month, r.Year, r.Period.OutsidePercent)
+	case r.Drift != nil:
+		r.Status = importStatusCompletedWithErrors
+		r.Message = fmt.Sprintf("%d rows inserted for month %s, year %s, the file or table drifted from mapping %s", r.Inserted, r.Month, r.Year, r.MappingVersion)
+	case r.Rejected > 0:
+		r.Status = importStatusCompletedWithErrors
+		r.Message = fmt.Sprintf("%d rows inserted and %d rows rejected in %d seconds for month %s, year %s", r.Inserted, r.Rejected, int(math.Ceil(duration.Seconds())), r.Month, r.Year)
+	default:
+		r.Status = importStatusCompleted
+		r.Message = fmt.Sprintf("Data inserted successfully in %d seconds for month %s, year %s", int(math.Ceil(duration.Seconds())), r.Month, r.Year)
+	}
+
+	return r
+}
+
+// httpStatus is the response code matching the report outcome.
+func (r ImportReport) httpStatus() int {
+	if r.LimitExceeded {
+		return http.StatusRequestEntityTooLarge
+	}
+	if r.TargetBusy {
+		return http.StatusConflict
+	}
+	if r.Status == importStatusFailed {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusOK
+}
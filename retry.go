@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleRetryErrors loads the stored rejects of a finished import (one class
+// with ?class=) as a new import into the same table, through ?mapping= when
+// the mapping was fixed meanwhile. Unlike retry-rejects, which re-runs the
+// converted rows, the rows are written back to text and go through the whole
+// pipeline again; the new import links back with retry_of.
+func handleRetryErrors(c *gin.Context) {
+	start := time.Now()
+
+	parent, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+	select {
+	case <-parent.done:
+	default:
+		c.JSON(http.StatusConflict, gin.H{"message": "Import is still running"})
+		return
+	}
+	if parent.undone() {
+		c.JSON(http.StatusConflict, gin.H{"message": "Import was rolled back, its rejects cannot be retried"})
+		return
+	}
+
+	class := c.Query("class")
+	switch class {
+	case "", rejectClassTransient, rejectClassData, rejectClassSchema, rejectClassOther:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown reject class " + class})
+		return
+	}
+	for i, mode := range parent.plan.tokenize {
+		if mode == tokenizeOnImport {
+			c.JSON(http.StatusConflict, gin.H{"message": "The rejects hold tokens of column " + parent.plan.columns[i] + ", use retry-rejects"})
+			return
+		}
+	}
+	if p := parent.plan.protections; len(p) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "The rejects hold protected values of column " + parent.plan.columns[p[0].column] + ", use retry-rejects"})
+		return
+	}
+
+	settings := cfg()
+	spec := importSpec{
+		date:    DateParams{Month: parent.Month, Year: parent.Year},
+		mapping: c.DefaultQuery("mapping", parent.plan.version),
+		mode:    importModeAppend,
+		// rows already in the table are skipped or updated as the first time
+		existing: parent.Existing,
+		// the rejects are written back by rejectsCSV
+		delimiter:   string(defaultDelimiter),
+		strict:      c.Query("strict") == "true",
+		transaction: c.Query("transaction") == "true",
+		priority:    c.DefaultQuery("priority", parent.Priority),
+		analyze:     queryFlag(c, "analyze", settings.AnalyzeAfterImport),
+		profile:     queryFlag(c, "profile", settings.ProfileImports),
+		tenant:      parent.Tenant,
+		database:    parent.Database,
+		source:      parent.Source,
+	}
+	if err := spec.resolve(settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	switch {
+	case spec.plan.combined:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + spec.plan.version + " combines fields, rejects hold the combined columns"})
+		return
+	case spec.plan.fileColumns != parent.plan.fileColumns:
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Mapping %s has %d columns, the rejects %d", spec.plan.version, spec.plan.fileColumns, parent.plan.fileColumns)})
+		return
+	case spec.schema != parent.Schema || spec.table != parent.Table:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + spec.plan.version + " loads into another table"})
+		return
+	}
+
+	rows := parent.takeRejects(class)
+	if len(rows) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "Import has no stored rejects to retry"})
+		return
+	}
+	body := rejectsCSV(spec.plan, rows)
+
+	release, err := reserveImportQuota(requestAPIKey(c), spec.tenant, int64(body.Len()))
+	if err != nil {
+		parent.putBackRejects(rows)
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		return
+	}
+	defer release()
+
+	imp, err := spec.newImport(requestTrace(c), "", int64(body.Len()))
+	if err != nil {
+		parent.putBackRejects(rows)
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	imp.FileName = "rejects_" + parent.ID + ".csv"
+	imp.Checksum = hex.EncodeToString(sum[:])
+	imp.RetryOf = parent.ID
+	imp.Principal = requestPrincipal(c)
+	imp.SourceIP = c.ClientIP()
+	imp.UserAgent = c.Request.UserAgent()
+	if key := requestAPIKey(c); key != nil {
+		imp.APIKey = key.Name
+	}
+	parent.mu.Lock()
+	parent.retries = append(parent.retries, imp.ID)
+	parent.mu.Unlock()
+
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+		imp.finish()
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	imp.publish(ImportEvent{Type: eventStarted, Message: imp.FileName})
+	runImport(imp, dbPool, &countingReader{r: body, imp: imp})
+
+	report := imp.report()
+	auditRequest(c, auditRetryErrors, parent.ID, fmt.Sprintf("class=%s retried=%d import=%s", class, len(rows), imp.ID))
+	log.Println("=> retry of", parent.ID, "as", imp.ID, report.Status, "in", time.Since(start))
+
+	c.JSON(report.httpStatus(), report)
+}
+
+// rejectsCSV writes rejected rows back as the semicolon separated file plan
+// reads, with the time columns in the layouts of plan.
+func rejectsCSV(plan *executionPlan, rows []RejectedRow) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+	// computed columns are computed again
+	w.Write(plan.columns[:plan.fileColumns])
+
+	record := make([]string, plan.fileColumns)
+	for _, r := range rows {
+		for i := range record {
+			record[i] = ""
+			if i >= len(r.Values) {
+				continue
+			}
+			if t, ok := r.Values[i].(time.Time); ok && plan.layouts[i] != "" {
+				if !t.IsZero() {
+					record[i] = t.Format(plan.layouts[i])
+				}
+				continue
+			}
+			record[i] = formatValue(r.Values[i])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return &buf
+}
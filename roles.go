@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roles in increasing order of privilege; each role can do everything the
+// roles below it can
+const (
+	roleUploader = "uploader"
+	roleApprover = "approver"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{
+	roleUploader: 1,
+	roleApprover: 2,
+	roleAdmin:    3,
+}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// requestRole is the role of the caller. Without API key enforcement every
+// caller is treated as an uploader.
+func requestRole(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil && key.Role != "" {
+		return key.Role
+	}
+	return roleUploader
+}
+
+// requireRole rejects callers whose role ranks below role.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if roleRank[requestRole(c)] < roleRank[role] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "This action requires the " + role + " role"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Rollup keeps a table next to the target with the number of rows and the
+// sums of Sums per value of GroupBy, e.g. per day or per client, so
+// dashboards do not scan the rows after every load. It is updated in the
+// transaction of every batch; rows with an empty group column are left out.
+type Rollup struct {
+	Name    string   `yaml:"name" json:"name,omitempty"`
+	GroupBy []string `yaml:"group_by" json:"group_by,omitempty"`
+	Sums    []string `yaml:"sums" json:"sums,omitempty"`
+}
+
+type rollupSpec struct {
+	name   string
+	groups []int
+	sums   []int
+}
+
+// compileRollups adds the rollups of a mapping to p.
+func (p *executionPlan) compileRollups(rollups []Rollup) error {
+	names := map[string]bool{}
+	for _, r := range rollups {
+		if !identifierPattern.MatchString(r.Name) || names[r.Name] {
+			return fmt.Errorf("rollup %q: name must be a unique plain identifier", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.GroupBy) == 0 {
+			return fmt.Errorf("rollup %s: group_by is required", r.Name)
+		}
+		spec := rollupSpec{name: r.Name}
+		for _, column := range r.GroupBy {
+			i := p.columnIndex(column)
+			if i < 0 {
+				return fmt.Errorf("rollup %s: unknown group_by column %q", r.Name, column)
+			}
+			if c := p.protection(i); c != nil && c.mode == protectMask {
+				return fmt.Errorf("rollup %s: masked column %s cannot be grouped by", r.Name, column)
+			}
+			spec.groups = append(spec.groups, i)
+		}
+		for _, column := range r.Sums {
+			i := p.columnIndex(column)
+			if i < 0 || !numericType(p.types[i]) {
+				return fmt.Errorf("rollup %s: %q is not a numeric column", r.Name, column)
+			}
+			spec.sums = append(spec.sums, i)
+		}
+		p.rollups = append(p.rollups, spec)
+	}
+	return nil
+}
+
+// rollupTable is the table of rollup r of the rows of target.
+func rollupTable(target string, r *rollupSpec) string {
+	return target + "_rollup_" + r.name
+}
+
+// groupColumn is the rollup column of column i: dates and timestamps are
+// rolled up by day.
+func (p *executionPlan) groupColumn(i int) (string, string) {
+	if p.types[i] == "date" || p.types[i] == "timestamp" {
+		return p.columns[i], "date"
+	}
+	return p.columns[i], sqlTypes[p.types[i]]
+}
+
+// rollupDDL is the CREATE TABLE statement of the table of r, for ensureTable.
+func (p *executionPlan) rollupDDL(r *rollupSpec) string {
+	var columns, key []string
+	for _, i := range r.groups {
+		name, typ := p.groupColumn(i)
+		columns = append(columns, name+" "+typ+" NOT NULL")
+		key = append(key, name)
+	}
+	columns = append(columns, "rows bigint NOT NULL")
+	for _, i := range r.sums {
+		columns = append(columns, "sum_"+p.columns[i]+" double precision NOT NULL")
+	}
+	columns = append(columns, "PRIMARY KEY ("+strings.Join(key, ", ")+")")
+	return "CREATE TABLE IF NOT EXISTS %[1]s (\n\t" + strings.Join(columns, ",\n\t") + "\n)"
+}
+
+// rollupConflict is the ON CONFLICT clause adding the new counts of the table
+// of r to those it holds.
+func (p *executionPlan) rollupConflict(r *rollupSpec) string {
+	var key []string
+	for _, i := range r.groups {
+		key = append(key, p.columns[i])
+	}
+	set := []string{"rows = r.rows + excluded.rows"}
+	for _, i := range r.sums {
+		set = append(set, fmt.Sprintf("sum_%[1]s = r.sum_%[1]s + excluded.sum_%[1]s", p.columns[i]))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(key, ", "), strings.Join(set, ", "))
+}
+
+// prepareRollups creates the missing rollup tables of imp.
+func prepareRollups(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	for i := range imp.plan.rollups {
+		r := &imp.plan.rollups[i]
+		if err := ensureTable(ctx, dbPool, rollupTable(imp.target(), r), imp.plan.rollupDDL(r)); err != nil {
+			return fmt.Errorf("failed to create rollup table %s: %w", rollupTable(imp.target(), r), err)
+		}
+	}
+	return nil
+}
+
+// rollsUpBatches reports whether the workers of imp update the rollups with
+// every batch. Staged imports roll up when their rows are moved.
+func (imp *Import) rollsUpBatches() bool {
+	return len(imp.plan.rollups) > 0 && imp.stagingTable == ""
+}
+
+type rollupGroup struct {
+	key  string
+	args []interface{}
+}
+
+// queueRollups queues on b the upserts adding rows to the rollups of target.
+// The groups are upserted in key order, so concurrent batches lock the rows
+// of a rollup table in the same order and do not deadlock.
+func (p *executionPlan) queueRollups(b *pgx.Batch, target string, rows [][]interface{}) {
+	for j := range p.rollups {
+		r := &p.rollups[j]
+		groups := map[string]*rollupGroup{}
+	rows:
+		for _, values := range rows {
+			var parts []string
+			for _, i := range r.groups {
+				v := values[i]
+				if v == nil {
+					continue rows
+				}
+				if t, ok := v.(time.Time); ok {
+					parts = append(parts, t.Format("2006-01-02"))
+				} else {
+					parts = append(parts, formatValue(v))
+				}
+			}
+			key := strings.Join(parts, "\x00")
+			g := groups[key]
+			if g == nil {
+				g = &rollupGroup{key: key}
+				for _, i := range r.groups {
+					g.args = append(g.args, values[i])
+				}
+				g.args = append(g.args, int64(0))
+				for range r.sums {
+					g.args = append(g.args, float64(0))
+				}
+				groups[key] = g
+			}
+			n := len(r.groups)
+			g.args[n] = g.args[n].(int64) + 1
+			for k, i := range r.sums {
+				if v, ok := numberValue(values[i]); ok {
+					g.args[n+1+k] = g.args[n+1+k].(float64) + v
+				}
+			}
+		}
+
+		sorted := make([]*rollupGroup, 0, len(groups))
+		for _, g := range groups {
+			sorted = append(sorted, g)
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a].key < sorted[b].key })
+
+		table := rollupTable(target, r)
+		var columns, params []string
+		for k, i := range r.groups {
+			name, typ := p.groupColumn(i)
+			columns = append(columns, name)
+			params = append(params, fmt.Sprintf("$%d::%s", k+1, typ))
+		}
+		columns = append(columns, "rows")
+		for _, i := range r.sums {
+			columns = append(columns, "sum_"+p.columns[i])
+		}
+		for k := len(r.groups); k < len(columns); k++ {
+			params = append(params, fmt.Sprintf("$%d", k+1))
+		}
+		query := fmt.Sprintf("INSERT INTO %s AS r (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(params, ", ")) +
+			p.rollupConflict(r)
+		for _, g := range sorted {
+			b.Queue(query, g.args...)
+		}
+	}
+}
+
+// insertRolledUp is insertBatch for imports with rollups: the rows and the
+// rollup upserts go in one implicit transaction. When a row fails, the batch
+// is replayed in a transaction with a savepoint per row, and only the rows
+// inserted are rolled up.
+func (imp *Import) insertRolledUp(ctx context.Context, conn *pgxpool.Conn, query string, rows [][]interface{}) []error {
+	errs := make([]error, len(rows))
+	target := imp.target()
+
+	b := &pgx.Batch{}
+	for _, values := range rows {
+		b.Queue(query, values...)
+	}
+	imp.plan.queueRollups(b, target, rows)
+
+	results := conn.SendBatch(ctx, b)
+	var failed error
+	for i := 0; i < b.Len(); i++ {
+		if _, err := results.Exec(); err != nil {
+			failed = err
+			break
+		}
+	}
+	if err := results.Close(); failed == nil {
+		failed = err
+	}
+	if failed == nil {
+		return errs
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return failAll(errs, err)
+	}
+	defer tx.Rollback(ctx)
+
+	inserted := make([][]interface{}, 0, len(rows))
+	for i, values := range rows {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return failAll(errs, err)
+		}
+		if _, errs[i] = sp.Exec(ctx, query, values...); errs[i] != nil {
+			err = sp.Rollback(ctx)
+		} else {
+			inserted = append(inserted, values)
+			err = sp.Commit(ctx)
+		}
+		if err != nil {
+			return failAll(errs, err)
+		}
+	}
+
+	b = &pgx.Batch{}
+	imp.plan.queueRollups(b, target, inserted)
+	results = tx.SendBatch(ctx, b)
+	for i := 0; i < b.Len() && err == nil; i++ {
+		_, err = results.Exec()
+	}
+	if closeErr := results.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return failAll(errs, fmt.Errorf("failed to update the rollups: %w", err))
+	}
+	return errs
+}
+
+// failAll sets every error of errs to err.
+func failAll(errs []error, err error) []error {
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// rollUpStaged adds the staged rows of imp to its rollups inside tx, before
+// they are moved. With existing=skip the rows whose key the target already
+// holds are left out, like they are by the move.
+func rollUpStaged(ctx context.Context, tx pgx.Tx, imp *Import) error {
+	p := imp.plan
+	for j := range p.rollups {
+		r := &p.rollups[j]
+		var columns, selects, conds []string
+		for _, i := range r.groups {
+			name, typ := p.groupColumn(i)
+			columns = append(columns, name)
+			selects = append(selects, fmt.Sprintf("s.%s::%s", name, typ))
+			conds = append(conds, "s."+name+" IS NOT NULL")
+		}
+		groupBy := strings.Join(selects, ", ")
+		columns = append(columns, "rows")
+		selects = append(selects, "count(*)")
+		for _, i := range r.sums {
+			columns = append(columns, "sum_"+p.columns[i])
+			selects = append(selects, fmt.Sprintf("coalesce(sum(s.%s), 0)", p.columns[i]))
+		}
+		if imp.Existing == existingSkip {
+			key := p.columns[p.key]
+			conds = append(conds, fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s t WHERE t.%s = s.%s)", imp.target(), key, key))
+		}
+
+		table := rollupTable(imp.target(), r)
+		query := fmt.Sprintf("INSERT INTO %s AS r (%s) SELECT %s FROM %s s WHERE %s GROUP BY %s ORDER BY %s",
+			table, strings.Join(columns, ", "), strings.Join(selects, ", "), imp.stagingTable,
+			strings.Join(conds, " AND "), groupBy, groupBy) + p.rollupConflict(r)
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to update rollup %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// insertRow inserts a retried row into the target of imp, or the table of its
+// route, rolling it up.
+func (imp *Import) insertRow(ctx context.Context, dbPool *pgxpool.Pool, values []interface{}) error {
+	routed := imp.routed()
+	if len(imp.plan.rollups) == 0 && !routed {
+		_, err := dbPool.Exec(ctx, imp.query, values...)
+		return err
+	}
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if routed {
+		return imp.insertRouted(ctx, conn, imp.routeQueries(imp.query), [][]interface{}{values})[0]
+	}
+	return imp.insertRolledUp(ctx, conn, imp.query, [][]interface{}{values})[0]
+}
+
+// summaryRollup returns the rollup of plan grouped by column alone that sums
+// at least columns, nil when there is none.
+func (p *executionPlan) summaryRollup(column string, columns []string) *rollupSpec {
+	for j := range p.rollups {
+		r := &p.rollups[j]
+		if len(r.groups) != 1 || p.columns[r.groups[0]] != column {
+			continue
+		}
+		covered := true
+		for _, name := range columns {
+			found := false
+			for _, i := range r.sums {
+				found = found || p.columns[i] == name
+			}
+			covered = covered && found
+		}
+		if covered {
+			return r
+		}
+	}
+	return nil
+}
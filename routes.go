@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RowRoute sends the rows for which When holds to Table, a table next to the
+// one of the mapping, e.g. `layanan = 'CARGO'` to domain_cargo. Routes are
+// tried in order; rows matching none go to the table of the mapping.
+type RowRoute struct {
+	Table string `yaml:"table" json:"table,omitempty"`
+	When  string `yaml:"when" json:"when,omitempty"`
+}
+
+// compileRoutes adds the routes of a mapping to p.
+func (p *executionPlan) compileRoutes(routes []RowRoute) error {
+	for _, r := range routes {
+		if !identifierPattern.MatchString(r.Table) || r.Table == p.table {
+			return fmt.Errorf("route %q: table must be a plain table name other than %s", r.Table, p.table)
+		}
+		fn, err := compileFilter(r.When, p.columns, p.types)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", r.Table, err)
+		}
+		p.routeTables = append(p.routeTables, r.Table)
+		p.routes = append(p.routes, fn)
+	}
+	return nil
+}
+
+// route returns where values go: 0 for the table of the mapping, i+1 for
+// route i.
+func (p *executionPlan) route(values []interface{}) int {
+	for i, matches := range p.routes {
+		if ok, err := matches(values); err != nil {
+			log.Println("Error evaluating route "+p.routeTables[i]+":", err)
+		} else if ok {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// routed reports whether the rows of imp are spread over several tables.
+func (imp *Import) routed() bool {
+	return len(imp.plan.routeTables) > 0
+}
+
+// routeTargets returns the qualified tables rows go to, indexed like route.
+func (imp *Import) routeTargets() []string {
+	targets := []string{imp.target()}
+	for _, table := range imp.plan.routeTables {
+		targets = append(targets, imp.Schema+"."+table)
+	}
+	return targets
+}
+
+// prepareRoutes creates the missing route tables as copies of the target.
+func prepareRoutes(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	for _, table := range imp.routeTargets()[1:] {
+		if _, err := dbPool.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING ALL)", table, imp.target())); err != nil {
+			return fmt.Errorf("failed to create route table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// insertRouted inserts each row of batch into the table of its route, one
+// insertBatch per table, and counts the rows every table got. queries are
+// the insert statements of routeTargets.
+func (imp *Import) insertRouted(ctx context.Context, conn *pgxpool.Conn, queries []string, batch [][]interface{}) []error {
+	groups := make(map[int][]int)
+	for i, values := range batch {
+		dest := imp.plan.route(values)
+		groups[dest] = append(groups[dest], i)
+	}
+
+	errs := make([]error, len(batch))
+	targets := imp.routeTargets()
+	for dest, rows := range groups {
+		group := make([][]interface{}, len(rows))
+		for j, i := range rows {
+			group[j] = batch[i]
+		}
+		inserted := int64(0)
+		for j, err := range insertBatch(ctx, conn, queries[dest], group) {
+			errs[rows[j]] = err
+			if err == nil {
+				inserted++
+			}
+		}
+		imp.mu.Lock()
+		imp.routedRows[targets[dest]] += inserted
+		imp.mu.Unlock()
+	}
+	return errs
+}
+
+// routeQueries returns the insert statements of routeTargets, query being the
+// one of the target.
+func (imp *Import) routeQueries(query string) []string {
+	queries := []string{query}
+	for _, table := range imp.routeTargets()[1:] {
+		queries = append(queries, imp.plan.insertQuery(table))
+	}
+	return queries
+}
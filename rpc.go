@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"time"
+)
+
+// grpcServer serves the ImportService of proto/import.proto on grpc_addr.
+// It needs google.golang.org/grpc and is set by grpc_server.go, built with
+// -tags grpc.
+var grpcServer func(settings *Config) (stop func(), err error)
+
+// startGRPC starts the grpc api when grpc_addr is set, on nodes that take
+// imports.
+func startGRPC(settings *Config) (func(), error) {
+	if settings.GRPCAddr == "" || settings.NodeRole == nodeRoleWorker {
+		return func() {}, nil
+	}
+	if grpcServer == nil {
+		return nil, errors.New("grpc_addr is set but the grpc api is not compiled in, build with -tags grpc")
+	}
+	return grpcServer(settings)
+}
+
+// errors of the rpc api, mapped to status codes by the transport
+var (
+	errRPCUnauthenticated = errors.New("missing or invalid API key")
+	errRPCForbidden       = errors.New("permission denied")
+	errRPCInvalid         = errors.New("invalid argument")
+	errRPCNotFound        = errors.New("not found")
+	errRPCQuota           = errors.New("quota exceeded")
+)
+
+// rpcCaller is the authenticated client of an rpc.
+type rpcCaller struct {
+	key    *APIKey
+	tenant string
+	ip     string
+	agent  string
+}
+
+// authenticateRPC checks the API key an rpc carries and the role it needs,
+// as requireAPIKey and requireRole do for http.
+func authenticateRPC(secret, role, ip, agent string) (*rpcCaller, error) {
+	caller := &rpcCaller{ip: ip, agent: agent}
+	if cfg().RequireAPIKey {
+		key, ok := lookupAPIKey(secret)
+		if !ok {
+			return nil, errRPCUnauthenticated
+		}
+		caller.key, caller.tenant = key, key.Tenant
+	}
+	if roleRank[caller.role()] < roleRank[role] {
+		return nil, fmt.Errorf("%w: this action requires the %s role", errRPCForbidden, role)
+	}
+	return caller, nil
+}
+
+func (c *rpcCaller) role() string {
+	if c.key != nil && c.key.Role != "" {
+		return c.key.Role
+	}
+	return roleUploader
+}
+
+func (c *rpcCaller) principal() string {
+	if c.key != nil {
+		return "key:" + c.key.Name + ":" + c.key.ID
+	}
+	return "anonymous"
+}
+
+// selectTenant picks the tenant the caller acts for like selectTenant: the
+// one of its key, or name for keys not bound to one.
+func (c *rpcCaller) selectTenant(name string) error {
+	if c.tenant != "" {
+		if name != "" && name != c.tenant {
+			return fmt.Errorf("%w: API key belongs to another tenant", errRPCForbidden)
+		}
+		return nil
+	}
+	if name != "" && cfg().tenant(name) == nil {
+		return fmt.Errorf("%w: unknown tenant %s", errRPCNotFound, name)
+	}
+	c.tenant = name
+	return nil
+}
+
+// findImport looks up an import the caller may see.
+func (c *rpcCaller) findImport(id string) (*Import, error) {
+	imp, ok := findImport(id)
+	if !ok || c.tenant != "" && imp.Tenant != c.tenant {
+		return nil, fmt.Errorf("%w: import %s", errRPCNotFound, id)
+	}
+	return imp, nil
+}
+
+// cancelImport cancels an import like handleCancelImport.
+func (c *rpcCaller) cancelImport(id, reason string) (*Import, error) {
+	imp, err := c.findImport(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := imp.cancel(c.principal(), reason); err != nil {
+		return imp, err
+	}
+	recordAudit(AuditEntry{Principal: c.principal(), SourceIP: c.ip, Action: auditCancel, ImportID: imp.ID, Details: reason})
+	return imp, nil
+}
+
+// rpcImportParams are the parameters of a pushed import, those of /upload.
+type rpcImportParams struct {
+	Month       string
+	Year        string
+	Mapping     string
+	Template    string
+	Source      string
+	Mode        string
+	Strict      bool
+	Transaction bool
+	Priority    string
+	Existing    string
+	Tenant      string
+	Target      string
+	Delimiter   string
+	ImportID    string
+	Format      string
+	Filename    string
+	PeriodCheck string
+	MaxOutside  string
+}
+
+// given tells applySource which parameters the client set itself.
+func (p rpcImportParams) given(param string) bool {
+	switch param {
+	case "mapping":
+		return p.Mapping != ""
+	case "template":
+		return p.Template != ""
+	case "mode":
+		return p.Mode != ""
+	case "strict":
+		return p.Strict
+	case "transaction":
+		return p.Transaction
+	case "priority":
+		return p.Priority != ""
+	case "existing":
+		return p.Existing != ""
+	case "delimiter":
+		return p.Delimiter != ""
+	case "period_check":
+		return p.PeriodCheck != ""
+	}
+	return false
+}
+
+// pushedImport is an import of a file a client pushes piece by piece over
+// the rpc api. It loads while the pieces arrive, like a streamed request
+// body, or goes to disk until the next import window.
+type pushedImport struct {
+	imp      *Import
+	pipe     *io.PipeWriter
+	sum      hash.Hash
+	loaded   chan struct{}
+	queued   bool
+	startsAt time.Time
+}
+
+// startPushedImport starts the import of params. With rows the client sends
+// rows of values, written out as csv with the delimiter the import reads;
+// without, it sends the raw file, compressed or not.
+func (c *rpcCaller) startPushedImport(params rpcImportParams, rows bool) (*pushedImport, error) {
+	settings := cfg()
+	if err := c.selectTenant(params.Tenant); err != nil {
+		return nil, err
+	}
+
+	format, delimiter := inputFormatCSV, params.Delimiter
+	if rows {
+		if d, err := parseDelimiter(delimiter); err == nil && d == 0 {
+			delimiter = ","
+		}
+	} else {
+		var err error
+		if format, err = inputFormat(params.Format, ""); err != nil {
+			return nil, fmt.Errorf("%w: %v", errRPCInvalid, err)
+		}
+	}
+	mode := params.Mode
+	if mode == "" {
+		mode = importModeAppend
+	}
+
+	spec := importSpec{
+		date:           DateParams{Month: params.Month, Year: params.Year},
+		mapping:        params.Mapping,
+		template:       params.Template,
+		mode:           mode,
+		strict:         params.Strict,
+		transaction:    params.Transaction,
+		priority:       params.Priority,
+		staged:         settings.StagingLoad,
+		existing:       params.Existing,
+		profile:        settings.ProfileImports,
+		rebuildIndexes: settings.RebuildIndexes,
+		analyze:        settings.AnalyzeAfterImport,
+		tenant:         c.tenant,
+		database:       params.Target,
+		format:         format,
+		delimiter:      delimiter,
+		source:         params.Source,
+		periodCheck:    params.PeriodCheck,
+		maxOutside:     params.MaxOutside,
+	}
+	err := spec.applySource(settings, params.given)
+	if err == nil {
+		err = spec.resolve(settings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRPCInvalid, err)
+	}
+
+	release, err := reserveImportQuota(c.key, spec.tenant, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRPCQuota, err)
+	}
+
+	filename := params.Filename
+	if filename == "" {
+		filename = "grpc." + format
+	}
+	imp, err := spec.newImport(context.Background(), params.ImportID, 0)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	imp.FileName = filename
+	imp.Principal = c.principal()
+	imp.SourceIP = c.ip
+	imp.UserAgent = c.agent
+	if c.key != nil {
+		imp.APIKey = c.key.Name
+	}
+
+	pr, pw := io.Pipe()
+	p := &pushedImport{imp: imp, pipe: pw, sum: sha256.New(), loaded: make(chan struct{})}
+
+	// outside the import windows the pieces go to disk like an upload
+	if windows := settings.windows; !windowOpen(windows, time.Now()) {
+		p.queued, p.startsAt = true, nextWindowOpen(windows, time.Now())
+		imp.setStatus(importStateQueued)
+		go func() {
+			defer close(p.loaded)
+			spool, err := spoolUpload(pr)
+			pr.CloseWithError(err)
+			if err != nil {
+				release()
+				log.Println(err.Error())
+				imp.abort(err)
+				imp.finish()
+				return
+			}
+			go runQueuedImport(imp, []string{spool}, []string{filename}, release)
+		}()
+		return p, nil
+	}
+
+	go func() {
+		defer close(p.loaded)
+		defer release()
+		// the client stops pushing once the import stopped reading
+		defer pr.Close()
+
+		dbPool, releasePool, err := imp.acquirePool()
+		if err != nil {
+			log.Println(err.Error())
+			imp.abort(err)
+			imp.finish()
+			return
+		}
+		defer releasePool()
+
+		body, err := decompressUpload(&countingReader{r: pr, imp: imp})
+		if err != nil {
+			imp.abort(err)
+			imp.finish()
+			return
+		}
+		defer body.Close()
+
+		imp.publish(ImportEvent{Type: eventStarted, Message: filename})
+		runImport(imp, dbPool, body)
+		log.Println("=> pushed import", imp.ID, imp.report().Status)
+	}()
+	return p, nil
+}
+
+// Write passes a piece of the file on to the import; it fails once the import
+// stopped reading.
+func (p *pushedImport) Write(b []byte) (int, error) {
+	p.sum.Write(b)
+	return p.pipe.Write(b)
+}
+
+// end tells the import the file is complete, or broke off with err, and waits
+// until it is loaded, or on disk for its window.
+func (p *pushedImport) end(err error) {
+	if err != nil {
+		p.imp.abort(fmt.Errorf("client stream: %w", err))
+		p.pipe.CloseWithError(err)
+	} else {
+		p.imp.Checksum = hex.EncodeToString(p.sum.Sum(nil))
+		p.pipe.Close()
+	}
+	<-p.loaded
+}
+
+// rpcImportStatus is where an import stands, as the rpc api returns it.
+type rpcImportStatus struct {
+	ImportID string
+	State    string
+	Status   string
+	RowsRead int64
+	Inserted int64
+	Rejected int64
+	Message  string
+	Finished bool
+	// the json report, once finished
+	Report []byte
+}
+
+func importRPCStatus(imp *Import) rpcImportStatus {
+	p := imp.progress()
+	s := rpcImportStatus{
+		ImportID: imp.ID,
+		State:    p.State,
+		RowsRead: p.RowsRead,
+		Inserted: p.Inserted,
+		Rejected: p.Rejected,
+		Finished: p.Finished,
+	}
+	if p.Finished {
+		r := imp.report()
+		s.Status, s.Message = r.Status, r.Message
+		s.Inserted, s.Rejected = r.Inserted, r.Rejected
+		s.Report, _ = json.Marshal(r)
+	}
+	return s
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// files younger than this may still be being written and wait for a later run
+const scheduleSettleTime = time.Minute
+
+// ScheduleConfig imports the files found in a watched location on a cron
+// schedule. Imported files are moved to archive_dir, failed ones to
+// failed_dir, both relative to the watched location.
+type ScheduleConfig struct {
+	Name            string `yaml:"name" json:"name"`
+	Cron            string `yaml:"cron" json:"cron"`
+	Source          string `yaml:"source" json:"source"`
+	Pattern         string `yaml:"pattern" json:"pattern"`
+	FilenamePattern string `yaml:"filename_pattern" json:"filename_pattern"`
+	Mapping         string `yaml:"mapping" json:"mapping"`
+	Mode            string `yaml:"mode" json:"mode"`
+	Strict          bool   `yaml:"strict" json:"strict"`
+	Priority        string `yaml:"priority" json:"priority,omitempty"`
+	Existing        string `yaml:"existing" json:"existing,omitempty"`
+	Tenant          string `yaml:"tenant" json:"tenant"`
+	Target          string `yaml:"target" json:"target"`
+	ArchiveDir      string `yaml:"archive_dir" json:"archive_dir"`
+	FailedDir       string `yaml:"failed_dir" json:"failed_dir"`
+
+	cron     *cronSchedule
+	filename *regexp.Regexp
+}
+
+// compile checks the schedule and prepares its cron and file name patterns.
+func (s *ScheduleConfig) compile() error {
+	if s.Name == "" {
+		return fmt.Errorf("schedules need a name")
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return fmt.Errorf("schedule %s: %w", s.Name, err)
+	}
+	s.cron = cron
+
+	if s.Source == "" {
+		return fmt.Errorf("schedule %s needs a source directory or url", s.Name)
+	}
+	if _, err := parseSourceURL(s.Source); err != nil {
+		return fmt.Errorf("schedule %s: %w", s.Name, err)
+	}
+	if _, err := path.Match(s.Pattern, ""); err != nil {
+		return fmt.Errorf("schedule %s: pattern %q: %w", s.Name, s.Pattern, err)
+	}
+	if s.FilenamePattern != "" {
+		if s.filename, err = filenamePattern(s.FilenamePattern); err != nil {
+			return fmt.Errorf("schedule %s: filename_pattern %w", s.Name, err)
+		}
+	}
+	if s.Mode != "" && !validImportMode(s.Mode) {
+		return fmt.Errorf("schedule %s: mode must be append or replace", s.Name)
+	}
+	if !validExistingMode(s.Existing) {
+		return fmt.Errorf("schedule %s: existing must be skip or update", s.Name)
+	}
+	if err := checkPriority(s.Priority); err != nil {
+		return fmt.Errorf("schedule %s: %w", s.Name, err)
+	}
+	for _, dir := range []string{s.ArchiveDir, s.FailedDir} {
+		if strings.Contains(dir, "/") || dir == "." || dir == ".." {
+			return fmt.Errorf("schedule %s: archive_dir and failed_dir must be plain directory names", s.Name)
+		}
+	}
+	return nil
+}
+
+func (s *ScheduleConfig) archiveDir() string {
+	if s.ArchiveDir != "" {
+		return s.ArchiveDir
+	}
+	return "processed"
+}
+
+func (s *ScheduleConfig) failedDir() string {
+	if s.FailedDir != "" {
+		return s.FailedDir
+	}
+	return "failed"
+}
+
+// period returns the month and year a file holds: from the file name when
+// filename_pattern is set, otherwise the month before the file arrived, as
+// the monthly export is dropped early in the following month.
+func (s *ScheduleConfig) period(f remoteFile) (DateParams, error) {
+	if s.filename == nil {
+		prev := f.ModTime.AddDate(0, 0, -f.ModTime.Day())
+		return DateParams{Month: prev.Month().String(), Year: strconv.Itoa(prev.Year())}, nil
+	}
+
+	m := s.filename.FindStringSubmatch(f.Name)
+	if m == nil {
+		return DateParams{}, fmt.Errorf("file name %s does not match filename_pattern", f.Name)
+	}
+	month, ok := parseMonth(m[s.filename.SubexpIndex("month")])
+	year := m[s.filename.SubexpIndex("year")]
+	if _, err := strconv.Atoi(year); !ok || err != nil || len(year) != 4 {
+		return DateParams{}, fmt.Errorf("no month and year in file name %s", f.Name)
+	}
+	return DateParams{Month: month.String(), Year: year}, nil
+}
+
+// parseMonth accepts 1-12, 01-12, and English month names or their first
+// three letters in any case.
+func parseMonth(v string) (time.Month, bool) {
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Month(n), n >= 1 && n <= 12
+	}
+	v = strings.ToLower(v)
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		if v == name || v == name[:3] {
+			return m, true
+		}
+	}
+	return 0, false
+}
+
+// ScheduleStatus is the state of a schedule for the admin api.
+type ScheduleStatus struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	LastRun   time.Time `json:"last_run"`
+	NextRun   time.Time `json:"next_run"`
+	Imports   []string  `json:"imports,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var schedules = struct {
+	sync.Mutex
+	byName map[string]*ScheduleStatus
+}{byName: map[string]*ScheduleStatus{}}
+
+// scheduleState returns the status of the named schedule, creating it.
+// The caller holds schedules.
+func scheduleState(name string) *ScheduleStatus {
+	st, ok := schedules.byName[name]
+	if !ok {
+		st = &ScheduleStatus{Name: name}
+		schedules.byName[name] = st
+	}
+	return st
+}
+
+// runScheduler starts the due schedules at the top of every minute. The
+// schedules are read from the live configuration each time; a schedule still
+// busy with its previous run is skipped.
+func runScheduler() {
+	for {
+		now := sleepToNextMinute()
+
+		for _, s := range cfg().Schedules {
+			if !s.cron.matches(now) {
+				continue
+			}
+
+			schedules.Lock()
+			st := scheduleState(s.Name)
+			busy := st.Running
+			st.Running = true
+			schedules.Unlock()
+
+			if busy {
+				log.Println("Schedule", s.Name, "skipped, the previous run is still busy")
+				continue
+			}
+			go runSchedule(s)
+		}
+	}
+}
+
+// runSchedule imports the waiting files of one schedule one after the other.
+func runSchedule(s ScheduleConfig) {
+	var imported []string
+	err := func() error {
+		ctx := context.Background()
+		src, err := openFileSource(ctx, s.Source)
+		if err != nil {
+			return err
+		}
+		defer src.close()
+
+		files, err := src.list(ctx)
+		if err != nil {
+			return err
+		}
+
+		var errs []string
+		for _, f := range files {
+			if ok, _ := path.Match(s.Pattern, f.Name); s.Pattern != "" && !ok {
+				continue
+			}
+			if time.Since(f.ModTime) < scheduleSettleTime {
+				continue
+			}
+
+			id, err := importScheduledFile(ctx, src, s, f)
+			if id != "" {
+				imported = append(imported, id)
+			}
+			if err != nil {
+				log.Println("Schedule", s.Name, "file", f.Name+":", err)
+				errs = append(errs, f.Name+": "+err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+		return nil
+	}()
+
+	schedules.Lock()
+	defer schedules.Unlock()
+	st := scheduleState(s.Name)
+	st.Running = false
+	st.LastRun = time.Now()
+	st.Imports = imported
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	}
+}
+
+// importScheduledFile loads one file like an upload, waiting for the import
+// window like a queued one, then archives it. A file that cannot be read is
+// left in place for the next run; one whose import fails goes to failed_dir.
+func importScheduledFile(ctx context.Context, src fileSource, s ScheduleConfig, f remoteFile) (string, error) {
+	settings := cfg()
+	spec := importSpec{
+		mapping:        s.Mapping,
+		mode:           s.Mode,
+		strict:         s.Strict,
+		priority:       s.Priority,
+		staged:         settings.StagingLoad,
+		existing:       s.Existing,
+		profile:        settings.ProfileImports,
+		rebuildIndexes: settings.RebuildIndexes,
+		analyze:        settings.AnalyzeAfterImport,
+		tenant:         s.Tenant,
+		database:       s.Target,
+	}
+	if spec.mode == "" {
+		spec.mode = importModeAppend
+	}
+
+	date, err := s.period(f)
+	if err == nil {
+		spec.date = date
+		err = spec.resolve(settings)
+	}
+	if err != nil {
+		if archiveErr := src.archive(ctx, f.Name, s.failedDir()); archiveErr != nil {
+			log.Println("Schedule", s.Name, "could not move", f.Name, "to", s.failedDir()+":", archiveErr)
+		}
+		return "", err
+	}
+
+	// over the tenant's quota the file stays for the next run
+	imp, err := loadSourceFile(ctx, src, &spec, f, "schedule:"+s.Name)
+	if err != nil {
+		return "", err
+	}
+
+	dir := s.archiveDir()
+	if imp.report().Status == importStatusFailed {
+		dir = s.failedDir()
+		err = fmt.Errorf("import %s failed", imp.ID)
+	}
+	if archiveErr := src.archive(ctx, f.Name, dir); archiveErr != nil {
+		return imp.ID, fmt.Errorf("import %s finished but the file could not be moved to %s: %w", imp.ID, dir, archiveErr)
+	}
+	return imp.ID, err
+}
+
+// loadSourceFile imports the file f of src with spec, resolved, as principal
+// and returns the finished import.
+func loadSourceFile(ctx context.Context, src fileSource, spec *importSpec, f remoteFile, principal string) (*Import, error) {
+	rc, err := src.open(ctx, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	spool, err := spoolUpload(io.TeeReader(rc, h))
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(spool)
+	if err != nil {
+		os.Remove(spool)
+		return nil, err
+	}
+	release, err := reserveImportQuota(nil, spec.tenant, fi.Size())
+	if err != nil {
+		os.Remove(spool)
+		return nil, err
+	}
+
+	imp, err := spec.newImport(context.Background(), "", fi.Size())
+	if err != nil {
+		release()
+		os.Remove(spool)
+		return nil, err
+	}
+	imp.FileName = f.Name
+	imp.Checksum = hex.EncodeToString(h.Sum(nil))
+	imp.Principal = principal
+	imp.setStatus(importStateQueued)
+	runQueuedImport(imp, []string{spool}, []string{f.Name}, release)
+	return imp, nil
+}
+
+// handleScheduleStatus lists the configured schedules with their last and next
+// run.
+func handleScheduleStatus(c *gin.Context) {
+	now := time.Now()
+	list := []ScheduleStatus{}
+
+	schedules.Lock()
+	defer schedules.Unlock()
+	for _, s := range cfg().Schedules {
+		st := *scheduleState(s.Name)
+		st.NextRun = s.cron.next(now)
+		list = append(list, st)
+	}
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MonthDDL creates the schema and table of a month in the schema_per_month
+// layout. The statements may use {schema}, {table}, {columns} (the columns of
+// the mapping with their sql types), {month}, {year} and {tenant}.
+type MonthDDL struct {
+	// create the month when an import is the first to load it
+	AutoCreate bool     `yaml:"auto_create" json:"auto_create"`
+	Schema     string   `yaml:"schema" json:"schema"`
+	Table      string   `yaml:"table" json:"table"`
+	Indexes    []string `yaml:"indexes" json:"indexes"`
+	Grants     []string `yaml:"grants" json:"grants"`
+}
+
+func defaultMonthDDL() MonthDDL {
+	return MonthDDL{
+		Schema: "CREATE SCHEMA IF NOT EXISTS {schema}",
+		Table:  "CREATE TABLE IF NOT EXISTS {schema}.{table} ({columns})",
+	}
+}
+
+// checkSchemaPattern verifies a schema_pattern makes a plain identifier for
+// every month.
+func checkSchemaPattern(pattern string) error {
+	name := strings.NewReplacer("{month}", "may", "{year}", "2024").Replace(pattern)
+	if !strings.Contains(pattern, "{month}") || !strings.Contains(pattern, "{year}") || !identifierPattern.MatchString(name) {
+		return fmt.Errorf("schema_pattern must be an identifier with {month} and {year}, like cashback_{month}_{year}")
+	}
+	return nil
+}
+
+// monthSchema is the schema of a month in the schema_per_month layout, before
+// a tenant template applies.
+func (c *Config) monthSchema(date DateParams) string {
+	return strings.NewReplacer("{month}", strings.ToLower(date.Month), "{year}", strings.ToLower(date.Year)).Replace(c.SchemaPattern)
+}
+
+// monthStatements fills in the month_ddl templates for the table schema.table
+// of plan, in the order they run.
+func (c *Config) monthStatements(plan *executionPlan, schema, table string, date DateParams, tenant string) []string {
+	columns := make([]string, len(plan.columns))
+	for i, name := range plan.columns {
+		columns[i] = name + " " + sqlTypes[plan.types[i]]
+	}
+	r := strings.NewReplacer(
+		"{schema}", schema,
+		"{table}", table,
+		"{columns}", strings.Join(columns, ", "),
+		"{month}", strings.ToLower(date.Month),
+		"{year}", strings.ToLower(date.Year),
+		"{tenant}", tenant,
+	)
+	var statements []string
+	for _, s := range append(append([]string{c.MonthDDL.Schema, c.MonthDDL.Table}, c.MonthDDL.Indexes...), c.MonthDDL.Grants...) {
+		if strings.TrimSpace(s) != "" {
+			statements = append(statements, r.Replace(s))
+		}
+	}
+	return statements
+}
+
+// createMonth runs statements in one transaction, once per process and table.
+func createMonth(ctx context.Context, dbPool *pgxpool.Pool, table string, statements []string) error {
+	createdTables.Lock()
+	defer createdTables.Unlock()
+	key := poolKey(dbPool, table)
+	if createdTables.names[key] {
+		return nil
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	for _, s := range statements {
+		if _, err := tx.Exec(ctx, s); err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	createdTables.names[key] = true
+	return nil
+}
+
+// createImportMonth creates the month an import loads into, with
+// month_ddl.auto_create.
+func createImportMonth(ctx context.Context, dbPool *pgxpool.Pool, imp *Import, settings *Config) error {
+	date := DateParams{Month: imp.Month, Year: imp.Year}
+	if err := createMonth(ctx, dbPool, imp.target(), settings.monthStatements(imp.plan, imp.Schema, imp.Table, date, imp.Tenant)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", imp.target(), err)
+	}
+	return nil
+}
+
+// handleCreateSchema creates the schema and table of ?month= and ?year= for
+// a mapping, tenant and target like an upload would load into, before the
+// first file arrives. With ?dry_run=true it only returns the statements.
+func handleCreateSchema(c *gin.Context) {
+	var date DateParams
+	if err := c.ShouldBindQuery(&date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid date parameters"})
+		return
+	}
+	if err := date.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	settings := cfg()
+	if partitionedLayout(settings.TableLayout) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "months are only created with the " + layoutSchemaPerMonth + " layout"})
+		return
+	}
+	s := &importSpec{
+		date:     date,
+		mapping:  c.Query("mapping"),
+		template: c.Query("template"),
+		mode:     importModeAppend,
+		tenant:   c.Query("tenant"),
+		database: c.Query("target"),
+	}
+	if err := s.resolve(settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	table := s.schema + "." + s.table
+	statements := settings.monthStatements(s.plan, s.schema, s.table, date, s.tenant)
+	if c.Query("dry_run") == "true" {
+		c.JSON(http.StatusOK, gin.H{"table": table, "dry_run": true, "statements": statements})
+		return
+	}
+
+	dbPool, releasePool, err := acquireImportPool(s.tenant, s.database)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+	if err := createMonth(c.Request.Context(), dbPool, table, statements); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	log.Println("=> month created:", table)
+	auditRequest(c, auditCreateSchema, "", "table="+table+" mapping="+s.plan.version)
+	c.JSON(http.StatusOK, gin.H{"table": table, "statements": statements})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longest lifetime of a signed link
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// signArtifactPath signs a download path with its query and expiry, so none of
+// them can be changed without invalidating the link.
+func signArtifactPath(secret, path, compression string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "\n" + compression + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleCreateRejectsLink returns a link to the rejects download of an import
+// that works without an API key until it expires (?ttl_minutes=, 60 by
+// default), for sharing with people who have no key.
+func handleCreateRejectsLink(c *gin.Context) {
+	secret := cfg().URLSigningSecret
+	if secret == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"message": "Signed links are not configured, set url_signing_secret"})
+		return
+	}
+
+	imp, ok := findRequestImport(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Import not found"})
+		return
+	}
+
+	ttlMinutes, err := strconv.Atoi(c.DefaultQuery("ttl_minutes", "60"))
+	ttl := time.Duration(ttlMinutes) * time.Minute
+	if err != nil || ttl <= 0 || ttl > maxSignedURLTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "ttl_minutes must be between 1 and 10080"})
+		return
+	}
+	compression := c.Query("compression")
+	if _, err := lookupCodec(compression); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	auditRequest(c, auditShareLink, imp.ID, "expires="+expires.UTC().Format(time.RFC3339))
+	c.JSON(http.StatusOK, gin.H{"url": signedRejectsPath(secret, imp.ID, compression, expires), "expires_at": expires})
+}
+
+// signedRejectsPath is the path and query of a signed link to the rejects of
+// an import.
+func signedRejectsPath(secret, importID, compression string, expires time.Time) string {
+	path := "/artifacts/imports/" + importID + "/rejects"
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signArtifactPath(secret, path, compression, expires.Unix()))
+	if compression != "" {
+		query.Set("compression", compression)
+	}
+	return path + "?" + query.Encode()
+}
+
+// requireSignedURL lets a request through when it carries a valid, unexpired
+// signature of its path.
+func requireSignedURL(c *gin.Context) {
+	secret := cfg().URLSigningSecret
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if secret == "" || err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Invalid link"})
+		return
+	}
+
+	want := signArtifactPath(secret, c.Request.URL.Path, c.Query("compression"), expires)
+	if !hmac.Equal([]byte(want), []byte(c.Query("signature"))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Invalid link"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "Link expired"})
+		return
+	}
+	c.Next()
+}
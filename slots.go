@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// slotRequest is an import waiting for one of the max_running_imports slots,
+// or holding one.
+type slotRequest struct {
+	imp   *Import
+	rank  int
+	ready chan struct{}
+}
+
+// imports running on this server, those waiting for a slot by priority then
+// arrival, and those that lent their slot to a higher priority import
+var importSlots = struct {
+	sync.Mutex
+	running   []*slotRequest
+	waiting   []*slotRequest
+	preempted []*slotRequest
+}{}
+
+func init() {
+	// a raised limit lets waiting imports start right away
+	configHooks = append(configHooks, func(old, next *Config) {
+		if old.MaxRunningImports != next.MaxRunningImports || old.PreemptImports != next.PreemptImports {
+			importSlots.Lock()
+			grantSlotsLocked(next)
+			importSlots.Unlock()
+		}
+	})
+}
+
+// acquireImportSlot waits until fewer than max_running_imports imports run
+// and returns the function giving the slot back.
+func acquireImportSlot(ctx context.Context, imp *Import) (func(), error) {
+	r := &slotRequest{imp: imp, rank: priorityRank(imp.Priority), ready: make(chan struct{})}
+
+	importSlots.Lock()
+	importSlots.waiting = insertByRank(importSlots.waiting, r)
+	grantSlotsLocked(cfg())
+	importSlots.Unlock()
+
+	release := func() {
+		importSlots.Lock()
+		defer importSlots.Unlock()
+		importSlots.running = removeSlot(importSlots.running, r)
+		// an import may run out of rows while preempted
+		importSlots.preempted = removeSlot(importSlots.preempted, r)
+		grantSlotsLocked(cfg())
+	}
+
+	select {
+	case <-r.ready:
+		return release, nil
+	case <-ctx.Done():
+		importSlots.Lock()
+		waiting := len(importSlots.waiting)
+		importSlots.waiting = removeSlot(importSlots.waiting, r)
+		granted := len(importSlots.waiting) == waiting
+		importSlots.Unlock()
+		if granted {
+			// granted meanwhile
+			release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// insertByRank adds r after the requests of the same or a higher priority.
+func insertByRank(queue []*slotRequest, r *slotRequest) []*slotRequest {
+	i := len(queue)
+	for i > 0 && queue[i-1].rank < r.rank {
+		i--
+	}
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = r
+	return queue
+}
+
+func removeSlot(queue []*slotRequest, r *slotRequest) []*slotRequest {
+	for i, q := range queue {
+		if q == r {
+			return append(queue[:i:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+// grantSlotsLocked hands free slots out by priority, 0 meaning no limit; a
+// preempted import gets its slot back before a waiting one of the same
+// priority starts. With preempt_imports a waiting import takes the slot of a
+// running one of a lower priority. The caller holds the importSlots lock.
+func grantSlotsLocked(settings *Config) {
+	limit := settings.MaxRunningImports
+	for {
+		if limit <= 0 || len(importSlots.running) < limit {
+			if !grantNextLocked() {
+				return
+			}
+			continue
+		}
+		if !settings.PreemptImports || !preemptLocked() {
+			return
+		}
+	}
+}
+
+// grantNextLocked starts or resumes the import first in line, if any.
+func grantNextLocked() bool {
+	waiting, preempted := importSlots.waiting, importSlots.preempted
+	switch {
+	case len(preempted) > 0 && (len(waiting) == 0 || preempted[0].rank >= waiting[0].rank):
+		r := preempted[0]
+		importSlots.preempted = preempted[1:]
+		importSlots.running = append(importSlots.running, r)
+		r.imp.unpreempt()
+	case len(waiting) > 0:
+		r := waiting[0]
+		importSlots.waiting = waiting[1:]
+		importSlots.running = append(importSlots.running, r)
+		close(r.ready)
+	default:
+		return false
+	}
+	return true
+}
+
+// preemptLocked pauses the running import of the lowest priority below the
+// first waiting one, the most recently started of them, to free its slot. An
+// import of the same table is left alone: it holds the table the waiting one
+// would then never get.
+func preemptLocked() bool {
+	if len(importSlots.waiting) == 0 {
+		return false
+	}
+	next := importSlots.waiting[0]
+	var victim *slotRequest
+	for _, r := range importSlots.running {
+		if r.rank < next.rank && (victim == nil || r.rank <= victim.rank) && !r.imp.oneTransaction() && r.imp.lockKey() != next.imp.lockKey() {
+			victim = r
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	importSlots.running = removeSlot(importSlots.running, victim)
+	importSlots.preempted = insertByRank(importSlots.preempted, victim)
+	victim.imp.preempt(next.imp.ID)
+	return true
+}
+
+// slotQueuePosition returns the place of owner among the imports waiting for
+// a slot, starting at 1, or 0 when it is not waiting.
+func slotQueuePosition(owner string) int {
+	importSlots.Lock()
+	defer importSlots.Unlock()
+	for i, r := range importSlots.waiting {
+		if r.imp.ID == owner {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// acquireSlot waits for a slot to run the import in, showing it as queued with
+// its position until then.
+func (imp *Import) acquireSlot(ctx context.Context) (func(), error) {
+	previous := imp.setStatus(importStateQueued)
+	defer imp.setStatus(previous)
+	return acquireImportSlot(ctx, imp)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// history columns an upload source can be identified by
+var sourceDimensions = map[string]string{
+	"api_key":    "api_key",
+	"source_ip":  "source_ip",
+	"user_agent": "user_agent",
+	"principal":  "principal",
+	"tenant":     "tenant",
+}
+
+func sourceColumn(by string) (string, bool) {
+	column, ok := sourceDimensions[by]
+	return column, ok
+}
+
+func sourceDimensionNames() string {
+	names := make([]string, 0, len(sourceDimensions))
+	for name := range sourceDimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// SourceStats sums up the imports of one upload source. Imports recorded
+// before sources were captured are grouped under an empty source.
+type SourceStats struct {
+	Source       string    `json:"source"`
+	Imports      int64     `json:"imports"`
+	Failed       int64     `json:"failed"`
+	RowsRead     int64     `json:"rows_read"`
+	Inserted     int64     `json:"inserted"`
+	Rejected     int64     `json:"rejected"`
+	Score        *float64  `json:"score"`
+	LastImportAt time.Time `json:"last_import_at"`
+}
+
+// handleSourceStats returns the import volume per ?by= source (api_key by
+// default) over the last ?days= days (30 by default), busiest source first,
+// within the tenant of the caller if it has one.
+func handleSourceStats(c *gin.Context) {
+	by := c.DefaultQuery("by", "api_key")
+	column, ok := sourceColumn(by)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "by must be one of " + sourceDimensionNames()})
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 || days > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "days must be between 1 and 366"})
+		return
+	}
+	since := time.Now().AddDate(0, 0, -days)
+
+	table := cfg().HistoryTable
+	query := `SELECT coalesce(` + column + `, ''), count(*), count(*) FILTER (WHERE status = $2), sum(rows_read)::bigint,
+		sum(inserted)::bigint, sum(rejected)::bigint, avg(quality_score), max(finished_at)
+		FROM ` + table + ` WHERE finished_at >= $1 AND ($3 = '' OR tenant = $3)
+		GROUP BY 1 ORDER BY count(*) DESC, 1`
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	ctx := c.Request.Context()
+	if err := ensureTable(ctx, dbPool, table, historyTableDDL); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+
+	rows, err := dbPool.Query(ctx, query, since, importStatusFailed, requestTenant(c))
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+	defer rows.Close()
+
+	sources := []SourceStats{}
+	for rows.Next() {
+		var s SourceStats
+		if err := rows.Scan(&s.Source, &s.Imports, &s.Failed, &s.RowsRead, &s.Inserted, &s.Rejected, &s.Score, &s.LastImportAt); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+			return
+		}
+		if s.Score != nil {
+			*s.Score = math.Round(*s.Score*10) / 10
+		}
+		sources = append(sources, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the import history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"by": by, "since": since, "sources": sources})
+}
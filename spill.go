@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+)
+
+// spooled files are named like this inside spool_dir
+const spoolPattern = "import-*.upload"
+
+// spillBuffer receives an upload, in memory up to upload_memory_bytes and in a
+// file in spool_dir beyond that, hashing it on the way so the file is not read
+// a second time for its checksum.
+type spillBuffer struct {
+	limit int64
+	mem   bytes.Buffer
+	file  *os.File
+	size  int64
+	sum   hash.Hash
+	// of the part the buffer was read from
+	contentType string
+}
+
+func newSpillBuffer(limit int64) *spillBuffer {
+	return &spillBuffer{limit: limit, sum: sha256.New()}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.size+int64(len(p)) > b.limit {
+		f, err := createSpoolFile()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		b.file = f
+		b.mem = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.sum.Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *spillBuffer) checksum() string {
+	return hex.EncodeToString(b.sum.Sum(nil))
+}
+
+// reader reads the upload from the start.
+func (b *spillBuffer) reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// detach hands the upload over as a spool file that outlives the request;
+// the buffer is empty afterwards.
+func (b *spillBuffer) detach() (string, error) {
+	if b.file == nil {
+		return spoolUpload(bytes.NewReader(b.mem.Bytes()))
+	}
+	path := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	return path, err
+}
+
+// close drops the upload.
+func (b *spillBuffer) close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.mem = bytes.Buffer{}
+}
+
+// readerAt reads the upload at any offset.
+func (b *spillBuffer) readerAt() io.ReaderAt {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes())
+	}
+	return b.file
+}
+
+// uploadsChecksum is the checksum of the upload of parts: that of the single
+// part, or of the checksums of several.
+func uploadsChecksum(parts []*spillBuffer) string {
+	if len(parts) == 1 {
+		return parts[0].checksum()
+	}
+	h := sha256.New()
+	for _, b := range parts {
+		io.WriteString(h, b.checksum()+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func closeUploads(parts []*spillBuffer) {
+	for _, b := range parts {
+		b.close()
+	}
+}
+
+// readUploadParts spills every "file" part of a multipart request, in the
+// order they were sent, and returns them with their file names. The parts
+// share limit, the later ones spill sooner.
+func readUploadParts(mr *multipart.Reader, limit int64) ([]*spillBuffer, []string, error) {
+	var parts []*spillBuffer
+	var names []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if len(parts) == 0 {
+				return nil, nil, errors.New("no file part in the upload")
+			}
+			return parts, names, nil
+		}
+		if err != nil {
+			closeUploads(parts)
+			return nil, nil, err
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		b := newSpillBuffer(limit)
+		_, err = io.Copy(b, part)
+		part.Close()
+		if err != nil {
+			b.close()
+			closeUploads(parts)
+			return nil, nil, err
+		}
+		b.contentType = part.Header.Get("Content-Type")
+		if b.file == nil {
+			limit -= b.size
+		}
+		parts = append(parts, b)
+		names = append(names, part.FileName())
+	}
+}
+
+// readUploadPart spills the "file" part of a multipart request and returns it
+// with its file name; other parts are skipped.
+func readUploadPart(mr *multipart.Reader, limit int64) (*spillBuffer, string, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", errors.New("no file part in the upload")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		b := newSpillBuffer(limit)
+		_, err = io.Copy(b, part)
+		part.Close()
+		if err != nil {
+			b.close()
+			return nil, "", err
+		}
+		b.contentType = part.Header.Get("Content-Type")
+		return b, part.FileName(), nil
+	}
+}
+
+func createSpoolFile() (*os.File, error) {
+	dir := cfg().SpoolDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, spoolPattern)
+}
+
+// cleanSpoolDir removes the spool files left by a previous run; the imports
+// they were queued for did not survive it.
+func cleanSpoolDir(dir string) {
+	leftovers, _ := filepath.Glob(filepath.Join(dir, spoolPattern))
+	for _, f := range leftovers {
+		if err := os.Remove(f); err == nil {
+			log.Println("=> removed leftover spool file", f)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// prepareAppendStaging creates the unlogged staging table of a staged append
+// import. It copies the constraints and indexes of the target so bad rows are
+// still rejected one by one while loading.
+func prepareAppendStaging(ctx context.Context, dbPool *pgxpool.Pool, imp *Import) error {
+	_, err := dbPool.Exec(ctx, fmt.Sprintf("CREATE UNLOGGED TABLE %s (LIKE %s INCLUDING ALL)", imp.stagingTable, imp.target()))
+	if err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+	return nil
+}
+
+// finishStagedAppend moves the rows of the staging table into the target in
+// one transaction, after checking the staging table holds exactly the rows
+// counted as inserted. Downstream queries see all rows of the file or none.
+// An aborted or failed import moves nothing and is reported rolled back.
+func finishStagedAppend(dbPool *pgxpool.Pool, imp *Import) error {
+	ctx := context.Background()
+	defer func() {
+		if _, err := dbPool.Exec(ctx, "DROP TABLE IF EXISTS "+imp.stagingTable); err != nil {
+			log.Println("Staged import", imp.ID, "failed to drop staging table:", err)
+		}
+	}()
+
+	imp.mu.Lock()
+	aborted := imp.abortReason != ""
+	imp.mu.Unlock()
+
+	err := moveStagedRows(ctx, dbPool, imp, aborted)
+	if err != nil || aborted {
+		atomic.StoreInt64(&imp.inserted, 0)
+		imp.mu.Lock()
+		imp.rolledBack = true
+		imp.mu.Unlock()
+		return err
+	}
+
+	// retried rejects go straight to the target from now on
+	imp.query = imp.plan.insertQuery(imp.target())
+	return nil
+}
+
+func moveStagedRows(ctx context.Context, dbPool *pgxpool.Pool, imp *Import, aborted bool) error {
+	inserted := atomic.LoadInt64(&imp.inserted)
+	if aborted || inserted == 0 {
+		return nil
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin move from staging: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var staged int64
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM "+imp.stagingTable).Scan(&staged); err != nil {
+		return fmt.Errorf("failed to count staged rows: %w", err)
+	}
+	if staged != inserted {
+		return fmt.Errorf("staging table holds %d rows, %d were inserted", staged, inserted)
+	}
+
+	if err := rollUpStaged(ctx, tx, imp); err != nil {
+		return err
+	}
+
+	var already, updated int64
+	if imp.Existing != "" {
+		if already, updated, err = moveNewStagedRows(ctx, tx, imp, staged); err != nil {
+			return err
+		}
+	} else {
+		columns := strings.Join(imp.plan.columns, ",")
+		tag, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", imp.target(), columns, columns, imp.stagingTable))
+		if err != nil {
+			return fmt.Errorf("failed to move staged rows into %s: %w", imp.target(), err)
+		}
+		if tag.RowsAffected() != staged {
+			return fmt.Errorf("moved %d of %d staged rows", tag.RowsAffected(), staged)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to move staged rows into %s: %w", imp.target(), err)
+	}
+	// rows already loaded are not counted as inserted
+	atomic.AddInt64(&imp.inserted, -already)
+	atomic.StoreInt64(&imp.alreadyLoaded, already)
+	atomic.StoreInt64(&imp.updatedRows, updated)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// preparedStatements remembers the inserts prepared on each connection, so a
+// worker sends the name of the statement instead of its sql.
+var preparedStatements = struct {
+	sync.Mutex
+	conns map[*pgx.Conn]map[string]bool
+
+	hits     int64
+	prepared int64
+	failed   int64
+}{conns: map[*pgx.Conn]map[string]bool{}}
+
+// statementName names an insert after its sql, which holds the schema and
+// table, so every target and mapping gets a statement of its own.
+func statementName(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return "ins_" + hex.EncodeToString(sum[:6])
+}
+
+// prepareInsert returns the name of query prepared on conn, preparing it the
+// first time the connection runs it. When it cannot be prepared query is
+// returned, to be sent as is.
+func prepareInsert(ctx context.Context, conn *pgxpool.Conn, query string) string {
+	c := conn.Conn()
+	name := statementName(query)
+
+	preparedStatements.Lock()
+	known := preparedStatements.conns[c][name]
+	preparedStatements.Unlock()
+	if known {
+		atomic.AddInt64(&preparedStatements.hits, 1)
+		return name
+	}
+
+	// the connection is held by this worker alone, so no one else prepares
+	// on it meanwhile
+	if _, err := c.Prepare(ctx, name, query); err != nil {
+		atomic.AddInt64(&preparedStatements.failed, 1)
+		return query
+	}
+	atomic.AddInt64(&preparedStatements.prepared, 1)
+
+	preparedStatements.Lock()
+	defer preparedStatements.Unlock()
+	if preparedStatements.conns[c] == nil {
+		// forget the connections the pool closed since
+		for old := range preparedStatements.conns {
+			if old.IsClosed() {
+				delete(preparedStatements.conns, old)
+			}
+		}
+		preparedStatements.conns[c] = map[string]bool{}
+	}
+	preparedStatements.conns[c][name] = true
+	return name
+}
+
+// statementCacheStats reports how often the workers found their insert
+// already prepared on the connection they hold.
+func statementCacheStats() map[string]interface{} {
+	preparedStatements.Lock()
+	conns := len(preparedStatements.conns)
+	preparedStatements.Unlock()
+
+	hits := atomic.LoadInt64(&preparedStatements.hits)
+	prepared := atomic.LoadInt64(&preparedStatements.prepared)
+	ratio := 0.0
+	if hits+prepared > 0 {
+		ratio = float64(hits) / float64(hits+prepared)
+	}
+	return map[string]interface{}{
+		"connections":    conns,
+		"prepared":       prepared,
+		"hits":           hits,
+		"prepare_errors": atomic.LoadInt64(&preparedStatements.failed),
+		"hit_ratio":      ratio,
+	}
+}
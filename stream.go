@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamReader hashes a raw request body while it is parsed. A body that
+// breaks off fails the import instead of passing for the end of the file.
+type streamReader struct {
+	r   io.Reader
+	imp *Import
+	sum hash.Hash
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.sum.Write(p[:n])
+	switch {
+	case err == io.EOF:
+		s.imp.Checksum = hex.EncodeToString(s.sum.Sum(nil))
+	case uploadTooLarge(err):
+		s.imp.abort(fmt.Errorf("%w: body is larger than %d bytes", errLimitExceeded, cfg().MaxUploadBytes))
+	case err != nil:
+		s.imp.abort(fmt.Errorf("request body: %w", err))
+	}
+	return n, err
+}
+
+// handleStreamImport loads a raw CSV request body into the dataset named by the
+// mapping version in the path, without a multipart form:
+//
+//	curl -T cashback.csv.gz -H "Content-Encoding: gzip" "http://localhost:8080/imports/default/stream?month=May&year=2023"
+//
+// The query parameters are those of /upload.
+func handleStreamImport(c *gin.Context) {
+	start := time.Now()
+	settings := cfg()
+
+	// gzip and zstd bodies are recognised by their magic bytes, the header
+	// only has to be one of them
+	switch strings.ToLower(c.GetHeader("Content-Encoding")) {
+	case "", "identity", "gzip", "x-gzip", "zstd":
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": "Content-Encoding must be gzip, zstd or identity"})
+		return
+	}
+
+	if limit := settings.MaxUploadBytes; limit > 0 {
+		if c.Request.ContentLength > limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Upload is larger than the limit of %d bytes", limit)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+
+	var dateParams DateParams
+	if err := c.ShouldBindQuery(&dateParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid date parameters"})
+		return
+	}
+
+	format, err := inputFormat(c.Query("format"), c.ContentType())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	spec := importSpec{
+		date:           dateParams,
+		mapping:        c.Param("dataset"),
+		mode:           c.DefaultQuery("mode", importModeAppend),
+		strict:         c.Query("strict") == "true",
+		transaction:    c.Query("transaction") == "true",
+		priority:       c.Query("priority"),
+		staged:         queryFlag(c, "staging", settings.StagingLoad),
+		existing:       c.Query("existing"),
+		profile:        queryFlag(c, "profile", settings.ProfileImports),
+		controls:       requestControls(c),
+		rebuildIndexes: queryFlag(c, "rebuild_indexes", settings.RebuildIndexes),
+		analyze:        queryFlag(c, "analyze", settings.AnalyzeAfterImport),
+		tenant:         requestTenant(c),
+		database:       c.Query("target"),
+		format:         format,
+		delimiter:      c.Query("delimiter"),
+		skipRows:       c.Query("skip_rows"),
+		skipColumns:    c.Query("skip_columns"),
+		source:         c.Query("source"),
+		periodCheck:    c.Query("period_check"),
+		maxOutside:     c.Query("max_outside_percent"),
+	}
+	given := queryGiven(c)
+	// the dataset of the path is the mapping
+	err = spec.applySource(settings, func(param string) bool { return param == "mapping" || given(param) })
+	if err == nil {
+		err = spec.resolve(settings)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// the size is only known up front when the client sends Content-Length
+	size := c.Request.ContentLength
+	if size < 0 {
+		size = 0
+	}
+	release, err := reserveImportQuota(requestAPIKey(c), spec.tenant, size)
+	if err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		return
+	}
+
+	filename := c.Query("filename")
+	if filename == "" {
+		filename = "stream." + format
+	}
+	imp, err := spec.newImport(requestTrace(c), c.Query("import_id"), size)
+	if err != nil {
+		release()
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	imp.FileName = filename
+	imp.Principal = requestPrincipal(c)
+	imp.SourceIP = c.ClientIP()
+	imp.UserAgent = c.Request.UserAgent()
+	if key := requestAPIKey(c); key != nil {
+		imp.APIKey = key.Name
+	}
+
+	// outside the import windows the body goes to disk like an upload
+	if windows := settings.windows; !windowOpen(windows, start) {
+		sum := sha256.New()
+		spool, err := spoolUpload(io.TeeReader(c.Request.Body, sum))
+		if err != nil {
+			release()
+			log.Println(err.Error())
+			imp.abort(err)
+			imp.finish()
+			status := http.StatusInternalServerError
+			if uploadTooLarge(err) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			c.JSON(status, gin.H{"message": "Failed to store the request body"})
+			return
+		}
+		imp.Checksum = hex.EncodeToString(sum.Sum(nil))
+
+		imp.setStatus(importStateQueued)
+		go runQueuedImport(imp, []string{spool}, []string{filename}, release)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"import_id": imp.ID,
+			"status":    importStateQueued,
+			"starts_at": nextWindowOpen(windows, start),
+			"message":   "Outside the import window, the file will be loaded when it opens",
+		})
+		return
+	}
+	defer release()
+
+	dbPool, releasePool, err := imp.acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		imp.abort(err)
+		imp.finish()
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	raw := &streamReader{r: c.Request.Body, imp: imp, sum: sha256.New()}
+	body, err := decompressUpload(&countingReader{r: raw, imp: imp})
+	if err != nil {
+		imp.abort(err)
+		imp.finish()
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	imp.publish(ImportEvent{Type: eventStarted, Message: filename})
+	runImport(imp, dbPool, body)
+
+	report := imp.report()
+	log.Println("=> streamed import", imp.ID, report.Status, "in", time.Since(start))
+
+	c.JSON(report.httpStatus(), report)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runStrictWorker inserts every row inside a single transaction, so a strict
+// import is all-or-nothing. The first insert error cancels ctx to stop the
+// reader, and any failure (including a cancellation from the reader) rolls the
+// whole transaction back.
+func runStrictWorker(ctx context.Context, cancel context.CancelFunc, pool *pgxpool.Pool, jobs <-chan []interface{}, wg *sync.WaitGroup, query string, imp *Import) error {
+	drain := func() {
+		for range jobs {
+			wg.Done()
+		}
+	}
+
+	txCtx, span := imp.startSpan("import.transaction")
+	var failed error
+	defer func() { span.end(failed, attr("rows", atomic.LoadInt64(&imp.inserted))) }()
+
+	_, acquire := startSpan(txCtx, "db.acquire")
+	conn, err := pool.Acquire(ctx)
+	acquire.end(err)
+	if err != nil {
+		cancel()
+		drain()
+		failed = fmt.Errorf("failed to acquire connection: %w", err)
+		return failed
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		cancel()
+		drain()
+		failed = fmt.Errorf("failed to begin transaction: %w", err)
+		return failed
+	}
+
+	for job := range jobs {
+		if failed == nil && ctx.Err() == nil {
+			if _, err := tx.Exec(ctx, query, job...); err != nil {
+				if ctx.Err() == nil {
+					failed = fmt.Errorf("row %d: %w", atomic.LoadInt64(&imp.inserted)+1, err)
+					imp.reject(job, err)
+					imp.deviate(Deviation{Row: atomic.LoadInt64(&imp.inserted) + 1, Kind: deviationRejected, Message: err.Error()})
+					imp.publish(ImportEvent{Type: eventWorkerError, Message: err.Error()})
+				}
+				cancel()
+			} else {
+				atomic.AddInt64(&imp.inserted, 1)
+				imp.countInserted(job, 1)
+			}
+		}
+		wg.Done()
+	}
+
+	if failed == nil && ctx.Err() == nil {
+		_, commit := startSpan(txCtx, "db.commit")
+		err := tx.Commit(context.Background())
+		commit.end(err)
+		if err == nil {
+			return nil
+		}
+		failed = fmt.Errorf("commit failed: %w", err)
+	}
+
+	if err := tx.Rollback(context.Background()); err != nil {
+		log.Println("Strict import", imp.ID, "rollback error:", err)
+	}
+	atomic.StoreInt64(&imp.inserted, 0)
+
+	imp.mu.Lock()
+	imp.rolledBack = true
+	imp.mu.Unlock()
+
+	if failed == nil {
+		failed = ctx.Err()
+	}
+	return failed
+}
+
+// kinds of deviation a strict import fails on
+const (
+	deviationHeader         = "unknown_header"
+	deviationColumnCount    = "column_count"
+	deviationMalformed      = "malformed_csv"
+	deviationParseError     = "parse_error"
+	deviationSuspicious     = "suspicious_value"
+	deviationPrecision      = "precision_loss"
+	deviationRepeatedHeader = "repeated_header"
+	deviationRejected       = "rejected"
+)
+
+// deviations kept with their details, the rest is only counted
+const maxDeviationSamples = 1000
+
+// significant digits a float64 holds without rounding
+const float64Digits = 15
+
+// Deviation is one place where a strict import did not match its mapping.
+// Row 0 is the header line.
+type Deviation struct {
+	Row     int64  `json:"row"`
+	Kind    string `json:"kind"`
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// DeviationReport lists everything that made a strict import fail. Loading
+// stops at the first deviation, but the file is still checked to the end so
+// the report covers all of it, unless the csv itself is broken or the
+// database refused a row.
+type DeviationReport struct {
+	Total   int64            `json:"total"`
+	ByKind  map[string]int64 `json:"by_kind"`
+	Samples []Deviation      `json:"samples"`
+}
+
+func (imp *Import) deviate(d Deviation) {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	if imp.deviations == nil {
+		imp.deviations = &DeviationReport{ByKind: map[string]int64{}, Samples: []Deviation{}}
+	}
+	imp.deviations.Total++
+	imp.deviations.ByKind[d.Kind]++
+	if len(imp.deviations.Samples) < maxDeviationSamples {
+		imp.deviations.Samples = append(imp.deviations.Samples, d)
+	}
+}
+
+func (imp *Import) deviationCount() int64 {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.deviations == nil {
+		return 0
+	}
+	return imp.deviations.Total
+}
+
+// deviationReport copies the deviations for a report, nil when there are none.
+func (imp *Import) deviationReport() *DeviationReport {
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+	if imp.deviations == nil {
+		return nil
+	}
+
+	r := &DeviationReport{Total: imp.deviations.Total, ByKind: copyCounts(imp.deviations.ByKind)}
+	r.Samples = append([]Deviation(nil), imp.deviations.Samples...)
+	return r
+}
+
+// checkHeader compares the header line with the file fields of the mapping
+// one by one, ignoring case, spaces and punctuation.
+func (imp *Import) checkHeader(plan *executionPlan, header []string) {
+	if len(header) != len(plan.fields) {
+		imp.deviate(Deviation{Kind: deviationColumnCount, Message: fmt.Sprintf("header has %d fields, mapping %s has %d", len(header), plan.version, len(plan.fields))})
+	}
+	for i, field := range header {
+		if i >= len(plan.fields) {
+			imp.deviate(Deviation{Kind: deviationHeader, Value: field, Message: "extra column"})
+			continue
+		}
+		if !plan.headerMatches(i, field) {
+			imp.deviate(Deviation{Kind: deviationHeader, Column: plan.fields[i], Value: field})
+		}
+	}
+}
+
+// headerMatches reports whether field is the name, or one of the aliases, of
+// file field i.
+func (p *executionPlan) headerMatches(i int, field string) bool {
+	key := headerKey(field)
+	if key == headerKey(p.fields[i]) {
+		return true
+	}
+	for _, alias := range p.aliases[i] {
+		if key == headerKey(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+var headerKeyPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+func headerKey(field string) string {
+	return strings.Trim(headerKeyPattern.ReplaceAllString(strings.ToLower(normalizeHeaderField(field)), "_"), "_")
+}
+
+// checkRow records the deviations of one cleaned data row.
+func (imp *Import) checkRow(plan *executionPlan, rowNumber int64, row []string, failed, flagged []int) {
+	if len(row) != plan.fileColumns {
+		imp.deviate(Deviation{Row: rowNumber, Kind: deviationColumnCount, Message: fmt.Sprintf("%d fields, %d expected", len(row), plan.fileColumns)})
+	}
+	for _, i := range failed {
+		// a computed column has no field of its own
+		var value string
+		if i < len(row) {
+			value = row[i]
+		}
+		imp.deviate(Deviation{Row: rowNumber, Kind: deviationParseError, Column: plan.columns[i], Value: plan.shown(i, value)})
+	}
+	for _, i := range flagged {
+		imp.deviate(Deviation{Row: rowNumber, Kind: deviationSuspicious, Column: plan.columns[i], Value: plan.shown(i, row[i])})
+	}
+	for i, t := range plan.types {
+		if t == "float" && i < len(row) && significantDigits(row[i]) > float64Digits {
+			imp.deviate(Deviation{Row: rowNumber, Kind: deviationPrecision, Column: plan.columns[i], Value: row[i]})
+		}
+		// decimals are rounded to their scale
+		if t == typeDecimal && i < len(row) && decimalPlaces(row[i]) > int(plan.scales[i]) {
+			imp.deviate(Deviation{Row: rowNumber, Kind: deviationPrecision, Column: plan.columns[i], Value: row[i]})
+		}
+	}
+}
+
+// significantDigits counts the digits of a decimal number that a float has to
+// hold, leading and trailing zeros aside.
+func significantDigits(s string) int {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s = s[:i]
+	}
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	return len(strings.Trim(digits, "0"))
+}
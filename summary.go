@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// what GET /summary groups the rows of a month by, and the column of each
+const (
+	summaryByDay     = "day"
+	summaryByClient  = "client"
+	summaryByPayment = "payment_method"
+)
+
+func (c *Config) summaryColumn(by string) string {
+	switch by {
+	case summaryByDay:
+		return c.PartitionColumn
+	case summaryByClient:
+		return c.ClientColumn
+	case summaryByPayment:
+		return c.PaymentColumn
+	}
+	return ""
+}
+
+// SummaryGroup counts the rows of one day, client or payment method and adds
+// up the summed columns over them. Key is null for rows without one.
+type SummaryGroup struct {
+	Key  *string            `json:"key"`
+	Rows int64              `json:"rows"`
+	Sums map[string]float64 `json:"sums"`
+}
+
+// Summary is what GET /summary returns. Source is "rollup" when the groups
+// were read from a rollup table of the mapping, which leaves out the rows
+// without a key, and "table" when they were computed from the rows.
+type Summary struct {
+	Table  string         `json:"table"`
+	By     string         `json:"by"`
+	Source string         `json:"source"`
+	Groups []SummaryGroup `json:"groups"`
+	Totals SummaryGroup   `json:"totals"`
+}
+
+// handleSummary aggregates the rows of a month for the dashboard, from a
+// rollup of the mapping grouped by the same column if there is one.
+func handleSummary(c *gin.Context) {
+	settings := cfg()
+	date := DateParams{Month: c.Query("month"), Year: c.Query("year")}
+	if err := date.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	s, err := dataSpec(c, date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	plan := s.plan
+
+	by := c.DefaultQuery("by", summaryByDay)
+	column := settings.summaryColumn(by)
+	if column == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "by must be day, client or payment_method"})
+		return
+	}
+	i := plan.columnIndex(column)
+	if i < 0 || plan.redactedColumns()[i] {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Mapping %s has no column %s to group by %s", plan.version, column, by)})
+		return
+	}
+	key := column + "::text"
+	if by == summaryByDay {
+		if plan.types[i] != "date" && plan.types[i] != "timestamp" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Column %s of mapping %s is not a date", column, plan.version)})
+			return
+		}
+		key = column + "::date::text"
+	}
+
+	// requested sums must exist, the configured ones are taken where they do
+	sums := c.QueryArray("sum")
+	requested := len(sums) > 0
+	if !requested {
+		sums = settings.SummarySums
+	}
+	var columns []string
+	for _, name := range sums {
+		j := plan.columnIndex(name)
+		if j < 0 || !numericType(plan.types[j]) {
+			if requested {
+				c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("sum=%s: not a numeric column of mapping %s", name, plan.version)})
+				return
+			}
+			continue
+		}
+		columns = append(columns, name)
+	}
+
+	f := newDataFilter(plan)
+	if err := f.month(settings, s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if client := c.Query("client"); client != "" {
+		if j := plan.columnIndex(settings.ClientColumn); j < 0 || !f.equal(plan, j, client) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mapping " + plan.version + " has no searchable client column " + settings.ClientColumn})
+			return
+		}
+	}
+
+	table := s.schema + "." + s.table
+	source := "table"
+	var query string
+	// rollups of the partitioned layout hold every month
+	if r := plan.summaryRollup(column, columns); r != nil && c.Query("client") == "" && !partitionedLayout(s.layout) {
+		source = "rollup"
+		selects := []string{column + "::text", "rows"}
+		for _, name := range columns {
+			selects = append(selects, "sum_"+name)
+		}
+		query = fmt.Sprintf("SELECT %s FROM %s ORDER BY 1", strings.Join(selects, ", "), rollupTable(table, r))
+	} else {
+		selects := []string{key, "count(*)"}
+		for _, name := range columns {
+			selects = append(selects, "coalesce(sum("+name+"), 0)::float8")
+		}
+		query = fmt.Sprintf("SELECT %s FROM %s t%s GROUP BY 1 ORDER BY 1", strings.Join(selects, ", "), table, f.where())
+	}
+
+	dbPool, releasePool, err := acquireImportPool(s.tenant, s.database)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return
+	}
+	defer releasePool()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dataQueryTimeout)
+	defer cancel()
+	rows, err := dbPool.Query(ctx, query, f.args...)
+	if err != nil {
+		dataError(c, table, err)
+		return
+	}
+	defer rows.Close()
+
+	summary := Summary{Table: table, By: by, Source: source, Groups: []SummaryGroup{}, Totals: SummaryGroup{Sums: map[string]float64{}}}
+	values := make([]float64, len(columns))
+	for rows.Next() {
+		g := SummaryGroup{Sums: map[string]float64{}}
+		dest := []interface{}{&g.Key, &g.Rows}
+		for j := range values {
+			dest = append(dest, &values[j])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			dataError(c, table, err)
+			return
+		}
+		summary.Totals.Rows += g.Rows
+		for j, name := range columns {
+			g.Sums[name] = values[j]
+			summary.Totals.Sums[name] += values[j]
+		}
+		summary.Groups = append(summary.Groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		dataError(c, table, err)
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
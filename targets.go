@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TargetConfig is a database imports can be sent to instead of database_url,
+// picked per request with ?target= (e.g. staging and production).
+type TargetConfig struct {
+	Name        string `yaml:"name" json:"name"`
+	DatabaseURL string `yaml:"database_url" json:"database_url"`
+	// 0 uses db_max_conns
+	DBMaxConns int `yaml:"db_max_conns" json:"db_max_conns"`
+}
+
+func (t *TargetConfig) check() error {
+	switch {
+	case !identifierPattern.MatchString(t.Name):
+		return fmt.Errorf("target name %q must be a plain identifier", t.Name)
+	case t.DatabaseURL == "":
+		return fmt.Errorf("target %s needs a database_url", t.Name)
+	case t.DBMaxConns < 0:
+		return fmt.Errorf("target %s: db_max_conns must not be negative", t.Name)
+	}
+	return nil
+}
+
+// target returns the named database target, nil if there is none.
+func (c *Config) target(name string) *TargetConfig {
+	if name == "" {
+		return nil
+	}
+	for i := range c.Targets {
+		if c.Targets[i].Name == name {
+			return &c.Targets[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) targetNames() []string {
+	names := make([]string, len(c.Targets))
+	for i, t := range c.Targets {
+		names[i] = t.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkDatabase verifies an import of tenant may go to the database target;
+// a tenant with its own database_url always loads into that one.
+func (c *Config) checkDatabase(tenant, database string) error {
+	if database == "" {
+		return nil
+	}
+	if c.target(database) == nil {
+		return fmt.Errorf("target must be one of %v", c.targetNames())
+	}
+	if t := c.tenant(tenant); t != nil && t.DatabaseURL != "" {
+		return fmt.Errorf("tenant %s loads into its own database, it cannot choose a target", t.Name)
+	}
+	return nil
+}
+
+// importDatabase returns the settings an import of tenant into database
+// connects with, and the name of the pool they get ("" for the shared one).
+func importDatabase(c *Config, tenant, database string) (*Config, string) {
+	if t := c.target(database); t != nil {
+		s := *c
+		s.DatabaseURL = t.DatabaseURL
+		if t.DBMaxConns > 0 {
+			s.DBMaxConns = t.DBMaxConns
+			s.DBMinConns = min(s.DBMinConns, t.DBMaxConns)
+		}
+		return &s, "target:" + t.Name
+	}
+	if t := c.tenant(tenant); t != nil && t.DatabaseURL != "" {
+		s := *c
+		s.DatabaseURL = t.DatabaseURL
+		return &s, "tenant:" + t.Name
+	}
+	return c, ""
+}
+
+// namedDatabaseExists reports whether the pool name of importDatabase still
+// has a database in c.
+func namedDatabaseExists(c *Config, name string) bool {
+	kind, n, _ := strings.Cut(name, ":")
+	if kind == "target" {
+		_, got := importDatabase(c, "", n)
+		return got == name
+	}
+	_, got := importDatabase(c, n, "")
+	return got == name
+}
+
+// acquirePool returns the pool of the database imp loads into.
+func (imp *Import) acquirePool() (*pgxpool.Pool, func(), error) {
+	return acquireImportPool(imp.Tenant, imp.Database)
+}
+
+// lockKey is the target table of imp within its database, the key of the
+// target locks and of the rollback snapshots.
+func (imp *Import) lockKey() string {
+	if imp.Database == "" {
+		return imp.target()
+	}
+	return imp.Database + ":" + imp.target()
+}
+
+// loadDatabase is a database imports load into: the one of database_url, a
+// target, or that of a tenant with its own database_url.
+type loadDatabase struct {
+	tenant, target string
+}
+
+// loadDatabases lists the databases imports of c load into, for the state
+// restored at startup.
+func loadDatabases(c *Config) []loadDatabase {
+	databases := []loadDatabase{{}}
+	for _, t := range c.Targets {
+		databases = append(databases, loadDatabase{target: t.Name})
+	}
+	for _, t := range c.Tenants {
+		if t.DatabaseURL != "" {
+			databases = append(databases, loadDatabase{tenant: t.Name})
+		}
+	}
+	return databases
+}
+
+// lockKey is Import.lockKey for a table of d.
+func (d loadDatabase) lockKey(table string) string {
+	if d.target == "" {
+		return table
+	}
+	return d.target + ":" + table
+}
+
+// undefinedTable reports whether err is about a missing table, as the tables
+// the service creates on first use are before that.
+func undefinedTable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42P01"
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Mapping templates are mappings kept in template_table instead of files, so
+// they can be changed through the admin api without a deploy. Every save adds
+// a revision; an upload with ?template=<name> uses the latest one, registered
+// as mapping version <name>@<revision> so the compiled plan of an older
+// revision stays valid for the imports already using it.
+
+const templateTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	name       text NOT NULL,
+	revision   int NOT NULL,
+	mapping    jsonb NOT NULL,
+	saved_by   text,
+	saved_at   timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (name, revision)
+)`
+
+// MappingTemplate is one revision of a template as the api shows it.
+type MappingTemplate struct {
+	Name     string    `json:"name"`
+	Revision int       `json:"revision"`
+	Version  string    `json:"version"`
+	SavedBy  string    `json:"saved_by,omitempty"`
+	SavedAt  time.Time `json:"saved_at"`
+	Mapping  *Mapping  `json:"mapping"`
+}
+
+func templateVersion(name string, revision int) string {
+	return name + "@" + strconv.Itoa(revision)
+}
+
+// templateQuery runs fn against template_table of the shared database.
+func templateQuery(ctx context.Context, fn func(table string, db *pgxpool.Pool) error) error {
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+
+	table := cfg().TemplateTable
+	if err := ensureTable(ctx, dbPool, table, templateTableDDL); err != nil {
+		return err
+	}
+	return fn(table, dbPool)
+}
+
+func scanTemplate(row pgx.Row) (*MappingTemplate, error) {
+	t := &MappingTemplate{}
+	var data []byte
+	if err := row.Scan(&t.Name, &t.Revision, &data, &t.SavedBy, &t.SavedAt); err != nil {
+		return nil, err
+	}
+	t.Mapping = new(Mapping)
+	if err := json.Unmarshal(data, t.Mapping); err != nil {
+		return nil, err
+	}
+	t.Version = templateVersion(t.Name, t.Revision)
+	t.Mapping.Version = t.Version
+	return t, nil
+}
+
+const templateColumns = "name, revision, mapping, coalesce(saved_by, ''), saved_at"
+
+// loadTemplate returns a revision of a template, the latest when revision is
+// 0, or nil when there is none.
+func loadTemplate(ctx context.Context, name string, revision int) (*MappingTemplate, error) {
+	var t *MappingTemplate
+	err := templateQuery(ctx, func(table string, db *pgxpool.Pool) error {
+		var err error
+		t, err = scanTemplate(db.QueryRow(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE name = $1 AND ($2 = 0 OR revision = $2)
+			ORDER BY revision DESC LIMIT 1`, templateColumns, table), name, revision))
+		if errors.Is(err, pgx.ErrNoRows) {
+			t, err = nil, nil
+		}
+		return err
+	})
+	return t, err
+}
+
+// registerTemplate makes a template revision usable as a mapping version.
+func registerTemplate(t *MappingTemplate) error {
+	if _, err := compilePlan(t.Mapping); err != nil {
+		return fmt.Errorf("template %s: %w", t.Version, err)
+	}
+	mappings.Lock()
+	mappings.byVersion[t.Version] = t.Mapping
+	mappings.Unlock()
+	return nil
+}
+
+// resolveTemplate returns the mapping version of the latest revision of the
+// named template.
+func resolveTemplate(name string) (string, error) {
+	t, err := loadTemplate(context.Background(), name, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+	if t == nil {
+		return "", fmt.Errorf("unknown template %q", name)
+	}
+	return t.Version, registerTemplate(t)
+}
+
+// templateMapping loads the template revision behind a <name>@<revision>
+// version this node has not seen, e.g. on a distributed worker.
+func templateMapping(version string) (*Mapping, bool) {
+	name, rev, ok := strings.Cut(version, "@")
+	revision, err := strconv.Atoi(rev)
+	if !ok || err != nil || revision < 1 {
+		return nil, false
+	}
+	t, err := loadTemplate(context.Background(), name, revision)
+	if err != nil {
+		log.Println("Loading template", version, "failed:", err)
+		return nil, false
+	}
+	if t == nil || registerTemplate(t) != nil {
+		return nil, false
+	}
+	return t.Mapping, true
+}
+
+// handleListTemplates lists the latest revision of every template.
+func handleListTemplates(c *gin.Context) {
+	ctx := c.Request.Context()
+	templates := []*MappingTemplate{}
+	err := templateQuery(ctx, func(table string, db *pgxpool.Pool) error {
+		rows, err := db.Query(ctx, fmt.Sprintf("SELECT DISTINCT ON (name) %s FROM %s ORDER BY name, revision DESC", templateColumns, table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			t, err := scanTemplate(rows)
+			if err != nil {
+				return err
+			}
+			templates = append(templates, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the templates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+// handleGetTemplate returns the latest revision of a template, or the one
+// given with ?revision=.
+func handleGetTemplate(c *gin.Context) {
+	revision, _ := strconv.Atoi(c.Query("revision"))
+	t, err := loadTemplate(c.Request.Context(), c.Param("name"), revision)
+	switch {
+	case err != nil:
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the template"})
+	case t == nil:
+		c.JSON(http.StatusNotFound, gin.H{"message": "Template not found"})
+	default:
+		c.JSON(http.StatusOK, t)
+	}
+}
+
+// handleSaveTemplate stores the mapping in the body as the next revision of
+// a template, once it compiles.
+func handleSaveTemplate(c *gin.Context) {
+	name := c.Param("name")
+	if !importIDPattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Template names are letters, digits, - and _"})
+		return
+	}
+	m := new(Mapping)
+	if err := c.ShouldBindJSON(m); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid mapping: " + err.Error()})
+		return
+	}
+	m.Version = ""
+	if _, err := buildPlan(m); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid mapping: " + err.Error()})
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var t *MappingTemplate
+	err = templateQuery(ctx, func(table string, db *pgxpool.Pool) error {
+		// the primary key turns a concurrent save of the same revision into an error
+		var err error
+		t, err = scanTemplate(db.QueryRow(ctx, fmt.Sprintf(`INSERT INTO %[1]s (name, revision, mapping, saved_by)
+			SELECT $1, coalesce(max(revision), 0) + 1, $2, $3 FROM %[1]s WHERE name = $1
+			RETURNING %[2]s`, table, templateColumns), name, data, requestPrincipal(c)))
+		return err
+	})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the template"})
+		return
+	}
+
+	auditRequest(c, auditTemplateSave, "", "template="+t.Version)
+	c.JSON(http.StatusOK, t)
+}
+
+// handleDeleteTemplate drops every revision of a template. Imports already
+// running keep their compiled plan.
+func handleDeleteTemplate(c *gin.Context) {
+	name := c.Param("name")
+	ctx := c.Request.Context()
+	var deleted int64
+	err := templateQuery(ctx, func(table string, db *pgxpool.Pool) error {
+		return db.QueryRow(ctx, fmt.Sprintf("WITH d AS (DELETE FROM %s WHERE name = $1 RETURNING 1) SELECT count(*) FROM d", table), name).Scan(&deleted)
+	})
+	switch {
+	case err != nil:
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete the template"})
+	case deleted == 0:
+		c.JSON(http.StatusNotFound, gin.H{"message": "Template not found"})
+	default:
+		auditRequest(c, auditTemplateDelete, "", "template="+name)
+		c.JSON(http.StatusOK, gin.H{"message": "Template deleted", "name": name, "revisions": deleted})
+	}
+}
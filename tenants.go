@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tenantContextKey = "tenant"
+
+// TenantConfig is a client whose imports are kept apart from the others: its
+// own tables, optionally its own database credentials, its own quotas, and
+// only its own imports and history visible to its keys.
+type TenantConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// schema and table names with {tenant}, {month}, {year} and {table}
+	// placeholders; one of them must use {tenant}
+	SchemaTemplate       string `yaml:"schema_template" json:"schema_template"`
+	TableTemplate        string `yaml:"table_template" json:"table_template"`
+	DatabaseURL          string `yaml:"database_url" json:"database_url"`
+	MaxConcurrentImports int    `yaml:"max_concurrent_imports" json:"max_concurrent_imports"`
+	DailyBytes           int64  `yaml:"daily_bytes" json:"daily_bytes"`
+}
+
+func (t *TenantConfig) check() error {
+	if !identifierPattern.MatchString(t.Name) {
+		return fmt.Errorf("tenant name %q must be a plain identifier", t.Name)
+	}
+	if t.MaxConcurrentImports < 0 || t.DailyBytes < 0 {
+		return fmt.Errorf("tenant %s: quotas must not be negative", t.Name)
+	}
+	// tables of different tenants must not meet, even in one database
+	if (t.SchemaTemplate != "" || t.TableTemplate != "") && !strings.Contains(t.SchemaTemplate, "{tenant}") && !strings.Contains(t.TableTemplate, "{tenant}") {
+		return fmt.Errorf("tenant %s: schema_template or table_template must contain {tenant}", t.Name)
+	}
+	return nil
+}
+
+// names returns the schema and table an import of the tenant loads into,
+// from the defaults of the layout. Without templates the default schema is
+// prefixed with the tenant name.
+func (t *TenantConfig) names(schema, table string, date DateParams) (string, string, error) {
+	schema, table = t.templates(schema, table)
+	r := strings.NewReplacer("{month}", strings.ToLower(date.Month), "{year}", strings.ToLower(date.Year))
+	schema, table = r.Replace(schema), r.Replace(table)
+	if !identifierPattern.MatchString(schema) || !identifierPattern.MatchString(table) {
+		return "", "", fmt.Errorf("tenant %s: %s.%s is not a valid table name", t.Name, schema, table)
+	}
+	return schema, table, nil
+}
+
+// templates is names before the month and year are filled in.
+func (t *TenantConfig) templates(schema, table string) (string, string) {
+	if t.SchemaTemplate == "" && t.TableTemplate == "" {
+		schema = t.Name + "_" + schema
+	}
+	r := strings.NewReplacer("{tenant}", t.Name, "{table}", table)
+	if t.SchemaTemplate != "" {
+		schema = r.Replace(t.SchemaTemplate)
+	}
+	if t.TableTemplate != "" {
+		table = r.Replace(t.TableTemplate)
+	}
+	return schema, table
+}
+
+// tenant returns the named tenant, nil if there is none.
+func (c *Config) tenant(name string) *TenantConfig {
+	if name == "" {
+		return nil
+	}
+	for i := range c.Tenants {
+		if c.Tenants[i].Name == name {
+			return &c.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// selectTenant picks the tenant of a request: the tenant of its API key, or
+// the :tenant path parameter for keys that are not bound to one.
+func selectTenant(c *gin.Context) {
+	name := c.Param("tenant")
+	if key := requestAPIKey(c); key != nil && key.Tenant != "" {
+		if name != "" && name != key.Tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "API key belongs to another tenant"})
+			return
+		}
+		name = key.Tenant
+	}
+	if name != "" && cfg().tenant(name) == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Unknown tenant " + name})
+		return
+	}
+
+	c.Set(tenantContextKey, name)
+	c.Next()
+}
+
+// requestTenant is the tenant a request acts for, empty for none.
+func requestTenant(c *gin.Context) string {
+	return c.GetString(tenantContextKey)
+}
+
+// findRequestImport looks up the import of the :id parameter; imports of
+// other tenants are not found.
+func findRequestImport(c *gin.Context) (*Import, bool) {
+	imp, ok := findImport(c.Param("id"))
+	if !ok {
+		return nil, false
+	}
+	if tenant := requestTenant(c); tenant != "" && imp.Tenant != tenant {
+		return nil, false
+	}
+	return imp, true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeParserFastPath(t *testing.T) {
+	tests := []struct {
+		layout string
+		in     string
+		// the fast path takes the value, else it falls back to time.Parse
+		fast bool
+	}{
+		{dateLayout, "2023-05-17", true},
+		{dateLayout, "2024-02-29", true},
+		{dateLayout, "2000-02-29", true},
+		{dateLayout, "2023-02-29", false},
+		{dateLayout, "1900-02-29", false},
+		{dateLayout, "2023-04-31", false},
+		{dateLayout, "2023-13-01", false},
+		{dateLayout, "2023-00-10", false},
+		{dateLayout, "2023-05-00", false},
+		{dateLayout, "2023-5-17", false},
+		{dateLayout, "2023-05-1", false},
+		{dateLayout, "", false},
+		{dateLayout, "+023-05-17", false},
+		{dateLayout, "2023/05/17", false},
+		{timestampLayout, "2023-05-17 14:30:05", true},
+		{timestampLayout, "2024-02-29 23:59:59", true},
+		{timestampLayout, "2023-02-29 10:00:00", false},
+		{timestampLayout, "2023-05-17 24:00:00", false},
+		{timestampLayout, "2023-05-17 10:60:00", false},
+		{timestampLayout, "2023-05-17 10:00:60", false},
+		{timestampLayout, "2023-05-17T10:00:00", false},
+		{timestampLayout, "2023-05-17 10:00", false},
+		// time.Parse takes fractional seconds the layout does not name
+		{timestampLayout, "2023-05-17 10:00:00.5", false},
+		{"02/01/2006", "17/05/2023", false},
+	}
+	for _, tt := range tests {
+		var fast bool
+		switch tt.layout {
+		case dateLayout:
+			_, fast = parseDateFast(tt.in)
+		case timestampLayout:
+			_, fast = parseTimestampFast(tt.in)
+		}
+		if fast != tt.fast {
+			t.Errorf("%s %q: fast path %v, want %v", tt.layout, tt.in, fast, tt.fast)
+		}
+
+		got, err := timeParser(tt.layout)(tt.in)
+		want, wantErr := time.Parse(tt.layout, tt.in)
+		if (err == nil) != (wantErr == nil) || !got.Equal(want) {
+			t.Errorf("%s %q: got %v, %v; time.Parse gives %v, %v", tt.layout, tt.in, got, err, want, wantErr)
+		}
+		if err != nil && wantErr != nil && err.Error() != wantErr.Error() {
+			t.Errorf("%s %q: error %q, time.Parse gives %q", tt.layout, tt.in, err, wantErr)
+		}
+	}
+}
+
+func BenchmarkParseTimestamp(b *testing.B) {
+	const in = "2023-05-17 14:30:05"
+	b.Run("time.Parse", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := time.Parse(timestampLayout, in); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		parse := timeParser(timestampLayout)
+		for i := 0; i < b.N; i++ {
+			if _, err := parse(in); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// when a column is tokenized
+const (
+	tokenizeOnImport = "import"
+	tokenizeOnExport = "export"
+)
+
+const tokenPrefix = "tok_"
+
+// vault entries written per statement
+const tokenVaultBatch = 5000
+
+const tokenVaultDDL = `CREATE TABLE IF NOT EXISTS %s (
+	token text PRIMARY KEY,
+	kind text NOT NULL,
+	value text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// tokenize replaces an identifier with a keyed hash of it. The same value of
+// the same kind always gets the same token, so tokenized data can still be
+// joined; without the key a token cannot be traced back. Empty values stay
+// empty.
+func tokenize(key, kind, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return tokenPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+type vaultEntry struct {
+	kind, value string
+}
+
+// tokens waiting to be written to the vault, flushed in batches and whenever
+// an import finishes
+var tokenVault = struct {
+	sync.Mutex
+	pending map[string]vaultEntry
+}{pending: map[string]vaultEntry{}}
+
+func init() {
+	finishHooks = append(finishHooks, func(*Import) { flushTokenVault() })
+}
+
+// vaultToken tokenizes value and remembers the token for detokenization.
+func vaultToken(key, kind, value string) string {
+	token := tokenize(key, kind, value)
+	if token == "" {
+		return ""
+	}
+
+	tokenVault.Lock()
+	tokenVault.pending[token] = vaultEntry{kind: kind, value: value}
+	full := len(tokenVault.pending) >= tokenVaultBatch
+	tokenVault.Unlock()
+
+	if full {
+		flushTokenVault()
+	}
+	return token
+}
+
+// flushTokenVault writes the pending tokens; tokens already in the vault are
+// left alone. Entries that fail are kept for the next flush.
+func flushTokenVault() {
+	tokenVault.Lock()
+	pending := tokenVault.pending
+	tokenVault.pending = map[string]vaultEntry{}
+	tokenVault.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	err := writeTokenVault(pending)
+	if err == nil {
+		return
+	}
+	log.Println("Token vault not updated:", err)
+
+	tokenVault.Lock()
+	for token, e := range pending {
+		tokenVault.pending[token] = e
+	}
+	tokenVault.Unlock()
+}
+
+func writeTokenVault(entries map[string]vaultEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+
+	table := cfg().TokenVaultTable
+	if err := ensureTable(ctx, dbPool, table, tokenVaultDDL); err != nil {
+		return err
+	}
+
+	tokens := make([]string, 0, len(entries))
+	kinds := make([]string, 0, len(entries))
+	values := make([]string, 0, len(entries))
+	for token, e := range entries {
+		tokens = append(tokens, token)
+		kinds = append(kinds, e.kind)
+		values = append(values, e.value)
+	}
+	_, err = dbPool.Exec(ctx, "INSERT INTO "+table+` (token, kind, value)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::text[]) ON CONFLICT (token) DO NOTHING`, tokens, kinds, values)
+	return err
+}
+
+// tokenizeValues replaces the values of the columns tokenized on import.
+func (p *executionPlan) tokenizeValues(values []interface{}, key string) {
+	for i, when := range p.tokenize {
+		if when != tokenizeOnImport || i >= len(values) {
+			continue
+		}
+		if s, ok := values[i].(string); ok {
+			values[i] = vaultToken(key, p.tokenKinds[i], s)
+		}
+	}
+}
+
+// handleTokenize returns the tokens of values of one kind, for systems that
+// need to look up tokenized rows (`{"kind": "nik", "values": [...]}`).
+func handleTokenize(c *gin.Context) {
+	key := cfg().TokenizationKey
+	if key == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"message": "Tokenization is not configured, set tokenization_key"})
+		return
+	}
+
+	var req struct {
+		Kind   string   `json:"kind"`
+		Values []string `json:"values"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Kind == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "kind and values are required"})
+		return
+	}
+
+	tokens := make(map[string]string, len(req.Values))
+	for _, v := range req.Values {
+		tokens[v] = vaultToken(key, req.Kind, v)
+	}
+	flushTokenVault()
+	c.JSON(http.StatusOK, gin.H{"kind": req.Kind, "tokens": tokens})
+}
+
+// handleDetokenize looks tokens up in the vault. Every lookup is audited.
+func handleDetokenize(c *gin.Context) {
+	var req struct {
+		Tokens []string `json:"tokens"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Tokens) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "tokens are required"})
+		return
+	}
+	flushTokenVault()
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to connect to the database"})
+		return
+	}
+	defer releasePool()
+
+	ctx := c.Request.Context()
+	table := cfg().TokenVaultTable
+	if err := ensureTable(ctx, dbPool, table, tokenVaultDDL); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the token vault"})
+		return
+	}
+	rows, err := dbPool.Query(ctx, "SELECT token, kind, value FROM "+table+" WHERE token = ANY($1)", req.Tokens)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the token vault"})
+		return
+	}
+	defer rows.Close()
+
+	type entry struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	}
+	found := map[string]entry{}
+	for rows.Next() {
+		var token string
+		var e entry
+		if err := rows.Scan(&token, &e.Kind, &e.Value); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the token vault"})
+			return
+		}
+		found[token] = e
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the token vault"})
+		return
+	}
+
+	auditRequest(c, auditDetokenize, "", fmt.Sprintf("requested=%d found=%d", len(req.Tokens), len(found)))
+	c.JSON(http.StatusOK, gin.H{"values": found})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// traceAttr is a span attribute; values are strings, ints, int64s, float64s
+// or bools.
+type traceAttr struct {
+	key   string
+	value interface{}
+}
+
+func attr(key string, value interface{}) traceAttr {
+	return traceAttr{key: key, value: value}
+}
+
+type traceSpan interface {
+	// end closes the span, marking it failed when err is not nil.
+	end(err error, attrs ...traceAttr)
+}
+
+// tracer is a tracing backend. The contexts it returns only carry the span,
+// not the cancellation of the parent, so an import span can outlive the
+// request that started it.
+type tracer interface {
+	start(parent context.Context, name string, attrs []traceAttr) (context.Context, traceSpan)
+	// extract continues a trace started by the caller of a request
+	extract(ctx context.Context, header http.Header) context.Context
+	shutdown(ctx context.Context) error
+}
+
+type tracerFactory func(settings *Config) (tracer, error)
+
+// tracing backends by tracing_exporter; they need extra modules and register
+// themselves from files behind build tags
+var tracerFactories = map[string]tracerFactory{}
+
+func registerTracer(name string, factory tracerFactory) {
+	tracerFactories[name] = factory
+}
+
+func tracerNames() []string {
+	names := make([]string, 0, len(tracerFactories))
+	for name := range tracerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type noopTracer struct{}
+
+func (noopTracer) start(parent context.Context, _ string, _ []traceAttr) (context.Context, traceSpan) {
+	return parent, noopSpan{}
+}
+
+func (noopTracer) extract(ctx context.Context, _ http.Header) context.Context { return ctx }
+
+func (noopTracer) shutdown(context.Context) error { return nil }
+
+type noopSpan struct{}
+
+func (noopSpan) end(error, ...traceAttr) {}
+
+// the tracer spans go to, set once at startup
+var activeTracer atomic.Value
+
+func currentTracer() tracer {
+	if t, ok := activeTracer.Load().(tracer); ok {
+		return t
+	}
+	return noopTracer{}
+}
+
+// initTracing starts the tracing_exporter backend; without one spans cost
+// nothing. The returned function flushes the spans still buffered.
+func initTracing(settings *Config) (func(), error) {
+	if settings.TracingExporter == "" {
+		return func() {}, nil
+	}
+	factory := tracerFactories[settings.TracingExporter]
+	if factory == nil {
+		return nil, fmt.Errorf("tracing exporter %q is not compiled in, build with -tags otel", settings.TracingExporter)
+	}
+	t, err := factory(settings)
+	if err != nil {
+		return nil, err
+	}
+	activeTracer.Store(t)
+	log.Println("=> tracing with", settings.TracingExporter)
+
+	return func() {
+		if err := t.shutdown(context.Background()); err != nil {
+			log.Println("Tracing shutdown:", err)
+		}
+	}, nil
+}
+
+func startSpan(parent context.Context, name string, attrs ...traceAttr) (context.Context, traceSpan) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	return currentTracer().start(parent, name, attrs)
+}
+
+// requestTrace is the trace context of a request, continuing the caller's
+// trace when it sent a traceparent header.
+func requestTrace(c *gin.Context) context.Context {
+	return currentTracer().extract(context.Background(), c.Request.Header)
+}
+
+// startTrace opens the span covering the whole import; it is closed by a
+// finish hook.
+func (imp *Import) startTrace(parent context.Context) {
+	imp.trace, imp.span = startSpan(parent, "import",
+		attr("import_id", imp.ID),
+		attr("import.mode", imp.Mode),
+		attr("import.strict", imp.Strict),
+		attr("import.mapping", imp.plan.version),
+		attr("import.period", imp.Month+" "+imp.Year),
+	)
+}
+
+// startSpan opens a span under the import span, tagged with the import id.
+func (imp *Import) startSpan(name string, attrs ...traceAttr) (context.Context, traceSpan) {
+	return startSpan(imp.trace, name, append([]traceAttr{attr("import_id", imp.ID)}, attrs...)...)
+}
+
+func endImportTrace(imp *Import) {
+	if imp.span == nil {
+		return
+	}
+	report := imp.report()
+	var err error
+	if report.Status == importStatusFailed {
+		err = fmt.Errorf("import failed: %s", report.Message)
+	}
+	imp.span.end(err,
+		attr("import.status", report.Status),
+		attr("import.rows_read", report.RowsRead),
+		attr("import.inserted", report.Inserted),
+		attr("import.rejected", report.Rejected),
+		attr("import.bytes", atomic.LoadInt64(&imp.bytesRead)),
+	)
+}
+
+func init() {
+	finishHooks = append(finishHooks, endImportTrace)
+}
@@ -0,0 +1,107 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry needs the otel sdk and the OTLP exporter, so it is only
+// compiled in with `-tags otel`. Spans are sent over OTLP/HTTP to
+// tracing_endpoint (a url like http://collector:4318), or to where the
+// standard OTEL_EXPORTER_OTLP_* variables point when it is empty.
+func init() {
+	registerTracer("otlp", newOTLPTracer)
+}
+
+type otelTracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newOTLPTracer(settings *Config) (tracer, error) {
+	var opts []otlptracehttp.Option
+	if settings.TracingEndpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(settings.TracingEndpoint))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(settings.TracingServiceName),
+		semconv.ServiceVersion(buildVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(settings.TracingSampleRatio))),
+	)
+	return &otelTracer{
+		provider:   provider,
+		tracer:     provider.Tracer("big_file_pgsql"),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}, nil
+}
+
+func (t *otelTracer) start(parent context.Context, name string, attrs []traceAttr) (context.Context, traceSpan) {
+	_, span := t.tracer.Start(parent, name, trace.WithAttributes(otelAttributes(attrs)...))
+	// only the span is carried on, see tracer
+	return trace.ContextWithSpan(context.Background(), span), otelSpan{span}
+}
+
+func (t *otelTracer) extract(ctx context.Context, header http.Header) context.Context {
+	return t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+func (t *otelTracer) shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) end(err error, attrs ...traceAttr) {
+	s.span.SetAttributes(otelAttributes(attrs)...)
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+func otelAttributes(attrs []traceAttr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(a.key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(a.key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.key, v))
+		case float64:
+			kvs = append(kvs, attribute.Float64(a.key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.key, v))
+		}
+	}
+	return kvs
+}
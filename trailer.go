@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Trailer recognises the summary rows some partners end their files with,
+// like `TOTAL;;;12345`. A row is a trailer when one of Patterns matches its
+// fields joined by the delimiter of the file; trailers are counted and never
+// inserted. A pattern with a `rows` group, e.g. `^TOTAL;.*;(?P<rows>\d+)$`,
+// reads the number of rows the file declares, which OnMismatch (fail or
+// flag) checks against the rows read.
+type Trailer struct {
+	Patterns   []string `yaml:"patterns" json:"patterns,omitempty"`
+	OnMismatch string   `yaml:"on_mismatch" json:"on_mismatch,omitempty"`
+}
+
+type trailerSpec struct {
+	patterns   []*regexp.Regexp
+	onMismatch string
+}
+
+// TrailerReport counts the trailer rows of an import and the rows they
+// declare, when they do.
+type TrailerReport struct {
+	Rows  int64  `json:"rows"`
+	Count *int64 `json:"count,omitempty"`
+}
+
+// compileTrailer sets the trailer rows of p.
+func (p *executionPlan) compileTrailer(t *Trailer) error {
+	if len(t.Patterns) == 0 {
+		return fmt.Errorf("trailer: patterns are required")
+	}
+	spec := &trailerSpec{onMismatch: t.OnMismatch}
+	switch t.OnMismatch {
+	case "", controlMismatchFail, controlMismatchFlag:
+	default:
+		return fmt.Errorf("trailer: on_mismatch must be fail or flag")
+	}
+	counted := false
+	for _, pattern := range t.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("trailer: %w", err)
+		}
+		counted = counted || re.SubexpIndex("rows") > 0
+		spec.patterns = append(spec.patterns, re)
+	}
+	if spec.onMismatch != "" && !counted {
+		return fmt.Errorf("trailer: on_mismatch needs a pattern with a rows group")
+	}
+	p.trailer = spec
+	return nil
+}
+
+// trailer reports whether row is a trailer, counting it and the rows it
+// declares.
+func (imp *Import) trailer(row []string) bool {
+	t := imp.plan.trailer
+	if t == nil {
+		return false
+	}
+	line := strings.Join(row, string(imp.comma()))
+	for _, re := range t.patterns {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		atomic.AddInt64(&imp.trailerRows, 1)
+		if i := re.SubexpIndex("rows"); i > 0 {
+			if n, err := strconv.ParseInt(strings.TrimSpace(m[i]), 10, 64); err == nil {
+				atomic.AddInt64(&imp.trailerCount, n)
+				atomic.StoreInt32(&imp.trailerCounted, 1)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// trailerReport returns the trailer counts of imp, nil when it found none.
+func (imp *Import) trailerReport() *TrailerReport {
+	rows := atomic.LoadInt64(&imp.trailerRows)
+	if rows == 0 {
+		return nil
+	}
+	r := &TrailerReport{Rows: rows}
+	if atomic.LoadInt32(&imp.trailerCounted) == 1 {
+		count := atomic.LoadInt64(&imp.trailerCount)
+		r.Count = &count
+	}
+	return r
+}
+
+// mergeTrailer adds the trailer counts of a chunk to imp.
+func (imp *Import) mergeTrailer(r *TrailerReport) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&imp.trailerRows, r.Rows)
+	if r.Count != nil {
+		atomic.AddInt64(&imp.trailerCount, *r.Count)
+		atomic.StoreInt32(&imp.trailerCounted, 1)
+	}
+}
+
+// reconcilesTrailer reports whether the rows of imp are checked against the
+// count of its trailer.
+func (imp *Import) reconcilesTrailer() bool {
+	return imp.plan.trailer != nil && imp.plan.trailer.onMismatch != ""
+}
+
+// trailerCheck compares the rows the trailers of imp declare with the data
+// rows it read; a file without a counted trailer does not match.
+func (imp *Import) trailerCheck() ControlCheck {
+	read := atomic.LoadInt64(&imp.rowsRead) - atomic.LoadInt64(&imp.skippedEmpty)
+	check := ControlCheck{Name: "trailer_rows", Actual: float64(read)}
+	if r := imp.trailerReport(); r != nil && r.Count != nil {
+		check.Expected = float64(*r.Count)
+		check.Matched = *r.Count == read
+	}
+	return check
+}
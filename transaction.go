@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runTransactionWorker loads every row inside a single transaction, like
+// runStrictWorker, but a row the database refuses is rejected instead of
+// failing the import. Each batch runs under a savepoint; a failing batch is
+// rolled back to it and replayed row by row, every row under a savepoint of
+// its own, so only the offending rows are left out. A failed commit or a
+// cancellation still rolls the whole import back.
+func runTransactionWorker(ctx context.Context, cancel context.CancelFunc, pool *pgxpool.Pool, jobs <-chan []interface{}, wg *sync.WaitGroup, query string, imp *Import) error {
+	drain := func() {
+		for range jobs {
+			wg.Done()
+		}
+	}
+
+	txCtx, span := imp.startSpan("import.transaction")
+	var failed error
+	defer func() { span.end(failed, attr("rows", atomic.LoadInt64(&imp.inserted))) }()
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		cancel()
+		drain()
+		failed = fmt.Errorf("failed to acquire connection: %w", err)
+		return failed
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		cancel()
+		drain()
+		failed = fmt.Errorf("failed to begin transaction: %w", err)
+		return failed
+	}
+
+	batchSize := cfg().BatchSize
+	for job := range jobs {
+		batch := collectBatch(job, jobs, batchSize)
+		if ctx.Err() == nil {
+			batchNumber := atomic.AddInt64(&imp.batches, 1)
+			_, insert := startSpan(txCtx, "db.insert", attr("batch", batchNumber), attr("batch.rows", len(batch)))
+			errs := insertSavepoint(ctx, tx, query, batch)
+			rejected := 0
+			for i, err := range errs {
+				if err != nil {
+					rejected++
+					imp.reject(batch[i], err)
+					imp.publish(ImportEvent{Type: eventWorkerError, Message: err.Error()})
+				} else {
+					atomic.AddInt64(&imp.inserted, 1)
+					imp.countInserted(batch[i], 1)
+				}
+			}
+			insert.end(nil, attr("batch.rejected", rejected))
+		}
+		for range batch {
+			wg.Done()
+		}
+	}
+
+	if ctx.Err() == nil {
+		_, commit := startSpan(txCtx, "db.commit")
+		err := tx.Commit(context.Background())
+		commit.end(err)
+		if err == nil {
+			return nil
+		}
+		failed = fmt.Errorf("commit failed: %w", err)
+	}
+
+	if err := tx.Rollback(context.Background()); err != nil {
+		log.Println("Transaction import", imp.ID, "rollback error:", err)
+	}
+	atomic.StoreInt64(&imp.inserted, 0)
+
+	imp.mu.Lock()
+	imp.rolledBack = true
+	imp.mu.Unlock()
+
+	if failed == nil {
+		failed = ctx.Err()
+	}
+	return failed
+}
+
+// insertSavepoint is insertBatch inside tx: the rows are pipelined under one
+// savepoint and, when one of them fails, replayed one by one. The returned
+// errors are indexed like rows.
+func insertSavepoint(ctx context.Context, tx pgx.Tx, query string, rows [][]interface{}) []error {
+	errs := make([]error, len(rows))
+
+	// a nested pgx transaction is a savepoint
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	b := &pgx.Batch{}
+	for _, values := range rows {
+		b.Queue(query, values...)
+	}
+	results := sp.SendBatch(ctx, b)
+	var failed error
+	for range rows {
+		if _, err := results.Exec(); err != nil {
+			failed = err
+			break
+		}
+	}
+	if err := results.Close(); failed == nil {
+		failed = err
+	}
+	if failed == nil {
+		if failed = sp.Commit(ctx); failed == nil {
+			return errs
+		}
+	}
+	sp.Rollback(ctx)
+
+	for i, values := range rows {
+		errs[i] = execSavepoint(ctx, tx, query, values)
+	}
+	return errs
+}
+
+func execSavepoint(ctx context.Context, tx pgx.Tx, query string, values []interface{}) error {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := sp.Exec(ctx, query, values...); err != nil {
+		sp.Rollback(ctx)
+		return err
+	}
+	return sp.Commit(ctx)
+}
+
+// oneTransaction reports whether imp loads all its rows in one transaction,
+// with strict=true or transaction=true.
+func (imp *Import) oneTransaction() bool {
+	return imp.Strict || imp.Transaction
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resumable uploads follow the tus protocol, https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+const tusExtensions = "creation,termination,expiration"
+
+// tusUpload is a resumable upload in progress. The received bytes are kept in
+// upload_dir next to a json copy of this state, so uploads resume across
+// restarts.
+type tusUpload struct {
+	mu sync.Mutex // one PATCH at a time
+
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	KeyID    string            `json:"key_id"`
+	Expires  time.Time         `json:"expires"`
+
+	// set once the completed upload was handed to an import, for requests
+	// that were waiting on mu meanwhile
+	importID string
+}
+
+var tusUploads = struct {
+	sync.Mutex
+	byID map[string]*tusUpload
+}{byID: map[string]*tusUpload{}}
+
+func tusDataPath(id string) string {
+	return filepath.Join(cfg().UploadDir, id+".part")
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(cfg().UploadDir, id+".json")
+}
+
+func (u *tusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tusInfoPath(u.ID), data, 0600)
+}
+
+// remove forgets the upload; the data is kept when keepData is set, for the
+// import that takes it over.
+func (u *tusUpload) remove(keepData bool) {
+	tusUploads.Lock()
+	delete(tusUploads.byID, u.ID)
+	tusUploads.Unlock()
+
+	os.Remove(tusInfoPath(u.ID))
+	if !keepData {
+		os.Remove(tusDataPath(u.ID))
+	}
+}
+
+// findTusUpload returns an unexpired upload of the calling key, reading it
+// back from upload_dir after a restart.
+func findTusUpload(c *gin.Context) (*tusUpload, bool) {
+	id := c.Param("id")
+	if !importIDPattern.MatchString(id) {
+		return nil, false
+	}
+
+	tusUploads.Lock()
+	defer tusUploads.Unlock()
+	u, ok := tusUploads.byID[id]
+	if !ok {
+		data, err := os.ReadFile(tusInfoPath(id))
+		if err != nil {
+			return nil, false
+		}
+		u = new(tusUpload)
+		if err := json.Unmarshal(data, u); err != nil || u.ID != id {
+			return nil, false
+		}
+		tusUploads.byID[id] = u
+	}
+	if u.KeyID != requestKeyID(c) || time.Now().After(u.Expires) {
+		return nil, false
+	}
+	return u, true
+}
+
+func requestKeyID(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil {
+		return key.ID
+	}
+	return ""
+}
+
+// requireTusResumable answers requests made for another protocol version.
+func requireTusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+// handleTusOptions advertises the supported version and extensions; it needs
+// no API key.
+func handleTusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if limit := cfg().MaxUploadBytes; limit > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(limit, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes Upload-Metadata: comma separated keys, each
+// followed by its base64 value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("upload metadata %s is not base64", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// tusImportSpec reads the import parameters from the upload metadata, named
+// like the query parameters of /upload.
+func tusImportSpec(meta map[string]string, tenant string, settings *Config) (importSpec, error) {
+	flag := func(name string, def bool) bool {
+		if v, ok := meta[name]; ok && v != "" {
+			return v == "true"
+		}
+		return def
+	}
+
+	format, err := inputFormat(meta["format"], meta["filetype"])
+	if err != nil {
+		return importSpec{}, err
+	}
+
+	spec := importSpec{
+		date:           DateParams{Month: meta["month"], Year: meta["year"]},
+		mapping:        meta["mapping"],
+		mode:           meta["mode"],
+		strict:         meta["strict"] == "true",
+		transaction:    meta["transaction"] == "true",
+		priority:       meta["priority"],
+		staged:         flag("staging", settings.StagingLoad),
+		existing:       meta["existing"],
+		profile:        flag("profile", settings.ProfileImports),
+		rebuildIndexes: flag("rebuild_indexes", settings.RebuildIndexes),
+		analyze:        flag("analyze", settings.AnalyzeAfterImport),
+		tenant:         tenant,
+		database:       meta["target"],
+		format:         format,
+		delimiter:      meta["delimiter"],
+		skipRows:       meta["skip_rows"],
+		skipColumns:    meta["skip_columns"],
+		source:         meta["source"],
+		periodCheck:    meta["period_check"],
+		maxOutside:     meta["max_outside_percent"],
+	}
+	if spec.date.Month == "" || spec.date.Year == "" {
+		return spec, errors.New("month and year are required in Upload-Metadata")
+	}
+	if err := spec.applySource(settings, func(param string) bool { return meta[param] != "" }); err != nil {
+		return spec, err
+	}
+	if spec.mode == "" {
+		spec.mode = importModeAppend
+	}
+	return spec, spec.resolve(settings)
+}
+
+// handleTusCreate starts a resumable upload. The import parameters are checked
+// now rather than after gigabytes have been sent.
+func handleTusCreate(c *gin.Context) {
+	settings := cfg()
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload-Length must be known in advance"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload-Length is required"})
+		return
+	}
+	if settings.MaxUploadBytes > 0 && length > settings.MaxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Upload is larger than the limit of %d bytes", settings.MaxUploadBytes)})
+		return
+	}
+
+	meta, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err == nil {
+		_, err = tusImportSpec(meta, requestTenant(c), settings)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	u := &tusUpload{
+		ID:       randomHex(16),
+		Length:   length,
+		Metadata: meta,
+		KeyID:    requestKeyID(c),
+		Expires:  time.Now().Add(time.Duration(settings.UploadExpiryHours) * time.Hour),
+	}
+	if err := os.MkdirAll(settings.UploadDir, 0700); err == nil {
+		err = os.WriteFile(tusDataPath(u.ID), nil, 0600)
+	}
+	if err == nil {
+		err = u.save()
+	}
+	if err != nil {
+		log.Println("Resumable upload not created:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the upload"})
+		return
+	}
+
+	tusUploads.Lock()
+	tusUploads.byID[u.ID] = u
+	tusUploads.Unlock()
+
+	c.Header("Location", "/uploads/"+u.ID)
+	c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// handleTusHead tells a client where to resume.
+func handleTusHead(c *gin.Context) {
+	u, ok := findTusUpload(c)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// handleTusPatch appends a chunk at the offset the client last saw. What
+// arrived before a dropped connection is kept. The chunk completing the
+// upload hands the file to the importer and returns the import id in
+// X-Import-Id; if that fails (quota) the client repeats the empty final PATCH.
+// A repeat arriving once the import started gets the same X-Import-Id.
+func handleTusPatch(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	u, ok := findTusUpload(c)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.importID != "" {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.Header("X-Import-Id", u.importID)
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"message": "Upload-Offset does not match the received bytes"})
+		return
+	}
+
+	f, err := os.OpenFile(tusDataPath(u.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the upload"})
+		return
+	}
+	// bytes written after the last saved offset, before a crash, are dropped
+	if err := f.Truncate(u.Offset); err == nil {
+		_, err = f.Seek(u.Offset, io.SeekStart)
+	}
+	var n int64
+	if err == nil {
+		n, err = io.Copy(f, io.LimitReader(c.Request.Body, u.Length-u.Offset+1))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if u.Offset+n > u.Length {
+		os.Truncate(tusDataPath(u.ID), u.Offset)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Chunk goes past Upload-Length"})
+		return
+	}
+
+	u.Offset += n
+	if saveErr := u.save(); err == nil {
+		err = saveErr
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if err != nil {
+		log.Println("Resumable upload", u.ID, "stopped at", u.Offset, "of", u.Length, "bytes:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to store the whole chunk, resume from Upload-Offset"})
+		return
+	}
+
+	if u.Offset == u.Length {
+		if !startTusImport(c, u) {
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// startTusImport queues the import of a completed upload, which then waits for
+// the import window like a queued upload.
+func startTusImport(c *gin.Context, u *tusUpload) bool {
+	settings := cfg()
+	spec, err := tusImportSpec(u.Metadata, requestTenant(c), settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return false
+	}
+
+	release, err := reserveImportQuota(requestAPIKey(c), spec.tenant, u.Length)
+	if err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		return false
+	}
+
+	path := tusDataPath(u.ID)
+	f, err := os.Open(path)
+	var checksum string
+	if err == nil {
+		checksum, err = fileChecksum(f)
+		f.Close()
+	}
+	if err != nil {
+		release()
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the upload"})
+		return false
+	}
+
+	filename := u.Metadata["filename"]
+	imp, err := spec.newImport(requestTrace(c), u.Metadata["import_id"], u.Length)
+	if err != nil {
+		release()
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return false
+	}
+	imp.FileName = filename
+	imp.Checksum = checksum
+	imp.Principal = requestPrincipal(c)
+	imp.SourceIP = c.ClientIP()
+	imp.UserAgent = c.Request.UserAgent()
+	if key := requestAPIKey(c); key != nil {
+		imp.APIKey = key.Name
+	}
+	imp.setStatus(importStateQueued)
+
+	u.importID = imp.ID
+	u.remove(true)
+	go runQueuedImport(imp, []string{path}, []string{filename}, release)
+
+	c.Header("X-Import-Id", imp.ID)
+	return true
+}
+
+// handleTusDelete abandons an upload.
+func handleTusDelete(c *gin.Context) {
+	u, ok := findTusUpload(c)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// the data of a started import is the import's now
+	if u.importID != "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	u.remove(false)
+	c.Status(http.StatusNoContent)
+}
+
+// runTusCleanup deletes expired uploads from upload_dir every hour.
+func runTusCleanup() {
+	for {
+		infos, _ := filepath.Glob(filepath.Join(cfg().UploadDir, "*.json"))
+		for _, info := range infos {
+			data, err := os.ReadFile(info)
+			if err != nil {
+				continue
+			}
+			var u tusUpload
+			if json.Unmarshal(data, &u) != nil || time.Now().After(u.Expires) {
+				tusUploads.Lock()
+				delete(tusUploads.byID, u.ID)
+				tusUploads.Unlock()
+				os.Remove(info)
+				os.Remove(strings.TrimSuffix(info, ".json") + ".part")
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
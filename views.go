@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ViewRefresh is the refresh of one materialized view after an import.
+type ViewRefresh struct {
+	View         string  `json:"view"`
+	Concurrently bool    `json:"concurrently"`
+	Seconds      float64 `json:"seconds"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// a materialized view of a mapping, optionally schema qualified; {schema} is
+// the schema of the import
+var viewPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*|\{schema\})(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+const viewSchemaPlaceholder = "{schema}"
+
+// compileViews sets the materialized views the imports of p refresh.
+func (p *executionPlan) compileViews(views []string) error {
+	for _, view := range views {
+		if !viewPattern.MatchString(view) || view == viewSchemaPlaceholder {
+			return fmt.Errorf("materialized view %q must be a plain or schema qualified name", view)
+		}
+	}
+	p.views = append([]string(nil), views...)
+	return nil
+}
+
+// refreshViews refreshes the materialized views of the mapping of an import
+// that loaded rows and did not fail, in the order of the mapping, so a view
+// can be built on one listed before it. A view with a unique index is
+// refreshed concurrently, so dashboards keep reading it meanwhile. Failures
+// are reported and do not fail the import.
+func refreshViews(dbPool *pgxpool.Pool, imp *Import) {
+	r := imp.report()
+	if len(imp.plan.views) == 0 || r.Status == importStatusFailed || r.RolledBack || r.Inserted+r.Updated == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	for _, view := range imp.plan.views {
+		view = strings.Replace(view, viewSchemaPlaceholder, imp.Schema, 1)
+		started := time.Now()
+		refresh := ViewRefresh{View: view}
+
+		concurrently, err := refreshableConcurrently(ctx, dbPool, view)
+		if err == nil {
+			refresh.Concurrently = concurrently
+			stmt := "REFRESH MATERIALIZED VIEW " + view
+			if concurrently {
+				stmt = "REFRESH MATERIALIZED VIEW CONCURRENTLY " + view
+			}
+			_, err = dbPool.Exec(ctx, stmt)
+		}
+		if err != nil {
+			log.Println("Import", imp.ID, "failed to refresh", view+":", err)
+			refresh.Error = err.Error()
+		}
+		refresh.Seconds = seconds(time.Since(started))
+
+		imp.mu.Lock()
+		imp.viewRefreshes = append(imp.viewRefreshes, refresh)
+		imp.mu.Unlock()
+	}
+}
+
+// refreshableConcurrently reports whether view is populated and has a unique
+// index on plain columns without a predicate, which a concurrent refresh
+// needs.
+func refreshableConcurrently(ctx context.Context, dbPool *pgxpool.Pool, view string) (bool, error) {
+	var populated, unique bool
+	err := dbPool.QueryRow(ctx, `SELECT c.relispopulated, EXISTS (SELECT 1 FROM pg_index i
+		WHERE i.indrelid = c.oid AND i.indisunique AND i.indpred IS NULL AND i.indexprs IS NULL)
+		FROM pg_class c WHERE c.oid = to_regclass($1) AND c.relkind = 'm'`, view).Scan(&populated, &unique)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, fmt.Errorf("%s is not a materialized view", view)
+		}
+		return false, err
+	}
+	return populated && unique, nil
+}
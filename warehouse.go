@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pgxpool "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// historyRecord is one row of the import history as shipped to the warehouse.
+// The per-column stats and reject summaries are JSON objects.
+type historyRecord struct {
+	HistoryID      int64
+	ImportID       string
+	Month          string
+	Year           string
+	MappingVersion string
+	Mode           string
+	Status         string
+	RowsRead       int64
+	Inserted       int64
+	Rejected       int64
+	SkippedEmpty   int64
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	QualityScore   *float64
+	ParseErrors    string
+	Suspicious     string
+	RejectsByClass string
+	RejectsByCode  string
+}
+
+// warehouseSink writes history records to an analytics destination. Writes
+// must be idempotent on HistoryID: after a failure the same batch is sent again.
+type warehouseSink interface {
+	write(ctx context.Context, records []historyRecord) error
+	close()
+}
+
+// warehouse drivers compiled into this binary, by name
+var warehouseDrivers = map[string]func(ctx context.Context, dsn, table string) (warehouseSink, error){}
+
+func registerWarehouseDriver(name string, open func(ctx context.Context, dsn, table string) (warehouseSink, error)) {
+	warehouseDrivers[name] = open
+}
+
+func warehouseDriverNames() []string {
+	names := make([]string, 0, len(warehouseDrivers))
+	for name := range warehouseDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// watermarks of the exports, kept in the import database
+const watermarkTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	destination text PRIMARY KEY,
+	last_history_id bigint NOT NULL,
+	exported_at timestamptz NOT NULL
+)`
+
+const watermarkTable = "public.export_watermarks"
+
+// rows shipped per round, the exporter loops until it has caught up
+const warehouseBatchSize = 1000
+
+// history rows are exported once they are this old. Imports finish side by
+// side, so a lower id can commit after a higher one; the history insert times
+// out after 10 seconds, so a row recorded this long ago has committed or never
+// will, and no lower id can still appear behind the watermark.
+const warehouseSettleLag = time.Minute
+
+// exporter state for the admin api
+var warehouseStatus struct {
+	sync.Mutex
+	LastRun   time.Time
+	Watermark int64
+	Exported  int64
+	LastError string
+}
+
+// runWarehouseExporter ships new import history to the configured warehouse
+// every warehouse_interval_minutes. The settings are re-read on every round.
+func runWarehouseExporter() {
+	for {
+		settings := cfg()
+		interval := time.Duration(settings.WarehouseIntervalMinutes) * time.Minute
+
+		if settings.WarehouseDriver != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			n, watermark, err := exportHistory(ctx, settings)
+			cancel()
+
+			warehouseStatus.Lock()
+			warehouseStatus.LastRun = time.Now()
+			if watermark > 0 {
+				warehouseStatus.Watermark = watermark
+			}
+			warehouseStatus.Exported += n
+			warehouseStatus.LastError = ""
+			if err != nil {
+				warehouseStatus.LastError = err.Error()
+				log.Println("Warehouse export failed:", err)
+			}
+			warehouseStatus.Unlock()
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// exportHistory sends the history rows after the watermark of the destination
+// and advances it after each written batch.
+func exportHistory(ctx context.Context, settings *Config) (int64, int64, error) {
+	open, ok := warehouseDrivers[settings.WarehouseDriver]
+	if !ok {
+		return 0, 0, fmt.Errorf("warehouse driver %q is not compiled in, available: %v", settings.WarehouseDriver, warehouseDriverNames())
+	}
+	destination := settings.WarehouseDriver + ":" + settings.WarehouseTable
+
+	dbPool, releasePool, err := acquirePool()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer releasePool()
+
+	if err := ensureTable(ctx, dbPool, settings.HistoryTable, historyTableDDL); err != nil {
+		return 0, 0, err
+	}
+	if err := ensureTable(ctx, dbPool, watermarkTable, watermarkTableDDL); err != nil {
+		return 0, 0, err
+	}
+
+	var watermark int64
+	err = dbPool.QueryRow(ctx, "SELECT coalesce(max(last_history_id), 0) FROM "+watermarkTable+" WHERE destination = $1", destination).Scan(&watermark)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sink, err := open(ctx, settings.WarehouseDSN, settings.WarehouseTable)
+	if err != nil {
+		return 0, watermark, err
+	}
+	defer sink.close()
+
+	var exported int64
+	for {
+		records, err := readHistory(ctx, dbPool, settings.HistoryTable, watermark)
+		if err != nil || len(records) == 0 {
+			return exported, watermark, err
+		}
+
+		if err := sink.write(ctx, records); err != nil {
+			return exported, watermark, err
+		}
+
+		watermark = records[len(records)-1].HistoryID
+		exported += int64(len(records))
+		_, err = dbPool.Exec(ctx, "INSERT INTO "+watermarkTable+` (destination, last_history_id, exported_at) VALUES ($1, $2, now())
+			ON CONFLICT (destination) DO UPDATE SET last_history_id = EXCLUDED.last_history_id, exported_at = EXCLUDED.exported_at`,
+			destination, watermark)
+		if err != nil {
+			return exported, watermark, err
+		}
+	}
+}
+
+// readHistory returns the next batch of history rows after id after. It stops
+// at the first row recorded less than warehouseSettleLag ago, so the watermark
+// never passes an id that may still commit.
+func readHistory(ctx context.Context, dbPool *pgxpool.Pool, table string, after int64) ([]historyRecord, error) {
+	rows, err := dbPool.Query(ctx, `SELECT id, import_id, month, year, mapping_version, mode, status, rows_read, inserted,
+		rejected, skipped_empty, started_at, finished_at, quality_score, coalesce(parse_errors::text, '{}'),
+		coalesce(suspicious_values::text, '{}'), coalesce(rejects_by_class::text, '{}'), coalesce(rejects_by_code::text, '{}'),
+		recorded_at < now() - $3::interval
+		FROM `+table+` WHERE id > $1 ORDER BY id LIMIT $2`, after, warehouseBatchSize, warehouseSettleLag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []historyRecord
+	for rows.Next() {
+		var r historyRecord
+		var settled bool
+		err := rows.Scan(&r.HistoryID, &r.ImportID, &r.Month, &r.Year, &r.MappingVersion, &r.Mode, &r.Status, &r.RowsRead, &r.Inserted,
+			&r.Rejected, &r.SkippedEmpty, &r.StartedAt, &r.FinishedAt, &r.QualityScore, &r.ParseErrors,
+			&r.Suspicious, &r.RejectsByClass, &r.RejectsByCode, &settled)
+		if err != nil {
+			return nil, err
+		}
+		if !settled {
+			break
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// handleWarehouseStatus reports the exporter watermark and last error.
+func handleWarehouseStatus(c *gin.Context) {
+	warehouseStatus.Lock()
+	defer warehouseStatus.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"driver":    cfg().WarehouseDriver,
+		"table":     cfg().WarehouseTable,
+		"drivers":   warehouseDriverNames(),
+		"last_run":  warehouseStatus.LastRun,
+		"watermark": warehouseStatus.Watermark,
+		"exported":  warehouseStatus.Exported,
+		"error":     warehouseStatus.LastError,
+	})
+}
@@ -0,0 +1,102 @@
+//go:build bigquery
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// BigQuery support needs cloud.google.com/go/bigquery, so it is only compiled
+// in with `-tags bigquery`. The DSN is the project id and the table is given as
+// dataset.table; credentials come from the usual Google application defaults.
+func init() {
+	registerWarehouseDriver("bigquery", openBigQuerySink)
+}
+
+type bigQuerySink struct {
+	client   *bigquery.Client
+	inserter *bigquery.Inserter
+}
+
+func openBigQuerySink(ctx context.Context, project, table string) (warehouseSink, error) {
+	dataset, name, ok := strings.Cut(table, ".")
+	if !ok {
+		return nil, fmt.Errorf("bigquery table %q must look like dataset.table", table)
+	}
+
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &bigQuerySink{client: client, inserter: client.Dataset(dataset).Table(name).Inserter()}, nil
+}
+
+// write streams the batch; the history id is the insert id, so BigQuery drops
+// rows sent twice after a retry.
+func (s *bigQuerySink) write(ctx context.Context, records []historyRecord) error {
+	savers := make([]*bigquery.StructSaver, len(records))
+	for i := range records {
+		savers[i] = &bigquery.StructSaver{
+			Struct:   bigQueryRow(records[i]),
+			InsertID: strconv.FormatInt(records[i].HistoryID, 10),
+		}
+	}
+	return s.inserter.Put(ctx, savers)
+}
+
+func (s *bigQuerySink) close() {
+	s.client.Close()
+}
+
+// bigQueryRecord maps a record onto the column names of the warehouse table.
+type bigQueryRecord struct {
+	HistoryID      int64                  `bigquery:"history_id"`
+	ImportID       string                 `bigquery:"import_id"`
+	Month          string                 `bigquery:"month"`
+	Year           string                 `bigquery:"year"`
+	MappingVersion string                 `bigquery:"mapping_version"`
+	Mode           string                 `bigquery:"mode"`
+	Status         string                 `bigquery:"status"`
+	RowsRead       int64                  `bigquery:"rows_read"`
+	Inserted       int64                  `bigquery:"inserted"`
+	Rejected       int64                  `bigquery:"rejected"`
+	SkippedEmpty   int64                  `bigquery:"skipped_empty"`
+	StartedAt      bigquery.NullTimestamp `bigquery:"started_at"`
+	FinishedAt     bigquery.NullTimestamp `bigquery:"finished_at"`
+	QualityScore   bigquery.NullFloat64   `bigquery:"quality_score"`
+	ParseErrors    string                 `bigquery:"parse_errors"`
+	Suspicious     string                 `bigquery:"suspicious_values"`
+	RejectsByClass string                 `bigquery:"rejects_by_class"`
+	RejectsByCode  string                 `bigquery:"rejects_by_code"`
+}
+
+func bigQueryRow(r historyRecord) bigQueryRecord {
+	row := bigQueryRecord{
+		HistoryID:      r.HistoryID,
+		ImportID:       r.ImportID,
+		Month:          r.Month,
+		Year:           r.Year,
+		MappingVersion: r.MappingVersion,
+		Mode:           r.Mode,
+		Status:         r.Status,
+		RowsRead:       r.RowsRead,
+		Inserted:       r.Inserted,
+		Rejected:       r.Rejected,
+		SkippedEmpty:   r.SkippedEmpty,
+		StartedAt:      bigquery.NullTimestamp{Timestamp: r.StartedAt, Valid: true},
+		FinishedAt:     bigquery.NullTimestamp{Timestamp: r.FinishedAt, Valid: true},
+		ParseErrors:    r.ParseErrors,
+		Suspicious:     r.Suspicious,
+		RejectsByClass: r.RejectsByClass,
+		RejectsByCode:  r.RejectsByCode,
+	}
+	if r.QualityScore != nil {
+		row.QualityScore = bigquery.NullFloat64{Float64: *r.QualityScore, Valid: true}
+	}
+	return row
+}
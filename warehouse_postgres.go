@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func init() {
+	registerWarehouseDriver("postgres", openPostgresSink)
+}
+
+const postgresSinkDDL = `CREATE TABLE IF NOT EXISTS %s (
+	history_id bigint PRIMARY KEY,
+	import_id text NOT NULL,
+	month text NOT NULL,
+	year text NOT NULL,
+	mapping_version text NOT NULL,
+	mode text NOT NULL,
+	status text NOT NULL,
+	rows_read bigint NOT NULL,
+	inserted bigint NOT NULL,
+	rejected bigint NOT NULL,
+	skipped_empty bigint NOT NULL,
+	started_at timestamptz NOT NULL,
+	finished_at timestamptz NOT NULL,
+	quality_score double precision,
+	parse_errors jsonb,
+	suspicious_values jsonb,
+	rejects_by_class jsonb,
+	rejects_by_code jsonb
+)`
+
+// postgresSink writes to a table of any Postgres reachable with a DSN.
+type postgresSink struct {
+	conn  *pgx.Conn
+	table string
+}
+
+func openPostgresSink(ctx context.Context, dsn, table string) (warehouseSink, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, fmt.Errorf("warehouse table %q is not a table name", table)
+	}
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, fmt.Sprintf(postgresSinkDDL, table)); err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	return &postgresSink{conn: conn, table: table}, nil
+}
+
+// write inserts the batch in one transaction; rows already exported are skipped.
+func (s *postgresSink) write(ctx context.Context, records []historyRecord) error {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := "INSERT INTO " + s.table + ` (history_id, import_id, month, year, mapping_version, mode, status, rows_read,
+		inserted, rejected, skipped_empty, started_at, finished_at, quality_score, parse_errors, suspicious_values,
+		rejects_by_class, rejects_by_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (history_id) DO NOTHING`
+
+	for _, r := range records {
+		_, err := tx.Exec(ctx, query, r.HistoryID, r.ImportID, r.Month, r.Year, r.MappingVersion, r.Mode, r.Status, r.RowsRead,
+			r.Inserted, r.Rejected, r.SkippedEmpty, r.StartedAt, r.FinishedAt, r.QualityScore, r.ParseErrors, r.Suspicious,
+			r.RejectsByClass, r.RejectsByCode)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresSink) close() {
+	s.conn.Close(context.Background())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deliveries of one finished import before giving up
+const webhookAttempts = 5
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook events
+const (
+	webhookImportFinished = "import.finished"
+	webhookImportFailed   = "import.failed"
+)
+
+// webhookPayload is posted to every webhook url when an import finishes. The
+// counts a reporting job needs are on top, the full report comes along.
+type webhookPayload struct {
+	Event           string       `json:"event"`
+	DeliveryID      string       `json:"delivery_id"`
+	ImportID        string       `json:"import_id"`
+	Status          string       `json:"status"`
+	Month           string       `json:"month"`
+	Year            string       `json:"year"`
+	Target          string       `json:"target"`
+	RowsRead        int64        `json:"rows_read"`
+	Inserted        int64        `json:"inserted"`
+	Rejected        int64        `json:"rejected"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Report          ImportReport `json:"report"`
+}
+
+func init() {
+	finishHooks = append(finishHooks, notifyWebhook)
+}
+
+// signWebhook is the X-Webhook-Signature of body sent at timestamp. The
+// timestamp is signed with the body so a captured request cannot be replayed
+// later with a fresh timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhook posts the outcome of a finished import to every webhook url
+// in the background, each url retried on its own.
+func notifyWebhook(imp *Import) {
+	settings := cfg()
+	if len(settings.WebhookURLs) == 0 {
+		return
+	}
+
+	r := imp.report()
+	payload := webhookPayload{
+		Event:           webhookImportFinished,
+		DeliveryID:      randomHex(16),
+		ImportID:        imp.ID,
+		Status:          r.Status,
+		Month:           imp.Month,
+		Year:            imp.Year,
+		Target:          imp.target(),
+		RowsRead:        r.RowsRead,
+		Inserted:        r.Inserted,
+		Rejected:        r.Rejected,
+		DurationSeconds: r.DurationSeconds,
+		Report:          r,
+	}
+	if r.Status == importStatusFailed {
+		payload.Event = webhookImportFailed
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Webhook of import", imp.ID, "not sent:", err)
+		return
+	}
+	for _, url := range settings.WebhookURLs {
+		go deliverWebhook(url, settings.WebhookSecret, imp.ID, body)
+	}
+}
+
+// deliverWebhook retries with a growing delay until the receiver answers 2xx.
+// Every attempt is signed with its own timestamp; the delivery id stays the
+// same so the receiver can drop duplicates.
+func deliverWebhook(url, secret, importID string, body []byte) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(url, secret, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Println("Webhook of import", importID, "to", url, "failed after", attempt, "attempts:", err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 4
+	}
+}
+
+func postWebhook(url, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// importWindow is a daily time range, in minutes since local midnight, during
+// which bulk loads are allowed. end < start means the window spans midnight.
+type importWindow struct {
+	start, end int
+}
+
+// parseImportWindows parses specs like "22:00-06:00".
+func parseImportWindows(specs []string) ([]importWindow, error) {
+	windows := make([]importWindow, 0, len(specs))
+
+	for _, spec := range specs {
+		from, to, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("import window %q must look like 22:00-06:00", spec)
+		}
+
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("import window %q: %w", spec, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("import window %q: %w", spec, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("import window %q is empty", spec)
+		}
+
+		windows = append(windows, importWindow{start: start, end: end})
+	}
+
+	return windows, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w importWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// windowOpen reports whether t falls inside one of the windows. No windows
+// means imports are always allowed.
+func windowOpen(windows []importWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range windows {
+		if w.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindowOpen returns the next time at or after t when a window is open.
+func nextWindowOpen(windows []importWindow, t time.Time) time.Time {
+	if windowOpen(windows, t) {
+		return t
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	var next time.Time
+	for _, w := range windows {
+		open := midnight.Add(time.Duration(w.start) * time.Minute)
+		if !open.After(t) {
+			open = open.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || open.Before(next) {
+			next = open
+		}
+	}
+	return next
+}
+
+// waitForWindow blocks while the configured import windows are closed. A
+// running import is shown paused meanwhile, like one paused through the api;
+// its position in the file is kept so it resumes exactly where it stopped.
+// Strict and transaction=true imports only wait for the window before they
+// start: paused they would keep their transaction open, so they run on.
+func (imp *Import) waitForWindow(ctx context.Context) error {
+	windows := cfg().windows
+	if imp.oneTransaction() || windowOpen(windows, time.Now()) {
+		return nil
+	}
+
+	imp.mu.Lock()
+	imp.enterPauseLocked()
+	imp.outsideWindow = true
+	imp.mu.Unlock()
+	opensAt := nextWindowOpen(windows, time.Now())
+	imp.publish(ImportEvent{Type: eventPaused, Rows: imp.progress().RowsRead, Message: "outside import window, resuming at " + opensAt.Format(time.RFC3339)})
+
+	err := sleepUntilWindow(ctx)
+
+	imp.mu.Lock()
+	imp.outsideWindow = false
+	imp.leavePauseLocked()
+	imp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	imp.publish(ImportEvent{Type: eventResumed, Rows: imp.progress().RowsRead})
+	return nil
+}
+
+// sleepUntilWindow blocks until an import window is open. The configuration is
+// re-read every minute so that window changes take effect while waiting.
+func sleepUntilWindow(ctx context.Context) error {
+	for !windowOpen(cfg().windows, time.Now()) {
+		wait := time.Until(nextWindowOpen(cfg().windows, time.Now()))
+		if wait > time.Minute || wait <= 0 {
+			wait = time.Minute
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}